@@ -0,0 +1,346 @@
+package api
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html/template"
+	"io"
+	"net/http"
+	"regexp"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/open-policy-agent/opa/util"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	maxReportSizeBytes  = 4 * 1024 // Maximum size of an abuse report
+	maxReportsPerShare  = 20       // Number of reports kept with a share, further ones are only counted
+	maxReportReasonSize = 1024     // Maximum length of the reason of a report
+
+	blocklistActionReject     = "reject"
+	blocklistActionQuarantine = "quarantine"
+
+	// acceptWarningParam is set on the link of the warning page to a share
+	// that was reported or quarantined, to serve the share after all.
+	acceptWarningParam = "accept-warning"
+)
+
+// AbuseReportRequest represents a report of a share by a visitor.
+type AbuseReportRequest struct {
+	Reason string `json:"reason"`
+}
+
+// AbuseReport represents a report of a share, as it's kept with the share.
+type AbuseReport struct {
+	At         time.Time `json:"at"`
+	Reason     string    `json:"reason"`
+	RemoteAddr string    `json:"remote_addr"`
+}
+
+// AbuseReports represents the reports of a share.
+type AbuseReports struct {
+	Count  int           `json:"count"`  // all reports, including those no longer kept
+	Recent []AbuseReport `json:"recent"` // up to maxReportsPerShare of the most recent reports
+}
+
+// add returns the reports with report added, keeping up to
+// maxReportsPerShare of the most recent ones. r isn't modified, as it may be
+// shared with DataRequests gotten from a store.
+func (r *AbuseReports) add(report AbuseReport) *AbuseReports {
+	reports := &AbuseReports{}
+	if r != nil {
+		reports.Count = r.Count
+		reports.Recent = r.Recent[max(len(r.Recent)-maxReportsPerShare+1, 0):]
+	}
+	reports.Count++
+	reports.Recent = append(slices.Clip(reports.Recent), report)
+	return reports
+}
+
+// shareUpdater is implemented by stores that can update a DataRequest
+// atomically. Updates don't wake the watchers of the DataRequest, as they
+// are meant for the fields that only the server sets, e.g. the reports.
+type shareUpdater interface {
+	// update applies fn to a DataRequest, including an expired one, and
+	// stores the result unless fn returns an error. It returns false if the
+	// key isn't set. fn may be applied again if the DataRequest is changed
+	// concurrently.
+	update(key *StoreKey, fn func(*DataRequest) error) (bool, error)
+}
+
+var (
+	errShareNotFound  = errors.New("key not found")
+	errShareTakenDown = errors.New("share was taken down")
+)
+
+// Quarantine records that the content of a share matched the blocklist when
+// it was written. The share is served with a warning until a moderator
+// restores it.
+type Quarantine struct {
+	At     time.Time `json:"at"`
+	Reason string    `json:"reason,omitempty"`
+}
+
+// BlocklistRule matches content that must not be shared. A rule matches if
+// its pattern matches any module, the input or the data, or if its hash is
+// the hash of any module.
+type BlocklistRule struct {
+	Pattern string `json:"pattern,omitempty"` // (optional) regular expression
+	Hash    string `json:"hash,omitempty"`    // (optional) hex encoded SHA-256 digest of a module
+	Action  string `json:"action,omitempty"`  // (optional) "reject" or "quarantine"; defaults to "reject"
+	Reason  string `json:"reason,omitempty"`  // (optional) returned to the writer and recorded with quarantined shares
+
+	re *regexp.Regexp
+}
+
+// Blocklist represents rules that writes of shares are checked against.
+type Blocklist struct {
+	rules []BlocklistRule
+}
+
+// NewBlocklist returns a blocklist of rules, or an error if a rule is invalid.
+func NewBlocklist(rules []BlocklistRule) (*Blocklist, error) {
+	b := &Blocklist{rules: make([]BlocklistRule, 0, len(rules))}
+
+	for i, rule := range rules {
+		switch {
+		case (rule.Pattern == "") == (rule.Hash == ""):
+			return nil, fmt.Errorf("blocklist rule %d: set either a pattern or a hash", i)
+		case rule.Hash != "":
+			if digest, err := hex.DecodeString(rule.Hash); err != nil || len(digest) != sha256.Size {
+				return nil, fmt.Errorf("blocklist rule %d: hash must be a hex encoded SHA-256 digest", i)
+			}
+		}
+
+		switch rule.Action {
+		case "":
+			rule.Action = blocklistActionReject
+		case blocklistActionReject, blocklistActionQuarantine:
+		default:
+			return nil, fmt.Errorf("blocklist rule %d: invalid action %q", i, rule.Action)
+		}
+
+		if rule.Pattern != "" {
+			re, err := regexp.Compile(rule.Pattern)
+			if err != nil {
+				return nil, fmt.Errorf("blocklist rule %d: %w", i, err)
+			}
+			rule.re = re
+		}
+
+		rule.Hash = strings.ToLower(rule.Hash)
+		b.rules = append(b.rules, rule)
+	}
+
+	return b, nil
+}
+
+// LoadBlocklist reads a JSON or YAML list of blocklist rules.
+func LoadBlocklist(r io.Reader) (*Blocklist, error) {
+	bs, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+
+	var rules []BlocklistRule
+	if err := util.Unmarshal(bs, &rules); err != nil {
+		return nil, fmt.Errorf("failed to parse blocklist: %w", err)
+	}
+
+	return NewBlocklist(rules)
+}
+
+// Match returns the first rule that matches the content of dr, or nil.
+func (b *Blocklist) Match(dr *DataRequest) *BlocklistRule {
+	if b == nil || len(b.rules) == 0 {
+		return nil
+	}
+
+	var texts, hashes []string
+	for _, m := range dr.RegoModules {
+		s, ok := m.(string)
+		if !ok {
+			continue
+		}
+		digest := sha256.Sum256([]byte(s))
+		texts = append(texts, s)
+		hashes = append(hashes, hex.EncodeToString(digest[:]))
+	}
+	for _, doc := range []interface{}{dr.Input, dr.Data, dr.DataDocuments} {
+		if bs, err := json.Marshal(doc); err == nil {
+			texts = append(texts, string(bs))
+		}
+	}
+
+	for i := range b.rules {
+		rule := &b.rules[i]
+		for _, h := range hashes {
+			if rule.Hash == h {
+				return rule
+			}
+		}
+		if rule.re == nil {
+			continue
+		}
+		for _, s := range texts {
+			if rule.re.MatchString(s) {
+				return rule
+			}
+		}
+	}
+
+	return nil
+}
+
+// SetBlocklist sets the blocklist that shares, distributions and publishes
+// are checked against when they are written.
+func (api *API) SetBlocklist(b *Blocklist) {
+	api.blocklist = b
+}
+
+// checkBlocklist checks the content of msg against the blocklist, marking it
+// quarantined if a quarantining rule matches. Published gists are stored in
+// the GitHub account of their author rather than by the playground, so they
+// can't be quarantined; callers set canQuarantine to false to reject them
+// instead. Rejections are written to w, and false is returned.
+func (api *API) checkBlocklist(w http.ResponseWriter, msg *DataRequest, canQuarantine bool) bool {
+	rule := api.blocklist.Match(msg)
+	if rule == nil {
+		return true
+	}
+
+	action := rule.Action
+	if action == blocklistActionQuarantine && !canQuarantine {
+		action = blocklistActionReject
+	}
+
+	api.blocklistMatches.WithLabelValues(action).Inc()
+	log.WithField("reason", rule.Reason).WithField("action", action).Info("Content matched the blocklist.")
+
+	if action == blocklistActionQuarantine {
+		msg.Quarantine = &Quarantine{At: time.Now().UTC(), Reason: rule.Reason}
+		return true
+	}
+
+	err := errors.New("content is not allowed")
+	if rule.Reason != "" {
+		err = fmt.Errorf("content is not allowed: %s", rule.Reason)
+	}
+	writeError(w, http.StatusForbidden, apiCodeForbidden, err)
+	return false
+}
+
+func (api *API) handleReport(w http.ResponseWriter, r *http.Request) {
+	addCORSHeaders(w, r)
+
+	key := getKeyFromRequest(r)
+
+	bs, err := io.ReadAll(io.LimitReader(r.Body, maxReportSizeBytes+1))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, apiCodeParseError, err)
+		return
+	}
+
+	if len(bs) > maxReportSizeBytes {
+		writeError(w, http.StatusBadRequest, apiCodeFileTooLarge, fmt.Errorf("cannot report with more than %v bytes", maxReportSizeBytes))
+		return
+	}
+
+	var req AbuseReportRequest
+	if err := util.UnmarshalJSON(bs, &req); err != nil {
+		writeError(w, http.StatusBadRequest, apiCodeParseError, err)
+		return
+	}
+
+	req.Reason = strings.TrimSpace(req.Reason)
+	if req.Reason == "" || len(req.Reason) > maxReportReasonSize {
+		writeError(w, http.StatusBadRequest, apiCodeInvalidArgument, fmt.Errorf("reason must be between 1 and %d bytes", maxReportReasonSize))
+		return
+	}
+
+	if key.KeyType != KeyTypeLegacy {
+		writeError(w, http.StatusBadRequest, apiCodeInvalidArgument, errors.New("only shares stored by the playground can be reported, report gists to GitHub"))
+		return
+	}
+
+	report := AbuseReport{At: time.Now().UTC(), Reason: req.Reason, RemoteAddr: r.RemoteAddr}
+
+	// The report is added atomically, so that concurrent reports and
+	// takedowns of the share aren't lost.
+	found, err := api.v1(r.Context()).update(key, func(dr *DataRequest) error {
+		switch {
+		case dr.expired(time.Now()):
+			return errShareNotFound
+		case dr.TakenDown != nil:
+			return errShareTakenDown
+		}
+		dr.Reports = dr.Reports.add(report)
+		return nil
+	})
+	switch {
+	case errors.Is(err, errShareTakenDown):
+		writeTakenDown(w)
+		return
+	case !found || errors.Is(err, errShareNotFound):
+		writeError(w, http.StatusNotFound, apiCodeNotFound, errShareNotFound)
+		return
+	case err != nil:
+		writeError(w, http.StatusInternalServerError, apiCodeInternalError, err)
+		return
+	}
+
+	api.abuseReports.Inc()
+	log.WithField("key", key.Id).WithField("reason", report.Reason).WithField("remote_addr", report.RemoteAddr).Info("Share reported.")
+
+	w.WriteHeader(http.StatusAccepted)
+}
+
+// warning returns why a share is served with a warning, or "" if it isn't.
+func (dr *DataRequest) warning() string {
+	switch {
+	case dr.Quarantine != nil:
+		return "This share was flagged automatically as possibly harmful."
+	case dr.Reports != nil && dr.Reports.Count > 0:
+		return "This share was reported as possibly harmful by visitors of the playground."
+	}
+	return ""
+}
+
+var warningPage = template.Must(template.New("warning").Parse(`<!DOCTYPE html>
+<html lang="en">
+<head>
+<meta charset="utf-8">
+<meta name="robots" content="noindex">
+<title>Warning - Rego Playground</title>
+</head>
+<body>
+<h1>Warning</h1>
+<p>{{.Warning}} It was not reviewed by the maintainers of the playground yet.</p>
+<p>Don't enter credentials or follow links from shares that you don't trust.</p>
+<p><a href="{{.URL}}">Continue to the share</a></p>
+</body>
+</html>
+`))
+
+// writeWarningPage writes the page served instead of the UI for a share with
+// a warning, linking to the share with the warning accepted.
+func writeWarningPage(w http.ResponseWriter, r *http.Request, warning string) {
+	u := *r.URL
+	q := u.Query()
+	q.Set(acceptWarningParam, "true")
+	u.RawQuery = q.Encode()
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(http.StatusOK)
+
+	if err := warningPage.Execute(w, struct{ Warning, URL string }{warning, u.RequestURI()}); err != nil {
+		log.WithError(err).Error("Failed to write warning page.")
+	}
+}
@@ -0,0 +1,242 @@
+package api
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/open-policy-agent/opa/util"
+)
+
+func TestBlocklist(t *testing.T) {
+	module := "package play\n\nallow := true\n"
+	digest := sha256.Sum256([]byte(module))
+
+	b, err := LoadBlocklist(strings.NewReader(`
+- pattern: "(?i)verify your password"
+  action: quarantine
+  reason: phishing
+- hash: ` + strings.ToUpper(hex.EncodeToString(digest[:])) + `
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	input := interface{}(map[string]interface{}{"msg": "Please VERIFY your password"})
+
+	tests := []struct {
+		note   string
+		dr     DataRequest
+		action string
+	}{
+		{note: "no match", dr: makeDR("package play\n\nallow := false\n", "", "", 1)},
+		{note: "hash", dr: makeDR(module, "", "", 1), action: blocklistActionReject},
+		{note: "pattern in input", dr: DataRequest{Input: &input}, action: blocklistActionQuarantine},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.note, func(t *testing.T) {
+			rule := b.Match(&tc.dr)
+			if tc.action == "" {
+				if rule != nil {
+					t.Fatalf("expected no match but got: %+v", rule)
+				}
+				return
+			}
+			if rule == nil || rule.Action != tc.action {
+				t.Fatalf("expected a match with action %v but got: %+v", tc.action, rule)
+			}
+		})
+	}
+
+	for _, rules := range [][]BlocklistRule{
+		{{}},
+		{{Pattern: "a", Hash: hex.EncodeToString(digest[:])}},
+		{{Pattern: "("}},
+		{{Hash: "abc"}},
+		{{Pattern: "a", Action: "delete"}},
+	} {
+		if _, err := NewBlocklist(rules); err == nil {
+			t.Fatalf("expected an error for %+v", rules)
+		}
+	}
+}
+
+func TestApiBlocklistAndReports(t *testing.T) {
+	store := NewMemoryDataRequestStore()
+	s := NewAPIService("", store, NewMemoryDataRequestStore(), "./", "", "", "")
+
+	b, err := NewBlocklist([]BlocklistRule{
+		{Pattern: "evil", Reason: "malware"},
+		{Pattern: "suspicious", Action: blocklistActionQuarantine},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.SetBlocklist(b)
+
+	do := func(method, path string, body interface{}) *httptest.ResponseRecorder {
+		var bs []byte
+		if body != nil {
+			bs, _ = json.Marshal(body)
+		}
+		w := httptest.NewRecorder()
+		s.router.ServeHTTP(w, httptest.NewRequest(method, path, bytes.NewReader(bs)))
+		return w
+	}
+
+	share := func(module string) string {
+		w := do("POST", "/v1/share", makeDR(module, "", "", 1))
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected 200 response but got: %v, body: %s", w.Code, w.Body.String())
+		}
+		var resp DataResponse
+		if err := util.UnmarshalJSON(w.Body.Bytes(), &resp); err != nil {
+			t.Fatal(err)
+		}
+		result := resp.Result.(string)
+		return result[strings.LastIndex(result, "/")+1:]
+	}
+
+	// Rejection
+	for _, path := range []string{"/v1/share", "/v1/distribute", "/v2/publish"} {
+		w := do("POST", path, makeDR("package play\n\nevil := true\n", "", "", 1))
+		if w.Code != http.StatusForbidden || !strings.Contains(w.Body.String(), "malware") {
+			t.Fatalf("expected 403 response for %v but got: %v, body: %s", path, w.Code, w.Body.String())
+		}
+	}
+
+	// Quarantine
+	quarantined := share("package play\n\nsuspicious := true\n")
+
+	w := do("GET", "/p/"+quarantined, nil)
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), "flagged automatically") ||
+		!strings.Contains(w.Body.String(), "accept-warning=true") {
+		t.Fatalf("expected the warning page but got: %v, body: %s", w.Code, w.Body.String())
+	}
+
+	if w := do("GET", "/p/"+quarantined+"?accept-warning=true", nil); strings.Contains(w.Body.String(), "flagged automatically") {
+		t.Fatal("expected the warning to be accepted")
+	}
+
+	var data DataResponse
+	w = do("GET", "/v1/data/"+quarantined, nil)
+	if err := util.UnmarshalJSON(w.Body.Bytes(), &data); err != nil {
+		t.Fatal(err)
+	}
+	if data.Warning == "" {
+		t.Fatal("expected a warning for the quarantined share")
+	}
+
+	// Reports
+	key := share("package play\n\nallow := true\n")
+
+	if w := do("GET", "/p/"+key, nil); strings.Contains(w.Body.String(), "<h1>Warning</h1>") {
+		t.Fatal("expected no warning before the share is reported")
+	}
+
+	if w := do("POST", "/v1/report/"+key, AbuseReportRequest{}); w.Code != http.StatusBadRequest {
+		t.Fatalf("expected 400 response without a reason but got: %v", w.Code)
+	}
+
+	if w := do("POST", "/v1/report/missing", AbuseReportRequest{Reason: "spam"}); w.Code != http.StatusNotFound {
+		t.Fatalf("expected 404 response but got: %v", w.Code)
+	}
+
+	for i := 0; i < maxReportsPerShare+1; i++ {
+		if w := do("POST", "/v1/report/"+key, AbuseReportRequest{Reason: "spam"}); w.Code != http.StatusAccepted {
+			t.Fatalf("expected 202 response but got: %v, body: %s", w.Code, w.Body.String())
+		}
+	}
+
+	dr, _, _ := store.Get(&StoreKey{Id: key}, nil)
+	if dr.Reports == nil || dr.Reports.Count != maxReportsPerShare+1 || len(dr.Reports.Recent) != maxReportsPerShare {
+		t.Fatalf("unexpected reports: %+v", dr.Reports)
+	}
+
+	if w := do("GET", "/p/"+key, nil); !strings.Contains(w.Body.String(), "reported as possibly harmful") {
+		t.Fatalf("expected the warning page for the reported share but got: %s", w.Body.String())
+	}
+
+	// Reviewing the share dismisses its reports.
+	s.EnableAdmin("secret", nil)
+	r := httptest.NewRequest("POST", "/admin/v1/shares/"+key+"/restore", nil)
+	r.Header.Set("Authorization", "Bearer secret")
+	w = httptest.NewRecorder()
+	s.router.ServeHTTP(w, r)
+	if w.Code != http.StatusNoContent {
+		t.Fatalf("expected 204 response but got: %v, body: %s", w.Code, w.Body.String())
+	}
+
+	if w := do("GET", "/p/"+key, nil); strings.Contains(w.Body.String(), "<h1>Warning</h1>") {
+		t.Fatal("expected no warning after the share was restored")
+	}
+}
+
+func TestApiReportConcurrently(t *testing.T) {
+	store := NewMemoryDataRequestStore()
+	s := NewAPIService("", store, nil, "./", "", "", "")
+
+	key := &StoreKey{Id: "reported"}
+	share := makeDR("package play\n\nallow := true\n", "", "", 1)
+	if _, err := store.Put(key, share, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	woken := make(chan DataRequest, 1)
+	if _, err := store.Watch(key, share.Etag, time.Minute, func(dr DataRequest) { woken <- dr }, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	n := 2 * maxReportsPerShare
+	var wg sync.WaitGroup
+	for range n {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			bs, _ := json.Marshal(AbuseReportRequest{Reason: "spam"})
+			w := httptest.NewRecorder()
+			s.router.ServeHTTP(w, httptest.NewRequest("POST", "/v1/report/"+key.Id, bytes.NewReader(bs)))
+			if w.Code != http.StatusAccepted {
+				t.Errorf("expected 202 response but got: %v, body: %s", w.Code, w.Body.String())
+			}
+		}()
+	}
+	wg.Wait()
+
+	dr, _, _ := store.peek(key)
+	if dr.Reports == nil || dr.Reports.Count != n || len(dr.Reports.Recent) != maxReportsPerShare {
+		t.Fatalf("expected %d reports but got: %+v", n, dr.Reports)
+	}
+
+	select {
+	case <-woken:
+		t.Fatal("expected the reports not to wake the watchers of the share")
+	default:
+	}
+
+	// Reports of a share taken down meanwhile are refused rather than
+	// overwriting the takedown.
+	dr.TakenDown = &Takedown{At: time.Now().UTC()}
+	if _, err := store.Put(key, dr, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	bs, _ := json.Marshal(AbuseReportRequest{Reason: "spam"})
+	w := httptest.NewRecorder()
+	s.router.ServeHTTP(w, httptest.NewRequest("POST", "/v1/report/"+key.Id, bytes.NewReader(bs)))
+	if w.Code != http.StatusGone {
+		t.Fatalf("expected 410 response but got: %v, body: %s", w.Code, w.Body.String())
+	}
+
+	if dr, _, _ := store.peek(key); dr.TakenDown == nil || dr.Reports.Count != n {
+		t.Fatalf("expected the takedown and the reports to be kept, got: %+v, %+v", dr.TakenDown, dr.Reports)
+	}
+}
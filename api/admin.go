@@ -0,0 +1,541 @@
+package api
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/open-policy-agent/opa/util"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	defaultAdminListLimit = 100  // Number of shares listed per page by default
+	maxAdminListLimit     = 1000 // Maximum number of shares listed per page
+	maxAuditEntries       = 1000 // Number of recent audit entries kept in memory
+
+	// adminStatsMaxAge is how stale the statistics of the shares may get
+	// before they are computed again, as that reads every share.
+	adminStatsMaxAge = 15 * time.Minute
+
+	// Names of the admin routes, recorded as the action in the audit log.
+	adminActionList     = "list"
+	adminActionView     = "view"
+	adminActionTakedown = "takedown"
+	adminActionRestore  = "restore"
+	adminActionOwner    = "owner"
+	adminActionStats    = "stats"
+	adminActionAudit    = "audit"
+)
+
+// Takedown records that a moderator took a share down. The share is kept so
+// that it can be restored, but it is served as gone.
+type Takedown struct {
+	At     time.Time `json:"at"`
+	Reason string    `json:"reason,omitempty"`
+}
+
+// AdminShareList represents a page of share keys.
+type AdminShareList struct {
+	Keys []string `json:"keys"`
+	Next string   `json:"next,omitempty"` // the cursor of the next page, if there is one
+}
+
+// sharePager is implemented by stores that can list keys a page at a time,
+// in order, without listing the keys of the other pages.
+type sharePager interface {
+	// listPage returns up to limit keys with a prefix from a cursor, and the
+	// cursor of the next page, or an empty one if it's the last page. The
+	// cursors are opaque, e.g. continuation tokens, and empty for the first
+	// page.
+	listPage(prefix, cursor string, limit int) ([]string, string, error)
+}
+
+// pageKeys returns up to limit of the keys after cursor, and the last key
+// returned as the cursor of the next page if there are more.
+func pageKeys(keys []string, cursor string, limit int) ([]string, string) {
+	sort.Strings(keys)
+	if cursor != "" {
+		keys = keys[sort.Search(len(keys), func(i int) bool { return keys[i] > cursor }):]
+	}
+	if len(keys) > limit {
+		return keys[:limit], keys[limit-1]
+	}
+	return keys, ""
+}
+
+// AdminShareMetadata represents what the server tracks about a share.
+type AdminShareMetadata struct {
+	ReadOnly       bool          `json:"read_only"`   // a share, rather than a distribution
+	OwnerToken     bool          `json:"owner_token"` // a distribution that requires an owner token to change
+	ExpiresAt      *time.Time    `json:"expires_at,omitempty"`
+	LastAccessedAt *time.Time    `json:"last_accessed_at,omitempty"`
+	TakenDown      *Takedown     `json:"taken_down,omitempty"`
+	Quarantine     *Quarantine   `json:"quarantine,omitempty"`
+	Reports        *AbuseReports `json:"reports,omitempty"`
+	Etag           string        `json:"etag,omitempty"`
+	Size           int           `json:"size"` // size of the stored share in bytes
+}
+
+// AdminShare represents a share with its metadata.
+type AdminShare struct {
+	Key      string             `json:"key"`
+	Share    DataRequest        `json:"share"`
+	Metadata AdminShareMetadata `json:"metadata"`
+}
+
+// AdminTakedownRequest represents a request to take a share down.
+type AdminTakedownRequest struct {
+	Reason string `json:"reason"` // (optional) recorded with the takedown and in the audit log
+}
+
+// AdminStats represents aggregate statistics of the shares.
+type AdminStats struct {
+	Shares        int `json:"shares"`        // all stored shares, including distributions
+	ReadOnly      int `json:"read_only"`     // shares that can't be changed
+	Distributions int `json:"distributions"` // shares that can be changed
+	OwnerTokens   int `json:"owner_tokens"`  // distributions with an owner token
+	Expiring      int `json:"expiring"`      // shares with a TTL that didn't expire yet
+	Expired       int `json:"expired"`       // shares that expired but weren't collected yet
+	TakenDown     int `json:"taken_down"`
+	Quarantined   int `json:"quarantined"`
+	Reported      int `json:"reported"`
+	AccessedDay   int `json:"accessed_day"`   // shares accessed in the last day
+	AccessedMonth int `json:"accessed_month"` // shares accessed in the last 30 days
+	Size          int `json:"size"`           // total size of the shares in bytes
+	Errors        int `json:"errors"`         // shares that failed to be read
+
+	ComputedAt time.Time `json:"computed_at"` // the statistics are refreshed in the background once older than adminStatsMaxAge
+}
+
+// adminStatsCache holds the last statistics of the shares, which are
+// computed in the background since that reads every share.
+type adminStatsCache struct {
+	mu        sync.Mutex
+	stats     *AdminStats
+	computing bool
+}
+
+// get returns the last statistics, or nil if none were computed yet, and
+// starts computing them with compute if they are missing or stale.
+func (c *adminStatsCache) get(now time.Time, compute func() AdminStats) *AdminStats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if !c.computing && (c.stats == nil || now.Sub(c.stats.ComputedAt) > adminStatsMaxAge) {
+		c.computing = true
+		go func() {
+			stats := compute()
+
+			c.mu.Lock()
+			defer c.mu.Unlock()
+			c.stats = &stats
+			c.computing = false
+		}()
+	}
+
+	return c.stats
+}
+
+// AuditEntry represents an admin action.
+type AuditEntry struct {
+	Time       time.Time `json:"time"`
+	Action     string    `json:"action"`
+	Key        string    `json:"key,omitempty"`
+	Reason     string    `json:"reason,omitempty"`
+	RemoteAddr string    `json:"remote_addr"`
+	Status     int       `json:"status"`
+}
+
+// auditLog writes admin actions as JSON lines, and keeps the most recent ones.
+type auditLog struct {
+	mu      sync.Mutex
+	w       io.Writer
+	entries []AuditEntry
+}
+
+func (l *auditLog) record(e AuditEntry) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if len(l.entries) == maxAuditEntries {
+		l.entries = l.entries[1:]
+	}
+	l.entries = append(l.entries, e)
+
+	log.WithFields(log.Fields{
+		"action":      e.Action,
+		"key":         e.Key,
+		"reason":      e.Reason,
+		"remote_addr": e.RemoteAddr,
+		"status":      e.Status,
+	}).Info("Admin action.")
+
+	if l.w != nil {
+		bs, _ := json.Marshal(e)
+		if _, err := l.w.Write(append(bs, '\n')); err != nil {
+			log.WithError(err).Error("Failed to write audit log.")
+		}
+	}
+}
+
+// recent returns up to limit of the most recent entries, latest first.
+func (l *auditLog) recent(limit int) []AuditEntry {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	entries := make([]AuditEntry, 0, min(limit, len(l.entries)))
+	for i := len(l.entries) - 1; i >= 0 && len(entries) < limit; i-- {
+		entries = append(entries, l.entries[i])
+	}
+	return entries
+}
+
+// EnableAdmin enables the /admin/v1 API for requests bearing token, writing
+// its audit log to audit in addition to the service log. The admin API is
+// not served unless it's enabled.
+func (api *API) EnableAdmin(token string, audit io.Writer) {
+	api.adminToken = token
+	api.audit = &auditLog{w: audit}
+	api.adminStats = &adminStatsCache{}
+}
+
+type auditEntryKey struct{}
+
+// requireAdmin authenticates admin requests, and records them in the audit
+// log once they were handled.
+func (api *API) requireAdmin(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if api.adminToken == "" {
+			api.handleNotFound(w, r)
+			return
+		}
+
+		entry := &AuditEntry{
+			Time:       time.Now().UTC(),
+			Key:        mux.Vars(r)["key"],
+			RemoteAddr: r.RemoteAddr,
+		}
+		if route := mux.CurrentRoute(r); route != nil {
+			entry.Action = route.GetName()
+		}
+
+		sw := &statusWriter{ResponseWriter: w, status: http.StatusOK}
+		defer func() {
+			entry.Status = sw.status
+			api.audit.record(*entry)
+		}()
+
+		token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok || subtle.ConstantTimeCompare([]byte(token), []byte(api.adminToken)) != 1 {
+			writeError(sw, http.StatusUnauthorized, apiCodeUnauthorized, errors.New("admin token required"))
+			return
+		}
+
+		next.ServeHTTP(sw, r.WithContext(context.WithValue(r.Context(), auditEntryKey{}, entry)))
+	})
+}
+
+// statusWriter records the status of a response.
+type statusWriter struct {
+	http.ResponseWriter
+	status int
+}
+
+func (w *statusWriter) WriteHeader(status int) {
+	w.status = status
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (api *API) handleAdminListShares(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+
+	limit := defaultAdminListLimit
+	if v := q.Get("limit"); v != "" {
+		var err error
+		limit, err = strconv.Atoi(v)
+		if err != nil || limit < 1 || limit > maxAdminListLimit {
+			writeError(w, http.StatusBadRequest, apiCodeInvalidArgument, fmt.Errorf("limit must be between 1 and %d", maxAdminListLimit))
+			return
+		}
+	}
+
+	keys, next, err := api.v1(r.Context()).listPage(q.Get("prefix"), q.Get("cursor"), limit)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, apiCodeInternalError, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, AdminShareList{Keys: keys, Next: next})
+}
+
+func (api *API) handleAdminViewShare(w http.ResponseWriter, r *http.Request) {
+	key := getKeyFromRequest(r)
+
+	dr, ok := api.getAdminShare(r.Context(), w, key)
+	if !ok {
+		return
+	}
+
+	bs, _ := json.Marshal(dr)
+
+	writeJSON(w, http.StatusOK, AdminShare{
+		Key:   key.Id,
+		Share: dr,
+		Metadata: AdminShareMetadata{
+			ReadOnly:       dr.ReadOnly,
+			OwnerToken:     dr.OwnerTokenHash != "",
+			ExpiresAt:      dr.ExpiresAt,
+			LastAccessedAt: dr.LastAccessedAt,
+			TakenDown:      dr.TakenDown,
+			Quarantine:     dr.Quarantine,
+			Reports:        dr.Reports,
+			Etag:           dr.Etag,
+			Size:           len(bs),
+		},
+	})
+}
+
+func (api *API) handleAdminTakedown(w http.ResponseWriter, r *http.Request) {
+	key := getKeyFromRequest(r)
+
+	var req AdminTakedownRequest
+	if bs, err := io.ReadAll(r.Body); err != nil {
+		writeError(w, http.StatusBadRequest, apiCodeParseError, err)
+		return
+	} else if len(bs) > 0 {
+		if err := util.UnmarshalJSON(bs, &req); err != nil {
+			writeError(w, http.StatusBadRequest, apiCodeParseError, err)
+			return
+		}
+	}
+
+	if entry, ok := r.Context().Value(auditEntryKey{}).(*AuditEntry); ok {
+		entry.Reason = req.Reason
+	}
+
+	takedown := &Takedown{At: time.Now().UTC(), Reason: req.Reason}
+
+	if !api.updateAdminShare(r.Context(), w, key, func(dr *DataRequest) error {
+		dr.TakenDown = takedown
+		return nil
+	}) {
+		return
+	}
+
+	writeJSON(w, http.StatusOK, takedown)
+}
+
+func (api *API) handleAdminRestore(w http.ResponseWriter, r *http.Request) {
+	key := getKeyFromRequest(r)
+
+	if !api.updateAdminShare(r.Context(), w, key, func(dr *DataRequest) error {
+		if dr.TakenDown == nil && dr.Quarantine == nil && dr.Reports == nil {
+			return errors.New("share was not taken down, quarantined or reported")
+		}
+
+		// restoring a share also dismisses its reports, as it was reviewed
+		dr.TakenDown, dr.Quarantine, dr.Reports = nil, nil, nil
+		return nil
+	}) {
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// handleAdminAssignOwner assigns the holder of the token whose hash is given
+// as the owner of a distribution, e.g. of one created before owner tokens
+// were introduced, once they proved to a moderator that it's theirs.
+func (api *API) handleAdminAssignOwner(w http.ResponseWriter, r *http.Request) {
+	key := getKeyFromRequest(r)
+
+	bs, err := io.ReadAll(r.Body)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, apiCodeParseError, err)
+		return
+	}
+
+	var req DistributeOwnerRequest
+	if err := util.UnmarshalJSON(bs, &req); err != nil {
+		writeError(w, http.StatusBadRequest, apiCodeParseError, err)
+		return
+	}
+
+	if !validOwnerTokenHash(req.OwnerTokenHash) {
+		writeError(w, http.StatusBadRequest, apiCodeInvalidArgument, errors.New("owner_token_hash must be a hex encoded SHA-256 digest"))
+		return
+	}
+
+	if !api.updateAdminShare(r.Context(), w, key, func(dr *DataRequest) error {
+		if dr.ReadOnly {
+			return errors.New("share is not a distribution")
+		}
+		dr.OwnerTokenHash = req.OwnerTokenHash
+		return nil
+	}) {
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// handleAdminStats serves the last statistics of the shares, which are
+// computed in the background. Until the first ones are, it asks to retry.
+func (api *API) handleAdminStats(w http.ResponseWriter, r *http.Request) {
+	stats := api.adminStats.get(time.Now(), func() AdminStats {
+		return api.computeAdminStats(context.WithoutCancel(r.Context()))
+	})
+	if stats == nil {
+		w.Header().Set("Retry-After", "10")
+		writeError(w, http.StatusServiceUnavailable, apiCodeUnavailable, errors.New("statistics are being computed, retry later"))
+		return
+	}
+
+	writeJSON(w, http.StatusOK, stats)
+}
+
+// computeAdminStats reads every share to compute the statistics of the shares.
+func (api *API) computeAdminStats(ctx context.Context) AdminStats {
+	now := time.Now()
+	stats := AdminStats{ComputedAt: now.UTC()}
+
+	keys, err := api.v1(ctx).ListAll(nil)
+	if err != nil {
+		log.WithError(err).Warn("Failed to list shares for statistics.")
+		stats.Errors++
+		return stats
+	}
+
+	for _, key := range keys {
+		dr, found, err := api.peekShare(ctx, key)
+		if err != nil {
+			stats.Errors++
+			continue
+		}
+		if !found {
+			continue
+		}
+
+		stats.Shares++
+		if dr.ReadOnly {
+			stats.ReadOnly++
+		} else {
+			stats.Distributions++
+		}
+		if dr.OwnerTokenHash != "" {
+			stats.OwnerTokens++
+		}
+		switch {
+		case dr.expired(now):
+			stats.Expired++
+		case dr.ExpiresAt != nil:
+			stats.Expiring++
+		}
+		if dr.TakenDown != nil {
+			stats.TakenDown++
+		}
+		if dr.Quarantine != nil {
+			stats.Quarantined++
+		}
+		if dr.Reports != nil {
+			stats.Reported++
+		}
+		if dr.LastAccessedAt != nil {
+			if since := now.Sub(*dr.LastAccessedAt); since <= 24*time.Hour {
+				stats.AccessedDay++
+				stats.AccessedMonth++
+			} else if since <= 30*24*time.Hour {
+				stats.AccessedMonth++
+			}
+		}
+
+		bs, _ := json.Marshal(dr)
+		stats.Size += len(bs)
+	}
+
+	return stats
+}
+
+func (api *API) handleAdminAudit(w http.ResponseWriter, r *http.Request) {
+	limit := defaultAdminListLimit
+	if v := r.URL.Query().Get("limit"); v != "" {
+		var err error
+		limit, err = strconv.Atoi(v)
+		if err != nil || limit < 1 || limit > maxAuditEntries {
+			writeError(w, http.StatusBadRequest, apiCodeInvalidArgument, fmt.Errorf("limit must be between 1 and %d", maxAuditEntries))
+			return
+		}
+	}
+
+	writeJSON(w, http.StatusOK, api.audit.recent(limit))
+}
+
+// getAdminShare retrieves a v1 share, including an expired or taken down
+// one, without recording an access. Errors are written to w.
+func (api *API) getAdminShare(ctx context.Context, w http.ResponseWriter, key *StoreKey) (DataRequest, bool) {
+	if key.KeyType != KeyTypeLegacy {
+		writeError(w, http.StatusBadRequest, apiCodeInvalidArgument, errors.New("only shares stored by the playground can be moderated"))
+		return DataRequest{}, false
+	}
+
+	dr, found, err := api.peekShare(ctx, key)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, apiCodeInternalError, err)
+		return DataRequest{}, false
+	}
+	if !found {
+		writeError(w, http.StatusNotFound, apiCodeNotFound, errors.New("key not found"))
+		return DataRequest{}, false
+	}
+
+	return dr, true
+}
+
+// updateAdminShare applies fn to a v1 share atomically, including to an
+// expired or taken down one. Errors of fn are written to w as invalid
+// arguments, and the other errors as they are.
+func (api *API) updateAdminShare(ctx context.Context, w http.ResponseWriter, key *StoreKey, fn func(*DataRequest) error) bool {
+	if key.KeyType != KeyTypeLegacy {
+		writeError(w, http.StatusBadRequest, apiCodeInvalidArgument, errors.New("only shares stored by the playground can be moderated"))
+		return false
+	}
+
+	var fnErr error
+	found, err := api.v1(ctx).update(key, func(dr *DataRequest) error {
+		fnErr = fn(dr)
+		return fnErr
+	})
+	switch {
+	case fnErr != nil:
+		writeError(w, http.StatusBadRequest, apiCodeInvalidArgument, fnErr)
+		return false
+	case err != nil:
+		writeError(w, http.StatusInternalServerError, apiCodeInternalError, err)
+		return false
+	case !found:
+		writeError(w, http.StatusNotFound, apiCodeNotFound, errors.New("key not found"))
+		return false
+	}
+
+	return true
+}
+
+func (api *API) peekShare(ctx context.Context, key *StoreKey) (DataRequest, bool, error) {
+	return api.v1(ctx).peek(key)
+}
+
+// writeTakenDown writes an error for a share that was taken down.
+func writeTakenDown(w http.ResponseWriter) {
+	writeError(w, http.StatusGone, apiCodeGone, errShareTakenDown)
+}
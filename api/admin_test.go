@@ -0,0 +1,231 @@
+package api
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/open-policy-agent/opa/util"
+)
+
+func TestAdminAuth(t *testing.T) {
+	s := NewAPIService("", NewMemoryDataRequestStore(), nil, "./", "", "", "")
+
+	w := httptest.NewRecorder()
+	s.router.ServeHTTP(w, httptest.NewRequest("GET", "/admin/v1/stats", nil))
+	if w.Code != http.StatusNotFound {
+		t.Fatalf("expected 404 response without an admin token configured but got: %v", w.Code)
+	}
+
+	var audit bytes.Buffer
+	s.EnableAdmin("secret", &audit)
+
+	for _, header := range []string{"", "secret", "Bearer wrong"} {
+		r := httptest.NewRequest("GET", "/admin/v1/stats", nil)
+		if header != "" {
+			r.Header.Set("Authorization", header)
+		}
+		w := httptest.NewRecorder()
+		s.router.ServeHTTP(w, r)
+		if w.Code != http.StatusUnauthorized {
+			t.Fatalf("expected 401 response with authorization %q but got: %v", header, w.Code)
+		}
+	}
+
+	var entry AuditEntry
+	lines := strings.Split(strings.TrimSpace(audit.String()), "\n")
+	if err := json.Unmarshal([]byte(lines[len(lines)-1]), &entry); err != nil {
+		t.Fatal(err)
+	}
+	if len(lines) != 3 || entry.Action != adminActionStats || entry.Status != http.StatusUnauthorized {
+		t.Fatalf("expected the failed attempts to be audited, got: %s", audit.String())
+	}
+}
+
+func TestAdminModeration(t *testing.T) {
+	store := NewMemoryDataRequestStore()
+	s := NewAPIService("", store, nil, "./", "", "", "")
+	s.EnableAdmin("secret", nil)
+
+	do := func(method, path string, body interface{}) *httptest.ResponseRecorder {
+		var bs []byte
+		if body != nil {
+			bs, _ = json.Marshal(body)
+		}
+		r := httptest.NewRequest(method, path, bytes.NewReader(bs))
+		if strings.HasPrefix(path, "/admin/") {
+			r.Header.Set("Authorization", "Bearer secret")
+		}
+		w := httptest.NewRecorder()
+		s.router.ServeHTTP(w, r)
+		return w
+	}
+
+	dr := makeDR("package play\n\nallow := true\n", "", "", 1)
+	dr.ReadOnly = true
+	for i := 0; i < 3; i++ {
+		store.Put(&StoreKey{Id: fmt.Sprintf("share%d", i)}, dr, nil)
+	}
+
+	// Listing
+	var page AdminShareList
+	w := do("GET", "/admin/v1/shares?limit=2", nil)
+	if err := util.UnmarshalJSON(w.Body.Bytes(), &page); err != nil {
+		t.Fatal(err)
+	}
+	if exp := (AdminShareList{Keys: []string{"share0", "share1"}, Next: "share1"}); !reflect.DeepEqual(page, exp) {
+		t.Fatalf("expected %+v but got: %+v", exp, page)
+	}
+
+	next := page.Next
+	page = AdminShareList{}
+	w = do("GET", "/admin/v1/shares?limit=2&cursor="+next, nil)
+	if err := util.UnmarshalJSON(w.Body.Bytes(), &page); err != nil {
+		t.Fatal(err)
+	}
+	if exp := (AdminShareList{Keys: []string{"share2"}}); !reflect.DeepEqual(page, exp) {
+		t.Fatalf("expected %+v but got: %+v", exp, page)
+	}
+
+	if w := do("GET", "/admin/v1/shares?limit=0", nil); w.Code != http.StatusBadRequest {
+		t.Fatalf("expected 400 response but got: %v", w.Code)
+	}
+
+	// Viewing
+	var view AdminShare
+	w = do("GET", "/admin/v1/shares/share0", nil)
+	if err := util.UnmarshalJSON(w.Body.Bytes(), &view); err != nil {
+		t.Fatal(err)
+	}
+	if view.Key != "share0" || !view.Metadata.ReadOnly || view.Metadata.Size == 0 || !reflect.DeepEqual(view.Share.RegoModules, dr.RegoModules) {
+		t.Fatalf("unexpected share: %+v", view)
+	}
+
+	if w := do("GET", "/admin/v1/shares/missing", nil); w.Code != http.StatusNotFound {
+		t.Fatalf("expected 404 response but got: %v", w.Code)
+	}
+
+	// Takedown
+	if w := do("POST", "/admin/v1/shares/share0/takedown", AdminTakedownRequest{Reason: "spam"}); w.Code != http.StatusOK {
+		t.Fatalf("expected 200 response but got: %v, body: %s", w.Code, w.Body.String())
+	}
+
+	if w := do("POST", "/admin/v1/shares/missing/takedown", AdminTakedownRequest{Reason: "spam"}); w.Code != http.StatusNotFound {
+		t.Fatalf("expected 404 response for a missing share but got: %v", w.Code)
+	}
+
+	owner := DistributeOwnerRequest{OwnerTokenHash: strings.Repeat("ab", 32)}
+	if w := do("PUT", "/admin/v1/shares/share1/owner", owner); w.Code != http.StatusBadRequest || !strings.Contains(w.Body.String(), "share is not a distribution") {
+		t.Fatalf("expected 400 response for a share but got: %v, body: %s", w.Code, w.Body.String())
+	}
+
+	for _, path := range []string{"/p/share0", "/v1/data/share0", "/v1/input/share0", "/bundles/share0"} {
+		if w := do("GET", path, nil); w.Code != http.StatusGone {
+			t.Fatalf("expected 410 response for %v but got: %v, body: %s", path, w.Code, w.Body.String())
+		}
+	}
+
+	if w := do("GET", "/p/share1", nil); w.Code != http.StatusOK {
+		t.Fatalf("expected 200 response for another share but got: %v", w.Code)
+	}
+
+	// The statistics are computed in the background.
+	w = do("GET", "/admin/v1/stats", nil)
+	for deadline := time.Now().Add(5 * time.Second); w.Code == http.StatusServiceUnavailable && time.Now().Before(deadline); {
+		time.Sleep(10 * time.Millisecond)
+		w = do("GET", "/admin/v1/stats", nil)
+	}
+
+	var stats AdminStats
+	if err := util.UnmarshalJSON(w.Body.Bytes(), &stats); err != nil {
+		t.Fatal(err)
+	}
+	if stats.Shares != 3 || stats.ReadOnly != 3 || stats.TakenDown != 1 || stats.AccessedDay != 3 || stats.Size == 0 {
+		t.Fatalf("unexpected stats: %+v", stats)
+	}
+
+	// Restoration
+	if w := do("POST", "/admin/v1/shares/share0/restore", nil); w.Code != http.StatusNoContent {
+		t.Fatalf("expected 204 response but got: %v, body: %s", w.Code, w.Body.String())
+	}
+
+	if w := do("POST", "/admin/v1/shares/share0/restore", nil); w.Code != http.StatusBadRequest {
+		t.Fatalf("expected 400 response for a share that isn't taken down but got: %v", w.Code)
+	}
+
+	if w := do("GET", "/v1/data/share0", nil); w.Code != http.StatusOK {
+		t.Fatalf("expected 200 response for the restored share but got: %v, body: %s", w.Code, w.Body.String())
+	}
+
+	// Audit
+	var entries []AuditEntry
+	w = do("GET", "/admin/v1/audit?limit=3", nil)
+	if err := util.UnmarshalJSON(w.Body.Bytes(), &entries); err != nil {
+		t.Fatal(err)
+	}
+
+	var actions []string
+	for _, e := range entries {
+		actions = append(actions, fmt.Sprintf("%s %s %d", e.Action, e.Key, e.Status))
+	}
+	exp := []string{"restore share0 400", "restore share0 204", "stats  200"}
+	if !reflect.DeepEqual(actions, exp) {
+		t.Fatalf("expected %v but got: %v", exp, actions)
+	}
+
+	for _, e := range s.audit.recent(maxAuditEntries) {
+		if e.Action == adminActionTakedown && e.Reason != "spam" {
+			t.Fatalf("expected the reason of the takedown to be audited, got: %+v", e)
+		}
+	}
+}
+
+func TestAdminStatsCache(t *testing.T) {
+	var c adminStatsCache
+	computed := make(chan time.Time, 3)
+	compute := func(at time.Time) func() AdminStats {
+		return func() AdminStats {
+			computed <- at
+			return AdminStats{Shares: 1, ComputedAt: at}
+		}
+	}
+
+	now := time.Now()
+	if stats := c.get(now, compute(now)); stats != nil {
+		t.Fatalf("expected no statistics before they were computed but got: %+v", stats)
+	}
+	<-computed
+
+	for deadline := time.Now().Add(5 * time.Second); ; {
+		if stats := c.get(now, compute(now)); stats != nil {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("expected the statistics to be computed")
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	if stats := c.get(now.Add(adminStatsMaxAge), compute(now)); !stats.ComputedAt.Equal(now) {
+		t.Fatalf("expected the cached statistics but got: %+v", stats)
+	}
+	select {
+	case <-computed:
+		t.Fatal("expected fresh statistics not to be computed again")
+	default:
+	}
+
+	later := now.Add(2 * adminStatsMaxAge)
+	if stats := c.get(later, compute(later)); !stats.ComputedAt.Equal(now) {
+		t.Fatalf("expected the stale statistics while they are computed again but got: %+v", stats)
+	}
+	if at := <-computed; !at.Equal(later) {
+		t.Fatalf("expected the statistics to be computed again but got: %v", at)
+	}
+}
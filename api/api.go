@@ -2,9 +2,11 @@ package api
 
 import (
 	"bufio"
+	"bytes"
 	"compress/gzip"
 	"context"
 	"crypto/sha256"
+	"crypto/tls"
 	"encoding/base64"
 	"encoding/hex"
 	"encoding/json"
@@ -12,13 +14,17 @@ import (
 	"fmt"
 	"io"
 	"math/rand"
+	"net"
 	"net/http"
 	"net/url"
 	"path"
 	"reflect"
 	"runtime/debug"
+	"slices"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/google/go-github/v73/github"
@@ -34,15 +40,16 @@ import (
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 	log "github.com/sirupsen/logrus"
-	"github.com/styrainc/regal/pkg/config"
 	"github.com/styrainc/regal/pkg/linter"
 	"github.com/styrainc/regal/pkg/report"
-	"github.com/styrainc/regal/pkg/rules"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 	"golang.org/x/oauth2"
 	oauthGithub "golang.org/x/oauth2/github"
 
 	"github.com/open-policy-agent/rego-playground/opa"
 	"github.com/open-policy-agent/rego-playground/presentation"
+	"github.com/open-policy-agent/rego-playground/utils"
 	"github.com/open-policy-agent/rego-playground/version"
 )
 
@@ -64,6 +71,9 @@ type apiRouteNotFoundError struct {
 type DataRequest struct {
 	Input               *interface{}                    `json:"input"`                  // (optional)
 	Data                *interface{}                    `json:"data"`                   // (optional)
+	InputFormat         string                          `json:"input_format"`           // (optional) format of the input if it's given as text, e.g. "yaml"; see opa.DecodeDocument
+	DataFormat          string                          `json:"data_format"`            // (optional) format of the data if it's given as text
+	DataDocuments       []opa.DataDocument              `json:"data_documents"`         // (optional) documents mounted at paths under data, e.g. data.users
 	RegoModules         map[string]interface{}          `json:"rego_modules"`           // (optional) typically will contain at least one module
 	RegoQuery           string                          `json:"rego"`                   // (optional) client side; if empty, opa.go will query either data.<package> or data depending on whether there's one or more modules
 	RegoVersion         *int                            `json:"rego_version"`           // (optional) version of Rego to parse for
@@ -76,12 +86,39 @@ type DataRequest struct {
 	BuiltInErrorsAll    bool                            `json:"built_in_errors_all"`    // (optional) if true, all built-in errors will be returned
 	BuiltInErrorsStrict bool                            `json:"built_in_errors_strict"` // (optional) if true, the first built in error encountered is fatal returned
 	Etag                string                          `json:"etag"`                   // (optional)
+	RegalConfig         *string                         `json:"regal_config,omitempty"` // (optional) contents of a .regal/config.yaml, persisted so that everyone sees the same lint findings
+	Target              string                          `json:"target,omitempty"`       // (optional) also build for the "plan" or "wasm" target
+	Metrics             bool                            `json:"metrics,omitempty"`      // (optional) if true, all compile and eval metrics and built-in call counts will be returned
+	Mode                string                          `json:"mode,omitempty"`         // (optional) "conftest" to also evaluate the deny, warn and violation rules and summarise their messages
+	Namespaces          []string                        `json:"namespaces,omitempty"`   // (optional) packages whose rules are evaluated in conftest mode, e.g. "main"; defaults to all packages
+	Format              string                          `json:"format,omitempty"`       // (optional) format of the "pretty" result, see presentation.Formats; defaults to "pretty"
+	PrettyLimit         int                             `json:"pretty_limit,omitempty"` // (optional) truncate the values in pretty tables to this many bytes
+	Entrypoints         []string                        `json:"entrypoints,omitempty"`  // (optional) entrypoints to build, e.g. "play/allow"; defaults to the query if it refers to a document under data
 	Patch               *[]jsonpatch.JsonPatchOperation `json:"patch"`
+	OwnerTokenHash      string                          `json:"owner_token_hash,omitempty"` // (internal) hash of the owner token of a distribution, ignored in requests
+	TTL                 string                          `json:"ttl,omitempty"`              // (optional) time after which a new share or distribution expires, e.g. "720h"
+	ExpiresAt           *time.Time                      `json:"expires_at,omitempty"`       // (internal) set from the TTL, ignored in requests
+	LastAccessedAt      *time.Time                      `json:"-"`                          // (internal) tracked by the store, see DataRequestStore.Get
+	TakenDown           *Takedown                       `json:"taken_down,omitempty"`       // (internal) set when a moderator took the share down, ignored in requests
+	Quarantine          *Quarantine                     `json:"quarantine,omitempty"`       // (internal) set when the content matched the blocklist, ignored in requests
+	Reports             *AbuseReports                   `json:"reports,omitempty"`          // (internal) abuse reports of the share, ignored in requests
+}
+
+// clearServerFields clears the fields that only the server sets, so that
+// requests can't set them.
+func (dr *DataRequest) clearServerFields() {
+	dr.OwnerTokenHash = ""
+	dr.ExpiresAt = nil
+	dr.LastAccessedAt = nil
+	dr.TakenDown = nil
+	dr.Quarantine = nil
+	dr.Reports = nil
 }
 
 // DataRequestStore represents a system for storing and retrieving DataRequests.
 type DataRequestStore interface {
 	// Get a DataRequest from the store (potentially empty) and whether that key is set, returns an error if the correct values for both could not be determined (e.g. errors from the network, demarshaling, etc...).
+	// Stores that expire DataRequests don't return them once they have expired, and record when they were last gotten.
 	Get(key *StoreKey, principal *Principal) (DataRequest, bool, error)
 	// Put adds/sets a DataRequest in the store, or errors if it can't.
 	Put(key *StoreKey, dr DataRequest, principal *Principal) (*StoreKey, error)
@@ -92,6 +129,8 @@ type DataRequestStore interface {
 	ListAll(principal *Principal) ([]*StoreKey, error)
 	// Watch adds a watcher to provide change notifications when the store is changed.
 	Watch(key *StoreKey, etag string, timeout time.Duration, cb func(DataRequest), principal *Principal) (bool, error)
+	// Delete removes a DataRequest from the store, waking its watchers with an empty DataRequest. Deleting a key that isn't set is not an error.
+	Delete(key *StoreKey, principal *Principal) error
 }
 
 type KeyType int
@@ -188,27 +227,42 @@ func (p *Principal) AccessToken() *oauth2.Token {
 }
 
 func (p *Principal) Client(ctx context.Context) *github.Client {
-	return github.NewClient(p.oauthConfig.Client(ctx, p.accessToken))
+	return github.NewClient(p.oauthConfig.Client(withGithubHTTPClient(ctx), p.accessToken))
 }
 
 // DataResponse represents the data returned to the FE
 type DataResponse struct {
-	Result        interface{}      `json:"result"`
-	BundleId      interface{}      `json:"bundle_id"`
-	BundleUrl     interface{}      `json:"bundle_url"`
-	CommitId      interface{}      `json:"commit_id"`
-	CommitUrl     interface{}      `json:"commit_url"`
-	Pretty        interface{}      `json:"pretty"` // The "pretty"-printed results
-	Value         string           `json:"value"`
-	Input         *interface{}     `json:"input"`
-	Data          *interface{}     `json:"data"`
-	RegoVersion   *int             `json:"rego_version"`
-	EvalTime      interface{}      `json:"eval_time"`
-	BuiltInErrors []topdown.Error  `json:"built_in_errors,omitempty"`
-	Trace         interface{}      `json:"trace,omitempty"`
-	Output        string           `json:"output,omitempty"`
-	Coverage      *coverpkg.Report `json:"coverage,omitempty"`
-	Ignored       []string         `json:"ignored,omitempty"`
+	Result        interface{}        `json:"result"`
+	BundleId      interface{}        `json:"bundle_id"`
+	BundleUrl     interface{}        `json:"bundle_url"`
+	CommitId      interface{}        `json:"commit_id"`
+	CommitUrl     interface{}        `json:"commit_url"`
+	Pretty        interface{}        `json:"pretty"` // The "pretty"-printed results, in the format of the request
+	Value         string             `json:"value"`
+	Input         *interface{}       `json:"input"`
+	Data          *interface{}       `json:"data"`
+	DataDocuments []opa.DataDocument `json:"data_documents,omitempty"`
+	RegoVersion   *int               `json:"rego_version"`
+	EvalTime      interface{}        `json:"eval_time"`
+	BuiltInErrors []topdown.Error    `json:"built_in_errors,omitempty"`
+	Trace         interface{}        `json:"trace,omitempty"`
+	Output        string             `json:"output,omitempty"`
+	Coverage      *coverpkg.Report   `json:"coverage,omitempty"`
+	Ignored       []string           `json:"ignored,omitempty"`
+	RegalConfig   *string            `json:"regal_config,omitempty"`
+	Build         *opa.BuildResult   `json:"build,omitempty"`
+
+	Metrics      map[string]interface{} `json:"metrics,omitempty"`
+	BuiltinCalls map[string]int         `json:"builtin_calls,omitempty"`
+	Conftest     *opa.ConftestSummary   `json:"conftest,omitempty"` // The summary in conftest mode, also rendered as the "pretty" result
+	Warning      string                 `json:"warning,omitempty"`  // Set for shares that were reported or quarantined
+}
+
+// BuildResponse represents the result of building for a target
+type BuildResponse struct {
+	Result      *opa.BuildResult `json:"result"`
+	RegoVersion *int             `json:"rego_version"`
+	Ignored     []string         `json:"ignored,omitempty"`
 }
 
 // InputResponse represents a policy's input
@@ -250,15 +304,137 @@ type FormatResponse struct {
 
 // LintRequest represents a request from the frontend to lint rego code
 type LintRequest struct {
-	RegoVersion *int   `json:"rego_version"`
-	RegoModule  string `json:"rego_module"`
+	RegoVersion *int                   `json:"rego_version"`
+	RegoModule  string                 `json:"rego_module"`  // (optional) a single module, linted as policy.rego
+	RegoModules map[string]interface{} `json:"rego_modules"` // (optional) all modules of a share, takes precedence over rego_module
+	RegalConfig string                 `json:"regal_config"` // (optional) contents of a .regal/config.yaml
+}
+
+// Position represents a cursor position in a module (1-based)
+type Position struct {
+	Row int `json:"row"`
+	Col int `json:"col"`
+}
+
+// CompleteRequest represents a request for completions at a cursor position
+type CompleteRequest struct {
+	RegoModules map[string]interface{} `json:"rego_modules"` // all modules of the playground, used for rule names and data paths
+	RegoModule  string                 `json:"rego_module"`  // (optional) key of the module the cursor is in; may be omitted with a single module
+	Position    Position               `json:"position"`
+	Input       *interface{}           `json:"input"`        // (optional) used to suggest input paths
+	Data        *interface{}           `json:"data"`         // (optional) used to suggest data paths
+	RegoVersion *int                   `json:"rego_version"` // (optional) version of Rego to parse for
+}
+
+// CompleteResponse represents the completions for a cursor position
+type CompleteResponse struct {
+	Token  string           `json:"token"`
+	Result []opa.Completion `json:"result"`
 }
 
 // LintResponse represents a response to a lint request
 type LintResponse struct {
-	ErrorMessage string         `json:"error_message"`
-	Errors       []*ast.Error   `json:"errors"`
-	Report       *report.Report `json:"report"`
+	ErrorMessage string                        `json:"error_message"`
+	Errors       []*ast.Error                  `json:"errors"`
+	Report       *report.Report                `json:"report"`
+	Violations   map[string][]report.Violation `json:"violations,omitempty"` // Violations of the report, keyed by file
+}
+
+// LintFixResponse represents a response to a lint fix request
+type LintFixResponse struct {
+	ErrorMessage string              `json:"error_message"`
+	Errors       []*ast.Error        `json:"errors"`
+	Result       map[string]string   `json:"result"` // Fixed modules, keyed by file
+	Fixes        map[string][]string `json:"fixes"`  // Titles of the fixes applied, keyed by file
+	Diff         string              `json:"diff"`   // Unified diff of all fixed modules
+}
+
+// ASTRequest represents a request to inspect the AST of modules and a query
+type ASTRequest struct {
+	RegoModule  string                 `json:"rego_module"`  // (optional) a single module, parsed as policy.rego
+	RegoModules map[string]interface{} `json:"rego_modules"` // (optional) all modules of a share, takes precedence over rego_module
+	RegoVersion *int                   `json:"rego_version"` // (optional) version of Rego to parse for, defaults to 1
+	Query       string                 `json:"query"`        // (optional) query to parse
+	Stages      []string               `json:"stages"`       // (optional) compiler stages to snapshot the modules after, e.g. RewriteLocalVars
+}
+
+// MigrateRequest represents a request to migrate Rego v0 modules to v1
+type MigrateRequest struct {
+	RegoModule  string                 `json:"rego_module"`  // (optional) a single module, migrated as policy.rego
+	RegoModules map[string]interface{} `json:"rego_modules"` // (optional) all modules of a share, takes precedence over rego_module
+}
+
+// MigrateResponse represents the migrated modules and the issues left for the user
+type MigrateResponse struct {
+	Result map[string]string `json:"result"` // Migrated modules, keyed by file
+	Diffs  map[string]string `json:"diffs"`  // Unified diffs of the changed modules, keyed by file
+	Issues []*ast.Error      `json:"issues"` // Constructs that need to be migrated manually
+}
+
+// CompareRequest represents a request to compare the decisions of two policies
+type CompareRequest struct {
+	Base   CompareSource `json:"base"`
+	Head   CompareSource `json:"head"`
+	Inputs []interface{} `json:"inputs"` // the corpus of inputs to evaluate both sides with
+}
+
+// CompareSource is one side of a comparison, either a data request or a share
+type CompareSource struct {
+	DataRequest *DataRequest `json:"data_request"` // (optional) modules, data and query to evaluate
+	Key         string       `json:"key"`          // (optional) key of a share to evaluate instead
+	Revision    string       `json:"revision"`     // (optional) revision of a published share, defaults to the one in the key
+}
+
+// CompareResponse represents the decisions that differ between two policies
+type CompareResponse struct {
+	Result          *opa.CompareResult `json:"result"`
+	BaseRegoVersion *int               `json:"base_rego_version"`
+	HeadRegoVersion *int               `json:"head_rego_version"`
+}
+
+// ReplayResponse represents the decisions of a decision log that differ when
+// replayed against a share
+type ReplayResponse struct {
+	Result      *opa.ReplayResult `json:"result"`
+	RegoVersion *int              `json:"rego_version"`
+	Ignored     []string          `json:"ignored,omitempty"`
+}
+
+// GenerateInputsRequest represents a request to generate inputs from a JSON
+// Schema that drive a rule to each of its outcomes
+type GenerateInputsRequest struct {
+	DataRequest DataRequest `json:"data_request"` // modules and data to evaluate the rule with
+	Rule        string      `json:"rule"`         // reference to the rule, e.g. data.play.allow
+	Schema      interface{} `json:"schema"`       // JSON Schema of the input
+	Seed        *int64      `json:"seed"`         // (optional) seed of the random inputs, defaults to a random one
+	Random      int         `json:"random"`       // (optional) number of random inputs, defaults to 100
+}
+
+// GenerateInputsResponse represents the outcomes of a rule for the generated inputs
+type GenerateInputsResponse struct {
+	Result      *opa.GenerateResult `json:"result"`
+	RegoVersion *int                `json:"rego_version"`
+	Ignored     []string            `json:"ignored,omitempty"`
+}
+
+// TestGenerateResponse represents a test module generated from an evaluation
+type TestGenerateResponse struct {
+	Result      string   `json:"result"` // the test.rego module
+	RegoVersion *int     `json:"rego_version"`
+	Ignored     []string `json:"ignored,omitempty"`
+}
+
+// DistributeResponse represents a distribution and, when it was created or
+// its token rotated, the secret token required to change it
+type DistributeResponse struct {
+	Result     string `json:"result"`                // the URL of the distribution
+	OwnerToken string `json:"owner_token,omitempty"` // only returned once, send it in the X-Owner-Token header
+}
+
+// DistributeOwnerRequest represents a request to transfer the ownership of a
+// distribution to the holder of another token
+type DistributeOwnerRequest struct {
+	OwnerTokenHash string `json:"owner_token_hash"` // hex encoded SHA-256 digest of the new owner's token
 }
 
 type update struct {
@@ -274,17 +450,49 @@ const (
 	apiCodeInternalError    = "internal_error"
 	apiCodeFileTooLarge     = "file_too_large"
 	apiCodeInvalidArgument  = "invalid_argument"
-	maxUploadSizeLimitBytes = int64(32768) // 32KB size limit
+	apiCodeGone             = "gone"
+	apiCodeTooManyRequests  = "too_many_requests"
+	apiCodeUnavailable      = "unavailable"
+	maxUploadSizeLimitBytes = int64(32768)   // 32KB size limit
+	maxCompareInputs        = 1000           // Maximum number of inputs in a comparison
+	maxCompareSizeBytes     = int64(8 << 20) // 8MB size limit of comparisons
+	maxReplaySizeBytes      = int64(8 << 20) // 8MB size limit of uploaded decision logs
+	maxReplayEntries        = 10000          // Maximum number of decision log entries to replay
+	maxModulesSizeBytes     = int64(1 << 20) // 1MB size limit of the modules to fix or migrate
+
+	maxReplayDecompressedBytes = 4 * maxReplaySizeBytes // Maximum size of uploaded decision logs once decompressed
+	maxRequestEvalTime         = 30 * time.Second       // Time budget of all evaluations of a request evaluating many inputs, within the write timeout
+
+	defaultGeneratedRandomInputs = 100  // Number of random inputs generated from a schema by default
+	maxGeneratedRandomInputs     = 1000 // Maximum number of random inputs generated from a schema
+	maxGeneratedVariantInputs    = 500  // Maximum number of inputs enumerated from a schema
+	maxGeneratedInputShrinks     = 100  // Maximum number of evaluations to minimize the input of an outcome
+
+	// Timeouts of the HTTP server.
+	serverReadHeaderTimeout = 10 * time.Second
+	serverReadTimeout       = 30 * time.Second
+	serverWriteTimeout      = 60 * time.Second // extended by the wait of long-polls
+	serverIdleTimeout       = 120 * time.Second
 
 	// Set of handlers for use in the "handler" dimension of the duration metric.
-	promHandlerBundlesGet       = "v1/bundles_get"
-	promHandlerV1Data           = "v1/data"
-	promHandlerV1ShareGet       = "v1/share_get"
-	promHandlerV1SharePost      = "v1/share_post"
-	promHandlerV1VarsPost       = "v1/vars_post"
-	promHandlerV1Lint           = "v1/lint"
-	promHandlerV1FormattingPost = "v1/formatting_post"
-	promHandlerV1CORSPreflight  = "v1/cors_preflight"
+	promHandlerBundlesGet         = "v1/bundles_get"
+	promHandlerV1Data             = "v1/data"
+	promHandlerV1ShareGet         = "v1/share_get"
+	promHandlerV1SharePost        = "v1/share_post"
+	promHandlerV1VarsPost         = "v1/vars_post"
+	promHandlerV1Lint             = "v1/lint"
+	promHandlerV1LintFix          = "v1/lint_fix"
+	promHandlerV1MigratePost      = "v1/migrate_post"
+	promHandlerV1ASTPost          = "v1/ast_post"
+	promHandlerV1BuildPost        = "v1/build_post"
+	promHandlerV1ComparePost      = "v1/compare_post"
+	promHandlerV1ReplayPost       = "v1/replay_post"
+	promHandlerV1GeneratePost     = "v1/generate_post"
+	promHandlerV1TestGeneratePost = "v1/test_generate_post"
+	promHandlerV1ReportPost       = "v1/report_post"
+	promHandlerV1FormattingPost   = "v1/formatting_post"
+	promHandlerV1CompletePost     = "v1/complete_post"
+	promHandlerV1CORSPreflight    = "v1/cors_preflight"
 
 	corsMaxAgeSec = "7200" // How long to let browsers cache CORS preflight responses. 2 hours is chromium's default (after v76)
 
@@ -294,6 +502,9 @@ const (
 	// defaultBundleMode indicates that OPA supports snapshot bundle processing
 	defaultBundleMode = "snapshot"
 
+	// conftestMode summarises the deny, warn and violation rules of a query
+	conftestMode = "conftest"
+
 	githubAuthCookie = "github_access_token"
 )
 
@@ -320,16 +531,16 @@ func NewGithubAuth(config *oauth2.Config) *GithubAuth {
 
 // Token returns a token (automatically refreshed if possible) or an error
 func (g GithubAuth) Token(ctx context.Context, token *oauth2.Token) (*oauth2.Token, error) {
-	return g.config.TokenSource(ctx, token).Token()
+	return g.config.TokenSource(withGithubHTTPClient(ctx), token).Token()
 }
 
 // Exchange converts an authorization code into a token
 func (g GithubAuth) Exchange(ctx context.Context, code string) (*oauth2.Token, error) {
-	return g.config.Exchange(ctx, code)
+	return g.config.Exchange(withGithubHTTPClient(ctx), code)
 }
 
 func (g GithubAuth) Check(ctx context.Context, token *oauth2.Token) bool {
-	client := github.NewClient(g.config.Client(ctx, token))
+	client := github.NewClient(g.config.Client(withGithubHTTPClient(ctx), token))
 	_, _, err := client.Gists.ListAll(ctx, nil)
 	if err != nil {
 		return false
@@ -348,6 +559,21 @@ type API struct {
 	externalURL       string
 	githubOauthConfig *oauth2.Config
 	auth              Auth
+	promRegistry      *prometheus.Registry
+	adminToken        string
+	audit             *auditLog
+	adminStats        *adminStatsCache
+	blocklist         *Blocklist
+	blocklistMatches  *prometheus.CounterVec
+	abuseReports      prometheus.Counter
+	metrics           *apiMetrics
+	rateLimiter       *RateLimiter
+	health            *HealthRegistry
+	certs             *certReloader
+	server            *http.Server
+	draining          atomic.Bool
+	shutdown          chan struct{} // closed when the server shuts down, to end long-polls
+	shutdownOnce      sync.Once
 }
 
 // NewAPIService returns a instance of the API.
@@ -371,11 +597,26 @@ func NewAPIService(addr string, v1Store, v2Store DataRequestStore, contentRoot s
 		externalURL:       externalURL,
 		githubOauthConfig: conf,
 		auth:              NewGithubAuth(conf),
+		shutdown:          make(chan struct{}),
+		health:            NewHealthRegistry(defaultHealthCacheTTL),
+		metrics:           newAPIMetrics(),
+		blocklistMatches: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "blocklist_matches_total",
+			Help: "The number of writes of shares that matched the blocklist, by the action taken.",
+		}, []string{"action"}),
+		abuseReports: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "abuse_reports_total",
+			Help: "The number of abuse reports of shares.",
+		}),
 	}
 
+	api.registerHealthChecks()
+
 	api.router = mux.NewRouter()
+	api.router.Use(traceRoute)
 
 	promRegistry := prometheus.NewRegistry()
+	api.promRegistry = promRegistry
 	duration := prometheus.NewHistogramVec(
 		prometheus.HistogramOpts{
 			Name: "http_request_duration_seconds",
@@ -388,41 +629,85 @@ func NewAPIService(addr string, v1Store, v2Store DataRequestStore, contentRoot s
 	v1ShareGetDur := duration.MustCurryWith(prometheus.Labels{"handler": promHandlerV1ShareGet})
 	v1SharePostDur := duration.MustCurryWith(prometheus.Labels{"handler": promHandlerV1SharePost})
 	v1LintDur := duration.MustCurryWith(prometheus.Labels{"handler": promHandlerV1Lint})
+	v1LintFixDur := duration.MustCurryWith(prometheus.Labels{"handler": promHandlerV1LintFix})
 	v1Vars := duration.MustCurryWith(prometheus.Labels{"handler": promHandlerV1VarsPost})
 	v1Formatting := duration.MustCurryWith(prometheus.Labels{"handler": promHandlerV1FormattingPost})
+	v1Complete := duration.MustCurryWith(prometheus.Labels{"handler": promHandlerV1CompletePost})
+	v1Migrate := duration.MustCurryWith(prometheus.Labels{"handler": promHandlerV1MigratePost})
+	v1AST := duration.MustCurryWith(prometheus.Labels{"handler": promHandlerV1ASTPost})
+	v1Build := duration.MustCurryWith(prometheus.Labels{"handler": promHandlerV1BuildPost})
+	v1Compare := duration.MustCurryWith(prometheus.Labels{"handler": promHandlerV1ComparePost})
+	v1Replay := duration.MustCurryWith(prometheus.Labels{"handler": promHandlerV1ReplayPost})
+	v1Generate := duration.MustCurryWith(prometheus.Labels{"handler": promHandlerV1GeneratePost})
+	v1TestGen := duration.MustCurryWith(prometheus.Labels{"handler": promHandlerV1TestGeneratePost})
+	v1Report := duration.MustCurryWith(prometheus.Labels{"handler": promHandlerV1ReportPost})
 	v1CORSPreflightDur := duration.MustCurryWith(prometheus.Labels{"handler": promHandlerV1CORSPreflight})
 	promRegistry.MustRegister(duration)
 	promRegistry.MustRegister(prometheus.NewGoCollector())
+	promRegistry.MustRegister(api.blocklistMatches, api.abuseReports)
+	promRegistry.MustRegister(api.metrics.collectors()...)
+
+	// Stores may have metrics of their backend, e.g. the GitHub rate limit.
+	for _, store := range []DataRequestStore{v1Store, v2Store} {
+		if c, ok := store.(prometheus.Collector); ok {
+			promRegistry.MustRegister(c)
+		}
+	}
 
 	api.router.StrictSlash(true)
 	api.router.Handle("/metrics", promhttp.HandlerFor(promRegistry, promhttp.HandlerOpts{})).Methods(http.MethodGet)
-	api.router.HandleFunc("/bundles/{key}", promhttp.InstrumentHandlerDuration(v1BundlesGetDur, http.HandlerFunc(api.handleRetrieveBundle))).Methods(http.MethodGet)
+	api.router.HandleFunc("/bundles/{key}", promhttp.InstrumentHandlerDuration(v1BundlesGetDur, api.rateLimit(RateClassBundle, http.HandlerFunc(api.handleRetrieveBundle)))).Methods(http.MethodGet)
 	api.router.HandleFunc("/v1/input/{key}", promhttp.InstrumentHandlerDuration(v1ShareGetDur, http.HandlerFunc(api.handleRetrieveInput))).Methods(http.MethodGet)
-	api.router.HandleFunc("/v1/data", promhttp.InstrumentHandlerDuration(v1DataDur, http.HandlerFunc(api.handleQuery))).Methods(http.MethodPost)
-	api.router.HandleFunc("/v1/data/{path:.+}", promhttp.InstrumentHandlerDuration(v1DataDur, http.HandlerFunc(api.handleQuery))).Methods(http.MethodPost)
-	api.router.HandleFunc("/v1/data/{key:.+}", promhttp.InstrumentHandlerDuration(v1ShareGetDur, http.HandlerFunc(api.handleRetrieveFromStore))).Methods(http.MethodGet)
-	api.router.HandleFunc("/v1/distribute", promhttp.InstrumentHandlerDuration(v1SharePostDur, http.HandlerFunc(api.handleCreateDistribute))).Methods(http.MethodPost)
-	api.router.HandleFunc("/v1/distribute/{key}", promhttp.InstrumentHandlerDuration(v1SharePostDur, http.HandlerFunc(api.handleUpdateDistribute))).Methods(http.MethodPut)
-	api.router.HandleFunc("/v1/share", promhttp.InstrumentHandlerDuration(v1SharePostDur, http.HandlerFunc(api.handleShareUpload))).Methods(http.MethodPost)
+	api.router.HandleFunc("/v1/data", promhttp.InstrumentHandlerDuration(v1DataDur, api.rateLimit(RateClassEval, http.HandlerFunc(api.handleQuery)))).Methods(http.MethodPost)
+	api.router.HandleFunc("/v1/data/{path:.+}", promhttp.InstrumentHandlerDuration(v1DataDur, api.rateLimit(RateClassEval, http.HandlerFunc(api.handleQuery)))).Methods(http.MethodPost)
+	api.router.HandleFunc("/v1/data/{key:.+}", promhttp.InstrumentHandlerDuration(v1ShareGetDur, api.rateLimitRead(http.HandlerFunc(api.handleRetrieveFromStore)))).Methods(http.MethodGet)
+	api.router.HandleFunc("/v1/distribute", promhttp.InstrumentHandlerDuration(v1SharePostDur, api.rateLimit(RateClassShare, http.HandlerFunc(api.handleCreateDistribute)))).Methods(http.MethodPost)
+	api.router.HandleFunc("/v1/distribute/{key}", promhttp.InstrumentHandlerDuration(v1SharePostDur, api.rateLimit(RateClassShare, http.HandlerFunc(api.handleUpdateDistribute)))).Methods(http.MethodPut)
+	api.router.HandleFunc("/v1/distribute/{key}", promhttp.InstrumentHandlerDuration(v1SharePostDur, api.rateLimit(RateClassShare, http.HandlerFunc(api.handleDeleteDistribute)))).Methods(http.MethodDelete)
+	api.router.HandleFunc("/v1/distribute/{key}/token", promhttp.InstrumentHandlerDuration(v1SharePostDur, api.rateLimit(RateClassShare, http.HandlerFunc(api.handleRotateDistributeToken)))).Methods(http.MethodPost)
+	api.router.HandleFunc("/v1/distribute/{key}/owner", promhttp.InstrumentHandlerDuration(v1SharePostDur, api.rateLimit(RateClassShare, http.HandlerFunc(api.handleTransferDistribute)))).Methods(http.MethodPut)
+	api.router.HandleFunc("/v1/share", promhttp.InstrumentHandlerDuration(v1SharePostDur, api.rateLimit(RateClassShare, http.HandlerFunc(api.handleShareUpload)))).Methods(http.MethodPost)
 	api.router.HandleFunc("/v2/decode/{key:.+}", api.decodeKey).Methods(http.MethodGet)
-	api.router.HandleFunc("/v2/publish", promhttp.InstrumentHandlerDuration(v1SharePostDur, http.HandlerFunc(api.handlePublish))).Methods(http.MethodPost)
-	api.router.HandleFunc("/v2/publish/{key}", promhttp.InstrumentHandlerDuration(v1SharePostDur, http.HandlerFunc(api.handleUpdatePublish))).Methods(http.MethodPut)
+	api.router.HandleFunc("/v2/publish", promhttp.InstrumentHandlerDuration(v1SharePostDur, api.rateLimit(RateClassShare, http.HandlerFunc(api.handlePublish)))).Methods(http.MethodPost)
+	api.router.HandleFunc("/v2/publish/{key}", promhttp.InstrumentHandlerDuration(v1SharePostDur, api.rateLimit(RateClassShare, http.HandlerFunc(api.handleUpdatePublish)))).Methods(http.MethodPut)
 	api.router.HandleFunc("/v2/auth/test", api.testAuth)
 	api.router.HandleFunc("/v2/auth", api.handleGithubAuth)
 	api.router.HandleFunc("/v1/githubcallback", api.handleGithubCallback) // TODO rename this to /v2/authcallback
 	api.router.HandleFunc("/v1/session", api.handleSession).Methods(http.MethodGet)
-	api.router.HandleFunc("/v1/lint", promhttp.InstrumentHandlerDuration(v1LintDur, http.HandlerFunc(api.handleLint))).Methods(http.MethodPost)
+	api.router.HandleFunc("/v1/lint", promhttp.InstrumentHandlerDuration(v1LintDur, api.rateLimit(RateClassLint, http.HandlerFunc(api.handleLint)))).Methods(http.MethodPost)
+	api.router.HandleFunc("/v1/lint/fix", promhttp.InstrumentHandlerDuration(v1LintFixDur, api.rateLimit(RateClassLint, http.HandlerFunc(api.handleLintFix)))).Methods(http.MethodPost)
 	api.router.HandleFunc("/v1/system/alive", api.handleLiveness).Methods(http.MethodGet)
 	api.router.HandleFunc("/v1/system/ready", api.handleReadiness).Methods(http.MethodGet)
-	api.router.HandleFunc("/v1/fmt", promhttp.InstrumentHandlerDuration(v1Formatting, http.HandlerFunc(api.handleFormatting))).Methods(http.MethodPost)
-	api.router.HandleFunc("/v1/vars", promhttp.InstrumentHandlerDuration(v1Vars, http.HandlerFunc(api.handleVars))).Methods(http.MethodPost)
+	api.router.HandleFunc("/v1/system/health", api.handleHealth).Methods(http.MethodGet)
+	api.router.HandleFunc("/v1/fmt", promhttp.InstrumentHandlerDuration(v1Formatting, api.rateLimit(RateClassLint, http.HandlerFunc(api.handleFormatting)))).Methods(http.MethodPost)
+	api.router.HandleFunc("/v1/vars", promhttp.InstrumentHandlerDuration(v1Vars, api.rateLimit(RateClassLint, http.HandlerFunc(api.handleVars)))).Methods(http.MethodPost)
+	api.router.HandleFunc("/v1/complete", promhttp.InstrumentHandlerDuration(v1Complete, api.rateLimit(RateClassLint, http.HandlerFunc(api.handleComplete)))).Methods(http.MethodPost)
+	api.router.HandleFunc("/v1/migrate", promhttp.InstrumentHandlerDuration(v1Migrate, api.rateLimit(RateClassLint, http.HandlerFunc(api.handleMigrate)))).Methods(http.MethodPost)
+	api.router.HandleFunc("/v1/ast", promhttp.InstrumentHandlerDuration(v1AST, api.rateLimit(RateClassLint, http.HandlerFunc(api.handleAST)))).Methods(http.MethodPost)
+	api.router.HandleFunc("/v1/build", promhttp.InstrumentHandlerDuration(v1Build, api.rateLimit(RateClassEval, http.HandlerFunc(api.handleBuild)))).Methods(http.MethodPost)
+	api.router.HandleFunc("/v1/compare", promhttp.InstrumentHandlerDuration(v1Compare, api.rateLimit(RateClassEval, http.HandlerFunc(api.handleCompare)))).Methods(http.MethodPost)
+	api.router.HandleFunc("/v1/replay/{key}", promhttp.InstrumentHandlerDuration(v1Replay, api.rateLimit(RateClassEval, http.HandlerFunc(api.handleReplay)))).Methods(http.MethodPost)
+	api.router.HandleFunc("/v1/inputs/generate", promhttp.InstrumentHandlerDuration(v1Generate, api.rateLimit(RateClassEval, http.HandlerFunc(api.handleGenerateInputs)))).Methods(http.MethodPost)
+	api.router.HandleFunc("/v1/test/generate", promhttp.InstrumentHandlerDuration(v1TestGen, api.rateLimit(RateClassEval, http.HandlerFunc(api.handleTestGenerate)))).Methods(http.MethodPost)
+	api.router.HandleFunc("/v1/report/{key}", promhttp.InstrumentHandlerDuration(v1Report, api.rateLimit(RateClassShare, http.HandlerFunc(api.handleReport)))).Methods(http.MethodPost)
 	api.router.HandleFunc("/version", api.handleVersion).Methods(http.MethodGet)
+	api.router.HandleFunc("/v1/openapi.json", api.handleOpenAPI).Methods(http.MethodGet)
 	api.router.HandleFunc("/experimental", api.createNewExperimentalCookie).Methods(http.MethodGet)
 
 	// Preflight handlers for routes that can be accessed outside play.openpolicyagent.org. The real handlers for these routes also need to call addCORSHeaders(w, r).
 	api.router.HandleFunc("/v1/data", promhttp.InstrumentHandlerDuration(v1CORSPreflightDur, http.HandlerFunc(api.handleCORSPreflight))).Methods(http.MethodOptions)
 	api.router.HandleFunc("/v1/share", promhttp.InstrumentHandlerDuration(v1CORSPreflightDur, http.HandlerFunc(api.handleCORSPreflight))).Methods(http.MethodOptions)
 
+	admin := api.router.PathPrefix("/admin/v1").Subrouter()
+	admin.Use(api.requireAdmin, validateRequest)
+	admin.HandleFunc("/shares", api.handleAdminListShares).Methods(http.MethodGet).Name(adminActionList)
+	admin.HandleFunc("/shares/{key}", api.handleAdminViewShare).Methods(http.MethodGet).Name(adminActionView)
+	admin.HandleFunc("/shares/{key}/takedown", api.handleAdminTakedown).Methods(http.MethodPost).Name(adminActionTakedown)
+	admin.HandleFunc("/shares/{key}/restore", api.handleAdminRestore).Methods(http.MethodPost).Name(adminActionRestore)
+	admin.HandleFunc("/shares/{key}/owner", api.handleAdminAssignOwner).Methods(http.MethodPut).Name(adminActionOwner)
+	admin.HandleFunc("/stats", api.handleAdminStats).Methods(http.MethodGet).Name(adminActionStats)
+	admin.HandleFunc("/audit", api.handleAdminAudit).Methods(http.MethodGet).Name(adminActionAudit)
+
 	api.router.NotFoundHandler = http.HandlerFunc(api.handleNotFound)
 
 	// Serve the frontend content directory at `/` and `/p` and `/play` and `/d` and `/distribute`
@@ -439,26 +724,91 @@ func NewAPIService(addr string, v1Store, v2Store DataRequestStore, contentRoot s
 	return api
 }
 
+// Metrics returns the registry of the metrics served at /metrics, for other
+// services to register theirs with.
+func (api *API) Metrics() prometheus.Registerer {
+	return api.promRegistry
+}
+
 // Init initializes the service.
 func (api *API) Init(ctx context.Context) error {
 	log.ErrorKey = "err"
+	log.AddHook(traceLogHook{})
 	return nil
 }
 
-// Start starts the HTTP server.
+// Start starts the HTTP server, returning once it listens.
 func (api *API) Start(ctx context.Context) error {
-	go api.run()
+	api.server = &http.Server{
+		Addr:              api.addr,
+		Handler:           api.handler(),
+		ReadHeaderTimeout: serverReadHeaderTimeout,
+		ReadTimeout:       serverReadTimeout,
+		WriteTimeout:      serverWriteTimeout,
+		IdleTimeout:       serverIdleTimeout,
+	}
+
+	if api.certs != nil {
+		api.server.TLSConfig = &tls.Config{
+			MinVersion:     tls.VersionTLS12,
+			GetCertificate: api.certs.getCertificate,
+		}
+	}
+
+	ln, err := net.Listen("tcp", api.addr)
+	if err != nil {
+		return err
+	}
+
+	api.addr = ln.Addr().String()
+
+	log.WithField("addr", api.addr).WithField("tls", api.certs != nil).Info("Starting Rego Playground server...")
+
+	go func() {
+		var err error
+		if api.certs != nil {
+			err = api.server.ServeTLS(ln, "", "")
+		} else {
+			err = api.server.Serve(ln)
+		}
+		if !errors.Is(err, http.ErrServerClosed) {
+			log.WithError(err).Fatal("Rego Playground server failed.")
+		}
+	}()
+
 	return nil
 }
 
-// Stop stops the HTTP server. // TODO(sr): Does it?
-func (*API) Stop(context.Context) error {
-	return nil
+var (
+	_ utils.GracefulService  = (*API)(nil)
+	_ utils.DrainableService = (*API)(nil)
+)
+
+// Drain fails the readiness checks, so that load balancers stop sending
+// requests before the server is stopped.
+func (api *API) Drain() {
+	if !api.draining.Swap(true) {
+		log.Info("Draining Rego Playground server...")
+	}
 }
 
-func (api *API) run() error {
-	log.WithField("addr", api.addr).Info("Starting Rego Playground server...")
-	return http.ListenAndServe(api.addr, RecoveryHandler()(api.router))
+// Stop stops the HTTP server, ending long-polls and waiting for the requests
+// in flight to be handled until ctx is done.
+func (api *API) Stop(ctx context.Context) {
+	api.Drain()
+	api.shutdownOnce.Do(func() { close(api.shutdown) })
+
+	if api.server == nil {
+		return
+	}
+
+	if err := api.server.Shutdown(ctx); err != nil {
+		log.WithError(err).Warn("Failed to drain Rego Playground server, closing the remaining connections.")
+		api.server.Close()
+		return
+	}
+
+	log.Info("Stopped Rego Playground server.")
 }
 
 func (api *API) handleNotFound(w http.ResponseWriter, r *http.Request) {
@@ -509,26 +859,32 @@ func (api *API) doHandleQuery(w http.ResponseWriter, r *http.Request) {
 
 	err = util.UnmarshalJSON(bs, &msg)
 	if err != nil {
+		api.metrics.queryError(queryStageParse, http.StatusBadRequest)
 		writeError(w, http.StatusBadRequest, apiCodeParseError, err)
 		return
 	}
 
 	if len(msg.RegoModules) == 0 {
+		api.metrics.queryError(queryStageParse, http.StatusBadRequest)
 		writeError(w, http.StatusBadRequest, apiCodeParseError, err)
 		return
 	}
 
-	// Map paths and values to the filename and a string containing the module.
-	// Rego module sample key format: <package_name>/<policy_file_name>
-	// eg. rbac/authz/authz.rego
-	policies := make(map[string]string)
-	for path, value := range msg.RegoModules {
-		parts := strings.Split(path, "/")
-		str, ok := value.(string)
-		if !ok {
-			writeError(w, http.StatusBadRequest, apiCodeParseError, err)
-		}
-		policies[parts[len(parts)-1]] = str
+	if msg.Mode != "" && msg.Mode != conftestMode {
+		writeError(w, http.StatusBadRequest, apiCodeInvalidArgument, fmt.Errorf("unsupported mode %q: use %q", msg.Mode, conftestMode))
+		return
+	}
+
+	if msg.Format != "" && !slices.Contains(presentation.Formats, msg.Format) {
+		writeError(w, http.StatusBadRequest, apiCodeInvalidArgument, fmt.Errorf("unsupported format %q: use one of %s", msg.Format, strings.Join(presentation.Formats, ", ")))
+		return
+	}
+
+	policies, err := policiesFromModules(msg.RegoModules)
+	if err != nil {
+		api.metrics.queryError(queryStageParse, http.StatusBadRequest)
+		writeError(w, http.StatusBadRequest, apiCodeParseError, err)
+		return
 	}
 
 	fields := log.Fields{
@@ -552,48 +908,16 @@ func (api *API) doHandleQuery(w http.ResponseWriter, r *http.Request) {
 		fields["data"] = *msg.Data
 	}
 
-	// disable strict mode to allow valid queries to be compiled
-	if msg.RegoQuery != "" {
-		msg.Strict = false
-	}
-
-	log.WithFields(fields).Debug("Input to OPA.")
-
-	compileWithVersion := func(version int) (*opa.CompileResult, opa.Ignored, error) {
-		return opa.Compile(
-			r.Context(),
-			msg.Input, msg.Data,
-			policies,
-			msg.RegoQuery, msg.QueryPackage, msg.QueryImports, msg.Strict,
-			&version,
-		)
-	}
-
-	regoVersion := 1
-	if msg.RegoVersion != nil {
-		regoVersion = *msg.RegoVersion
-	}
+	log.WithContext(r.Context()).WithFields(fields).Debug("Input to OPA.")
 
-	compileResult, ignored, err := compileWithVersion(regoVersion)
+	compileResult, ignored, regoVersion, err := api.compileDataRequest(r.Context(), &msg, policies)
 	if err != nil {
-		if regoVersion == 1 {
-			// if there is an error parsing, and we were using v1, then attempt to parse as v0
-			compileResultv0, ignoredv0, errv0 := compileWithVersion(0)
-			// only if there is no err from the v0 operation, should the results be adopted
-			if errv0 == nil {
-				err, compileResult, ignored = errv0, compileResultv0, ignoredv0
-
-				// update the regoVersion here so the client can adapt and warn the user
-				regoVersion = 0
-			}
-		}
-		if err != nil {
-			log.WithError(err).WithField("version", regoVersion).Error("Compile Error")
-			writeErrorAndIgnored(w, http.StatusBadRequest, apiCodeParseError, err, ignored)
-			return
-		}
+		api.metrics.queryError(queryStageCompile, http.StatusBadRequest)
+		writeErrorAndIgnored(w, http.StatusBadRequest, apiCodeParseError, err, ignored)
+		return
 	}
 
+	evalStart := time.Now()
 	result, evalErr := opa.Eval(
 		r.Context(),
 		compileResult,
@@ -602,22 +926,26 @@ func (api *API) doHandleQuery(w http.ResponseWriter, r *http.Request) {
 			Cover:               msg.Coverage,
 			BuiltInErrorsAll:    msg.BuiltInErrorsAll,
 			BuiltInErrorsStrict: msg.BuiltInErrorsStrict,
+			Metrics:             msg.Metrics,
 		},
 	)
+	api.metrics.evalDuration.Observe(time.Since(evalStart).Seconds())
 	if evalErr != nil {
-		log.WithError(evalErr.RawError).Error("Eval Error.")
+		api.metrics.queryError(queryStageEval, evalErr.HTTPStatus)
+		log.WithContext(r.Context()).WithError(evalErr.RawError).Error("Eval Error.")
 		writeErrorAndIgnored(w, evalErr.HTTPStatus, apiCodeInternalError, evalErr.RawError, ignored)
 		return
 	}
 	response := DataResponse{
 		Result:   result.Result,
 		EvalTime: result.Time,
-		Pretty:   presentation.PrettyResultString(result.Result),
 		Trace:    result.Trace,
 		Output:   result.Output,
 		// this is used in the UI to test if the version used was different
 		// from the one supplied, trigger warnings etc.
-		RegoVersion: &regoVersion,
+		RegoVersion:  &regoVersion,
+		Metrics:      result.Metrics,
+		BuiltinCalls: result.BuiltinCalls,
 	}
 	if msg.Trace {
 		response.Trace = result.Trace
@@ -625,15 +953,43 @@ func (api *API) doHandleQuery(w http.ResponseWriter, r *http.Request) {
 	if msg.Coverage {
 		response.Coverage = result.Coverage
 	}
+	if msg.Mode == conftestMode {
+		response.Conftest, err = opa.EvalConftest(r.Context(), compileResult, msg.Namespaces)
+		if err != nil {
+			writeErrorAndIgnored(w, http.StatusBadRequest, apiCodeInvalidArgument, err, ignored)
+			return
+		}
+	}
+	format := msg.Format
+	if format == "" {
+		format = presentation.FormatPretty
+	}
+	if response.Conftest != nil && format == presentation.FormatPretty {
+		response.Pretty = presentation.ConftestSummaryString(response.Conftest)
+	} else {
+		response.Pretty, err = presentation.FormatString(format, result.Result, presentation.Options{Limit: msg.PrettyLimit})
+		if err != nil {
+			writeErrorAndIgnored(w, http.StatusBadRequest, apiCodeInvalidArgument, err, ignored)
+			return
+		}
+	}
+	if msg.Target != "" && msg.Target != opa.TargetRego {
+		response.Build, err = opa.Build(r.Context(), compileResult, msg.Target, msg.Entrypoints)
+		if err != nil {
+			writeErrorAndIgnored(w, http.StatusBadRequest, apiCodeInvalidArgument, err, ignored)
+			return
+		}
+	}
 	response.Ignored = ignored
 	writeJSON(w, http.StatusOK, response)
 }
 
-func (api *API) handleCreateDistribute(w http.ResponseWriter, r *http.Request) {
+func (api *API) handleBuild(w http.ResponseWriter, r *http.Request) {
 	addCORSHeaders(w, r)
+
 	bs, err := io.ReadAll(r.Body)
 	if err != nil {
-		writeError(w, http.StatusBadRequest, apiCodeParseError, err)
+		writeError(w, http.StatusInternalServerError, apiCodeInternalError, fmt.Errorf("failed reading request body: %w", err))
 		return
 	}
 
@@ -643,81 +999,119 @@ func (api *API) handleCreateDistribute(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if int64(len(bs)) > maxUploadSizeLimitBytes {
-		errMsg := fmt.Errorf("cannot distribute files greater than %v bytes", maxUploadSizeLimitBytes)
-		writeError(w, http.StatusBadRequest, apiCodeFileTooLarge, errMsg)
+	if len(msg.RegoModules) == 0 {
+		writeError(w, http.StatusBadRequest, apiCodeInvalidArgument, errors.New("no modules to build"))
 		return
 	}
 
-	msg.ReadOnly = false
-
-	bs, _ = json.Marshal(msg)
-	etag, err := getEtag(bs)
+	policies, err := policiesFromModules(msg.RegoModules)
 	if err != nil {
-		writeError(w, http.StatusInternalServerError, apiCodeInternalError, err)
+		writeError(w, http.StatusBadRequest, apiCodeParseError, err)
 		return
 	}
 
-	msg.Etag = etag
-
-	key := &StoreKey{Id: getUniqueID(), KeyType: KeyTypeLegacy}
-	key, err = api.v1Store.Put(key, msg, api.getPrincipal(r))
+	compileResult, ignored, regoVersion, err := api.compileDataRequest(r.Context(), &msg, policies)
 	if err != nil {
-		writeError(w, http.StatusInternalServerError, apiCodeInternalError, err)
+		writeErrorAndIgnored(w, http.StatusBadRequest, apiCodeParseError, err, ignored)
 		return
 	}
 
-	log.Debugf("Data uploaded successfully. Key: %v, Data: %+v", key, msg)
-
-	oKey, err := key.toOpaque()
+	result, err := opa.Build(r.Context(), compileResult, msg.Target, msg.Entrypoints)
 	if err != nil {
-		writeError(w, http.StatusInternalServerError, apiCodeInternalError, fmt.Errorf("failed to create opaque key: %w", err))
+		writeErrorAndIgnored(w, http.StatusBadRequest, apiCodeInvalidArgument, err, ignored)
 		return
 	}
 
-	result := DataResponse{
-		Result: fmt.Sprintf("%s/d/%s", strings.TrimSuffix(api.externalURL, "/"), oKey),
-	}
-	writeJSON(w, http.StatusOK, result)
+	writeJSON(w, http.StatusOK, BuildResponse{
+		Result:      result,
+		RegoVersion: &regoVersion,
+		Ignored:     ignored,
+	})
 }
 
-func (api *API) handleUpdateDistribute(w http.ResponseWriter, r *http.Request) {
+func (api *API) handleCompare(w http.ResponseWriter, r *http.Request) {
 	addCORSHeaders(w, r)
-	key := getKeyFromRequest(r)
-
-	api.doHandleUpdateDistribute(w, r, key)
-}
 
-func (api *API) doHandleUpdateDistribute(w http.ResponseWriter, r *http.Request, key *StoreKey) {
-	bs, err := io.ReadAll(r.Body)
+	bs, err := io.ReadAll(io.LimitReader(r.Body, maxCompareSizeBytes+1))
 	if err != nil {
-		writeError(w, http.StatusBadRequest, apiCodeParseError, err)
+		writeError(w, http.StatusInternalServerError, apiCodeInternalError, fmt.Errorf("failed reading request body: %w", err))
 		return
 	}
 
-	var msg DataRequest
+	if int64(len(bs)) > maxCompareSizeBytes {
+		writeError(w, http.StatusBadRequest, apiCodeFileTooLarge, fmt.Errorf("cannot compare requests greater than %v bytes", maxCompareSizeBytes))
+		return
+	}
+
+	var msg CompareRequest
 	if err := util.UnmarshalJSON(bs, &msg); err != nil {
 		writeError(w, http.StatusBadRequest, apiCodeParseError, err)
 		return
 	}
 
-	if int64(len(bs)) > maxUploadSizeLimitBytes {
-		errMsg := fmt.Errorf("cannot distribute files greater than %v bytes", maxUploadSizeLimitBytes)
-		writeError(w, http.StatusBadRequest, apiCodeFileTooLarge, errMsg)
+	if len(msg.Inputs) == 0 {
+		writeError(w, http.StatusBadRequest, apiCodeInvalidArgument, errors.New("no inputs to compare"))
 		return
 	}
 
-	bs, _ = json.Marshal(msg)
-	etag, err := getEtag(bs)
+	if len(msg.Inputs) > maxCompareInputs {
+		writeError(w, http.StatusBadRequest, apiCodeInvalidArgument, fmt.Errorf("too many inputs to compare: %d, the limit is %d", len(msg.Inputs), maxCompareInputs))
+		return
+	}
+
+	base, baseVersion, ok := api.compileCompareSource(w, r, "base", msg.Base)
+	if !ok {
+		return
+	}
+
+	head, headVersion, ok := api.compileCompareSource(w, r, "head", msg.Head)
+	if !ok {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), maxRequestEvalTime)
+	defer cancel()
+
+	result, err := opa.Compare(ctx, base, head, msg.Inputs)
 	if err != nil {
 		writeError(w, http.StatusInternalServerError, apiCodeInternalError, err)
 		return
 	}
 
-	msg.Etag = etag
+	writeJSON(w, http.StatusOK, CompareResponse{
+		Result:          result,
+		BaseRegoVersion: &baseVersion,
+		HeadRegoVersion: &headVersion,
+	})
+}
 
-	// this is a v1 distribution call, only check the v1 store
-	existingDataReq, found, err := api.v1Store.Get(key, api.getPrincipal(r))
+func (api *API) handleReplay(w http.ResponseWriter, r *http.Request) {
+	addCORSHeaders(w, r)
+
+	key := getKeyFromRequest(r)
+
+	bs, err := io.ReadAll(io.LimitReader(r.Body, maxReplaySizeBytes+1))
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, apiCodeInternalError, fmt.Errorf("failed reading request body: %w", err))
+		return
+	}
+
+	if int64(len(bs)) > maxReplaySizeBytes {
+		writeError(w, http.StatusBadRequest, apiCodeFileTooLarge, fmt.Errorf("cannot replay decision logs greater than %v bytes", maxReplaySizeBytes))
+		return
+	}
+
+	entries, err := opa.ReadDecisionLogs(bytes.NewReader(bs), maxReplayEntries, maxReplayDecompressedBytes)
+	if errors.Is(err, opa.ErrDecisionLogTooLarge) {
+		writeError(w, http.StatusBadRequest, apiCodeFileTooLarge, err)
+		return
+	}
+	if err != nil {
+		writeError(w, http.StatusBadRequest, apiCodeParseError, err)
+		return
+	}
+
+	msg, found, err := api.getShare(r.Context(), key, api.getPrincipal(r))
 	if err != nil {
 		if errors.Is(err, &UnauthorizedError{}) {
 			writeError(w, http.StatusUnauthorized, apiCodeUnauthorized, err)
@@ -727,116 +1121,769 @@ func (api *API) doHandleUpdateDistribute(w http.ResponseWriter, r *http.Request,
 		writeError(w, http.StatusInternalServerError, apiCodeInternalError, err)
 		return
 	}
+
 	if !found {
 		writeError(w, http.StatusNotFound, apiCodeNotFound, err)
 		return
 	}
 
-	policyUpdated := false
-	if !reflect.DeepEqual(msg.RegoModules, existingDataReq.RegoModules) {
-		policyUpdated = true
-		msg.Patch = nil
-	}
-
-	// create a JSON Patch if there is a data change but no policy update
-	if !policyUpdated {
-		err := generateJSONDataPatch(&existingDataReq, &msg)
-		if err != nil {
-			writeError(w, http.StatusInternalServerError, apiCodeInternalError, err)
-			return
-		}
+	if msg.TakenDown != nil {
+		writeTakenDown(w)
+		return
+	}
+
+	policies, err := policiesFromModules(msg.RegoModules)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, apiCodeParseError, err)
+		return
+	}
+
+	// The input of each entry is evaluated with the query of its path instead.
+	msg.Input, msg.InputFormat = nil, ""
+	msg.RegoQuery, msg.QueryPackage, msg.QueryImports = "", nil, nil
+
+	_, ignored, regoVersion, err := api.compileDataRequest(r.Context(), &msg, policies)
+	if err != nil {
+		writeErrorAndIgnored(w, http.StatusBadRequest, apiCodeParseError, err, ignored)
+		return
+	}
+
+	msg.RegoVersion = &regoVersion
+
+	ctx, cancel := context.WithTimeout(r.Context(), maxRequestEvalTime)
+	defer cancel()
+
+	result, err := opa.Replay(ctx, entries, func(query string) (*opa.CompileResult, error) {
+		q := msg
+		q.RegoQuery = query
+		compileResult, _, _, err := api.compileDataRequest(ctx, &q, policies)
+		return compileResult, err
+	})
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, apiCodeInternalError, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, ReplayResponse{
+		Result:      result,
+		RegoVersion: &regoVersion,
+		Ignored:     ignored,
+	})
+}
+
+func (api *API) handleGenerateInputs(w http.ResponseWriter, r *http.Request) {
+	addCORSHeaders(w, r)
+
+	bs, err := io.ReadAll(r.Body)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, apiCodeInternalError, fmt.Errorf("failed reading request body: %w", err))
+		return
+	}
+
+	var msg GenerateInputsRequest
+	if err := util.UnmarshalJSON(bs, &msg); err != nil {
+		writeError(w, http.StatusBadRequest, apiCodeParseError, err)
+		return
+	}
+
+	rule, err := ast.ParseRef(msg.Rule)
+	if err != nil || !rule.HasPrefix(ast.DefaultRootRef) {
+		writeError(w, http.StatusBadRequest, apiCodeInvalidArgument, fmt.Errorf("rule must be a reference to a rule under data, got %q", msg.Rule))
+		return
+	}
+
+	if msg.Schema == nil {
+		writeError(w, http.StatusBadRequest, apiCodeInvalidArgument, errors.New("no input schema to generate inputs from"))
+		return
+	}
+
+	if msg.Random < 0 || msg.Random > maxGeneratedRandomInputs {
+		writeError(w, http.StatusBadRequest, apiCodeInvalidArgument, fmt.Errorf("random must be between 0 and %d", maxGeneratedRandomInputs))
+		return
+	}
+
+	if len(msg.DataRequest.RegoModules) == 0 {
+		writeError(w, http.StatusBadRequest, apiCodeInvalidArgument, errors.New("no modules to generate inputs for"))
+		return
+	}
+
+	policies, err := policiesFromModules(msg.DataRequest.RegoModules)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, apiCodeParseError, err)
+		return
+	}
+
+	dr := msg.DataRequest
+	dr.Input, dr.InputFormat = nil, ""
+	dr.RegoQuery, dr.QueryPackage, dr.QueryImports = rule.String(), nil, nil
+
+	compileResult, ignored, regoVersion, err := api.compileDataRequest(r.Context(), &dr, policies)
+	if err != nil {
+		writeErrorAndIgnored(w, http.StatusBadRequest, apiCodeParseError, err, ignored)
+		return
+	}
+
+	opts := opa.GenerateOptions{
+		Seed:        time.Now().UnixNano(),
+		Random:      defaultGeneratedRandomInputs,
+		MaxVariants: maxGeneratedVariantInputs,
+		MaxShrinks:  maxGeneratedInputShrinks,
+	}
+	if msg.Seed != nil {
+		opts.Seed = *msg.Seed
+	}
+	if msg.Random != 0 {
+		opts.Random = msg.Random
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), maxRequestEvalTime)
+	defer cancel()
+
+	result, err := opa.GenerateInputs(ctx, compileResult, rule, msg.Schema, opts)
+	if err != nil {
+		writeErrorAndIgnored(w, http.StatusBadRequest, apiCodeInvalidArgument, err, ignored)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, GenerateInputsResponse{
+		Result:      result,
+		RegoVersion: &regoVersion,
+		Ignored:     ignored,
+	})
+}
+
+// handleTestGenerate generates a test module asserting the values of the
+// rules referred to by the query, as evaluated with the input and data of the
+// request.
+func (api *API) handleTestGenerate(w http.ResponseWriter, r *http.Request) {
+	addCORSHeaders(w, r)
+
+	bs, err := io.ReadAll(r.Body)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, apiCodeInternalError, fmt.Errorf("failed reading request body: %w", err))
+		return
+	}
+
+	var msg DataRequest
+	if err := util.UnmarshalJSON(bs, &msg); err != nil {
+		writeError(w, http.StatusBadRequest, apiCodeParseError, err)
+		return
+	}
+
+	if len(msg.RegoModules) == 0 {
+		writeError(w, http.StatusBadRequest, apiCodeInvalidArgument, errors.New("no modules to generate tests for"))
+		return
+	}
+
+	policies, err := policiesFromModules(msg.RegoModules)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, apiCodeParseError, err)
+		return
+	}
+
+	compileResult, ignored, regoVersion, err := api.compileDataRequest(r.Context(), &msg, policies)
+	if err != nil {
+		writeErrorAndIgnored(w, http.StatusBadRequest, apiCodeParseError, err, ignored)
+		return
+	}
+
+	result, err := opa.GenerateTests(r.Context(), compileResult, ast.RegoVersionFromInt(regoVersion))
+	if err != nil {
+		writeErrorAndIgnored(w, http.StatusBadRequest, apiCodeInvalidArgument, err, ignored)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, TestGenerateResponse{
+		Result:      string(result),
+		RegoVersion: &regoVersion,
+		Ignored:     ignored,
+	})
+}
+
+// compileCompareSource compiles one side of a comparison, retrieving it from
+// the store if it is a share. Errors are written to w, prefixed with the name
+// of the side.
+func (api *API) compileCompareSource(w http.ResponseWriter, r *http.Request, name string, src CompareSource) (*opa.CompileResult, int, bool) {
+	var msg DataRequest
+
+	switch {
+	case (src.DataRequest != nil) == (src.Key != ""):
+		writeError(w, http.StatusBadRequest, apiCodeInvalidArgument, fmt.Errorf("%s: provide either a data request or a share key", name))
+		return nil, 0, false
+	case src.DataRequest != nil:
+		msg = *src.DataRequest
+	default:
+		key, err := storeKeyFromOpaque(src.Key)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, apiCodeInvalidArgument, fmt.Errorf("%s: %w", name, err))
+			return nil, 0, false
+		}
+
+		if src.Revision != "" {
+			if key.KeyType != KeyTypeGist {
+				writeError(w, http.StatusBadRequest, apiCodeInvalidArgument, fmt.Errorf("%s: revisions are only supported for published shares", name))
+				return nil, 0, false
+			}
+			key.Revision = src.Revision
+		}
+
+		var found bool
+		msg, found, err = api.getShare(r.Context(), key, api.getPrincipal(r))
+		if err != nil {
+			if errors.Is(err, &UnauthorizedError{}) {
+				writeError(w, http.StatusUnauthorized, apiCodeUnauthorized, fmt.Errorf("%s: %w", name, err))
+				return nil, 0, false
+			}
+
+			writeError(w, http.StatusInternalServerError, apiCodeInternalError, fmt.Errorf("%s: %w", name, err))
+			return nil, 0, false
+		}
+
+		if !found {
+			writeError(w, http.StatusNotFound, apiCodeNotFound, fmt.Errorf("%s: share %v not found", name, src.Key))
+			return nil, 0, false
+		}
+
+		if msg.TakenDown != nil {
+			writeError(w, http.StatusGone, apiCodeGone, fmt.Errorf("%s: share %v was taken down", name, src.Key))
+			return nil, 0, false
+		}
+	}
+
+	if len(msg.RegoModules) == 0 {
+		writeError(w, http.StatusBadRequest, apiCodeInvalidArgument, fmt.Errorf("%s: no modules to compare", name))
+		return nil, 0, false
+	}
+
+	policies, err := policiesFromModules(msg.RegoModules)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, apiCodeParseError, fmt.Errorf("%s: %w", name, err))
+		return nil, 0, false
+	}
+
+	// The input is replaced by each input of the corpus.
+	msg.Input, msg.InputFormat = nil, ""
+
+	compileResult, ignored, regoVersion, err := api.compileDataRequest(r.Context(), &msg, policies)
+	if err != nil {
+		writeErrorAndIgnored(w, http.StatusBadRequest, apiCodeParseError, fmt.Errorf("%s: %w", name, err), ignored)
+		return nil, 0, false
+	}
+
+	return compileResult, regoVersion, true
+}
+
+// compileDataRequest compiles the modules and query of a request. Requests
+// without a Rego version are compiled as v1 first, falling back to v0; the
+// version that was used is returned so the client can adapt and warn the user.
+func (api *API) compileDataRequest(ctx context.Context, msg *DataRequest, policies map[string]string) (*opa.CompileResult, opa.Ignored, int, error) {
+	// disable strict mode to allow valid queries to be compiled
+	if msg.RegoQuery != "" {
+		msg.Strict = false
+	}
+
+	input, data, err := decodeDocuments(msg)
+	if err != nil {
+		return nil, nil, 0, err
+	}
+
+	compileWithVersion := func(version int) (*opa.CompileResult, opa.Ignored, error) {
+		defer api.metrics.observeCompile(version, time.Now())
+		return opa.Compile(
+			ctx,
+			input, data, msg.DataDocuments,
+			policies,
+			msg.RegoQuery, msg.QueryPackage, msg.QueryImports, msg.Strict,
+			&version,
+		)
+	}
+
+	regoVersion := 1
+	if msg.RegoVersion != nil {
+		regoVersion = *msg.RegoVersion
+	}
+
+	compileResult, ignored, err := compileWithVersion(regoVersion)
+	if err != nil {
+		if regoVersion == 1 {
+			// if there is an error parsing, and we were using v1, then attempt to parse as v0
+			compileResultv0, ignoredv0, errv0 := compileWithVersion(0)
+			// only if there is no err from the v0 operation, should the results be adopted
+			if errv0 == nil {
+				err, compileResult, ignored = errv0, compileResultv0, ignoredv0
+
+				// update the regoVersion here so the client can adapt and warn the user
+				regoVersion = 0
+				api.metrics.regoVersionFallbacks.Inc()
+			}
+		}
+		if err != nil {
+			log.WithContext(ctx).WithError(err).WithField("version", regoVersion).Error("Compile Error")
+			return nil, ignored, regoVersion, err
+		}
+	}
+
+	return compileResult, ignored, regoVersion, nil
+}
+
+// decodeDocuments returns the input and data of a request, parsed from the
+// text they are given as if they have a format.
+func decodeDocuments(msg *DataRequest) (*interface{}, *interface{}, error) {
+	input, err := decodeDocument("input", msg.Input, msg.InputFormat)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	data, err := decodeDocument("data", msg.Data, msg.DataFormat)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return input, data, nil
+}
+
+func decodeDocument(name string, doc *interface{}, format string) (*interface{}, error) {
+	if doc == nil || format == "" {
+		return doc, nil
+	}
+
+	text, ok := (*doc).(string)
+	if !ok {
+		if format == opa.FormatJSON {
+			return doc, nil
+		}
+		return nil, fmt.Errorf("%s must be given as text in the %s format", name, format)
+	}
+
+	x, err := opa.DecodeDocument(name+"."+opa.FormatExtension(format), format, text)
+	if err != nil {
+		return nil, err
+	}
+
+	return &x, nil
+}
+
+func (api *API) handleCreateDistribute(w http.ResponseWriter, r *http.Request) {
+	addCORSHeaders(w, r)
+	bs, err := io.ReadAll(r.Body)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, apiCodeParseError, err)
+		return
+	}
+
+	var msg DataRequest
+	if err := util.UnmarshalJSON(bs, &msg); err != nil {
+		writeError(w, http.StatusBadRequest, apiCodeParseError, err)
+		return
+	}
+
+	if int64(len(bs)) > maxUploadSizeLimitBytes {
+		errMsg := fmt.Errorf("cannot distribute files greater than %v bytes", maxUploadSizeLimitBytes)
+		writeError(w, http.StatusBadRequest, apiCodeFileTooLarge, errMsg)
+		return
+	}
+
+	msg.ReadOnly = false
+	msg.clearServerFields()
+
+	if err := applyTTL(&msg, time.Now()); err != nil {
+		writeError(w, http.StatusBadRequest, apiCodeInvalidArgument, err)
+		return
+	}
+
+	if !api.checkBlocklist(w, &msg, true) {
+		return
+	}
+
+	bs, _ = json.Marshal(msg)
+	etag, err := getEtag(bs)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, apiCodeInternalError, err)
+		return
+	}
+
+	msg.Etag = etag
+
+	token, hash, err := newOwnerToken()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, apiCodeInternalError, err)
+		return
+	}
+
+	msg.OwnerTokenHash = hash
+
+	key := &StoreKey{Id: getUniqueID(), KeyType: KeyTypeLegacy}
+	key, err = api.v1(r.Context()).Put(key, msg, api.getPrincipal(r))
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, apiCodeInternalError, err)
+		return
+	}
+
+	log.Debugf("Data uploaded successfully. Key: %v, Data: %+v", key, msg)
+
+	oKey, err := key.toOpaque()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, apiCodeInternalError, fmt.Errorf("failed to create opaque key: %w", err))
+		return
+	}
+
+	result := DistributeResponse{
+		Result:     fmt.Sprintf("%s/d/%s", strings.TrimSuffix(api.externalURL, "/"), oKey),
+		OwnerToken: token,
+	}
+	writeJSON(w, http.StatusOK, result)
+}
+
+func (api *API) handleUpdateDistribute(w http.ResponseWriter, r *http.Request) {
+	addCORSHeaders(w, r)
+	key := getKeyFromRequest(r)
+
+	api.doHandleUpdateDistribute(w, r, key)
+}
+
+func (api *API) doHandleUpdateDistribute(w http.ResponseWriter, r *http.Request, key *StoreKey) {
+	bs, err := io.ReadAll(r.Body)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, apiCodeParseError, err)
+		return
+	}
+
+	var msg DataRequest
+	if err := util.UnmarshalJSON(bs, &msg); err != nil {
+		writeError(w, http.StatusBadRequest, apiCodeParseError, err)
+		return
+	}
+
+	if int64(len(bs)) > maxUploadSizeLimitBytes {
+		errMsg := fmt.Errorf("cannot distribute files greater than %v bytes", maxUploadSizeLimitBytes)
+		writeError(w, http.StatusBadRequest, apiCodeFileTooLarge, errMsg)
+		return
+	}
+
+	if msg.ReadOnly {
+		writeError(w, http.StatusForbidden, apiCodeInvalidArgument, errors.New("cannot update readonly resource"))
+		return
+	}
+
+	existingDataReq, ok := api.getDistribution(w, r, key, true)
+	if !ok {
+		return
+	}
+
+	msg.clearServerFields()
+
+	// the expiry is kept unless a new TTL is given
+	if err := applyTTL(&msg, time.Now()); err != nil {
+		writeError(w, http.StatusBadRequest, apiCodeInvalidArgument, err)
+		return
+	}
+	if msg.ExpiresAt == nil {
+		msg.ExpiresAt = existingDataReq.ExpiresAt
+	}
+
+	if !api.checkBlocklist(w, &msg, true) {
+		return
+	}
+
+	// only a moderator lifts a quarantine, and the reports are kept for them
+	if msg.Quarantine == nil {
+		msg.Quarantine = existingDataReq.Quarantine
+	}
+	msg.Reports = existingDataReq.Reports
+
+	bs, _ = json.Marshal(msg)
+	etag, err := getEtag(bs)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, apiCodeInternalError, err)
+		return
+	}
+
+	msg.Etag = etag
+	msg.OwnerTokenHash = existingDataReq.OwnerTokenHash
+
+	policyUpdated := false
+	if !reflect.DeepEqual(msg.RegoModules, existingDataReq.RegoModules) {
+		policyUpdated = true
+		msg.Patch = nil
+	}
+
+	// create a JSON Patch if there is a data change but no policy update
+	if !policyUpdated {
+		err := generateJSONDataPatch(&existingDataReq, &msg)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, apiCodeInternalError, err)
+			return
+		}
+	}
+
+	key, err = api.v1(r.Context()).Put(key, msg, api.getPrincipal(r))
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, apiCodeInternalError, err)
+		return
+	}
+
+	log.Debugf("Data uploaded successfully. Key: %v, Data: %+v", key, msg)
+
+	result := DataResponse{
+		Result: fmt.Sprintf("%s/d/%s", strings.TrimSuffix(api.externalURL, "/"), key.Id),
+	}
+	writeJSON(w, http.StatusOK, result)
+}
+
+// handleDeleteDistribute deletes a distribution. Connected OPAs waiting for
+// a change are told that it no longer exists.
+func (api *API) handleDeleteDistribute(w http.ResponseWriter, r *http.Request) {
+	addCORSHeaders(w, r)
+	key := getKeyFromRequest(r)
+
+	if _, ok := api.getDistribution(w, r, key, false); !ok {
+		return
+	}
+
+	if err := api.v1(r.Context()).Delete(key, api.getPrincipal(r)); err != nil {
+		writeError(w, http.StatusInternalServerError, apiCodeInternalError, err)
+		return
+	}
+
+	log.Debugf("Distribution deleted successfully. Key: %v", key)
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// handleRotateDistributeToken replaces the owner token of a distribution,
+// returning the new one. Distributions without a token can't be claimed this
+// way, see handleAdminAssignOwner.
+func (api *API) handleRotateDistributeToken(w http.ResponseWriter, r *http.Request) {
+	addCORSHeaders(w, r)
+	key := getKeyFromRequest(r)
+
+	msg, ok := api.getDistribution(w, r, key, false)
+	if !ok {
+		return
+	}
+
+	token, hash, err := newOwnerToken()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, apiCodeInternalError, err)
+		return
+	}
+
+	msg.OwnerTokenHash = hash
+
+	if _, err := api.v1(r.Context()).Put(key, msg, api.getPrincipal(r)); err != nil {
+		writeError(w, http.StatusInternalServerError, apiCodeInternalError, err)
+		return
+	}
+
+	log.Debugf("Owner token rotated successfully. Key: %v", key)
+
+	result := DistributeResponse{
+		Result:     fmt.Sprintf("%s/d/%s", strings.TrimSuffix(api.externalURL, "/"), key.Id),
+		OwnerToken: token,
+	}
+	writeJSON(w, http.StatusOK, result)
+}
+
+// handleTransferDistribute transfers the ownership of a distribution to the
+// holder of the token whose hash is given, so that the token itself never has
+// to be shared. The token of the current owner stops working.
+func (api *API) handleTransferDistribute(w http.ResponseWriter, r *http.Request) {
+	addCORSHeaders(w, r)
+	key := getKeyFromRequest(r)
+
+	bs, err := io.ReadAll(r.Body)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, apiCodeParseError, err)
+		return
+	}
+
+	var req DistributeOwnerRequest
+	if err := util.UnmarshalJSON(bs, &req); err != nil {
+		writeError(w, http.StatusBadRequest, apiCodeParseError, err)
+		return
+	}
+
+	if !validOwnerTokenHash(req.OwnerTokenHash) {
+		writeError(w, http.StatusBadRequest, apiCodeInvalidArgument, errors.New("owner_token_hash must be a hex encoded SHA-256 digest"))
+		return
+	}
+
+	msg, ok := api.getDistribution(w, r, key, false)
+	if !ok {
+		return
+	}
+
+	msg.OwnerTokenHash = req.OwnerTokenHash
+
+	if _, err := api.v1(r.Context()).Put(key, msg, api.getPrincipal(r)); err != nil {
+		writeError(w, http.StatusInternalServerError, apiCodeInternalError, err)
+		return
+	}
+
+	log.Debugf("Ownership transferred successfully. Key: %v", key)
+
+	result := DataResponse{
+		Result: fmt.Sprintf("%s/d/%s", strings.TrimSuffix(api.externalURL, "/"), key.Id),
+	}
+	writeJSON(w, http.StatusOK, result)
+}
+
+// getDistribution retrieves a distribution that the request may change: it
+// must carry the owner token, and the distribution must not be a read-only
+// share. Distributions without an owner token may only be retrieved if
+// allowUnset is true. Errors are written to w.
+func (api *API) getDistribution(w http.ResponseWriter, r *http.Request, key *StoreKey, allowUnset bool) (DataRequest, bool) {
+	// this is a v1 distribution call, only check the v1 store
+	msg, found, err := api.v1(r.Context()).Get(key, api.getPrincipal(r))
+	if err != nil {
+		if errors.Is(err, &UnauthorizedError{}) {
+			writeError(w, http.StatusUnauthorized, apiCodeUnauthorized, err)
+			return DataRequest{}, false
+		}
+
+		writeError(w, http.StatusInternalServerError, apiCodeInternalError, err)
+		return DataRequest{}, false
+	}
+	if !found {
+		writeError(w, http.StatusNotFound, apiCodeNotFound, err)
+		return DataRequest{}, false
+	}
+
+	if msg.TakenDown != nil {
+		writeTakenDown(w)
+		return DataRequest{}, false
+	}
+
+	if err := checkOwnerToken(r, msg, allowUnset); err != nil {
+		writeOwnerTokenError(w, err)
+		return DataRequest{}, false
+	}
+
+	if msg.ReadOnly {
+		writeError(w, http.StatusForbidden, apiCodeInvalidArgument, errors.New("cannot update readonly resource"))
+		return DataRequest{}, false
+	}
+
+	return msg, true
+}
+
+func (api *API) handleLint(w http.ResponseWriter, r *http.Request) {
+	addCORSHeaders(w, r)
+
+	response := LintResponse{
+		Errors: []*ast.Error{},
+	}
+
+	bs, err := io.ReadAll(r.Body)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, apiCodeInternalError, err)
+		return
+	}
+
+	var req LintRequest
+	if err := util.UnmarshalJSON(bs, &req); err != nil {
+		writeError(w, http.StatusBadRequest, apiCodeInvalidArgument, err)
+		return
+	}
+
+	files, err := moduleFiles(req.RegoModules, req.RegoModule)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, apiCodeInvalidArgument, err)
+		return
 	}
 
-	key, err = api.v1Store.Put(key, msg, api.getPrincipal(r))
+	conf, err := regalConfig(req.RegalConfig)
 	if err != nil {
-		writeError(w, http.StatusInternalServerError, apiCodeInternalError, err)
+		writeError(w, http.StatusBadRequest, apiCodeInvalidArgument, err)
 		return
 	}
 
-	if msg.ReadOnly {
-		writeError(w, http.StatusForbidden, apiCodeInvalidArgument, errors.New("cannot update readonly resource"))
+	input, astErrs := lintInput(files, regoVersionFromRequest(req.RegoVersion, ast.RegoUndefined))
+	if len(astErrs) > 0 {
+		response.ErrorMessage = astErrs.Error()
+		response.Errors = astErrs
+
+		writeJSON(w, http.StatusOK, response)
 		return
 	}
 
-	log.Debugf("Data uploaded successfully. Key: %v, Data: %+v", key, msg)
+	regalInstance := linter.NewLinter().
+		WithInputModules(&input).
+		WithUserConfig(conf)
 
-	result := DataResponse{
-		Result: fmt.Sprintf("%s/d/%s", strings.TrimSuffix(api.externalURL, "/"), key.Id),
+	ctx, span := tracer.Start(r.Context(), "regal.Lint")
+	rpt, err := regalInstance.Lint(ctx)
+	endSpan(span, err)
+	if err != nil {
+		response.ErrorMessage = err.Error()
+		writeJSON(w, http.StatusOK, response)
+		return
 	}
-	writeJSON(w, http.StatusOK, result)
+
+	response.Report = &rpt
+	response.Violations = violationsByFile(rpt)
+
+	writeJSON(w, http.StatusOK, response)
 }
 
-func (api *API) handleLint(w http.ResponseWriter, r *http.Request) {
+func (api *API) handleLintFix(w http.ResponseWriter, r *http.Request) {
 	addCORSHeaders(w, r)
 
-	response := LintResponse{
+	response := LintFixResponse{
 		Errors: []*ast.Error{},
 	}
 
-	bs, err := io.ReadAll(r.Body)
+	bs, err := io.ReadAll(io.LimitReader(r.Body, maxModulesSizeBytes+1))
 	if err != nil {
 		writeError(w, http.StatusInternalServerError, apiCodeInternalError, err)
 		return
 	}
 
+	if int64(len(bs)) > maxModulesSizeBytes {
+		writeError(w, http.StatusBadRequest, apiCodeFileTooLarge, fmt.Errorf("cannot fix modules greater than %v bytes", maxModulesSizeBytes))
+		return
+	}
+
 	var req LintRequest
 	if err := util.UnmarshalJSON(bs, &req); err != nil {
 		writeError(w, http.StatusBadRequest, apiCodeInvalidArgument, err)
 		return
 	}
 
-	input, err := rules.InputFromTextWithOptions(
-		"policy.rego",
-		req.RegoModule,
-		ast.ParserOptions{RegoVersion: regoVersionFromRequest(req.RegoVersion, ast.RegoUndefined)},
-	)
+	files, err := moduleFiles(req.RegoModules, req.RegoModule)
 	if err != nil {
-		var astErrs ast.Errors
-		var astErr *ast.Error
-		response.ErrorMessage = err.Error()
-		if errors.As(err, &astErrs) {
-			response.ErrorMessage = astErrs.Error()
-			response.Errors = astErrs
-		} else if errors.As(err, &astErr) {
-			response.ErrorMessage = astErr.Message
-			response.Errors = ast.Errors{astErr}
-		}
+		writeError(w, http.StatusBadRequest, apiCodeInvalidArgument, err)
+		return
+	}
 
-		writeJSON(w, http.StatusOK, response)
+	conf, err := regalConfig(req.RegalConfig)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, apiCodeInvalidArgument, err)
 		return
 	}
 
-	regalInstance := linter.NewLinter().
-		WithInputModules(&input).
-		WithUserConfig(config.Config{
-			Rules: map[string]config.Category{
-				"idiomatic": {
-					"directory-package-mismatch": config.Rule{
-						// this rule is disabled because the playground
-						// operates with out the notion of a directory.
-						Level: "ignore",
-					},
-				},
-				"style": {
-					"line-length": config.Rule{
-						Extra: map[string]interface{}{
-							// this allows some long tokens to appear in example
-							// header comments without breaking the line length rule
-							"non-breakable-word-threshold": 100,
-						},
-					},
-				},
-			},
-		})
+	regoVersion := regoVersionFromRequest(req.RegoVersion, ast.RegoUndefined)
+
+	// Parse errors are reported like for linting, as nothing can be fixed
+	// before the modules parse.
+	if _, astErrs := lintInput(files, regoVersion); len(astErrs) > 0 {
+		response.ErrorMessage = astErrs.Error()
+		response.Errors = astErrs
+
+		writeJSON(w, http.StatusOK, response)
+		return
+	}
 
-	rpt, err := regalInstance.Lint(r.Context())
+	result, err := lintFix(r.Context(), files, regoVersion, conf)
 	if err != nil {
 		response.ErrorMessage = err.Error()
 		writeJSON(w, http.StatusOK, response)
 		return
 	}
 
-	response.Report = &rpt
+	response.Result = result.files
+	response.Fixes = result.fixes
+	response.Diff = result.diff
 
 	writeJSON(w, http.StatusOK, response)
 }
@@ -862,6 +1909,16 @@ func (api *API) handleShareUpload(w http.ResponseWriter, r *http.Request) {
 	}
 
 	msg.ReadOnly = true
+	msg.clearServerFields()
+
+	if err := applyTTL(&msg, time.Now()); err != nil {
+		writeError(w, http.StatusBadRequest, apiCodeInvalidArgument, err)
+		return
+	}
+
+	if !api.checkBlocklist(w, &msg, true) {
+		return
+	}
 
 	bs, _ = json.Marshal(msg)
 	etag, err := getEtag(bs)
@@ -873,7 +1930,7 @@ func (api *API) handleShareUpload(w http.ResponseWriter, r *http.Request) {
 	msg.Etag = etag
 
 	key := &StoreKey{Id: getUniqueID(), KeyType: KeyTypeLegacy}
-	key, err = api.v1Store.Put(key, msg, api.getPrincipal(r))
+	key, err = api.v1(r.Context()).Put(key, msg, api.getPrincipal(r))
 	if err != nil {
 		writeError(w, http.StatusInternalServerError, apiCodeInternalError, err)
 		return
@@ -932,10 +1989,14 @@ func (api *API) doPublish(w http.ResponseWriter, r *http.Request, key *StoreKey)
 
 	msg.ReadOnly = true
 
+	if !api.checkBlocklist(w, &msg, false) {
+		return
+	}
+
 	bs, _ = json.Marshal(msg)
 
 	// This is a v2 call, only update the v2 store
-	key, err = api.v2Store.Put(key, msg, api.getPrincipal(r))
+	key, err = api.v2(r.Context()).Put(key, msg, api.getPrincipal(r))
 	if err != nil {
 		writeError(w, http.StatusInternalServerError, apiCodeInternalError, err)
 		return
@@ -1092,7 +2153,7 @@ func (api *API) handleGithubCallback(w http.ResponseWriter, r *http.Request) {
 
 	code := r.URL.Query().Get("code")
 
-	tok, err := api.auth.Exchange(context.Background(), code)
+	tok, err := api.auth.Exchange(r.Context(), code)
 	if err != nil {
 		writeError(w, http.StatusInternalServerError, apiCodeInternalError, err)
 		return
@@ -1130,26 +2191,33 @@ func getKeyFromRequest(r *http.Request) *StoreKey {
 	return storeKey
 }
 
-func (api *API) handleRetrieveInput(w http.ResponseWriter, r *http.Request) {
-	key := getKeyFromRequest(r)
-
-	log.Debugf("Trying to retrieve data for key %v\n", key)
-
+// getShare retrieves a share from the v2 store if it is a gist, falling back
+// to the v1 store.
+func (api *API) getShare(ctx context.Context, key *StoreKey, principal *Principal) (DataRequest, bool, error) {
 	var msg DataRequest
 	var found bool
 	var err error
 
 	if api.v2Store != nil && key.KeyType == KeyTypeGist {
 		log.Debugf("Using v2 store for key %v", key)
-		msg, found, err = api.v2Store.Get(key, api.getPrincipal(r))
+		msg, found, err = api.v2(ctx).Get(key, principal)
 	}
 
 	if !found {
 		log.Debugf("Using v1 store for key %v", key)
 		// Fallback to v1 store
-		msg, found, err = api.v1Store.Get(key, api.getPrincipal(r))
+		msg, found, err = api.v1(ctx).Get(key, principal)
 	}
 
+	return msg, found, err
+}
+
+func (api *API) handleRetrieveInput(w http.ResponseWriter, r *http.Request) {
+	key := getKeyFromRequest(r)
+
+	log.Debugf("Trying to retrieve data for key %v\n", key)
+
+	msg, found, err := api.getShare(r.Context(), key, api.getPrincipal(r))
 	if err != nil {
 		if errors.Is(err, &UnauthorizedError{}) {
 			writeError(w, http.StatusUnauthorized, apiCodeUnauthorized, err)
@@ -1165,6 +2233,11 @@ func (api *API) handleRetrieveInput(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if msg.TakenDown != nil {
+		writeTakenDown(w)
+		return
+	}
+
 	log.Debugf("Successfully Retrieved Data %+v for key %v", msg, key)
 
 	result := InputResponse{
@@ -1199,28 +2272,31 @@ func (api *API) handleRetrieveBundle(w http.ResponseWriter, r *http.Request) {
 		modes = strings.Split(modesVal, ",")
 	}
 
-	api.doHandleRetrieveBundle(w, key, etag, timeout, modes, api.getPrincipal(r))
+	api.doHandleRetrieveBundle(r.Context(), w, key, etag, timeout, modes, api.getPrincipal(r))
 }
 
-func (api *API) doHandleRetrieveBundle(w http.ResponseWriter, key *StoreKey, etag string, timeout time.Duration, modes []string, principal *Principal) {
+func (api *API) doHandleRetrieveBundle(ctx context.Context, w http.ResponseWriter, key *StoreKey, etag string, timeout time.Duration, modes []string, principal *Principal) {
 	if timeout == 0 || etag == "" {
-		api.doRegularPollMode(w, key, etag, modes, principal)
+		api.doRegularPollMode(ctx, w, key, etag, modes, principal)
 		return
 	}
 
-	ch := make(chan DataRequest)
+	// buffered, so that the store isn't blocked if the poll ended on shutdown
+	ch := make(chan DataRequest, 1)
+	cb := func(dr DataRequest) {
+		select {
+		case ch <- dr:
+		default:
+		}
+	}
 
 	var found bool
 	var err error
 
 	if api.v2Store != nil && key.KeyType == KeyTypeGist {
-		found, err = api.v2Store.Watch(key, etag, timeout, func(dr DataRequest) {
-			ch <- dr
-		}, principal)
+		found, err = api.v2(ctx).Watch(key, etag, timeout, cb, principal)
 	} else {
-		found, err = api.v1Store.Watch(key, etag, timeout, func(dr DataRequest) {
-			ch <- dr
-		}, principal)
+		found, err = api.v1(ctx).Watch(key, etag, timeout, cb, principal)
 	}
 
 	if err != nil {
@@ -1238,37 +2314,49 @@ func (api *API) doHandleRetrieveBundle(w http.ResponseWriter, key *StoreKey, eta
 		return
 	}
 
-	msg := <-ch
+	api.metrics.bundleWatchers.Inc()
+	defer api.metrics.bundleWatchers.Dec()
 
-	if reflect.DeepEqual(msg, DataRequest{}) {
-		writeError(w, http.StatusInternalServerError, apiCodeInternalError, fmt.Errorf("invalid data for key %v", key))
-		return
+	// long-polls outlast the write timeout of the server
+	if err := http.NewResponseController(w).SetWriteDeadline(time.Now().Add(timeout + serverWriteTimeout)); err != nil {
+		log.WithError(err).Debug("Failed to extend the write deadline of a long-poll.")
 	}
 
-	if msg.Etag == etag {
+	var msg DataRequest
+	select {
+	case msg = <-ch:
+	case <-api.shutdown:
+		// the client polls again, reaching another instance
 		w.WriteHeader(http.StatusNotModified)
 		return
 	}
 
-	if isDeltaBundleModeSupported(modes) && msg.Patch != nil {
-		createAndWriteDeltaBundle(w, msg, key, etag)
-	} else {
-		createAndWriteSnapshotBundle(w, msg, key, etag)
+	// the stores notify the watchers of a deleted key with an empty request
+	if reflect.DeepEqual(msg, DataRequest{}) {
+		writeError(w, http.StatusNotFound, apiCodeNotFound, fmt.Errorf("key %v was deleted", key.Id))
+		return
 	}
+
+	if msg.TakenDown != nil {
+		writeTakenDown(w)
+		return
+	}
+
+	api.writeBundle(w, msg, key, etag, modes)
 }
 
-func (api *API) doRegularPollMode(w http.ResponseWriter, key *StoreKey, etag string, modes []string, principal *Principal) {
+func (api *API) doRegularPollMode(ctx context.Context, w http.ResponseWriter, key *StoreKey, etag string, modes []string, principal *Principal) {
 	var msg DataRequest
 	var found bool
 	var err error
 
 	// First check the v2 store, then fall back to the v1 store
 	if api.v2Store != nil && key.KeyType == KeyTypeGist {
-		msg, found, err = api.v2Store.Get(key, principal)
+		msg, found, err = api.v2(ctx).Get(key, principal)
 	}
 
 	if !found {
-		msg, found, err = api.v1Store.Get(key, principal)
+		msg, found, err = api.v1(ctx).Get(key, principal)
 	}
 
 	if err != nil {
@@ -1285,14 +2373,27 @@ func (api *API) doRegularPollMode(w http.ResponseWriter, key *StoreKey, etag str
 		return
 	}
 
-	if msg.Etag == etag {
-		w.WriteHeader(http.StatusNotModified)
+	if msg.TakenDown != nil {
+		writeTakenDown(w)
 		return
 	}
 
-	if etag != "" && isDeltaBundleModeSupported(modes) && msg.Patch != nil {
+	api.writeBundle(w, msg, key, etag, modes)
+}
+
+// writeBundle writes msg as a delta bundle if the client supports them and has
+// the previous revision, and as a snapshot bundle otherwise. Nothing is
+// written if the client has the current revision.
+func (api *API) writeBundle(w http.ResponseWriter, msg DataRequest, key *StoreKey, etag string, modes []string) {
+	switch {
+	case msg.Etag == etag:
+		api.metrics.bundleDownloads.WithLabelValues(bundleDownloadNotModified).Inc()
+		w.WriteHeader(http.StatusNotModified)
+	case etag != "" && isDeltaBundleModeSupported(modes) && msg.Patch != nil:
+		api.metrics.bundleDownloads.WithLabelValues(bundleDownloadDelta).Inc()
 		createAndWriteDeltaBundle(w, msg, key, etag)
-	} else {
+	default:
+		api.metrics.bundleDownloads.WithLabelValues(bundleDownloadSnapshot).Inc()
 		createAndWriteSnapshotBundle(w, msg, key, etag)
 	}
 }
@@ -1316,7 +2417,7 @@ func (api *API) doHandleRetrieveFromStore(ctx context.Context, w http.ResponseWr
 	// First check the v2 store, then fall back to the v1 store
 	if api.v2Store != nil && key.KeyType == KeyTypeGist {
 		var err error
-		msg, found, err = api.v2Store.Get(key, principal)
+		msg, found, err = api.v2(ctx).Get(key, principal)
 		if err != nil {
 			var e *UnauthorizedError
 			if errors.As(err, &e) {
@@ -1350,7 +2451,7 @@ func (api *API) doHandleRetrieveFromStore(ctx context.Context, w http.ResponseWr
 
 	if !found {
 		var err error
-		msg, found, err = api.v1Store.Get(key, principal)
+		msg, found, err = api.v1(ctx).Get(key, principal)
 		if err != nil {
 			writeError(w, http.StatusInternalServerError, apiCodeInternalError, err)
 			return
@@ -1362,6 +2463,11 @@ func (api *API) doHandleRetrieveFromStore(ctx context.Context, w http.ResponseWr
 		return
 	}
 
+	if msg.TakenDown != nil {
+		writeTakenDown(w)
+		return
+	}
+
 	log.Debugf("Successfully Retrieved Data %+v for key %v", msg, key)
 
 	keys := make([]string, len(msg.RegoModules))
@@ -1377,27 +2483,32 @@ func (api *API) doHandleRetrieveFromStore(ctx context.Context, w http.ResponseWr
 	}
 
 	response := DataResponse{
-		Value:       policy,
-		Input:       msg.Input,
-		Data:        msg.Data,
-		RegoVersion: msg.RegoVersion,
+		Value:         policy,
+		Input:         msg.Input,
+		Data:          msg.Data,
+		DataDocuments: msg.DataDocuments,
+		RegoVersion:   msg.RegoVersion,
+		RegalConfig:   msg.RegalConfig,
+		Warning:       msg.warning(),
 	}
 
 	if coverage || evaluate {
-		policies := make(map[string]string)
-		for path, value := range msg.RegoModules {
-			parts := strings.Split(path, "/")
-			str, ok := value.(string)
-			if !ok {
-				writeError(w, http.StatusBadRequest, apiCodeParseError, errors.New("bad request"))
-			}
-			policies[parts[len(parts)-1]] = str
+		policies, err := policiesFromModules(msg.RegoModules)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, apiCodeParseError, err)
+			return
+		}
+
+		input, data, err := decodeDocuments(&msg)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, apiCodeParseError, err)
+			return
 		}
 
-		compileResult, ignored, err := opa.Compile(ctx, msg.Input, msg.Data, policies, msg.RegoQuery,
+		compileResult, ignored, err := opa.Compile(ctx, input, data, msg.DataDocuments, policies, msg.RegoQuery,
 			msg.QueryPackage, msg.QueryImports, strict, msg.RegoVersion)
 		if err != nil {
-			log.WithError(err).Error("Compile Error.")
+			log.WithContext(ctx).WithError(err).Error("Compile Error.")
 			writeErrorAndIgnored(w, http.StatusBadRequest, apiCodeParseError, err, ignored)
 			return
 		}
@@ -1413,7 +2524,7 @@ func (api *API) doHandleRetrieveFromStore(ctx context.Context, w http.ResponseWr
 			},
 		)
 		if evalErr != nil {
-			log.WithError(evalErr.RawError).Error("Eval Error.")
+			log.WithContext(ctx).WithError(evalErr.RawError).Error("Eval Error.")
 			writeErrorAndIgnored(w, evalErr.HTTPStatus, apiCodeInternalError, evalErr.RawError, ignored)
 			return
 		}
@@ -1443,7 +2554,7 @@ func (api *API) handleServeShared(w http.ResponseWriter, r *http.Request) {
 	// First check the v2 store, then fall back to the v1 store
 	if api.v2Store != nil && key.KeyType == KeyTypeGist {
 		var err error
-		keys, err = api.v2Store.List(key, api.getPrincipal(r))
+		keys, err = api.v2(r.Context()).List(key, api.getPrincipal(r))
 		if err != nil {
 			expected := &UnauthorizedError{}
 			if errors.As(err, &expected) {
@@ -1455,7 +2566,7 @@ func (api *API) handleServeShared(w http.ResponseWriter, r *http.Request) {
 		}
 	} else {
 		var err error
-		keys, err = api.v1Store.List(key, api.getPrincipal(r))
+		keys, err = api.v1(r.Context()).List(key, api.getPrincipal(r))
 		if err != nil {
 			writeError(w, http.StatusInternalServerError, apiCodeInternalError, err)
 			return
@@ -1467,6 +2578,27 @@ func (api *API) handleServeShared(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// Shares taken down by a moderator are kept, so they have to be checked
+	if key.KeyType == KeyTypeLegacy {
+		msg, found, err := api.v1(r.Context()).Get(key, api.getPrincipal(r))
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, apiCodeInternalError, err)
+			return
+		}
+		if !found {
+			writeError(w, http.StatusNotFound, apiCodeNotFound, errors.New("key not found"))
+			return
+		}
+		if msg.TakenDown != nil {
+			writeTakenDown(w)
+			return
+		}
+		if warning := msg.warning(); warning != "" && !getBoolParam(r.URL, acceptWarningParam, false) {
+			writeWarningPage(w, r, warning)
+			return
+		}
+	}
+
 	log.Debugf("Successfully verified key %v", key)
 
 	// Serve files with the prefix removed, basically the same as `/`
@@ -1534,15 +2666,50 @@ func (api *API) handleVars(w http.ResponseWriter, r *http.Request) {
 	writeJSON(w, http.StatusOK, &VarsResponse{Result: result.Vars})
 }
 
-func (api *API) handleSession(w http.ResponseWriter, r *http.Request) {
-	writeJSON(w, http.StatusOK, "")
+func (api *API) handleComplete(w http.ResponseWriter, r *http.Request) {
+	bs, err := io.ReadAll(r.Body)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, apiCodeParseError, err)
+		return
+	}
+
+	var msg CompleteRequest
+	if err := util.UnmarshalJSON(bs, &msg); err != nil {
+		writeError(w, http.StatusBadRequest, apiCodeParseError, err)
+		return
+	}
+
+	policies, err := policiesFromModules(msg.RegoModules)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, apiCodeParseError, err)
+		return
+	}
+
+	file := moduleFileName(msg.RegoModule)
+	if msg.RegoModule == "" {
+		if len(policies) != 1 {
+			writeError(w, http.StatusBadRequest, apiCodeInvalidArgument, errors.New("request must provide rego_module with more than one module"))
+			return
+		}
+		for name := range policies {
+			file = name
+		}
+	}
+
+	result, err := opa.Complete(policies, file, msg.Position.Row, msg.Position.Col, msg.Input, msg.Data, msg.RegoVersion)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, apiCodeInvalidArgument, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, &CompleteResponse{Token: result.Token, Result: result.Completions})
 }
 
-func (api *API) handleLiveness(w http.ResponseWriter, r *http.Request) {
+func (api *API) handleSession(w http.ResponseWriter, r *http.Request) {
 	writeJSON(w, http.StatusOK, "")
 }
 
-func (api *API) handleReadiness(w http.ResponseWriter, r *http.Request) {
+func (api *API) handleLiveness(w http.ResponseWriter, r *http.Request) {
 	writeJSON(w, http.StatusOK, "")
 }
 
@@ -1575,6 +2742,7 @@ func (api *API) handleFormatting(w http.ResponseWriter, r *http.Request) {
 	for _, v := range parseVersionAttempts {
 		beginTimestamp := time.Now()
 		var formatted []byte
+		_, span := tracer.Start(r.Context(), "format.Source", trace.WithAttributes(attribute.String("rego.version", v.String())))
 		formatted, err = format.SourceWithOpts(
 			"policy.rego",
 			[]byte(msg.RegoModule),
@@ -1584,6 +2752,7 @@ func (api *API) handleFormatting(w http.ResponseWriter, r *http.Request) {
 				ParserOptions: &ast.ParserOptions{RegoVersion: regoVersion},
 			},
 		)
+		endSpan(span, err)
 		totalTime := time.Since(beginTimestamp)
 
 		if err != nil {
@@ -1610,6 +2779,92 @@ func (api *API) handleFormatting(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+func (api *API) handleMigrate(w http.ResponseWriter, r *http.Request) {
+	addCORSHeaders(w, r)
+
+	bs, err := io.ReadAll(io.LimitReader(r.Body, maxModulesSizeBytes+1))
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, apiCodeInternalError, err)
+		return
+	}
+
+	if int64(len(bs)) > maxModulesSizeBytes {
+		writeError(w, http.StatusBadRequest, apiCodeFileTooLarge, fmt.Errorf("cannot migrate modules greater than %v bytes", maxModulesSizeBytes))
+		return
+	}
+
+	var req MigrateRequest
+	if err := util.UnmarshalJSON(bs, &req); err != nil {
+		writeError(w, http.StatusBadRequest, apiCodeInvalidArgument, err)
+		return
+	}
+
+	files, err := moduleFiles(req.RegoModules, req.RegoModule)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, apiCodeInvalidArgument, err)
+		return
+	}
+
+	migrated := opa.Migrate(files)
+
+	response := MigrateResponse{
+		Result: migrated.Modules,
+		Diffs:  make(map[string]string),
+		Issues: migrated.Issues,
+	}
+	if response.Issues == nil {
+		response.Issues = []*ast.Error{}
+	}
+
+	for name, module := range migrated.Modules {
+		if diff := unifiedDiff(name, files[name], module); diff != "" {
+			response.Diffs[name] = diff
+		}
+	}
+
+	writeJSON(w, http.StatusOK, response)
+}
+
+func (api *API) handleAST(w http.ResponseWriter, r *http.Request) {
+	addCORSHeaders(w, r)
+
+	bs, err := io.ReadAll(r.Body)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, apiCodeInternalError, err)
+		return
+	}
+
+	var req ASTRequest
+	if err := util.UnmarshalJSON(bs, &req); err != nil {
+		writeError(w, http.StatusBadRequest, apiCodeInvalidArgument, err)
+		return
+	}
+
+	files, err := moduleFiles(req.RegoModules, req.RegoModule)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, apiCodeInvalidArgument, err)
+		return
+	}
+
+	regoVersion := 1
+	if req.RegoVersion != nil {
+		regoVersion = *req.RegoVersion
+	}
+
+	result, err := opa.Inspect(files, req.Query, req.Stages, &regoVersion)
+	if err != nil {
+		code := apiCodeInvalidArgument
+		var astErrs ast.Errors
+		if errors.As(err, &astErrs) {
+			code = apiCodeParseError
+		}
+		writeError(w, http.StatusBadRequest, code, err)
+		return
+	}
+
+	writeJSONWithLocations(w, http.StatusOK, result)
+}
+
 func createAndWriteSnapshotBundle(w http.ResponseWriter, dr DataRequest, key *StoreKey, etag string) {
 	files := make([]bundle.ModuleFile, 0, len(dr.RegoModules))
 
@@ -1620,14 +2875,10 @@ func createAndWriteSnapshotBundle(w http.ResponseWriter, dr DataRequest, key *St
 		})
 	}
 
-	var data map[string]interface{}
-	var ok bool
-	if dr.Data != nil {
-		data, ok = (*(dr.Data)).(map[string]interface{})
-		if !ok {
-			writeError(w, http.StatusInternalServerError, apiCodeInternalError, errors.New("unable convert data to map[string]interface{}"))
-			return
-		}
+	data, err := mountedData(&dr)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, apiCodeInternalError, err)
+		return
 	}
 
 	b := bundle.Bundle{
@@ -1717,7 +2968,16 @@ func isWritableError(err error) bool {
 }
 
 func writeJSON(w http.ResponseWriter, status int, x any) {
-	bs, _ := json.Marshal(x)
+	bs, _ := opa.MarshalJSON(x)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(bs)
+}
+
+// writeJSONWithLocations is like writeJSON, but includes the locations of all
+// AST nodes in x.
+func writeJSONWithLocations(w http.ResponseWriter, status int, x any) {
+	bs, _ := opa.MarshalJSONWithLocations(x)
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(status)
 	w.Write(bs)
@@ -1763,22 +3023,24 @@ func getPreferHeaderField(r *http.Request, field string) string {
 	return ""
 }
 
+// mountedData returns the data of a request as it's served in bundles.
+func mountedData(dr *DataRequest) (map[string]interface{}, error) {
+	data, err := decodeDocument("data", dr.Data, dr.DataFormat)
+	if err != nil {
+		return nil, err
+	}
+	return opa.MountData(data, dr.DataDocuments)
+}
+
 func generateJSONDataPatch(original, new *DataRequest) error {
-	var originalData map[string]interface{}
-	var ok bool
-	if original.Data != nil {
-		originalData, ok = (*(original.Data)).(map[string]interface{})
-		if !ok {
-			return errors.New("unable convert data to map[string]interface{}")
-		}
+	originalData, err := mountedData(original)
+	if err != nil {
+		return err
 	}
 
-	var newData map[string]interface{}
-	if new.Data != nil {
-		newData, ok = (*(new.Data)).(map[string]interface{})
-		if !ok {
-			return errors.New("unable convert data to map[string]interface{}")
-		}
+	newData, err := mountedData(new)
+	if err != nil {
+		return err
 	}
 
 	bsExisting, _ := json.Marshal(originalData)
@@ -1899,3 +3161,24 @@ func regoVersionFromRequest(version *int, defaultVersion ast.RegoVersion) ast.Re
 
 	return defaultVersion
 }
+
+// policiesFromModules maps the rego_modules of a request to the file name and
+// a string containing the module.
+// Rego module sample key format: <package_name>/<policy_file_name>
+// eg. rbac/authz/authz.rego
+func policiesFromModules(modules map[string]interface{}) (map[string]string, error) {
+	policies := make(map[string]string, len(modules))
+	for path, value := range modules {
+		str, ok := value.(string)
+		if !ok {
+			return nil, fmt.Errorf("module %v must be a string", path)
+		}
+		policies[moduleFileName(path)] = str
+	}
+	return policies, nil
+}
+
+func moduleFileName(path string) string {
+	parts := strings.Split(path, "/")
+	return parts[len(parts)-1]
+}
@@ -2,6 +2,7 @@ package api
 
 import (
 	"bytes"
+	"compress/gzip"
 	"context"
 	"encoding/base64"
 	"encoding/json"
@@ -18,10 +19,13 @@ import (
 	"golang.org/x/oauth2"
 
 	"github.com/mattbaird/jsonpatch"
+	"github.com/open-policy-agent/opa/ast"
 	"github.com/open-policy-agent/opa/bundle"
 
 	"github.com/open-policy-agent/opa/rego"
 	"github.com/open-policy-agent/opa/util"
+
+	"github.com/open-policy-agent/rego-playground/opa"
 )
 
 // TODO: Test store fallback
@@ -252,212 +256,1256 @@ func TestApiEvalOPARuntimeInPolicy(t *testing.T) {
 		t.Fatal(err)
 	}
 
-	exp := map[string]interface{}{
-		"message": "The Rego Playground does not provide OPA runtime information during policy execution.",
+	exp := map[string]interface{}{
+		"message": "The Rego Playground does not provide OPA runtime information during policy execution.",
+	}
+
+	if !reflect.DeepEqual(res.Result[0].Expressions[0].Value, exp) {
+		t.Fatalf("unexpected result for policy containing opa.runtime() call: %v", res.Result[0].Expressions[0].Value)
+	}
+}
+
+func TestApiEvalOPARuntimeInQuery(t *testing.T) {
+	dr := makeDR(`
+		package test
+		p = true`, `p; x := opa.runtime()`, `{}`, 0)
+	body, _ := json.Marshal(dr)
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("POST", "/v1/data", bytes.NewReader(body)) // These values don't matter
+	s := NewAPIService("", NewMemoryDataRequestStore(), nil, "./", "", "", "")
+
+	s.handleQuery(w, r)
+
+	if w.Code != 200 {
+		t.Fatalf("expected 200 response but got: %v", w.Code)
+	}
+
+	var res struct {
+		Result rego.ResultSet `json:"result"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &res); err != nil {
+		t.Fatal(err)
+	}
+
+	exp := map[string]interface{}{
+		"message": "The Rego Playground does not provide OPA runtime information during policy execution.",
+	}
+
+	if !reflect.DeepEqual(res.Result[0].Bindings["x"], exp) {
+		t.Fatalf("unexpected result for policy containing opa.runtime() call: %v", res.Result[0].Bindings["x"])
+	}
+}
+
+func TestApiEvalUnsafeBuiltins(t *testing.T) {
+	tests := []struct {
+		note string
+		dr   DataRequest
+	}{
+		{
+			note: "in policy",
+			dr: makeDR(`
+package test
+p {
+	http.send({"method": "get", "url": "https://httpbin.org"})
+}`,
+				"p", "{}", 0),
+		},
+		{
+			note: "in policy, 'with'",
+			dr: makeDR(`
+package test
+p {
+	is_object({"method": "get", "url": "https://httpbin.org"}) with is_object as http.send
+}`,
+				"p", "{}", 0),
+		},
+		{
+			note: "in query",
+			dr: makeDR(`
+package test
+p = true
+`,
+				`p; http.send({"method": "get", "url": "https://httpbin.org"})`, "{}", 0),
+		},
+		{
+			note: "in query, 'with'",
+			dr: makeDR(`
+package test
+p = true
+`,
+				`p; is_object({"method": "get", "url": "https://httpbin.org"}) with is_object as http.send`, "{}", 0),
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.note, func(t *testing.T) {
+			body, err := json.Marshal(tc.dr)
+			if err != nil {
+				t.Fatal(err)
+			}
+			w := httptest.NewRecorder()
+			r := httptest.NewRequest("POST", "/v1/data", bytes.NewReader(body)) // These values don't matter
+			s := NewAPIService("", NewMemoryDataRequestStore(), nil, "./", "", "", "")
+
+			s.handleQuery(w, r)
+
+			if w.Code != 400 {
+				t.Fatalf("expected 400 response but got: %v", w.Code)
+			}
+		})
+	}
+}
+
+func TestApiEvalWithCoverage(t *testing.T) {
+	dr := makeDR("package test\ndefault allow = false\nallow { input.foo = 1 }", `allow`, `{"foo": 1}`, 0)
+	dr.Coverage = true
+	body, _ := json.Marshal(dr)
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("POST", "/v1/data", bytes.NewReader(body)) // These values don't matter
+	s := NewAPIService("", NewMemoryDataRequestStore(), nil, "./", "", "", "")
+
+	s.doHandleQuery(w, r)
+
+	if w.Code != 200 {
+		t.Fatalf("expected 200 response but got: %v", w.Code)
+	}
+
+	var res DataResponse
+	json.Unmarshal(w.Body.Bytes(), &res)
+
+	if res.Coverage == nil {
+		t.Fatal("expected coverage to be set")
+	}
+}
+
+func TestApiLint(t *testing.T) {
+	lr := LintRequest{
+		RegoModule: "package test\nimport rego.v1\nthing = 1\n",
+	}
+
+	body, _ := json.Marshal(lr)
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("POST", "/v1/lint", bytes.NewReader(body)) // These values don't matter
+	s := NewAPIService("", NewMemoryDataRequestStore(), nil, "./", "", "", "")
+
+	s.handleLint(w, r)
+
+	if w.Code != 200 {
+		bs, err := io.ReadAll(w.Body)
+		if err != nil {
+			t.Fatalf("failed to read response body: %s", err)
+		}
+
+		t.Fatalf("expected 200 response but got: %v, body: %s", w.Code, string(bs))
+	}
+
+	var res LintResponse
+	err := json.Unmarshal(w.Body.Bytes(), &res)
+	if err != nil {
+		t.Fatalf("failed to unmarshal response: %s", err)
+	}
+
+	if res.Report == nil {
+		t.Fatal("expected lint report to be set")
+	}
+
+	if len(res.Report.Violations) != 2 {
+		t.Fatal("expected 2 violations in response but got:", len(res.Report.Violations))
+	}
+
+	expectedViolations := []string{"use-assignment-operator", "opa-fmt"}
+	for _, expected := range expectedViolations {
+		found := false
+		for _, violation := range res.Report.Violations {
+			if violation.Title == expected {
+				found = true
+				break
+			}
+		}
+		if !found {
+			t.Errorf("expected violation %s but not found", expected)
+		}
+	}
+}
+
+func TestApiLintErrors(t *testing.T) {
+	lr := LintRequest{
+		RegoModule: "package test\npackage foobar\n",
+	}
+
+	body, _ := json.Marshal(lr)
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("POST", "/v1/lint", bytes.NewReader(body)) // These values don't matter
+	s := NewAPIService("", NewMemoryDataRequestStore(), nil, "./", "", "", "")
+
+	s.handleLint(w, r)
+
+	if w.Code != 200 {
+		bs, err := io.ReadAll(w.Body)
+		if err != nil {
+			t.Fatalf("failed to read response body: %s", err)
+		}
+
+		t.Fatalf("expected 200 response but got: %v, body: %s", w.Code, string(bs))
+	}
+
+	var res LintResponse
+	err := json.Unmarshal(w.Body.Bytes(), &res)
+	if err != nil {
+		t.Fatalf("failed to unmarshal response: %s", err)
+	}
+
+	if len(res.Errors) != 1 {
+		t.Fatal("expected 1 errors in response but got:", len(res.Errors))
+	}
+
+	astError := res.Errors[0]
+	if exp, got := "rego_parse_error", astError.Code; exp != got {
+		t.Fatalf("expected error code %v but got: %v", exp, got)
+	}
+}
+
+func TestApiLintMultipleModulesWithConfig(t *testing.T) {
+	lr := LintRequest{
+		RegoModules: map[string]interface{}{
+			"authz/a.rego": "package a\n\nimport data.b.missing\n\nallow = missing\n",
+			"authz/b.rego": "package b\n\nexisting := true\n",
+		},
+		RegalConfig: "rules:\n  style:\n    use-assignment-operator:\n      level: ignore\n",
+	}
+
+	body, _ := json.Marshal(lr)
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("POST", "/v1/lint", bytes.NewReader(body))
+	s := NewAPIService("", NewMemoryDataRequestStore(), nil, "./", "", "", "")
+
+	s.handleLint(w, r)
+
+	if w.Code != 200 {
+		t.Fatalf("expected 200 response but got: %v, body: %s", w.Code, w.Body.String())
+	}
+
+	var res LintResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &res); err != nil {
+		t.Fatalf("failed to unmarshal response: %s", err)
+	}
+
+	if res.Report == nil {
+		t.Fatalf("expected lint report to be set, got error: %s", res.ErrorMessage)
+	}
+
+	titles := make(map[string]bool)
+	for _, v := range res.Violations["authz/a.rego"] {
+		titles[v.Title] = true
+	}
+
+	// aggregate rules see all modules
+	if !titles["unresolved-import"] {
+		t.Errorf("expected unresolved-import violation in authz/a.rego, got %v", res.Violations)
+	}
+
+	// disabled by the user supplied config
+	if titles["use-assignment-operator"] {
+		t.Errorf("expected use-assignment-operator to be disabled, got %v", res.Violations)
+	}
+
+	if len(res.Violations["authz/b.rego"]) != 0 {
+		t.Errorf("expected no violations in authz/b.rego, got %v", res.Violations["authz/b.rego"])
+	}
+}
+
+func TestApiLintInvalidConfig(t *testing.T) {
+	for _, conf := range []string{
+		"rules: [",
+		"capabilities:\n  from:\n    file: /etc/passwd\n",
+		"capabilities:\n  from:\n    url: http://169.254.169.254/\n",
+	} {
+		body, _ := json.Marshal(LintRequest{RegoModule: "package test\n", RegalConfig: conf})
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("POST", "/v1/lint", bytes.NewReader(body))
+		NewAPIService("", NewMemoryDataRequestStore(), nil, "./", "", "", "").handleLint(w, r)
+
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("expected 400 response for config %q but got: %v", conf, w.Code)
+		}
+	}
+}
+
+func TestApiLintFix(t *testing.T) {
+	lr := LintRequest{
+		RegoModules: map[string]interface{}{
+			"play/play.rego": "package play\n\nallow = true\n",
+			"play/lib.rego":  "package lib\n\n#no space\nx := 1\n",
+			"play/ok.rego":   "package ok\n\ny := 1\n",
+		},
+		RegalConfig: "rules:\n  style:\n    no-whitespace-comment:\n      level: ignore\n",
+	}
+
+	body, _ := json.Marshal(lr)
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("POST", "/v1/lint/fix", bytes.NewReader(body))
+	s := NewAPIService("", NewMemoryDataRequestStore(), nil, "./", "", "", "")
+
+	s.router.ServeHTTP(w, r)
+
+	if w.Code != 200 {
+		t.Fatalf("expected 200 response but got: %v, body: %s", w.Code, w.Body.String())
+	}
+
+	var res LintFixResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &res); err != nil {
+		t.Fatalf("failed to unmarshal response: %s", err)
+	}
+
+	if res.ErrorMessage != "" {
+		t.Fatalf("unexpected error: %s", res.ErrorMessage)
+	}
+
+	expResult := map[string]string{
+		"play/play.rego": "package play\n\nallow := true\n",
+		"play/lib.rego":  "package lib\n\n#no space\nx := 1\n",
+		"play/ok.rego":   "package ok\n\ny := 1\n",
+	}
+	if !reflect.DeepEqual(expResult, res.Result) {
+		t.Fatalf("expected result %v but got: %v", expResult, res.Result)
+	}
+
+	expFixes := map[string][]string{"play/play.rego": {"opa-fmt"}}
+	if !reflect.DeepEqual(expFixes, res.Fixes) {
+		t.Fatalf("expected fixes %v but got: %v", expFixes, res.Fixes)
+	}
+
+	expDiff := `--- a/play/play.rego
++++ b/play/play.rego
+@@ -1,3 +1,3 @@
+ package play
+ 
+-allow = true
++allow := true
+`
+	if expDiff != res.Diff {
+		t.Fatalf("expected diff:\n%s\ngot:\n%s", expDiff, res.Diff)
+	}
+}
+
+func TestApiMigrate(t *testing.T) {
+	mr := MigrateRequest{
+		RegoModules: map[string]interface{}{
+			"play/play.rego": "package play\n\nimport future.keywords\n\nallow {\n\tinput.x in [1, 2]\n}\n",
+			"play/lib.rego":  "package lib\n\ndata := 1\n",
+		},
+	}
+
+	body, _ := json.Marshal(mr)
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("POST", "/v1/migrate", bytes.NewReader(body))
+	s := NewAPIService("", NewMemoryDataRequestStore(), nil, "./", "", "", "")
+
+	s.router.ServeHTTP(w, r)
+
+	if w.Code != 200 {
+		t.Fatalf("expected 200 response but got: %v, body: %s", w.Code, w.Body.String())
+	}
+
+	var res MigrateResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &res); err != nil {
+		t.Fatalf("failed to unmarshal response: %s", err)
+	}
+
+	expDiffs := map[string]string{
+		"play/play.rego": `--- a/play/play.rego
++++ b/play/play.rego
+@@ -1,7 +1,5 @@
+ package play
+ 
+-import future.keywords
+-
+-allow {
++allow if {
+ 	input.x in [1, 2]
+ }
+`,
+	}
+	if !reflect.DeepEqual(expDiffs, res.Diffs) {
+		t.Fatalf("expected diffs %v but got: %v", expDiffs, res.Diffs)
+	}
+
+	if len(res.Issues) != 1 {
+		t.Fatalf("expected 1 issue but got: %v", res.Issues)
+	}
+
+	if exp, act := "play/lib.rego", res.Issues[0].Location.File; exp != act {
+		t.Fatalf("expected issue in %v but got: %v", exp, act)
+	}
+}
+
+func TestApiMigrateTooLarge(t *testing.T) {
+	for _, path := range []string{"/v1/migrate", "/v1/lint/fix"} {
+		t.Run(path, func(t *testing.T) {
+			mr := MigrateRequest{
+				RegoModule: "package play\n\n" + strings.Repeat("# comment\n", int(maxModulesSizeBytes)/10),
+			}
+
+			body, _ := json.Marshal(mr)
+			w := httptest.NewRecorder()
+			r := httptest.NewRequest("POST", path, bytes.NewReader(body))
+			s := NewAPIService("", NewMemoryDataRequestStore(), nil, "./", "", "", "")
+
+			s.router.ServeHTTP(w, r)
+
+			if w.Code != http.StatusBadRequest {
+				t.Fatalf("expected 400 response but got: %v, body: %s", w.Code, w.Body.String())
+			}
+
+			var resErr apiError
+			if err := json.Unmarshal(w.Body.Bytes(), &resErr); err != nil {
+				t.Fatal(err)
+			}
+			if resErr.Code != apiCodeFileTooLarge {
+				t.Fatalf("expected error code %v but got: %v", apiCodeFileTooLarge, resErr.Code)
+			}
+		})
+	}
+}
+
+func TestApiAST(t *testing.T) {
+	ar := ASTRequest{
+		RegoModule: "package play\n\nallow if input.x == 1\n",
+		Query:      "data.play.allow",
+		Stages:     []string{"RewriteLocalVars"},
+	}
+
+	body, _ := json.Marshal(ar)
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("POST", "/v1/ast", bytes.NewReader(body))
+	s := NewAPIService("", NewMemoryDataRequestStore(), nil, "./", "", "", "")
+
+	s.router.ServeHTTP(w, r)
+
+	if w.Code != 200 {
+		t.Fatalf("expected 200 response but got: %v, body: %s", w.Code, w.Body.String())
+	}
+
+	var res struct {
+		Modules map[string]struct {
+			Rules []struct {
+				Location *ast.Location `json:"location"`
+			} `json:"rules"`
+		} `json:"modules"`
+		Query []struct {
+			Location *ast.Location `json:"location"`
+		} `json:"query"`
+		Stages []struct {
+			Stage string `json:"stage"`
+		} `json:"stages"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &res); err != nil {
+		t.Fatalf("failed to unmarshal response: %s", err)
+	}
+
+	rules := res.Modules["policy.rego"].Rules
+	if len(rules) != 1 || rules[0].Location == nil || rules[0].Location.Row != 3 {
+		t.Fatalf("expected rule with location at row 3, got: %s", w.Body.String())
+	}
+
+	if len(res.Query) != 1 || res.Query[0].Location == nil {
+		t.Fatalf("expected query with location, got: %s", w.Body.String())
+	}
+
+	if len(res.Stages) != 1 || res.Stages[0].Stage != "RewriteLocalVars" {
+		t.Fatalf("expected RewriteLocalVars snapshot, got: %s", w.Body.String())
+	}
+
+	// AST nodes in other responses don't carry locations
+	if bs, _ := json.Marshal(ast.MustParseBody("x")); strings.Contains(string(bs), "location") {
+		t.Fatalf("expected the default AST JSON options to be unchanged, got: %s", bs)
+	}
+}
+
+func TestApiASTUnknownStage(t *testing.T) {
+	body, _ := json.Marshal(ASTRequest{RegoModule: "package play\n", Stages: []string{"NoSuchStage"}})
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("POST", "/v1/ast", bytes.NewReader(body))
+	NewAPIService("", NewMemoryDataRequestStore(), nil, "./", "", "", "").handleAST(w, r)
+
+	if w.Code != http.StatusBadRequest {
+		t.Fatalf("expected 400 response but got: %v", w.Code)
+	}
+}
+
+func TestApiEvalWithPlanTarget(t *testing.T) {
+	dr := makeDR("package play\n\nallow if input.x == 1\n", `data.play.allow`, `{"x": 1}`, 1)
+	dr.Target = "plan"
+
+	body, _ := json.Marshal(dr)
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("POST", "/v1/data", bytes.NewReader(body))
+	s := NewAPIService("", NewMemoryDataRequestStore(), nil, "./", "", "", "")
+
+	s.handleQuery(w, r)
+
+	if w.Code != 200 {
+		t.Fatalf("expected 200 response but got: %v, body: %s", w.Code, w.Body.String())
+	}
+
+	var res DataResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &res); err != nil {
+		t.Fatal(err)
+	}
+
+	if res.Build == nil || len(res.Build.Plan) == 0 {
+		t.Fatalf("expected plan in response, got: %s", w.Body.String())
+	}
+
+	if exp := []string{"play/allow"}; !reflect.DeepEqual(exp, res.Build.Entrypoints) {
+		t.Fatalf("expected entrypoints %v but got: %v", exp, res.Build.Entrypoints)
+	}
+}
+
+func TestApiEvalWithMetrics(t *testing.T) {
+	dr := makeDR("package play\n\nallow if upper(input.x) == \"A\"\n", `data.play.allow`, `{"x": "a"}`, 1)
+	dr.Metrics = true
+
+	body, _ := json.Marshal(dr)
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("POST", "/v1/data", bytes.NewReader(body))
+	s := NewAPIService("", NewMemoryDataRequestStore(), nil, "./", "", "", "")
+
+	s.handleQuery(w, r)
+
+	if w.Code != 200 {
+		t.Fatalf("expected 200 response but got: %v, body: %s", w.Code, w.Body.String())
+	}
+
+	var res DataResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &res); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, ok := res.Metrics["timer_rego_module_compile_ns"]; !ok {
+		t.Fatalf("expected compile timer in metrics, got: %v", res.Metrics)
+	}
+
+	if exp := map[string]int{"upper": 1}; !reflect.DeepEqual(exp, res.BuiltinCalls) {
+		t.Fatalf("expected builtin calls %v but got: %v", exp, res.BuiltinCalls)
+	}
+}
+
+func TestApiEvalWithDataDocuments(t *testing.T) {
+	tests := []struct {
+		note      string
+		documents []opa.DataDocument
+		expCode   int
+		expResult interface{}
+		expErr    string
+	}{
+		{
+			note: "mounted documents",
+			documents: []opa.DataDocument{
+				{Path: "data.users", Value: []interface{}{"alice", "bob"}},
+				{Path: "data.config.limits", Value: 2},
+			},
+			expCode:   http.StatusOK,
+			expResult: true,
+		},
+		{
+			note:      "conflict with rule",
+			documents: []opa.DataDocument{{Path: "data.play.allow", Value: false}},
+			expCode:   http.StatusBadRequest,
+			expErr:    "conflicting rule for data path play/allow found",
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.note, func(t *testing.T) {
+			dr := makeDR("package play\n\nallow if count(data.users) == data.config.limits\n", `data.play.allow`, `{}`, 1)
+			dr.DataDocuments = tc.documents
+
+			body, _ := json.Marshal(dr)
+			w := httptest.NewRecorder()
+			r := httptest.NewRequest("POST", "/v1/data", bytes.NewReader(body))
+			s := NewAPIService("", NewMemoryDataRequestStore(), nil, "./", "", "", "")
+
+			s.handleQuery(w, r)
+
+			if w.Code != tc.expCode {
+				t.Fatalf("expected %v response but got: %v, body: %s", tc.expCode, w.Code, w.Body.String())
+			}
+
+			if tc.expErr != "" {
+				if !strings.Contains(w.Body.String(), tc.expErr) {
+					t.Fatalf("expected error %q but got: %s", tc.expErr, w.Body.String())
+				}
+				return
+			}
+
+			var res DataResponse
+			if err := json.Unmarshal(w.Body.Bytes(), &res); err != nil {
+				t.Fatal(err)
+			}
+
+			result := res.Result.([]interface{})[0].(map[string]interface{})["expressions"].([]interface{})[0].(map[string]interface{})["value"]
+			if result != tc.expResult {
+				t.Fatalf("expected result %v but got: %v", tc.expResult, result)
+			}
+		})
+	}
+}
+
+func TestApiEvalWithInputFormat(t *testing.T) {
+	tests := []struct {
+		note      string
+		input     string
+		expCode   int
+		expResult interface{}
+		expErr    string
+	}{
+		{
+			note:      "yaml",
+			input:     "kind: Pod\nspec:\n  containers:\n    - name: web\n",
+			expCode:   http.StatusOK,
+			expResult: "web",
+		},
+		{
+			note:    "yaml parse error",
+			input:   "kind: Pod\nspec: 1\n  containers: []\n",
+			expCode: http.StatusBadRequest,
+			expErr:  `"file":"input.yaml","row":3`,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.note, func(t *testing.T) {
+			dr := makeDR("package play\n\nname := input.spec.containers[0].name\n", `data.play.name`, "", 1)
+			var input interface{} = tc.input
+			dr.Input, dr.InputFormat = &input, "yaml"
+
+			body, _ := json.Marshal(dr)
+			w := httptest.NewRecorder()
+			r := httptest.NewRequest("POST", "/v1/data", bytes.NewReader(body))
+			s := NewAPIService("", NewMemoryDataRequestStore(), nil, "./", "", "", "")
+
+			s.handleQuery(w, r)
+
+			if w.Code != tc.expCode {
+				t.Fatalf("expected %v response but got: %v, body: %s", tc.expCode, w.Code, w.Body.String())
+			}
+
+			if tc.expErr != "" {
+				if !strings.Contains(w.Body.String(), tc.expErr) {
+					t.Fatalf("expected error %q but got: %s", tc.expErr, w.Body.String())
+				}
+				return
+			}
+
+			var res DataResponse
+			if err := json.Unmarshal(w.Body.Bytes(), &res); err != nil {
+				t.Fatal(err)
+			}
+
+			result := res.Result.([]interface{})[0].(map[string]interface{})["expressions"].([]interface{})[0].(map[string]interface{})["value"]
+			if result != tc.expResult {
+				t.Fatalf("expected result %v but got: %v", tc.expResult, result)
+			}
+		})
+	}
+}
+
+func TestApiEvalConftestMode(t *testing.T) {
+	module := "package main\n\ndeny contains \"no root\" if input.user == \"root\"\n\nwarn contains \"no tag\" if not input.tag\n\nviolation if false\n"
+	dr := makeDR(module, "", `{"user": "root"}`, 1)
+	dr.Mode = "conftest"
+
+	body, _ := json.Marshal(dr)
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("POST", "/v1/data", bytes.NewReader(body))
+	s := NewAPIService("", NewMemoryDataRequestStore(), nil, "./", "", "", "")
+
+	s.handleQuery(w, r)
+
+	if w.Code != 200 {
+		t.Fatalf("expected 200 response but got: %v, body: %s", w.Code, w.Body.String())
+	}
+
+	var res DataResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &res); err != nil {
+		t.Fatal(err)
+	}
+
+	if res.Conftest == nil || res.Conftest.Tests != 3 || res.Conftest.Failures != 1 || res.Conftest.Warnings != 1 {
+		t.Fatalf("expected a conftest summary with 3 tests but got: %+v", res.Conftest)
+	}
+
+	exp := "FAIL - main - deny - no root\nWARN - main - warn - no tag\n\n3 tests, 1 passed, 1 warning, 1 failure, 0 exceptions\n"
+	if res.Pretty != exp {
+		t.Fatalf("expected pretty result:\n%v\ngot:\n%v", exp, res.Pretty)
+	}
+}
+
+func TestApiEvalUnsupportedMode(t *testing.T) {
+	dr := makeDR("package play\n\nallow := true\n", "", "", 1)
+	dr.Mode = "opa-test"
+
+	body, _ := json.Marshal(dr)
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("POST", "/v1/data", bytes.NewReader(body))
+	s := NewAPIService("", NewMemoryDataRequestStore(), nil, "./", "", "", "")
+
+	s.handleQuery(w, r)
+
+	if w.Code != http.StatusBadRequest || !strings.Contains(w.Body.String(), apiCodeInvalidArgument) {
+		t.Fatalf("expected invalid argument response but got: %v, body: %s", w.Code, w.Body.String())
+	}
+}
+
+func TestApiEvalWithFormat(t *testing.T) {
+	dr := makeDR("package play\n\nusers := [{\"name\": \"alice\"}, {\"name\": \"bob\"}]\n", `data.play.users`, "", 1)
+	dr.Format = "csv"
+
+	body, _ := json.Marshal(dr)
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("POST", "/v1/data", bytes.NewReader(body))
+	s := NewAPIService("", NewMemoryDataRequestStore(), nil, "./", "", "", "")
+
+	s.handleQuery(w, r)
+
+	if w.Code != 200 {
+		t.Fatalf("expected 200 response but got: %v, body: %s", w.Code, w.Body.String())
+	}
+
+	var res DataResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &res); err != nil {
+		t.Fatal(err)
+	}
+
+	if exp := "name\nalice\nbob\n"; res.Pretty != exp {
+		t.Fatalf("expected pretty result %q but got: %q", exp, res.Pretty)
+	}
+
+	dr.Format = ""
+	body, _ = json.Marshal(dr)
+	w = httptest.NewRecorder()
+	s.handleQuery(w, httptest.NewRequest("POST", "/v1/data", bytes.NewReader(body)))
+
+	res = DataResponse{}
+	if err := json.Unmarshal(w.Body.Bytes(), &res); err != nil {
+		t.Fatal(err)
+	}
+	if pretty, ok := res.Pretty.(string); !ok || !strings.Contains(pretty, "alice") || strings.Contains(pretty, "name\nalice") {
+		t.Fatalf("expected the pretty result by default but got: %q", res.Pretty)
+	}
+
+	dr.Format = "toml"
+	body, _ = json.Marshal(dr)
+	w = httptest.NewRecorder()
+	s.handleQuery(w, httptest.NewRequest("POST", "/v1/data", bytes.NewReader(body)))
+
+	if w.Code != http.StatusBadRequest || !strings.Contains(w.Body.String(), `unsupported format \"toml\"`) {
+		t.Fatalf("expected unsupported format response but got: %v, body: %s", w.Code, w.Body.String())
+	}
+}
+
+func TestApiCompare(t *testing.T) {
+	store := NewMemoryDataRequestStore()
+	s := NewAPIService("", store, nil, "./", "", "", "")
+
+	key := StoreKey{Id: "head"}
+	head := makeDR("package play\n\nallow if input.role in {\"admin\", \"editor\"}\n", `data.play.allow`, "", 1)
+	if _, err := store.Put(&key, head, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	base := makeDR("package play\n\nallow if input.role == \"admin\"\n", `data.play.allow`, "", 1)
+	body, _ := json.Marshal(CompareRequest{
+		Base: CompareSource{DataRequest: &base},
+		Head: CompareSource{Key: key.Id},
+		Inputs: []interface{}{
+			map[string]interface{}{"role": "admin"},
+			map[string]interface{}{"role": "editor"},
+		},
+	})
+
+	w := httptest.NewRecorder()
+	s.router.ServeHTTP(w, httptest.NewRequest("POST", "/v1/compare", bytes.NewReader(body)))
+
+	if w.Code != 200 {
+		t.Fatalf("expected 200 response but got: %v, body: %s", w.Code, w.Body.String())
+	}
+
+	var res CompareResponse
+	if err := util.UnmarshalJSON(w.Body.Bytes(), &res); err != nil {
+		t.Fatal(err)
+	}
+
+	if res.Result.Summary.Changed != 1 || res.Result.Summary.Unchanged != 1 {
+		t.Fatalf("expected one changed and one unchanged input but got: %+v", res.Result.Summary)
+	}
+
+	if len(res.Result.Changes) != 1 || res.Result.Changes[0].Index != 1 || !reflect.DeepEqual(res.Result.Changes[0].Rules, []string{"data.play.allow"}) {
+		t.Fatalf("expected the editor input to change data.play.allow but got: %+v", res.Result.Changes)
+	}
+
+	tests := []struct {
+		note    string
+		req     CompareRequest
+		expCode int
+		expMsg  string
+	}{
+		{
+			note:    "no inputs",
+			req:     CompareRequest{Base: CompareSource{DataRequest: &base}, Head: CompareSource{Key: key.Id}},
+			expCode: http.StatusBadRequest,
+			expMsg:  "no inputs to compare",
+		},
+		{
+			note:    "no source",
+			req:     CompareRequest{Base: CompareSource{DataRequest: &base}, Inputs: []interface{}{1}},
+			expCode: http.StatusBadRequest,
+			expMsg:  "head: provide either a data request or a share key",
+		},
+		{
+			note:    "unknown share",
+			req:     CompareRequest{Base: CompareSource{Key: "missing"}, Head: CompareSource{Key: key.Id}, Inputs: []interface{}{1}},
+			expCode: http.StatusNotFound,
+			expMsg:  "base: share missing not found",
+		},
+		{
+			note:    "revision of a legacy share",
+			req:     CompareRequest{Base: CompareSource{Key: key.Id, Revision: "abc"}, Head: CompareSource{Key: key.Id}, Inputs: []interface{}{1}},
+			expCode: http.StatusBadRequest,
+			expMsg:  "base: revisions are only supported for published shares",
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.note, func(t *testing.T) {
+			body, _ := json.Marshal(tc.req)
+			w := httptest.NewRecorder()
+			s.router.ServeHTTP(w, httptest.NewRequest("POST", "/v1/compare", bytes.NewReader(body)))
+
+			if w.Code != tc.expCode || !strings.Contains(w.Body.String(), tc.expMsg) {
+				t.Fatalf("expected %v response with %q but got: %v, body: %s", tc.expCode, tc.expMsg, w.Code, w.Body.String())
+			}
+		})
+	}
+
+	w = httptest.NewRecorder()
+	large := `{"inputs": ["` + strings.Repeat("x", int(maxCompareSizeBytes)) + `"]}`
+	s.router.ServeHTTP(w, httptest.NewRequest("POST", "/v1/compare", strings.NewReader(large)))
+	if w.Code != http.StatusBadRequest || !strings.Contains(w.Body.String(), apiCodeFileTooLarge) {
+		t.Fatalf("expected 400 response for a large comparison but got: %v, body: %s", w.Code, w.Body.String())
+	}
+}
+
+func TestApiReplay(t *testing.T) {
+	store := NewMemoryDataRequestStore()
+	s := NewAPIService("", store, nil, "./", "", "", "")
+
+	key := StoreKey{Id: "foo"}
+	dr := makeDR("package play\n\nallow if input.role == data.role\n", `data.play`, `{"role": "viewer"}`, 1, `{"role": "admin"}`)
+	if _, err := store.Put(&key, dr, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	var gz bytes.Buffer
+	zw := gzip.NewWriter(&gz)
+	zw.Write([]byte(`{"decision_id": "a", "path": "play/allow", "input": {"role": "admin"}, "result": true}
+{"decision_id": "b", "path": "play/allow", "input": {"role": "editor"}, "result": true}
+`))
+	zw.Close()
+
+	w := httptest.NewRecorder()
+	s.router.ServeHTTP(w, httptest.NewRequest("POST", "/v1/replay/foo", &gz))
+
+	if w.Code != 200 {
+		t.Fatalf("expected 200 response but got: %v, body: %s", w.Code, w.Body.String())
+	}
+
+	var res ReplayResponse
+	if err := util.UnmarshalJSON(w.Body.Bytes(), &res); err != nil {
+		t.Fatal(err)
+	}
+
+	if res.Result.Summary.Changed != 1 || res.Result.Summary.Unchanged != 1 {
+		t.Fatalf("expected one changed and one unchanged decision but got: %+v", res.Result.Summary)
+	}
+
+	if len(res.Result.Changes) != 1 || res.Result.Changes[0].DecisionID != "b" {
+		t.Fatalf("expected decision b to change but got: %+v", res.Result.Changes)
+	}
+
+	w = httptest.NewRecorder()
+	s.router.ServeHTTP(w, httptest.NewRequest("POST", "/v1/replay/foo", strings.NewReader("{\n")))
+
+	if w.Code != http.StatusBadRequest || !strings.Contains(w.Body.String(), "line 1: ") {
+		t.Fatalf("expected 400 response for invalid decision log but got: %v, body: %s", w.Code, w.Body.String())
+	}
+
+	w = httptest.NewRecorder()
+	s.router.ServeHTTP(w, httptest.NewRequest("POST", "/v1/replay/bar", strings.NewReader("")))
+
+	if w.Code != http.StatusNotFound {
+		t.Fatalf("expected 404 response for unknown share but got: %v, body: %s", w.Code, w.Body.String())
+	}
+}
+
+func TestApiGenerateInputs(t *testing.T) {
+	s := NewAPIService("", NewMemoryDataRequestStore(), nil, "./", "", "", "")
+
+	dr := makeDR("package play\n\nallow if input.role == data.admin\n", "", "", 1, `{"admin": "root"}`)
+	seed := int64(1)
+	body, _ := json.Marshal(GenerateInputsRequest{
+		DataRequest: dr,
+		Rule:        "data.play.allow",
+		Schema: map[string]interface{}{
+			"type":       "object",
+			"required":   []string{"role"},
+			"properties": map[string]interface{}{"role": map[string]interface{}{"enum": []string{"user", "root"}}},
+		},
+		Seed:   &seed,
+		Random: 10,
+	})
+
+	w := httptest.NewRecorder()
+	s.router.ServeHTTP(w, httptest.NewRequest("POST", "/v1/inputs/generate", bytes.NewReader(body)))
+
+	if w.Code != 200 {
+		t.Fatalf("expected 200 response but got: %v, body: %s", w.Code, w.Body.String())
+	}
+
+	var res GenerateInputsResponse
+	if err := util.UnmarshalJSON(w.Body.Bytes(), &res); err != nil {
+		t.Fatal(err)
+	}
+
+	var outcomes []string
+	for _, o := range res.Result.Outcomes {
+		outcomes = append(outcomes, o.Outcome)
+	}
+
+	if !reflect.DeepEqual(outcomes, []string{"true", "undefined"}) || res.Result.Seed != 1 {
+		t.Fatalf("expected true and undefined outcomes but got: %+v", res.Result)
+	}
+
+	if exp := map[string]interface{}{"role": "root"}; !reflect.DeepEqual(res.Result.Outcomes[0].Input, exp) {
+		t.Fatalf("expected input %v for the true outcome but got: %v", exp, res.Result.Outcomes[0].Input)
+	}
+
+	body, _ = json.Marshal(GenerateInputsRequest{DataRequest: dr, Rule: "input.role", Schema: true})
+	w = httptest.NewRecorder()
+	s.router.ServeHTTP(w, httptest.NewRequest("POST", "/v1/inputs/generate", bytes.NewReader(body)))
+
+	if w.Code != http.StatusBadRequest || !strings.Contains(w.Body.String(), "rule must be a reference to a rule under data") {
+		t.Fatalf("expected 400 response for an invalid rule but got: %v, body: %s", w.Code, w.Body.String())
+	}
+}
+
+func TestApiTestGenerate(t *testing.T) {
+	s := NewAPIService("", NewMemoryDataRequestStore(), nil, "./", "", "", "")
+
+	dr := makeDR("package play\n\nallow if input.role == data.admin\n", "data.play.allow", `{"role": "root"}`, 1, `{"admin": "root"}`)
+	body, _ := json.Marshal(dr)
+
+	w := httptest.NewRecorder()
+	s.router.ServeHTTP(w, httptest.NewRequest("POST", "/v1/test/generate", bytes.NewReader(body)))
+
+	if w.Code != 200 {
+		t.Fatalf("expected 200 response but got: %v, body: %s", w.Code, w.Body.String())
+	}
+
+	var res TestGenerateResponse
+	if err := util.UnmarshalJSON(w.Body.Bytes(), &res); err != nil {
+		t.Fatal(err)
+	}
+
+	exp := `package play_test
+
+test_allow if {
+	data.play.allow with input as {"role": "root"} with data.admin as "root"
+}
+`
+	if res.Result != exp || res.RegoVersion == nil || *res.RegoVersion != 1 {
+		t.Fatalf("expected:\n%s\ngot:\n%s", exp, res.Result)
+	}
+
+	body, _ = json.Marshal(makeDR("package play\n\nallow := true\n", "input.role", "", 1))
+	w = httptest.NewRecorder()
+	s.router.ServeHTTP(w, httptest.NewRequest("POST", "/v1/test/generate", bytes.NewReader(body)))
+
+	if w.Code != http.StatusBadRequest || !strings.Contains(w.Body.String(), "query does not refer to any rules") {
+		t.Fatalf("expected 400 response for a query without rules but got: %v, body: %s", w.Code, w.Body.String())
+	}
+}
+
+func TestApiDistributeOwnerToken(t *testing.T) {
+	store := NewMemoryDataRequestStore()
+	s := NewAPIService("", store, nil, "./", "", "", "")
+
+	do := func(method, path, token string, body interface{}) *httptest.ResponseRecorder {
+		t.Helper()
+		bs, _ := json.Marshal(body)
+		r := httptest.NewRequest(method, path, bytes.NewReader(bs))
+		if token != "" {
+			r.Header.Set(ownerTokenHeader, token)
+		}
+		w := httptest.NewRecorder()
+		s.router.ServeHTTP(w, r)
+		return w
+	}
+
+	dr := makeDR("package play\n\nallow := true\n", "", "", 1)
+
+	w := do("POST", "/v1/distribute", "", dr)
+	if w.Code != 200 {
+		t.Fatalf("expected 200 response but got: %v, body: %s", w.Code, w.Body.String())
+	}
+
+	var created DistributeResponse
+	if err := util.UnmarshalJSON(w.Body.Bytes(), &created); err != nil {
+		t.Fatal(err)
+	}
+
+	id := created.Result[strings.LastIndex(created.Result, "/")+1:]
+	path := "/v1/distribute/" + id
+	token := created.OwnerToken
+
+	stored, _, _ := store.Get(&StoreKey{Id: id}, nil)
+	if token == "" || stored.OwnerTokenHash != hashOwnerToken(token) {
+		t.Fatalf("expected the hash of the owner token %q to be stored, got: %q", token, stored.OwnerTokenHash)
+	}
+
+	update := dr
+	update.OwnerTokenHash = hashOwnerToken("mine")
+
+	for _, tc := range []struct {
+		token string
+		code  int
+	}{
+		{"", http.StatusUnauthorized},
+		{"wrong", http.StatusForbidden},
+		{token, http.StatusOK},
+	} {
+		if w := do("PUT", path, tc.token, update); w.Code != tc.code {
+			t.Fatalf("expected %d response with token %q but got: %v, body: %s", tc.code, tc.token, w.Code, w.Body.String())
+		}
+	}
+
+	stored, _, _ = store.Get(&StoreKey{Id: id}, nil)
+	if stored.OwnerTokenHash != hashOwnerToken(token) {
+		t.Fatal("expected an update not to change the owner token")
+	}
+
+	// Rotation
+	w = do("POST", path+"/token", token, nil)
+	if w.Code != 200 {
+		t.Fatalf("expected 200 response but got: %v, body: %s", w.Code, w.Body.String())
+	}
+
+	var rotated DistributeResponse
+	if err := util.UnmarshalJSON(w.Body.Bytes(), &rotated); err != nil {
+		t.Fatal(err)
+	}
+
+	if w := do("PUT", path, token, dr); w.Code != http.StatusForbidden {
+		t.Fatalf("expected 403 response with the rotated token but got: %v", w.Code)
 	}
 
-	if !reflect.DeepEqual(res.Result[0].Expressions[0].Value, exp) {
-		t.Fatalf("unexpected result for policy containing opa.runtime() call: %v", res.Result[0].Expressions[0].Value)
+	// Transfer
+	if w := do("PUT", path+"/owner", rotated.OwnerToken, DistributeOwnerRequest{OwnerTokenHash: "abc"}); w.Code != http.StatusBadRequest {
+		t.Fatalf("expected 400 response for an invalid hash but got: %v", w.Code)
 	}
-}
 
-func TestApiEvalOPARuntimeInQuery(t *testing.T) {
-	dr := makeDR(`
-		package test
-		p = true`, `p; x := opa.runtime()`, `{}`, 0)
-	body, _ := json.Marshal(dr)
-	w := httptest.NewRecorder()
-	r := httptest.NewRequest("POST", "/v1/data", bytes.NewReader(body)) // These values don't matter
-	s := NewAPIService("", NewMemoryDataRequestStore(), nil, "./", "", "", "")
+	if w := do("PUT", path+"/owner", rotated.OwnerToken, DistributeOwnerRequest{OwnerTokenHash: hashOwnerToken("theirs")}); w.Code != 200 {
+		t.Fatalf("expected 200 response but got: %v, body: %s", w.Code, w.Body.String())
+	}
 
-	s.handleQuery(w, r)
+	if w := do("PUT", path, rotated.OwnerToken, dr); w.Code != http.StatusForbidden {
+		t.Fatalf("expected 403 response with the previous owner's token but got: %v", w.Code)
+	}
 
-	if w.Code != 200 {
-		t.Fatalf("expected 200 response but got: %v", w.Code)
+	if w := do("PUT", path, "theirs", dr); w.Code != 200 {
+		t.Fatalf("expected 200 response with the new owner's token but got: %v, body: %s", w.Code, w.Body.String())
 	}
 
-	var res struct {
-		Result rego.ResultSet `json:"result"`
+	// Deletion
+	if w := do("DELETE", path, "", nil); w.Code != http.StatusUnauthorized {
+		t.Fatalf("expected 401 response but got: %v", w.Code)
 	}
-	if err := json.Unmarshal(w.Body.Bytes(), &res); err != nil {
-		t.Fatal(err)
+
+	if w := do("DELETE", path, "theirs", nil); w.Code != http.StatusNoContent {
+		t.Fatalf("expected 204 response but got: %v, body: %s", w.Code, w.Body.String())
 	}
 
-	exp := map[string]interface{}{
-		"message": "The Rego Playground does not provide OPA runtime information during policy execution.",
+	if _, found, _ := store.Get(&StoreKey{Id: id}, nil); found {
+		t.Fatal("expected the distribution to be deleted")
 	}
 
-	if !reflect.DeepEqual(res.Result[0].Bindings["x"], exp) {
-		t.Fatalf("unexpected result for policy containing opa.runtime() call: %v", res.Result[0].Bindings["x"])
+	if w := do("GET", "/bundles/"+id, "", nil); w.Code != http.StatusNotFound {
+		t.Fatalf("expected 404 response for the deleted bundle but got: %v", w.Code)
 	}
 }
 
-func TestApiEvalUnsafeBuiltins(t *testing.T) {
-	tests := []struct {
-		note string
-		dr   DataRequest
-	}{
-		{
-			note: "in policy",
-			dr: makeDR(`
-package test
-p {
-	http.send({"method": "get", "url": "https://httpbin.org"})
-}`,
-				"p", "{}", 0),
-		},
-		{
-			note: "in policy, 'with'",
-			dr: makeDR(`
-package test
-p {
-	is_object({"method": "get", "url": "https://httpbin.org"}) with is_object as http.send
-}`,
-				"p", "{}", 0),
-		},
-		{
-			note: "in query",
-			dr: makeDR(`
-package test
-p = true
-`,
-				`p; http.send({"method": "get", "url": "https://httpbin.org"})`, "{}", 0),
-		},
-		{
-			note: "in query, 'with'",
-			dr: makeDR(`
-package test
-p = true
-`,
-				`p; is_object({"method": "get", "url": "https://httpbin.org"}) with is_object as http.send`, "{}", 0),
-		},
+func TestApiDistributeReadOnlyAndLegacy(t *testing.T) {
+	store := NewMemoryDataRequestStore()
+	s := NewAPIService("", store, nil, "./", "", "", "")
+
+	shared := makeDR("package play\n\nallow := true\n", "", "", 1)
+	shared.ReadOnly = true
+	store.Put(&StoreKey{Id: "shared"}, shared, nil)
+
+	legacy := makeDR("package play\n\nallow := true\n", "", "", 1)
+	store.Put(&StoreKey{Id: "legacy"}, legacy, nil)
+
+	body, _ := json.Marshal(makeDR("package play\n\nallow := false\n", "", "", 1))
+
+	w := httptest.NewRecorder()
+	s.router.ServeHTTP(w, httptest.NewRequest("PUT", "/v1/distribute/shared", bytes.NewReader(body)))
+
+	if w.Code != http.StatusForbidden {
+		t.Fatalf("expected 403 response but got: %v, body: %s", w.Code, w.Body.String())
 	}
 
-	for _, tc := range tests {
-		t.Run(tc.note, func(t *testing.T) {
-			body, err := json.Marshal(tc.dr)
-			if err != nil {
-				t.Fatal(err)
-			}
-			w := httptest.NewRecorder()
-			r := httptest.NewRequest("POST", "/v1/data", bytes.NewReader(body)) // These values don't matter
-			s := NewAPIService("", NewMemoryDataRequestStore(), nil, "./", "", "", "")
+	if dr, _, _ := store.Get(&StoreKey{Id: "shared"}, nil); !reflect.DeepEqual(dr.RegoModules, shared.RegoModules) {
+		t.Fatalf("expected read-only share to be unchanged, got: %+v", dr)
+	}
 
-			s.handleQuery(w, r)
+	do := func(method, path, token string, body []byte) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(method, path, bytes.NewReader(body))
+		if token != "" {
+			r.Header.Set(ownerTokenHeader, token)
+		}
+		if strings.HasPrefix(path, "/admin/") {
+			r.Header.Set("Authorization", "Bearer secret")
+		}
+		w := httptest.NewRecorder()
+		s.router.ServeHTTP(w, r)
+		return w
+	}
 
-			if w.Code != 400 {
-				t.Fatalf("expected 400 response but got: %v", w.Code)
-			}
-		})
+	// Distributions created before owner tokens can be updated without one,
+	// as before, but not deleted or claimed.
+	if w := do("PUT", "/v1/distribute/legacy", "", body); w.Code != http.StatusOK {
+		t.Fatalf("expected 200 response but got: %v, body: %s", w.Code, w.Body.String())
 	}
-}
 
-func TestApiEvalWithCoverage(t *testing.T) {
-	dr := makeDR("package test\ndefault allow = false\nallow { input.foo = 1 }", `allow`, `{"foo": 1}`, 0)
-	dr.Coverage = true
-	body, _ := json.Marshal(dr)
-	w := httptest.NewRecorder()
-	r := httptest.NewRequest("POST", "/v1/data", bytes.NewReader(body)) // These values don't matter
-	s := NewAPIService("", NewMemoryDataRequestStore(), nil, "./", "", "", "")
+	claim, _ := json.Marshal(DistributeOwnerRequest{OwnerTokenHash: hashOwnerToken("mine")})
 
-	s.doHandleQuery(w, r)
+	for _, req := range []struct {
+		method, path string
+		body         []byte
+	}{
+		{"DELETE", "/v1/distribute/legacy", nil},
+		{"POST", "/v1/distribute/legacy/token", nil},
+		{"PUT", "/v1/distribute/legacy/owner", claim},
+	} {
+		if w := do(req.method, req.path, "", req.body); w.Code != http.StatusForbidden {
+			t.Fatalf("expected 403 response for %v %v but got: %v, body: %s", req.method, req.path, w.Code, w.Body.String())
+		}
+	}
 
-	if w.Code != 200 {
-		t.Fatalf("expected 200 response but got: %v", w.Code)
+	if dr, found, _ := store.Get(&StoreKey{Id: "legacy"}, nil); !found || dr.OwnerTokenHash != "" {
+		t.Fatalf("expected the legacy distribution to be kept without owner, got: %+v", dr)
 	}
 
-	var res DataResponse
-	json.Unmarshal(w.Body.Bytes(), &res)
+	// An admin assigns the owner, who can then delete it.
+	s.EnableAdmin("secret", io.Discard)
 
-	if res.Coverage == nil {
-		t.Fatal("expected coverage to be set")
+	if w := do("PUT", "/admin/v1/shares/legacy/owner", "", claim); w.Code != http.StatusNoContent {
+		t.Fatalf("expected 204 response but got: %v, body: %s", w.Code, w.Body.String())
 	}
-}
 
-func TestApiLint(t *testing.T) {
-	lr := LintRequest{
-		RegoModule: "package test\nimport rego.v1\nthing = 1\n",
+	if w := do("PUT", "/v1/distribute/legacy", "", body); w.Code != http.StatusUnauthorized {
+		t.Fatalf("expected 401 response without the owner token but got: %v", w.Code)
 	}
 
-	body, _ := json.Marshal(lr)
+	if w := do("DELETE", "/v1/distribute/legacy", "mine", nil); w.Code != http.StatusNoContent {
+		t.Fatalf("expected 204 response but got: %v, body: %s", w.Code, w.Body.String())
+	}
+}
+
+func TestApiBuild(t *testing.T) {
+	dr := makeDR("package play\n\nallow if input.x == 1\n", ``, `{"x": 1}`, 1)
+	dr.Target = "wasm"
+	dr.Entrypoints = []string{"play/allow"}
+
+	body, _ := json.Marshal(dr)
 	w := httptest.NewRecorder()
-	r := httptest.NewRequest("POST", "/v1/lint", bytes.NewReader(body)) // These values don't matter
+	r := httptest.NewRequest("POST", "/v1/build", bytes.NewReader(body))
 	s := NewAPIService("", NewMemoryDataRequestStore(), nil, "./", "", "", "")
 
-	s.handleLint(w, r)
+	s.router.ServeHTTP(w, r)
 
 	if w.Code != 200 {
-		bs, err := io.ReadAll(w.Body)
-		if err != nil {
-			t.Fatalf("failed to read response body: %s", err)
-		}
-
-		t.Fatalf("expected 200 response but got: %v, body: %s", w.Code, string(bs))
+		t.Fatalf("expected 200 response but got: %v, body: %s", w.Code, w.Body.String())
 	}
 
-	var res LintResponse
-	err := json.Unmarshal(w.Body.Bytes(), &res)
-	if err != nil {
-		t.Fatalf("failed to unmarshal response: %s", err)
+	var res BuildResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &res); err != nil {
+		t.Fatal(err)
 	}
 
-	if res.Report == nil {
-		t.Fatal("expected lint report to be set")
+	if !bytes.HasPrefix(res.Result.Wasm, []byte("\x00asm")) {
+		t.Fatal("expected a wasm module in response")
 	}
 
-	if len(res.Report.Violations) != 2 {
-		t.Fatal("expected 2 violations in response but got:", len(res.Report.Violations))
+	if len(res.Result.Evaluations) != 1 || res.Result.Evaluations[0].Topdown != true {
+		t.Fatalf("expected topdown evaluation of play/allow, got: %+v", res.Result.Evaluations)
 	}
 
-	expectedViolations := []string{"use-assignment-operator", "opa-fmt"}
-	for _, expected := range expectedViolations {
-		found := false
-		for _, violation := range res.Report.Violations {
-			if violation.Title == expected {
-				found = true
-				break
-			}
-		}
-		if !found {
-			t.Errorf("expected violation %s but not found", expected)
-		}
+	dr.Target = "js"
+	body, _ = json.Marshal(dr)
+	w = httptest.NewRecorder()
+	s.router.ServeHTTP(w, httptest.NewRequest("POST", "/v1/build", bytes.NewReader(body)))
+
+	if w.Code != http.StatusBadRequest {
+		t.Fatalf("expected 400 response for unsupported target but got: %v", w.Code)
 	}
 }
 
-func TestApiLintErrors(t *testing.T) {
-	lr := LintRequest{
-		RegoModule: "package test\npackage foobar\n",
+func TestApiComplete(t *testing.T) {
+	cr := CompleteRequest{
+		RegoModules: map[string]interface{}{
+			"play/play.rego": "package play\n\nallow if input.user.\n",
+			"play/lib.rego":  "package lib\n\nadmins := {\"alice\"}\n",
+		},
+		RegoModule: "play/play.rego",
+		Position:   Position{Row: 3, Col: 21},
 	}
+	util.UnmarshalJSON([]byte(`{"user": {"name": "alice", "roles": ["admin"]}}`), &cr.Input)
 
-	body, _ := json.Marshal(lr)
+	body, _ := json.Marshal(cr)
 	w := httptest.NewRecorder()
-	r := httptest.NewRequest("POST", "/v1/lint", bytes.NewReader(body)) // These values don't matter
+	r := httptest.NewRequest("POST", "/v1/complete", bytes.NewReader(body))
 	s := NewAPIService("", NewMemoryDataRequestStore(), nil, "./", "", "", "")
 
-	s.handleLint(w, r)
+	s.router.ServeHTTP(w, r)
 
 	if w.Code != 200 {
-		bs, err := io.ReadAll(w.Body)
-		if err != nil {
-			t.Fatalf("failed to read response body: %s", err)
-		}
+		t.Fatalf("expected 200 response but got: %v, body: %s", w.Code, w.Body.String())
+	}
 
-		t.Fatalf("expected 200 response but got: %v, body: %s", w.Code, string(bs))
+	var res CompleteResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &res); err != nil {
+		t.Fatal(err)
 	}
 
-	var res LintResponse
-	err := json.Unmarshal(w.Body.Bytes(), &res)
-	if err != nil {
-		t.Fatalf("failed to unmarshal response: %s", err)
+	if exp, act := "input.user.", res.Token; exp != act {
+		t.Fatalf("expected token %q, got %q", exp, act)
 	}
 
-	if len(res.Errors) != 1 {
-		t.Fatal("expected 1 errors in response but got:", len(res.Errors))
+	if len(res.Result) != 2 || res.Result[0].Label != "input.user.name" || res.Result[1].Label != "input.user.roles" {
+		t.Fatalf("unexpected completions: %+v", res.Result)
 	}
 
-	astError := res.Errors[0]
-	if exp, got := "rego_parse_error", astError.Code; exp != got {
-		t.Fatalf("expected error code %v but got: %v", exp, got)
+	// the module must be named when there is more than one
+	cr.RegoModule = ""
+	body, _ = json.Marshal(cr)
+	w = httptest.NewRecorder()
+	r = httptest.NewRequest("POST", "/v1/complete", bytes.NewReader(body))
+	s.router.ServeHTTP(w, r)
+
+	if w.Code != http.StatusBadRequest {
+		t.Fatalf("expected 400 response but got: %v", w.Code)
 	}
 }
 
@@ -1130,7 +2178,7 @@ func TestDoHandleRetrieveBundleRegularPoll(t *testing.T) {
 
 	// no bundle
 	w := httptest.NewRecorder()
-	s.doHandleRetrieveBundle(w, &key, "", 0, []string{}, nil)
+	s.doHandleRetrieveBundle(context.Background(), w, &key, "", 0, []string{}, nil)
 
 	if w.Code != http.StatusNotFound {
 		t.Fatalf("Expected status code %v, but got %v", http.StatusNotFound, w.Code)
@@ -1144,7 +2192,7 @@ func TestDoHandleRetrieveBundleRegularPoll(t *testing.T) {
 
 	// unmodified bundle
 	w = httptest.NewRecorder()
-	s.doHandleRetrieveBundle(w, &key, key.Id, 0, []string{}, nil)
+	s.doHandleRetrieveBundle(context.Background(), w, &key, key.Id, 0, []string{}, nil)
 
 	if w.Code != http.StatusNotModified {
 		t.Fatalf("Expected status code %v, but got %v", http.StatusNotModified, w.Code)
@@ -1152,7 +2200,7 @@ func TestDoHandleRetrieveBundleRegularPoll(t *testing.T) {
 
 	// new snapshot bundle available
 	w = httptest.NewRecorder()
-	s.doHandleRetrieveBundle(w, &key, "", 0, []string{}, nil)
+	s.doHandleRetrieveBundle(context.Background(), w, &key, "", 0, []string{}, nil)
 
 	if w.Code != http.StatusOK {
 		t.Fatalf("Expected status code %v, but got %v", http.StatusOK, w.Code)
@@ -1182,7 +2230,7 @@ func TestDoHandleRetrieveBundleRegularPoll(t *testing.T) {
 	}
 
 	w = httptest.NewRecorder()
-	s.doHandleRetrieveBundle(w, &key, "bar", 0, []string{deltaBundleMode}, nil)
+	s.doHandleRetrieveBundle(context.Background(), w, &key, "bar", 0, []string{deltaBundleMode}, nil)
 
 	if w.Code != http.StatusOK {
 		t.Fatalf("Expected status code %v, but got %v", http.StatusOK, w.Code)
@@ -1203,6 +2251,45 @@ func TestDoHandleRetrieveBundleRegularPoll(t *testing.T) {
 	}
 }
 
+func TestDoHandleRetrieveBundleWithDataDocuments(t *testing.T) {
+	dr := makeDR("package test\n\np { data.config.limits.max > 1 }", `p`, `{}`, 0, `{"foo": "bar"}`)
+	dr.DataDocuments = []opa.DataDocument{
+		{Path: "data.users", Value: []interface{}{"alice"}},
+		{Path: "data.config.limits", Value: map[string]interface{}{"max": 2}},
+	}
+	dr.Etag = "foo"
+
+	store := NewMemoryDataRequestStore()
+	s := NewAPIService("", store, nil, "./", "", "", "")
+	key := StoreKey{Id: "foo"}
+
+	if _, err := store.Put(&key, dr, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	w := httptest.NewRecorder()
+	s.doHandleRetrieveBundle(context.Background(), w, &key, "", 0, []string{}, nil)
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected status code %v, but got %v", http.StatusOK, w.Code)
+	}
+
+	loader := bundle.NewTarballLoaderWithBaseURL(w.Body, "")
+	b, err := bundle.NewCustomReader(loader).Read()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	exp := map[string]interface{}{
+		"foo":    "bar",
+		"users":  []interface{}{"alice"},
+		"config": map[string]interface{}{"limits": map[string]interface{}{"max": json.Number("2")}},
+	}
+	if !reflect.DeepEqual(exp, b.Data) {
+		t.Fatalf("Expected bundle data %v, but got %v", exp, b.Data)
+	}
+}
+
 func TestDoHandleRetrieveBundleLongPoll(t *testing.T) {
 	dr := makeDR(`
 		package test
@@ -1223,7 +2310,7 @@ func TestDoHandleRetrieveBundleLongPoll(t *testing.T) {
 	}
 
 	w := httptest.NewRecorder()
-	s.doHandleRetrieveBundle(w, &key, "bar", 1*time.Second, []string{}, nil)
+	s.doHandleRetrieveBundle(context.Background(), w, &key, "bar", 1*time.Second, []string{}, nil)
 
 	if w.Code != http.StatusOK {
 		t.Fatalf("Expected status code %v, but got %v", http.StatusOK, w.Code)
@@ -1236,6 +2323,128 @@ func TestDoHandleRetrieveBundleLongPoll(t *testing.T) {
 	}
 }
 
+func TestApiBundleLongPollDeleted(t *testing.T) {
+	store := NewMemoryDataRequestStore()
+	s := NewAPIService("", store, nil, "./", "", "", "")
+
+	key := StoreKey{Id: "foo"}
+	dr := makeDR("package test\n\np := 1\n", "", "", 1)
+	dr.Etag = "bar"
+	if _, err := store.Put(&key, dr, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	polled := make(chan *httptest.ResponseRecorder, 1)
+	go func() {
+		r := httptest.NewRequest("GET", "/bundles/foo", nil)
+		r.Header.Set("If-None-Match", "bar")
+		r.Header.Set("Prefer", "wait=60")
+		w := httptest.NewRecorder()
+		s.router.ServeHTTP(w, r)
+		polled <- w
+	}()
+
+	for i := 0; ; i++ {
+		store.mu.Lock()
+		_, watching := store.watchers[key.Id]
+		store.mu.Unlock()
+		if watching {
+			break
+		}
+		if i == 100 {
+			t.Fatal("expected the long-poll to watch the bundle")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if err := store.Delete(&key, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case w := <-polled:
+		if w.Code != http.StatusNotFound {
+			t.Fatalf("expected 404 response to the long-poll but got: %v, body: %s", w.Code, w.Body.String())
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected the long-poll to end when the bundle was deleted")
+	}
+}
+
+func TestApiGracefulShutdown(t *testing.T) {
+	store := NewMemoryDataRequestStore()
+	s := NewAPIService("127.0.0.1:0", store, nil, "./", "", "", "")
+
+	key := StoreKey{Id: "foo"}
+	dr := makeDR("package test\n\np := 1\n", "", "", 1)
+	dr.Etag = "bar"
+	if _, err := store.Put(&key, dr, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := s.Start(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	base := "http://" + s.addr
+
+	if resp, err := http.Get(base + "/v1/system/ready"); err != nil || resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected the server to be ready, got: %v, %v", resp, err)
+	}
+
+	// A long-poll that would outlast the shutdown.
+	polled := make(chan int, 1)
+	go func() {
+		req, _ := http.NewRequest("GET", base+"/bundles/foo", nil)
+		req.Header.Set("If-None-Match", "bar")
+		req.Header.Set("Prefer", "wait=60")
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			polled <- 0
+			return
+		}
+		resp.Body.Close()
+		polled <- resp.StatusCode
+	}()
+
+	for i := 0; ; i++ {
+		store.mu.Lock()
+		_, watching := store.watchers[key.Id]
+		store.mu.Unlock()
+		if watching {
+			break
+		}
+		if i == 100 {
+			t.Fatal("expected the long-poll to watch the bundle")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	s.Drain()
+
+	if resp, err := http.Get(base + "/v1/system/ready"); err != nil || resp.StatusCode != http.StatusServiceUnavailable {
+		t.Fatalf("expected the draining server not to be ready, got: %v, %v", resp, err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	start := time.Now()
+	s.Stop(ctx)
+
+	if d := time.Since(start); d > 2*time.Second {
+		t.Fatalf("expected the long-poll to end on shutdown, but stopping took %v", d)
+	}
+
+	if code := <-polled; code != http.StatusNotModified {
+		t.Fatalf("expected 304 response to the long-poll but got: %v", code)
+	}
+
+	if _, err := http.Get(base + "/v1/system/alive"); err == nil {
+		t.Fatal("expected the server to be stopped")
+	}
+}
+
 func TestDoHandleUpdateDistributeWithPatch(t *testing.T) {
 	key := StoreKey{Id: "foo"}
 
@@ -0,0 +1,185 @@
+package api
+
+import (
+	"fmt"
+	"strings"
+)
+
+const (
+	// diffContextLines is the number of unchanged lines shown around changes.
+	diffContextLines = 3
+
+	// maxDiffCells is the size of the largest table of common subsequences
+	// computed, which bounds the memory of a diff. Beyond it, the lines
+	// between the common prefix and suffix are replaced as a whole.
+	maxDiffCells = 1 << 22
+)
+
+type diffOp struct {
+	kind byte // ' ', '-' or '+'
+	line string
+}
+
+// unifiedDiff returns the unified diff between the old and new contents of
+// the named file, or an empty string if they are equal.
+func unifiedDiff(name, old, new string) string {
+	if old == new {
+		return ""
+	}
+
+	ops := diffLines(splitLines(old), splitLines(new))
+
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "--- a/%s\n+++ b/%s\n", name, name)
+
+	// oldPos and newPos hold the number of old and new lines preceding each op.
+	oldPos := make([]int, len(ops)+1)
+	newPos := make([]int, len(ops)+1)
+	for i, op := range ops {
+		oldPos[i+1], newPos[i+1] = oldPos[i], newPos[i]
+		if op.kind != '+' {
+			oldPos[i+1]++
+		}
+		if op.kind != '-' {
+			newPos[i+1]++
+		}
+	}
+
+	for _, h := range diffHunks(ops) {
+		start, end := h[0], h[1]
+		fmt.Fprintf(&sb, "@@ -%s +%s @@\n",
+			hunkRange(oldPos[start], oldPos[end]-oldPos[start]),
+			hunkRange(newPos[start], newPos[end]-newPos[start]))
+
+		for _, op := range ops[start:end] {
+			sb.WriteByte(op.kind)
+			sb.WriteString(op.line)
+			if !strings.HasSuffix(op.line, "\n") {
+				sb.WriteString("\n\\ No newline at end of file\n")
+			}
+		}
+	}
+
+	return sb.String()
+}
+
+// splitLines splits s into lines, keeping the line endings so that a missing
+// newline at the end of the file shows up as a change.
+func splitLines(s string) []string {
+	lines := strings.SplitAfter(s, "\n")
+	if lines[len(lines)-1] == "" {
+		lines = lines[:len(lines)-1]
+	}
+	return lines
+}
+
+// diffLines computes an edit script from a to b based on their longest common
+// subsequence. Common prefixes and suffixes are trimmed first, which keeps the
+// quadratic part small for the typical edit. If the rest is larger than
+// maxDiffCells, all of it is removed and added instead.
+func diffLines(a, b []string) []diffOp {
+	var prefix, suffix int
+	for prefix < len(a) && prefix < len(b) && a[prefix] == b[prefix] {
+		prefix++
+	}
+	for suffix < len(a)-prefix && suffix < len(b)-prefix && a[len(a)-1-suffix] == b[len(b)-1-suffix] {
+		suffix++
+	}
+
+	ops := make([]diffOp, 0, len(a)+len(b))
+	for _, l := range a[:prefix] {
+		ops = append(ops, diffOp{' ', l})
+	}
+
+	x, y := a[prefix:len(a)-suffix], b[prefix:len(b)-suffix]
+
+	if (len(x)+1)*(len(y)+1) > maxDiffCells {
+		for _, l := range x {
+			ops = append(ops, diffOp{'-', l})
+		}
+		for _, l := range y {
+			ops = append(ops, diffOp{'+', l})
+		}
+		for _, l := range a[len(a)-suffix:] {
+			ops = append(ops, diffOp{' ', l})
+		}
+		return ops
+	}
+
+	// lcs[i][j] is the length of the longest common subsequence of x[i:] and y[j:].
+	lcs := make([][]int, len(x)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(y)+1)
+	}
+	for i := len(x) - 1; i >= 0; i-- {
+		for j := len(y) - 1; j >= 0; j-- {
+			if x[i] == y[j] {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else {
+				lcs[i][j] = max(lcs[i+1][j], lcs[i][j+1])
+			}
+		}
+	}
+
+	i, j := 0, 0
+	for i < len(x) || j < len(y) {
+		switch {
+		case i < len(x) && j < len(y) && x[i] == y[j]:
+			ops = append(ops, diffOp{' ', x[i]})
+			i++
+			j++
+		case j == len(y) || (i < len(x) && lcs[i+1][j] >= lcs[i][j+1]):
+			ops = append(ops, diffOp{'-', x[i]})
+			i++
+		default:
+			ops = append(ops, diffOp{'+', y[j]})
+			j++
+		}
+	}
+
+	for _, l := range a[len(a)-suffix:] {
+		ops = append(ops, diffOp{' ', l})
+	}
+
+	return ops
+}
+
+// diffHunks groups the changes in ops into [start, end) ranges including
+// their context. Changes separated by no more than twice the context lines
+// are merged into a single hunk.
+func diffHunks(ops []diffOp) [][2]int {
+	var hunks [][2]int
+	last := -1
+
+	for k, op := range ops {
+		if op.kind == ' ' {
+			continue
+		}
+		if last >= 0 && k-last-1 > 2*diffContextLines {
+			hunks[len(hunks)-1][1] = last + diffContextLines + 1
+			last = -1
+		}
+		if last < 0 {
+			hunks = append(hunks, [2]int{max(k-diffContextLines, 0), 0})
+		}
+		last = k
+	}
+
+	if last >= 0 {
+		hunks[len(hunks)-1][1] = min(last+diffContextLines+1, len(ops))
+	}
+
+	return hunks
+}
+
+// hunkRange formats a hunk range given the number of lines preceding it.
+func hunkRange(before, count int) string {
+	switch count {
+	case 0:
+		return fmt.Sprintf("%d,0", before)
+	case 1:
+		return fmt.Sprintf("%d", before+1)
+	default:
+		return fmt.Sprintf("%d,%d", before+1, count)
+	}
+}
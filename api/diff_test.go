@@ -0,0 +1,92 @@
+package api
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestUnifiedDiff(t *testing.T) {
+	lines := func(from, to int) string {
+		var sb strings.Builder
+		for i := from; i <= to; i++ {
+			sb.WriteString("line ")
+			sb.WriteString(string(rune('a' + i - 1)))
+			sb.WriteString("\n")
+		}
+		return sb.String()
+	}
+
+	tests := []struct {
+		note     string
+		old, new string
+		exp      string
+	}{
+		{
+			note: "equal",
+			old:  "a\n",
+			new:  "a\n",
+			exp:  "",
+		},
+		{
+			note: "new file",
+			old:  "",
+			new:  "a\nb\n",
+			exp:  "--- a/f.rego\n+++ b/f.rego\n@@ -0,0 +1,2 @@\n+a\n+b\n",
+		},
+		{
+			note: "missing newline at end of file",
+			old:  "a\nb",
+			new:  "a\nb\n",
+			exp:  "--- a/f.rego\n+++ b/f.rego\n@@ -1,2 +1,2 @@\n a\n-b\n\\ No newline at end of file\n+b\n",
+		},
+		{
+			note: "separate hunks",
+			old:  lines(1, 12),
+			new:  "line A\n" + lines(2, 11) + "line L\n",
+			exp: "--- a/f.rego\n+++ b/f.rego\n" +
+				"@@ -1,4 +1,4 @@\n-line a\n+line A\n line b\n line c\n line d\n" +
+				"@@ -9,4 +9,4 @@\n line i\n line j\n line k\n-line l\n+line L\n",
+		},
+		{
+			note: "merged hunks",
+			old:  lines(1, 8),
+			new:  "line A\n" + lines(2, 7) + "line H\n",
+			exp: "--- a/f.rego\n+++ b/f.rego\n" +
+				"@@ -1,8 +1,8 @@\n-line a\n+line A\n line b\n line c\n line d\n line e\n line f\n line g\n-line h\n+line H\n",
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.note, func(t *testing.T) {
+			if act := unifiedDiff("f.rego", tc.old, tc.new); act != tc.exp {
+				t.Fatalf("expected:\n%s\ngot:\n%s", tc.exp, act)
+			}
+		})
+	}
+}
+
+func TestUnifiedDiffLarge(t *testing.T) {
+	// Every other line changes, too many for the table of common subsequences.
+	var old, new strings.Builder
+	n := 4096
+	for i := range n {
+		fmt.Fprintf(&old, "line %d\n", i)
+		if i%2 == 0 {
+			fmt.Fprintf(&new, "line %d\n", i)
+		} else {
+			fmt.Fprintf(&new, "changed %d\n", i)
+		}
+	}
+
+	act := unifiedDiff("f.rego", old.String(), new.String())
+
+	exp := fmt.Sprintf("--- a/f.rego\n+++ b/f.rego\n@@ -1,%d +1,%d @@\n line 0\n-line 1\n", n, n)
+	if !strings.HasPrefix(act, exp) {
+		t.Fatalf("expected prefix:\n%s\ngot:\n%.200s", exp, act)
+	}
+	// All but the first line are replaced, +++ b/f.rego aside.
+	if exp, act := 2*(n-1), strings.Count(act, "\n-")+strings.Count(act, "\n+")-1; exp != act {
+		t.Fatalf("expected %d changed lines but got: %d", exp, act)
+	}
+}
@@ -0,0 +1,268 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	maxShareTTL = 365 * 24 * time.Hour // Maximum TTL of a share or distribution
+
+	// lastAccessResolution is how stale the last access of a DataRequest may
+	// get before a Get records it again, so that reads rarely cause writes.
+	lastAccessResolution = time.Hour
+
+	defaultGCInterval = time.Hour
+
+	gcReasonExpired = "expired"
+	gcReasonIdle    = "idle"
+)
+
+// applyTTL sets the expiry of a share or distribution from its TTL, if it has
+// one, and clears the TTL.
+func applyTTL(dr *DataRequest, now time.Time) error {
+	ttl := dr.TTL
+	dr.TTL = ""
+
+	if ttl == "" {
+		return nil
+	}
+
+	d, err := time.ParseDuration(ttl)
+	if err != nil {
+		return fmt.Errorf("invalid ttl: %w", err)
+	}
+	if d <= 0 || d > maxShareTTL {
+		return fmt.Errorf("ttl must be positive and at most %v", maxShareTTL)
+	}
+
+	expiresAt := now.Add(d).UTC()
+	dr.ExpiresAt = &expiresAt
+	return nil
+}
+
+func (dr *DataRequest) expired(now time.Time) bool {
+	return dr.ExpiresAt != nil && !now.Before(*dr.ExpiresAt)
+}
+
+// accessTracker is implemented by stores that record when DataRequests were
+// last gotten. The garbage collector uses it to read them without counting
+// as an access.
+type accessTracker interface {
+	// peek gets a DataRequest, including an expired one, without recording an access.
+	peek(key *StoreKey) (DataRequest, bool, error)
+	// touch records an access of a DataRequest at a time.
+	touch(key *StoreKey, at time.Time) error
+}
+
+// GCService periodically deletes shares that expired, or that were not
+// accessed for a while, from a DataRequestStore.
+type GCService struct {
+	store    DataRequestStore
+	interval time.Duration
+	maxIdle  time.Duration
+	dryRun   bool
+	now      func() time.Time
+
+	runs    prometheus.Counter
+	errors  prometheus.Counter
+	deleted *prometheus.CounterVec
+
+	stop chan struct{}
+	wg   sync.WaitGroup
+}
+
+type GCServiceOption func(*GCService)
+
+// NewGCService returns a garbage collector of the shares in store.
+func NewGCService(store DataRequestStore, options ...GCServiceOption) *GCService {
+	s := &GCService{
+		store:    store,
+		interval: defaultGCInterval,
+		now:      time.Now,
+		runs: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "share_gc_runs_total",
+			Help: "The number of garbage collections of shares.",
+		}),
+		errors: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "share_gc_errors_total",
+			Help: "The number of shares that failed to be read or deleted by the garbage collection.",
+		}),
+		deleted: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "share_gc_deleted_total",
+			Help: "The number of shares deleted by the garbage collection, or that would have been in dry-run mode.",
+		}, []string{"reason", "dry_run"}),
+		stop: make(chan struct{}),
+	}
+
+	for _, opt := range options {
+		opt(s)
+	}
+
+	return s
+}
+
+// GCInterval sets the time between garbage collections.
+func GCInterval(d time.Duration) GCServiceOption {
+	return func(s *GCService) {
+		s.interval = d
+	}
+}
+
+// GCMaxIdle sets how long shares may go without being accessed before they
+// are deleted; zero keeps them regardless.
+func GCMaxIdle(d time.Duration) GCServiceOption {
+	return func(s *GCService) {
+		s.maxIdle = d
+	}
+}
+
+// GCDryRun logs and counts the shares that would be deleted without
+// deleting them.
+func GCDryRun(dryRun bool) GCServiceOption {
+	return func(s *GCService) {
+		s.dryRun = dryRun
+	}
+}
+
+// GCMetrics registers the metrics of the garbage collection.
+func GCMetrics(r prometheus.Registerer) GCServiceOption {
+	return func(s *GCService) {
+		r.MustRegister(s.runs, s.errors, s.deleted)
+	}
+}
+
+// Name returns the name of the service.
+func (*GCService) Name() string {
+	return "share-gc"
+}
+
+// Init initializes the service.
+func (s *GCService) Init(context.Context) error {
+	if s.interval <= 0 {
+		return errors.New("garbage collection interval must be positive")
+	}
+	if s.maxIdle < 0 {
+		return errors.New("maximum idle time must not be negative")
+	}
+	return nil
+}
+
+// Start starts collecting garbage periodically.
+func (s *GCService) Start(context.Context) error {
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+
+		ticker := time.NewTicker(s.interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+				if _, err := s.Collect(); err != nil {
+					log.WithError(err).Error("Share garbage collection failed.")
+				}
+			case <-s.stop:
+				return
+			}
+		}
+	}()
+	return nil
+}
+
+// Stop stops the service, waiting for a running collection to finish.
+func (s *GCService) Stop(ctx context.Context) {
+	close(s.stop)
+
+	done := make(chan struct{})
+	go func() {
+		s.wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-ctx.Done():
+	}
+}
+
+// Collect deletes the expired and idle shares, and returns their number.
+// Shares that fail to be read or deleted are logged and skipped. Shares
+// whose last access was never recorded are recorded as accessed now.
+func (s *GCService) Collect() (int, error) {
+	s.runs.Inc()
+
+	keys, err := s.store.ListAll(nil)
+	if err != nil {
+		return 0, fmt.Errorf("failed to list shares: %w", err)
+	}
+
+	tracker, _ := s.store.(accessTracker)
+	now := s.now()
+	var n int
+
+	for _, key := range keys {
+		var dr DataRequest
+		var found bool
+		var err error
+
+		if tracker != nil {
+			dr, found, err = tracker.peek(key)
+		} else {
+			dr, found, err = s.store.Get(key, nil)
+		}
+		if err != nil {
+			s.errors.Inc()
+			log.WithError(err).WithField("key", key.Id).Warn("Failed to read share for garbage collection.")
+			continue
+		}
+		if !found {
+			continue
+		}
+
+		reason := s.reason(dr, now)
+		if reason == "" {
+			if dr.LastAccessedAt == nil && tracker != nil {
+				if err := tracker.touch(key, now); err != nil {
+					log.WithError(err).WithField("key", key.Id).Warn("Failed to record access of share.")
+				}
+			}
+			continue
+		}
+
+		logger := log.WithField("key", key.Id).WithField("reason", reason)
+
+		if s.dryRun {
+			logger.Info("Would delete share (dry-run).")
+		} else {
+			if err := s.store.Delete(key, nil); err != nil {
+				s.errors.Inc()
+				logger.WithError(err).Warn("Failed to delete share.")
+				continue
+			}
+			logger.Info("Deleted share.")
+		}
+
+		s.deleted.WithLabelValues(reason, fmt.Sprint(s.dryRun)).Inc()
+		n++
+	}
+
+	return n, nil
+}
+
+func (s *GCService) reason(dr DataRequest, now time.Time) string {
+	switch {
+	case dr.expired(now):
+		return gcReasonExpired
+	case s.maxIdle > 0 && dr.LastAccessedAt != nil && now.Sub(*dr.LastAccessedAt) > s.maxIdle:
+		return gcReasonIdle
+	}
+	return ""
+}
@@ -0,0 +1,136 @@
+package api
+
+import (
+	"context"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestApplyTTL(t *testing.T) {
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	past := now.Add(-time.Hour)
+
+	tests := []struct {
+		ttl    string
+		exp    *time.Time
+		expErr string
+	}{
+		{ttl: "", exp: &past},
+		{ttl: "24h", exp: func() *time.Time { t := now.Add(24 * time.Hour); return &t }()},
+		{ttl: "-1h", expErr: "ttl must be positive and at most 8760h0m0s"},
+		{ttl: "9000h", expErr: "ttl must be positive and at most 8760h0m0s"},
+		{ttl: "soon", expErr: `invalid ttl: time: invalid duration "soon"`},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.ttl, func(t *testing.T) {
+			dr := DataRequest{TTL: tc.ttl, ExpiresAt: &past}
+
+			err := applyTTL(&dr, now)
+			if tc.expErr != "" {
+				if err == nil || err.Error() != tc.expErr {
+					t.Fatalf("expected error %q but got: %v", tc.expErr, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if dr.TTL != "" {
+				t.Fatalf("expected the TTL to be cleared, got: %+v", dr)
+			}
+			if (tc.exp == nil) != (dr.ExpiresAt == nil) || tc.exp != nil && !tc.exp.Equal(*dr.ExpiresAt) {
+				t.Fatalf("expected expiry %v but got: %v", tc.exp, dr.ExpiresAt)
+			}
+		})
+	}
+}
+
+func TestGCService(t *testing.T) {
+	now := time.Now()
+	past := now.Add(-time.Minute)
+	future := now.Add(time.Hour)
+	longAgo := now.Add(-48 * time.Hour)
+
+	for _, dryRun := range []bool{false, true} {
+		store := NewMemoryDataRequestStore()
+		store.Put(&StoreKey{Id: "expired"}, DataRequest{ExpiresAt: &past}, nil)
+		store.Put(&StoreKey{Id: "expiring"}, DataRequest{ExpiresAt: &future}, nil)
+		store.Put(&StoreKey{Id: "idle"}, DataRequest{}, nil)
+		store.Put(&StoreKey{Id: "active"}, DataRequest{}, nil)
+		store.Put(&StoreKey{Id: "untracked"}, DataRequest{}, nil)
+
+		store.touch(&StoreKey{Id: "idle"}, longAgo)
+		store.store["untracked"] = DataRequest{}
+
+		registry := prometheus.NewRegistry()
+		gc := NewGCService(store, GCMaxIdle(24*time.Hour), GCDryRun(dryRun), GCMetrics(registry))
+
+		n, err := gc.Collect()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n != 2 {
+			t.Fatalf("expected 2 shares to be collected (dry-run: %v), got: %d", dryRun, n)
+		}
+
+		var keys []string
+		for k := range store.store {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+
+		exp := []string{"active", "expiring", "untracked"}
+		if dryRun {
+			exp = []string{"active", "expired", "expiring", "idle", "untracked"}
+		}
+		if len(keys) != len(exp) {
+			t.Fatalf("expected keys %v (dry-run: %v), got: %v", exp, dryRun, keys)
+		}
+
+		if dr := store.store["untracked"]; dr.LastAccessedAt == nil {
+			t.Fatal("expected the access of an untracked share to be recorded")
+		}
+
+		label := "false"
+		if dryRun {
+			label = "true"
+		}
+		for _, reason := range []string{gcReasonExpired, gcReasonIdle} {
+			if v := testutil.ToFloat64(gc.deleted.WithLabelValues(reason, label)); v != 1 {
+				t.Fatalf("expected 1 share deleted as %s (dry-run: %v), got: %v", reason, dryRun, v)
+			}
+		}
+	}
+}
+
+func TestGCServiceStop(t *testing.T) {
+	gc := NewGCService(NewMemoryDataRequestStore(), GCInterval(time.Millisecond))
+
+	ctx := context.Background()
+	if err := gc.Init(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if err := gc.Start(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	time.Sleep(10 * time.Millisecond)
+
+	ctx, cancel := context.WithTimeout(ctx, time.Second)
+	defer cancel()
+	gc.Stop(ctx)
+
+	if ctx.Err() != nil {
+		t.Fatal("expected the service to stop before the deadline")
+	}
+
+	if testutil.ToFloat64(gc.runs) == 0 {
+		t.Fatal("expected at least one collection")
+	}
+}
@@ -13,11 +13,17 @@ import (
 
 	"github.com/google/go-github/v73/github"
 	gists "github.com/open-policy-agent/rego-playground/internal/github"
+	"github.com/open-policy-agent/rego-playground/opa"
+	"github.com/prometheus/client_golang/prometheus"
 	log "github.com/sirupsen/logrus"
 )
 
 const (
 	readme = `# This is a Rego Playground Share`
+
+	// regalConfigFile holds the Regal config of a share, named so that Regal
+	// picks it up when the gist is cloned.
+	regalConfigFile = ".regal.yaml"
 )
 
 type UnauthorizedError struct {
@@ -70,11 +76,22 @@ type GistStore struct {
 	externalURL string   // Used to add playground share link into README.md
 	watchers    map[string]update
 	wl          sync.Mutex
+
+	rateLimitRemaining prometheus.Gauge
+	rateLimitReset     prometheus.Gauge
 }
 
 func NewGistStore(options ...GistStoreOption) *GistStore {
 	s := &GistStore{
 		watchers: make(map[string]update),
+		rateLimitRemaining: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "github_rate_limit_remaining",
+			Help: "The number of requests to the GitHub API remaining, as of the latest gist response.",
+		}),
+		rateLimitReset: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "github_rate_limit_reset_timestamp_seconds",
+			Help: "The time the GitHub API rate limit resets, as of the latest gist response.",
+		}),
 	}
 	for _, opt := range options {
 		opt(s)
@@ -97,8 +114,11 @@ func GistStoreBaseUrl(baseUrl *url.URL) GistStoreOption {
 }
 
 type metadata struct {
-	Coverage    bool `json:"coverage"`
-	RegoVersion int  `json:"rego_version"`
+	Coverage      bool               `json:"coverage"`
+	RegoVersion   int                `json:"rego_version"`
+	DataDocuments []opa.DataDocument `json:"data_documents,omitempty"`
+	InputFormat   string             `json:"input_format,omitempty"`
+	DataFormat    string             `json:"data_format,omitempty"`
 }
 
 func (m *metadata) toJSON() string {
@@ -116,6 +136,9 @@ func (m *metadata) updateDataRequest(dr *DataRequest) {
 
 	dr.Coverage = m.Coverage
 	dr.RegoVersion = &m.RegoVersion
+	dr.DataDocuments = m.DataDocuments
+	dr.InputFormat = m.InputFormat
+	dr.DataFormat = m.DataFormat
 }
 
 func metadataFromDataRequest(dr *DataRequest) *metadata {
@@ -126,6 +149,9 @@ func metadataFromDataRequest(dr *DataRequest) *metadata {
 	}
 
 	meta.Coverage = dr.Coverage
+	meta.DataDocuments = dr.DataDocuments
+	meta.InputFormat = dr.InputFormat
+	meta.DataFormat = dr.DataFormat
 
 	if dr.RegoVersion != nil {
 		meta.RegoVersion = *dr.RegoVersion
@@ -189,6 +215,10 @@ func (s *GistStore) Get(key *StoreKey, principal *Principal) (DataRequest, bool,
 			}
 		}
 
+		if file, ok := gist.Files[regalConfigFile]; ok && file.Content != nil {
+			dr.RegalConfig = file.Content
+		}
+
 		if file, ok := gist.Files["rego_playground_metadata.json"]; ok && file.Content != nil {
 			meta, err := metadataFromJSON([]byte(*file.Content))
 			if err != nil {
@@ -196,6 +226,14 @@ func (s *GistStore) Get(key *StoreKey, principal *Principal) (DataRequest, bool,
 				return DataRequest{}, false, fmt.Errorf("failed to unmarshal metadata: %w", err)
 			}
 			meta.updateDataRequest(&dr)
+
+			// Documents given as text are saved as is, in a file named after their format.
+			if text, ok := formattedDocument(gist, "input", dr.InputFormat); ok {
+				dr.Input = &text
+			}
+			if text, ok := formattedDocument(gist, "data", dr.DataFormat); ok {
+				dr.Data = &text
+			}
 		} else {
 			log.Debugf("No metadata found for gist: %v", key)
 		}
@@ -246,6 +284,36 @@ func (s *GistStore) Put(key *StoreKey, dr DataRequest, principal *Principal) (*S
 	return s.createNewGist(ctx, principal, &dr)
 }
 
+func (s *GistStore) Delete(key *StoreKey, principal *Principal) error {
+	if principal == nil {
+		return NewUnauthorizedError("authentication required to delete a gist", true)
+	}
+
+	ctx := context.Background()
+
+	resp, err := s.getClient(ctx, principal).Delete(ctx, key.Id)
+	log.Debugf("Delete gist response: %v", resp)
+	if resp != nil {
+		s.observeRateLimit(resp)
+		if ok, err := checkResponseError(resp); !ok {
+			return err
+		}
+	}
+	if err != nil {
+		return fmt.Errorf("failed to delete gist: %w", err)
+	}
+
+	s.wl.Lock()
+	defer s.wl.Unlock()
+	if up, ok := s.watchers[key.Id]; ok {
+		up.cb(DataRequest{})
+		delete(s.watchers, key.Id)
+		close(up.done)
+	}
+
+	return nil
+}
+
 func (s *GistStore) createNewGist(ctx context.Context, principal *Principal, dr *DataRequest) (*StoreKey, error) {
 	gist, rev, err := s.createGist(ctx, principal, dr)
 	if err != nil {
@@ -397,6 +465,7 @@ func (s *GistStore) getGist(ctx context.Context, id string, revision string, pri
 		log.Debugf("Get gist revision response: %v", resp)
 
 		if resp != nil {
+			s.observeRateLimit(resp)
 			if ok, err := checkResponseError(resp); !ok {
 				return nil, "", err
 			}
@@ -406,6 +475,7 @@ func (s *GistStore) getGist(ctx context.Context, id string, revision string, pri
 		log.Debugf("Get gist response: %v", resp)
 
 		if resp != nil {
+			s.observeRateLimit(resp)
 			if ok, err := checkResponseError(resp); !ok {
 				return nil, "", err
 			}
@@ -429,6 +499,28 @@ func (s *GistStore) getGist(ctx context.Context, id string, revision string, pri
 	return gist, revision, err
 }
 
+// observeRateLimit records the rate limit of the principal, or of the
+// playground, of a response.
+func (s *GistStore) observeRateLimit(resp *github.Response) {
+	if resp.Rate.Limit == 0 {
+		return
+	}
+	s.rateLimitRemaining.Set(float64(resp.Rate.Remaining))
+	s.rateLimitReset.Set(float64(resp.Rate.Reset.Unix()))
+}
+
+// Describe implements prometheus.Collector.
+func (s *GistStore) Describe(ch chan<- *prometheus.Desc) {
+	s.rateLimitRemaining.Describe(ch)
+	s.rateLimitReset.Describe(ch)
+}
+
+// Collect implements prometheus.Collector.
+func (s *GistStore) Collect(ch chan<- prometheus.Metric) {
+	s.rateLimitRemaining.Collect(ch)
+	s.rateLimitReset.Collect(ch)
+}
+
 func checkResponseError(resp *github.Response) (bool, error) {
 	if resp == nil {
 		return true, nil
@@ -483,6 +575,7 @@ Check the second revision for the Playground share link`
 	client := s.getClient(ctx, principal)
 	gist, resp, err := client.Create(ctx, gist)
 	if resp != nil {
+		s.observeRateLimit(resp)
 		if ok, err := checkResponseError(resp); !ok {
 			return nil, "", err
 		}
@@ -515,11 +608,16 @@ func (s *GistStore) patchGist(ctx context.Context, principal *Principal, key *St
 	if err != nil {
 		return nil, "", fmt.Errorf("failed to update gist: %w", err)
 	}
+	if dr.RegalConfig == nil || *dr.RegalConfig == "" {
+		// An empty file entry deletes the Regal config left by an earlier revision.
+		gist.Files[regalConfigFile] = gists.GistFile{}
+	}
 
 	client := s.getClient(ctx, principal)
 	// If the user doesn't own the Gist, the API behaves as if it doesn't exist, replying with a 404
 	result, resp, err := client.Edit(context.Background(), key.Id, gist)
 	if resp != nil {
+		s.observeRateLimit(resp)
 		if ok, err := checkResponseError(resp); !ok {
 			return nil, "", err
 		}
@@ -556,7 +654,11 @@ func updateGist(dr *DataRequest, gist *gists.Gist) (*gists.Gist, error) {
 		}
 	}
 
-	if dr.Input != nil {
+	if name, text, ok := formattedDocumentFile("input", dr.Input, dr.InputFormat); ok {
+		gist.Files[name] = gists.GistFile{
+			Content: github.Ptr(text),
+		}
+	} else if dr.Input != nil {
 		inputContent, err := json.Marshal(dr.Input)
 		if err != nil {
 			return nil, fmt.Errorf("failed to marshal input: %w", err)
@@ -571,7 +673,11 @@ func updateGist(dr *DataRequest, gist *gists.Gist) (*gists.Gist, error) {
 		}
 	}
 
-	if dr.Data != nil {
+	if name, text, ok := formattedDocumentFile("data", dr.Data, dr.DataFormat); ok {
+		gist.Files[name] = gists.GistFile{
+			Content: github.Ptr(text),
+		}
+	} else if dr.Data != nil {
 		dataContent, err := json.Marshal(dr.Data)
 		if err != nil {
 			return nil, fmt.Errorf("failed to marshal data: %w", err)
@@ -586,6 +692,12 @@ func updateGist(dr *DataRequest, gist *gists.Gist) (*gists.Gist, error) {
 		}
 	}
 
+	if dr.RegalConfig != nil && *dr.RegalConfig != "" {
+		gist.Files[regalConfigFile] = gists.GistFile{
+			Content: github.Ptr(*dr.RegalConfig),
+		}
+	}
+
 	if meta := metadataFromDataRequest(dr); meta != nil {
 		gist.Files["rego_playground_metadata.json"] = gists.GistFile{
 			Content: github.Ptr(meta.toJSON()),
@@ -600,6 +712,39 @@ func updateGist(dr *DataRequest, gist *gists.Gist) (*gists.Gist, error) {
 	return gist, nil
 }
 
+// formattedDocumentFile returns the file name and text of a document that is
+// given as text in a format other than JSON, e.g. input.yaml. JSON text is
+// saved as a string in input.json or data.json, which must stay valid JSON.
+func formattedDocumentFile(name string, doc *interface{}, format string) (gists.GistFilename, string, bool) {
+	ext := opa.FormatExtension(format)
+	if doc == nil || ext == "" || format == opa.FormatJSON {
+		return "", "", false
+	}
+
+	text, ok := (*doc).(string)
+	if !ok {
+		return "", "", false
+	}
+
+	return gists.GistFilename(name + "." + ext), text, true
+}
+
+// formattedDocument returns the text of a document saved by
+// formattedDocumentFile.
+func formattedDocument(gist *gists.Gist, name string, format string) (interface{}, bool) {
+	ext := opa.FormatExtension(format)
+	if ext == "" || format == opa.FormatJSON {
+		return nil, false
+	}
+
+	file, ok := gist.Files[gists.GistFilename(name+"."+ext)]
+	if !ok || file.Content == nil {
+		return nil, false
+	}
+
+	return *file.Content, true
+}
+
 func (s *GistStore) getGistCommits(ctx context.Context, gist *gists.Gist, principal *Principal) ([]*gists.GistCommit, error) {
 	if history := gist.GetHistory(); len(history) > 0 {
 		log.Debugf("Gist %s has history, returning cached commits", gist.GetID())
@@ -611,6 +756,7 @@ func (s *GistStore) getGistCommits(ctx context.Context, gist *gists.Gist, princi
 	commits, resp, err := client.ListCommits(ctx, gist.GetID(), nil)
 
 	if resp != nil {
+		s.observeRateLimit(resp)
 		if ok, err := checkResponseError(resp); !ok {
 			return nil, err
 		}
@@ -642,12 +788,32 @@ func (s *GistStore) getLatestGistCommit(ctx context.Context, gist *gists.Gist, p
 	return commits[0], nil
 }
 
+// CheckHealth checks that the GitHub API is reachable and that the playground
+// isn't rate limited by it (see api.HealthChecker)
+func (s *GistStore) CheckHealth(ctx context.Context) error {
+	c := github.NewClient(githubHTTPClient)
+	if s.baseUrl != nil {
+		c.BaseURL = s.baseUrl
+	}
+
+	limits, _, err := c.RateLimit.Get(ctx)
+	if err != nil {
+		return err
+	}
+
+	if core := limits.GetCore(); core != nil && core.Limit > 0 && core.Remaining == 0 {
+		return fmt.Errorf("rate limited by GitHub until %v", core.Reset.Time.UTC().Format(time.RFC3339))
+	}
+
+	return nil
+}
+
 func (s *GistStore) getClient(ctx context.Context, principal *Principal) *gists.GistsService {
 	var c *github.Client
 	if principal != nil {
 		c = principal.Client(ctx)
 	} else {
-		c = github.NewClient(nil)
+		c = github.NewClient(githubHTTPClient)
 	}
 
 	if s.baseUrl != nil {
@@ -17,6 +17,7 @@ import (
 	"github.com/google/go-github/v73/github"
 	"github.com/open-policy-agent/opa/v1/util"
 	gists "github.com/open-policy-agent/rego-playground/internal/github"
+	"github.com/prometheus/client_golang/prometheus/testutil"
 	"golang.org/x/oauth2"
 )
 
@@ -74,6 +75,44 @@ func TestGistStore_Get(t *testing.T) {
 				1,
 				""),
 		},
+		{
+			note:      "get key, found (with regal config)",
+			key:       &StoreKey{Id: "foo"},
+			principal: &Principal{},
+			status:    200,
+			gist: func() *gists.Gist {
+				g := makeGist("foo")
+				g.Files[regalConfigFile] = gists.GistFile{Content: github.Ptr("rules: {}\n")}
+				return g
+			}(),
+			commits: makeGistCommits("bar"),
+			expResult: func() *DataRequest {
+				dr := makeDataRequest("policy.rego", `package example`, `{}`, `{}`, 1, "bar")
+				dr.RegalConfig = github.Ptr("rules: {}\n")
+				return dr
+			}(),
+		},
+		{
+			note:      "get key, found (with yaml input)",
+			key:       &StoreKey{Id: "foo"},
+			principal: &Principal{},
+			status:    200,
+			gist: func() *gists.Gist {
+				g := makeGist("foo")
+				delete(g.Files, "input.json")
+				g.Files["input.yaml"] = gists.GistFile{Content: github.Ptr("kind: Pod\n")}
+				g.Files["rego_playground_metadata.json"] = gists.GistFile{Content: github.Ptr(`{"rego_version":1,"input_format":"yaml"}`)}
+				return g
+			}(),
+			commits: makeGistCommits("bar"),
+			expResult: func() *DataRequest {
+				dr := makeDataRequest("policy.rego", `package example`, `{}`, "", 1, "bar")
+				var input interface{} = "kind: Pod\n"
+				dr.Input = &input
+				dr.InputFormat = "yaml"
+				return dr
+			}(),
+		},
 		{
 			note:      "get key, not found",
 			key:       &StoreKey{Id: "foo"},
@@ -469,6 +508,7 @@ func TestGistStore_Put(t *testing.T) {
 						"rego_playground_metadata.json": {
 							Content: github.Ptr(`{"coverage":false,"rego_version":1}`),
 						},
+						".regal.yaml": {},
 					},
 				},
 				status: 200,
@@ -687,6 +727,32 @@ func toJson(t *testing.T, v any) string {
 	return string(bs)
 }
 
+func TestUpdateGistFormattedDocuments(t *testing.T) {
+	dr := makeDataRequest("policy.rego", `package example`, "", "", 1, "")
+	var input, data interface{} = "kind: Pod\n", `{"a": 1}`
+	dr.Input, dr.InputFormat = &input, "yaml"
+	dr.Data, dr.DataFormat = &data, "json"
+
+	gist, err := updateGist(dr, &gists.Gist{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for name, exp := range map[gists.GistFilename]string{
+		"input.yaml":                    "kind: Pod\n",
+		"data.json":                     `"{\"a\": 1}"`,
+		"rego_playground_metadata.json": `{"coverage":false,"rego_version":1,"input_format":"yaml","data_format":"json"}`,
+	} {
+		if file, ok := gist.Files[name]; !ok || file.Content == nil || *file.Content != exp {
+			t.Errorf("expected %v to be %q but got %+v", name, exp, file)
+		}
+	}
+
+	if _, ok := gist.Files["input.json"]; ok {
+		t.Errorf("expected no input.json for a yaml input")
+	}
+}
+
 func makeGist(id string) *gists.Gist {
 	g := gists.Gist{
 		ID: github.Ptr(id),
@@ -752,3 +818,69 @@ func makeDataRequest(moduleName string, module string, data string, input string
 
 	return &out
 }
+
+func TestGistStore_CheckHealth(t *testing.T) {
+	for _, tc := range []struct {
+		note      string
+		remaining int
+		status    int
+		expErr    string
+	}{
+		{note: "ok", remaining: 10, status: 200},
+		{note: "rate limited", remaining: 0, status: 200, expErr: "rate limited by GitHub until 2025-01-01T00:00:00Z"},
+		{note: "unreachable", status: 500, expErr: "500"},
+	} {
+		t.Run(tc.note, func(t *testing.T) {
+			ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if r.URL.Path != "/rate_limit" {
+					t.Fatalf("unexpected request: %v", r.URL.Path)
+				}
+				w.WriteHeader(tc.status)
+				fmt.Fprintf(w, `{"resources": {"core": {"limit": 60, "remaining": %d, "reset": 1735689600}}}`, tc.remaining)
+			}))
+			defer ts.Close()
+
+			base, _ := url.Parse(ts.URL + "/")
+			err := NewGistStore(GistStoreBaseUrl(base)).CheckHealth(t.Context())
+
+			if tc.expErr == "" {
+				if err != nil {
+					t.Fatal(err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tc.expErr) {
+				t.Fatalf("expected error containing %q but got: %v", tc.expErr, err)
+			}
+		})
+	}
+}
+
+func TestGistStore_RateLimitMetrics(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-RateLimit-Limit", "60")
+		w.Header().Set("X-RateLimit-Remaining", "42")
+		w.Header().Set("X-RateLimit-Reset", "1735689600")
+		w.WriteHeader(http.StatusNotFound)
+	}))
+	defer ts.Close()
+
+	base, _ := url.Parse(ts.URL + "/")
+	store := NewGistStore(GistStoreBaseUrl(base))
+
+	principal := &Principal{
+		oauthConfig: &oauth2.Config{Endpoint: oauth2.Endpoint{TokenURL: ts.URL + "/oauth/token"}},
+		accessToken: &oauth2.Token{AccessToken: "foobar"},
+	}
+
+	if _, found, _ := store.Get(&StoreKey{Id: "foo"}, principal); found {
+		t.Fatal("expected the gist not to be found")
+	}
+
+	if v := testutil.ToFloat64(store.rateLimitRemaining); v != 42 {
+		t.Fatalf("expected 42 remaining requests but got: %v", v)
+	}
+	if v := testutil.ToFloat64(store.rateLimitReset); v != 1735689600 {
+		t.Fatalf("expected the reset time but got: %v", v)
+	}
+}
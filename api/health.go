@@ -0,0 +1,237 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/google/go-github/v73/github"
+)
+
+const (
+	defaultHealthCacheTTL = 10 * time.Second // How long results are reused, so that probes don't hammer dependencies
+	healthCheckTimeout    = 5 * time.Second  // Maximum duration of a check
+
+	healthStatusUp       = "up"
+	healthStatusDown     = "down"
+	healthStatusDegraded = "degraded" // only components that aren't critical are down
+	healthStatusDraining = "draining" // the server is shutting down
+
+	// Names of the components checked by the API.
+	healthComponentV1Store     = "v1_store"
+	healthComponentV2Store     = "v2_store"
+	healthComponentGithubOAuth = "github_oauth"
+)
+
+// HealthCheck returns an error if a component is unhealthy.
+type HealthCheck func(ctx context.Context) error
+
+// HealthChecker is implemented by stores, and other dependencies, that can
+// check their health.
+type HealthChecker interface {
+	CheckHealth(ctx context.Context) error
+}
+
+// ComponentHealth represents the result of the latest check of a component.
+type ComponentHealth struct {
+	Status      string     `json:"status"`
+	Critical    bool       `json:"critical"` // the server isn't ready while a critical component is down
+	Latency     float64    `json:"latency_ms"`
+	CheckedAt   time.Time  `json:"checked_at"`
+	LastError   string     `json:"last_error,omitempty"` // the latest error, kept after the component recovered
+	LastErrorAt *time.Time `json:"last_error_at,omitempty"`
+}
+
+// HealthReport represents the health of the server and its components.
+type HealthReport struct {
+	Status     string                     `json:"status"`
+	Components map[string]ComponentHealth `json:"components"`
+}
+
+type healthComponent struct {
+	name     string
+	critical bool
+	check    HealthCheck
+
+	mu     sync.Mutex // held while checking, so that concurrent probes share a check
+	result ComponentHealth
+}
+
+// HealthRegistry checks the health of the registered components, caching the
+// results.
+type HealthRegistry struct {
+	mu         sync.Mutex
+	components []*healthComponent
+	ttl        time.Duration
+	now        func() time.Time
+}
+
+// NewHealthRegistry returns a registry without components, caching results
+// for ttl.
+func NewHealthRegistry(ttl time.Duration) *HealthRegistry {
+	return &HealthRegistry{ttl: ttl, now: time.Now}
+}
+
+// Register adds a component to be checked. A registered component replaces
+// another of the same name.
+func (h *HealthRegistry) Register(name string, critical bool, check HealthCheck) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	c := &healthComponent{name: name, critical: critical, check: check}
+	for i, existing := range h.components {
+		if existing.name == name {
+			h.components[i] = c
+			return
+		}
+	}
+	h.components = append(h.components, c)
+}
+
+// Check returns the health of the components, checking them concurrently
+// unless they were checked recently. Only the critical components are
+// checked if criticalOnly is set.
+func (h *HealthRegistry) Check(ctx context.Context, criticalOnly bool) HealthReport {
+	h.mu.Lock()
+	components := make([]*healthComponent, 0, len(h.components))
+	for _, c := range h.components {
+		if c.critical || !criticalOnly {
+			components = append(components, c)
+		}
+	}
+	h.mu.Unlock()
+
+	results := make([]ComponentHealth, len(components))
+
+	var wg sync.WaitGroup
+	for i, c := range components {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			results[i] = h.checkComponent(ctx, c)
+		}()
+	}
+	wg.Wait()
+
+	report := HealthReport{Status: healthStatusUp, Components: make(map[string]ComponentHealth, len(components))}
+	for i, c := range components {
+		report.Components[c.name] = results[i]
+		if results[i].Status != healthStatusDown {
+			continue
+		}
+		if c.critical {
+			report.Status = healthStatusDown
+		} else if report.Status == healthStatusUp {
+			report.Status = healthStatusDegraded
+		}
+	}
+
+	return report
+}
+
+func (h *HealthRegistry) checkComponent(ctx context.Context, c *healthComponent) ComponentHealth {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if !c.result.CheckedAt.IsZero() && h.now().Sub(c.result.CheckedAt) < h.ttl {
+		return c.result
+	}
+
+	// The check isn't canceled with the probe, as its result is shared.
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), healthCheckTimeout)
+	defer cancel()
+
+	start := h.now()
+	err := c.check(ctx)
+	end := h.now()
+
+	c.result.Critical = c.critical
+	c.result.CheckedAt = end
+	c.result.Latency = float64(end.Sub(start)) / float64(time.Millisecond)
+	c.result.Status = healthStatusUp
+
+	if err != nil {
+		c.result.Status = healthStatusDown
+		c.result.LastError = err.Error()
+		c.result.LastErrorAt = &end
+	}
+
+	return c.result
+}
+
+// Health returns the registry of the components checked by the readiness and
+// health endpoints, for other dependencies to register with.
+func (api *API) Health() *HealthRegistry {
+	return api.health
+}
+
+// registerHealthChecks registers the checks of the stores and of the GitHub
+// OAuth app. The playground can't share without its v1 store, so it's
+// critical, while publishing to gists is optional.
+func (api *API) registerHealthChecks() {
+	if c, ok := api.v1Store.(HealthChecker); ok {
+		api.health.Register(healthComponentV1Store, true, c.CheckHealth)
+	}
+	if c, ok := api.v2Store.(HealthChecker); ok {
+		api.health.Register(healthComponentV2Store, false, c.CheckHealth)
+	}
+	if id := api.githubOauthConfig.ClientID; id != "" {
+		client := github.NewClient((&github.BasicAuthTransport{
+			Username:  id,
+			Password:  api.githubOauthConfig.ClientSecret,
+			Transport: githubHTTPClient.Transport,
+		}).Client())
+		api.health.Register(healthComponentGithubOAuth, false, githubOAuthHealthCheck(client, id))
+	}
+}
+
+// githubOAuthHealthCheck checks the credentials of the GitHub OAuth app of
+// client by checking a token that doesn't exist: GitHub answers 404 if the
+// credentials are valid, and 401 otherwise.
+func githubOAuthHealthCheck(client *github.Client, clientID string) HealthCheck {
+	return func(ctx context.Context) error {
+		_, resp, err := client.Authorizations.Check(ctx, clientID, "playground-health-check")
+		if resp != nil {
+			switch resp.StatusCode {
+			case http.StatusNotFound:
+				return nil
+			case http.StatusUnauthorized:
+				return errors.New("invalid GitHub OAuth app credentials")
+			}
+		}
+		if err != nil {
+			return fmt.Errorf("failed to check GitHub OAuth app: %w", err)
+		}
+		return nil
+	}
+}
+
+func (api *API) handleHealth(w http.ResponseWriter, r *http.Request) {
+	api.writeHealth(w, r, false)
+}
+
+func (api *API) handleReadiness(w http.ResponseWriter, r *http.Request) {
+	api.writeHealth(w, r, true)
+}
+
+// writeHealth writes the health of the components with a status that
+// Kubernetes probes understand: 503 if a critical component is down or the
+// server is draining, 200 otherwise.
+func (api *API) writeHealth(w http.ResponseWriter, r *http.Request, criticalOnly bool) {
+	report := api.health.Check(r.Context(), criticalOnly)
+
+	if api.draining.Load() {
+		report.Status = healthStatusDraining
+	}
+
+	code := http.StatusOK
+	if report.Status == healthStatusDown || report.Status == healthStatusDraining {
+		code = http.StatusServiceUnavailable
+	}
+
+	w.Header().Set("Cache-Control", "no-store")
+	writeJSON(w, code, report)
+}
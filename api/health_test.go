@@ -0,0 +1,145 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/google/go-github/v73/github"
+	"github.com/open-policy-agent/opa/util"
+)
+
+// checkedStore is a memory store whose health is set by the test.
+type checkedStore struct {
+	*MemoryDataRequestStore
+	err    error
+	checks int
+}
+
+func (s *checkedStore) CheckHealth(context.Context) error {
+	s.checks++
+	return s.err
+}
+
+func TestHealthRegistry(t *testing.T) {
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	h := NewHealthRegistry(10 * time.Second)
+	h.now = func() time.Time { return now }
+
+	var storeErr, githubErr error
+	var checks int
+	h.Register("store", true, func(context.Context) error { checks++; return storeErr })
+	h.Register("github", false, func(context.Context) error { return githubErr })
+
+	if report := h.Check(context.Background(), false); report.Status != healthStatusUp || len(report.Components) != 2 {
+		t.Fatalf("unexpected report: %+v", report)
+	}
+
+	githubErr = errors.New("unreachable")
+	now = now.Add(10 * time.Second)
+
+	if report := h.Check(context.Background(), false); report.Status != healthStatusDegraded || report.Components["github"].LastError != "unreachable" {
+		t.Fatalf("expected a degraded report but got: %+v", report)
+	}
+
+	if report := h.Check(context.Background(), true); report.Status != healthStatusUp || len(report.Components) != 1 {
+		t.Fatalf("expected only the critical components to be checked, got: %+v", report)
+	}
+
+	if checks != 2 {
+		t.Fatalf("expected cached results to be reused, got %d checks", checks)
+	}
+
+	storeErr = errors.New("bucket unreachable")
+	now = now.Add(10 * time.Second)
+
+	if report := h.Check(context.Background(), false); report.Status != healthStatusDown {
+		t.Fatalf("expected a down report but got: %+v", report)
+	}
+
+	storeErr = nil
+	now = now.Add(10 * time.Second)
+
+	report := h.Check(context.Background(), false)
+	store := report.Components["store"]
+	if report.Status != healthStatusDegraded || store.Status != healthStatusUp || store.LastError != "bucket unreachable" || store.LastErrorAt == nil {
+		t.Fatalf("expected the last error to be kept after recovery, got: %+v", report)
+	}
+}
+
+func TestApiHealth(t *testing.T) {
+	store := &checkedStore{MemoryDataRequestStore: NewMemoryDataRequestStore()}
+	s := NewAPIService("", store, nil, "./", "", "", "")
+
+	get := func(path string) (int, HealthReport) {
+		w := httptest.NewRecorder()
+		s.router.ServeHTTP(w, httptest.NewRequest("GET", path, nil))
+
+		var report HealthReport
+		if err := util.UnmarshalJSON(w.Body.Bytes(), &report); err != nil {
+			t.Fatal(err)
+		}
+		return w.Code, report
+	}
+
+	for _, path := range []string{"/v1/system/ready", "/v1/system/health"} {
+		if code, report := get(path); code != http.StatusOK || report.Components[healthComponentV1Store].Status != healthStatusUp {
+			t.Fatalf("expected %v to be up, got: %v, %+v", path, code, report)
+		}
+	}
+
+	if store.checks != 1 {
+		t.Fatalf("expected the probes to share a check, got %d checks", store.checks)
+	}
+
+	// A failing store fails both once the cached result expired.
+	store.err = errors.New("bucket unreachable")
+	s.health.now = func() time.Time { return time.Now().Add(defaultHealthCacheTTL) }
+
+	for _, path := range []string{"/v1/system/ready", "/v1/system/health"} {
+		if code, report := get(path); code != http.StatusServiceUnavailable || report.Status != healthStatusDown {
+			t.Fatalf("expected %v to be down, got: %v, %+v", path, code, report)
+		}
+	}
+
+	store.err = nil
+	s.health.now = func() time.Time { return time.Now().Add(2 * defaultHealthCacheTTL) }
+	s.Drain()
+
+	if code, report := get("/v1/system/ready"); code != http.StatusServiceUnavailable || report.Status != healthStatusDraining {
+		t.Fatalf("expected the draining server not to be ready, got: %v, %+v", code, report)
+	}
+}
+
+func TestGithubOAuthHealthCheck(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if user, pass, _ := r.BasicAuth(); user != "id" || pass != "secret" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		w.WriteHeader(http.StatusNotFound)
+	}))
+	defer ts.Close()
+
+	base, _ := url.Parse(ts.URL + "/")
+
+	for _, tc := range []struct {
+		secret string
+		ok     bool
+	}{
+		{"secret", true},
+		{"wrong", false},
+	} {
+		client := github.NewClient((&github.BasicAuthTransport{Username: "id", Password: tc.secret}).Client())
+		client.BaseURL = base
+
+		err := githubOAuthHealthCheck(client, "id")(context.Background())
+		if (err == nil) != tc.ok {
+			t.Fatalf("expected the check with secret %q to succeed: %v, got: %v", tc.secret, tc.ok, err)
+		}
+	}
+}
@@ -0,0 +1,222 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"maps"
+	"sort"
+	"strings"
+
+	"github.com/open-policy-agent/opa/ast"
+	"github.com/styrainc/regal/pkg/config"
+	"github.com/styrainc/regal/pkg/fixer"
+	"github.com/styrainc/regal/pkg/fixer/fileprovider"
+	"github.com/styrainc/regal/pkg/fixer/fixes"
+	"github.com/styrainc/regal/pkg/linter"
+	"github.com/styrainc/regal/pkg/report"
+	"github.com/styrainc/regal/pkg/rules"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	"gopkg.in/yaml.v3"
+)
+
+// singleModuleFileName is the file name used for requests carrying a single
+// module in `rego_module`.
+const singleModuleFileName = "policy.rego"
+
+// playgroundRegalRules are applied unless the user supplied Regal config
+// configures the same rule.
+var playgroundRegalRules = map[string]config.Category{
+	"idiomatic": {
+		"directory-package-mismatch": config.Rule{
+			// this rule is disabled because the playground
+			// operates with out the notion of a directory.
+			Level: "ignore",
+		},
+	},
+	"style": {
+		"line-length": config.Rule{
+			Extra: map[string]interface{}{
+				// this allows some long tokens to appear in example
+				// header comments without breaking the line length rule
+				"non-breakable-word-threshold": 100,
+			},
+		},
+	},
+}
+
+// moduleFiles returns the modules of a request keyed by file name. Requests
+// either carry all modules of a share in `rego_modules` or a single
+// `rego_module`.
+func moduleFiles(modules map[string]interface{}, module string) (map[string]string, error) {
+	if len(modules) == 0 {
+		return map[string]string{singleModuleFileName: module}, nil
+	}
+
+	files := make(map[string]string, len(modules))
+	for path, value := range modules {
+		str, ok := value.(string)
+		if !ok {
+			return nil, fmt.Errorf("module %v must be a string", path)
+		}
+		files[path] = str
+	}
+
+	return files, nil
+}
+
+// lintInput parses all files for linting. Parse errors of all files are
+// returned together so the UI can show them per file.
+func lintInput(files map[string]string, regoVersion ast.RegoVersion) (rules.Input, ast.Errors) {
+	content := make(map[string]string, len(files))
+	modules := make(map[string]*ast.Module, len(files))
+
+	var errs ast.Errors
+
+	names := make([]string, 0, len(files))
+	for name := range files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		input, err := rules.InputFromTextWithOptions(name, files[name], ast.ParserOptions{RegoVersion: regoVersion})
+		if err != nil {
+			var astErrs ast.Errors
+			var astErr *ast.Error
+			switch {
+			case errors.As(err, &astErrs):
+				errs = append(errs, astErrs...)
+			case errors.As(err, &astErr):
+				errs = append(errs, astErr)
+			default:
+				errs = append(errs, ast.NewError(ast.ParseErr, &ast.Location{File: name}, "%s", err.Error()))
+			}
+			continue
+		}
+
+		content[name] = input.FileContent[name]
+		modules[name] = input.Modules[name]
+	}
+
+	return rules.NewInput(content, modules), errs
+}
+
+// regalConfig parses the body of a user supplied .regal/config.yaml and
+// merges it with the playground defaults.
+func regalConfig(body string) (config.Config, error) {
+	conf := config.Config{}
+
+	if body != "" {
+		// Capabilities can be loaded from arbitrary files and URLs, neither
+		// of which we want to be reachable from a shared playground.
+		var raw struct {
+			Capabilities struct {
+				From struct {
+					File string `yaml:"file"`
+					URL  string `yaml:"url"`
+				} `yaml:"from"`
+			} `yaml:"capabilities"`
+		}
+		if err := yaml.Unmarshal([]byte(body), &raw); err != nil {
+			return conf, fmt.Errorf("invalid Regal config: %w", err)
+		}
+		if raw.Capabilities.From.File != "" || raw.Capabilities.From.URL != "" {
+			return conf, errors.New("invalid Regal config: capabilities can only be loaded from an engine and version")
+		}
+
+		if err := yaml.Unmarshal([]byte(body), &conf); err != nil {
+			return conf, fmt.Errorf("invalid Regal config: %w", err)
+		}
+	}
+
+	if conf.Rules == nil {
+		conf.Rules = make(map[string]config.Category, len(playgroundRegalRules))
+	}
+
+	for category, defaults := range playgroundRegalRules {
+		if conf.Rules[category] == nil {
+			conf.Rules[category] = make(config.Category, len(defaults))
+		}
+		for name, rule := range defaults {
+			if _, ok := conf.Rules[category][name]; !ok {
+				conf.Rules[category][name] = rule
+			}
+		}
+	}
+
+	return conf, nil
+}
+
+// violationsByFile groups the violations of a report by the file they were
+// found in.
+func violationsByFile(rpt report.Report) map[string][]report.Violation {
+	byFile := make(map[string][]report.Violation)
+	for _, v := range rpt.Violations {
+		byFile[v.Location.File] = append(byFile[v.Location.File], v)
+	}
+	return byFile
+}
+
+// lintFixResult holds the outcome of applying Regal's fixers to a set of files.
+type lintFixResult struct {
+	files map[string]string   // contents of all files after fixing
+	fixes map[string][]string // titles of the applied fixes, keyed by file
+	diff  string              // unified diff of all fixed files
+}
+
+// lintFix applies Regal's fixers to files until no fixable violations remain.
+// Fixers moving files around are not registered, as the playground has no
+// notion of directories.
+func lintFix(ctx context.Context, files map[string]string, regoVersion ast.RegoVersion, conf config.Config) (_ *lintFixResult, err error) {
+	ctx, span := tracer.Start(ctx, "regal.Fix", trace.WithAttributes(attribute.Int("rego.modules", len(files))))
+	defer func() { endSpan(span, err) }()
+
+	f := fixer.NewFixer()
+	f.RegisterFixes(fixes.NewDefaultFormatterFixes()...)
+	f.RegisterFixes(&fixes.Fmt{NameOverride: "use-rego-v1"})
+	if regoVersion != ast.RegoUndefined {
+		f.SetRegoVersionsMap(map[string]ast.RegoVersion{"": regoVersion})
+	}
+
+	// The file provider updates the map it is given in place.
+	fp := fileprovider.NewInMemoryFileProvider(maps.Clone(files))
+
+	l := linter.NewLinter().WithUserConfig(conf)
+
+	rpt, err := f.Fix(ctx, &l, fp)
+	if err != nil {
+		return nil, err
+	}
+
+	result := &lintFixResult{
+		files: make(map[string]string, len(files)),
+		fixes: make(map[string][]string),
+	}
+
+	names := make([]string, 0, len(files))
+	for name := range files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var diff strings.Builder
+	for _, name := range names {
+		fixed, err := fp.Get(name)
+		if err != nil {
+			return nil, err
+		}
+		result.files[name] = fixed
+		diff.WriteString(unifiedDiff(name, files[name], fixed))
+	}
+	result.diff = diff.String()
+
+	for _, name := range rpt.FixedFiles() {
+		for _, fix := range rpt.FixesForFile(name) {
+			result.fixes[name] = append(result.fixes[name], fix.Title)
+		}
+	}
+
+	return result, nil
+}
@@ -23,14 +23,55 @@ func NewMemoryDataRequestStore() *MemoryDataRequestStore {
 
 // Get a DataRequest (see api.DataRequestStore)
 func (s *MemoryDataRequestStore) Get(key *StoreKey, _ *Principal) (DataRequest, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	dr, ok := s.store[key.Id]
+	now := time.Now()
+	if !ok || dr.expired(now) {
+		return DataRequest{}, false, nil
+	}
+	dr.LastAccessedAt = &now
+	s.store[key.Id] = dr
+	return dr, true, nil
+}
+
+func (s *MemoryDataRequestStore) peek(key *StoreKey) (DataRequest, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
 	dr, ok := s.store[key.Id]
 	return dr, ok, nil
 }
 
+func (s *MemoryDataRequestStore) touch(key *StoreKey, at time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if dr, ok := s.store[key.Id]; ok {
+		dr.LastAccessedAt = &at
+		s.store[key.Id] = dr
+	}
+	return nil
+}
+
+func (s *MemoryDataRequestStore) update(key *StoreKey, fn func(*DataRequest) error) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	dr, ok := s.store[key.Id]
+	if !ok {
+		return false, nil
+	}
+	if err := fn(&dr); err != nil {
+		return true, err
+	}
+	s.store[key.Id] = dr
+	return true, nil
+}
+
 // Put a DataRequest (see api.DataRequestStore)
 func (s *MemoryDataRequestStore) Put(key *StoreKey, dr DataRequest, _ *Principal) (*StoreKey, error) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
+	now := time.Now()
+	dr.LastAccessedAt = &now
 	s.store[key.Id] = dr
 	if up, ok := s.watchers[key.Id]; ok {
 		up.cb(dr)
@@ -40,8 +81,23 @@ func (s *MemoryDataRequestStore) Put(key *StoreKey, dr DataRequest, _ *Principal
 	return key, nil
 }
 
+// Delete a DataRequest (see api.DataRequestStore)
+func (s *MemoryDataRequestStore) Delete(key *StoreKey, _ *Principal) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.store, key.Id)
+	if up, ok := s.watchers[key.Id]; ok {
+		up.cb(DataRequest{})
+		delete(s.watchers, key.Id)
+		close(up.done)
+	}
+	return nil
+}
+
 // List the keys that are set with a given prefix (see api.DataRequestStore)
 func (s *MemoryDataRequestStore) List(prefix *StoreKey, _ *Principal) ([]*StoreKey, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
 	keys := []*StoreKey{}
 	for key := range s.store {
 		if strings.HasPrefix(key, prefix.Id) {
@@ -51,6 +107,19 @@ func (s *MemoryDataRequestStore) List(prefix *StoreKey, _ *Principal) ([]*StoreK
 	return keys, nil
 }
 
+func (s *MemoryDataRequestStore) listPage(prefix, cursor string, limit int) ([]string, string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	keys := []string{}
+	for key := range s.store {
+		if strings.HasPrefix(key, prefix) {
+			keys = append(keys, key)
+		}
+	}
+	keys, next := pageKeys(keys, cursor, limit)
+	return keys, next, nil
+}
+
 // ListAll the keys that are set (see api.DataRequestStore)
 func (s *MemoryDataRequestStore) ListAll(principal *Principal) ([]*StoreKey, error) {
 	return s.List(&StoreKey{Id: ""}, principal)
@@ -61,7 +130,7 @@ func (s *MemoryDataRequestStore) Watch(key *StoreKey, etag string, timeout time.
 
 	s.mu.Lock()
 	dr, ok := s.store[key.Id]
-	if !ok {
+	if !ok || dr.expired(time.Now()) {
 		s.mu.Unlock()
 		return false, nil
 	}
@@ -168,3 +168,57 @@ func TestWatchMemStore(t *testing.T) {
 }
 
 // NOTE: May want more extensive tests if this gets used more.
+
+func TestDeleteMemStore(t *testing.T) {
+	var store = NewMemoryDataRequestStore()
+	store.Put(&StoreKey{Id: "a"}, DataRequest{RegoQuery: "a", Etag: "1"}, nil)
+
+	ch := make(chan DataRequest, 1)
+	if found, err := store.Watch(&StoreKey{Id: "a"}, "1", time.Minute, func(dr DataRequest) { ch <- dr }, nil); !found || err != nil {
+		t.Fatalf("Watch returned the wrong values: %v, %v instead of true, nil.", found, err)
+	}
+
+	if err := store.Delete(&StoreKey{Id: "a"}, nil); err != nil {
+		t.Fatalf("Delete errored: %v.", err)
+	}
+
+	if dr := <-ch; !reflect.DeepEqual(dr, DataRequest{}) {
+		t.Errorf("Watcher was not woken with an empty DataRequest: %v.", dr)
+	}
+
+	if _, ok, _ := store.Get(&StoreKey{Id: "a"}, nil); ok {
+		t.Error("Get found a deleted key.")
+	}
+
+	if err := store.Delete(&StoreKey{Id: "a"}, nil); err != nil {
+		t.Errorf("Delete errored for a missing key: %v.", err)
+	}
+}
+
+func TestExpiryAndAccessMemStore(t *testing.T) {
+	var store = NewMemoryDataRequestStore()
+
+	past := time.Now().Add(-time.Minute)
+	store.Put(&StoreKey{Id: "expired"}, DataRequest{RegoQuery: "expired", ExpiresAt: &past}, nil)
+
+	if _, ok, _ := store.Get(&StoreKey{Id: "expired"}, nil); ok {
+		t.Error("Get found an expired key.")
+	}
+
+	if _, ok, _ := store.peek(&StoreKey{Id: "expired"}); !ok {
+		t.Error("peek did not find an expired key.")
+	}
+
+	store.Put(&StoreKey{Id: "a"}, DataRequest{RegoQuery: "a"}, nil)
+	store.touch(&StoreKey{Id: "a"}, past)
+
+	if dr, _, _ := store.peek(&StoreKey{Id: "a"}); !dr.LastAccessedAt.Equal(past) {
+		t.Errorf("peek returned the wrong last access: %v instead of %v.", dr.LastAccessedAt, past)
+	}
+
+	store.Get(&StoreKey{Id: "a"}, nil)
+
+	if dr, _, _ := store.peek(&StoreKey{Id: "a"}); !dr.LastAccessedAt.After(past) {
+		t.Errorf("Get did not record an access: %v.", dr.LastAccessedAt)
+	}
+}
@@ -0,0 +1,98 @@
+package api
+
+import (
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	// Stages of queries that fail, see apiMetrics.queryErrors.
+	queryStageParse   = "parse"
+	queryStageCompile = "compile"
+	queryStageEval    = "eval"
+
+	// Modes of bundle downloads, see apiMetrics.bundleDownloads.
+	bundleDownloadSnapshot    = "snapshot"
+	bundleDownloadDelta       = "delta"
+	bundleDownloadNotModified = "not_modified"
+)
+
+// apiMetrics are the metrics of evaluations, stores and bundles served at
+// /metrics.
+type apiMetrics struct {
+	compileDuration      *prometheus.HistogramVec
+	evalDuration         prometheus.Histogram
+	queryErrors          *prometheus.CounterVec
+	regoVersionFallbacks prometheus.Counter
+	storeDuration        *prometheus.HistogramVec
+	storeErrors          *prometheus.CounterVec
+	bundleWatchers       prometheus.Gauge
+	bundleDownloads      *prometheus.CounterVec
+}
+
+func newAPIMetrics() *apiMetrics {
+	return &apiMetrics{
+		compileDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name: "opa_compile_duration_seconds",
+			Help: "A histogram of duration for compilations of policies and queries, by Rego version.",
+		}, []string{"rego_version"}),
+		evalDuration: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Name: "opa_eval_duration_seconds",
+			Help: "A histogram of duration for evaluations of queries.",
+		}),
+		queryErrors: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "query_errors_total",
+			Help: "The number of queries that failed, by stage and status code.",
+		}, []string{"stage", "code"}),
+		regoVersionFallbacks: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "rego_version_fallbacks_total",
+			Help: "The number of compilations that failed as Rego v1 and were compiled as Rego v0.",
+		}),
+		storeDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name: "store_operation_duration_seconds",
+			Help: "A histogram of duration for store operations, by backend and operation.",
+		}, []string{"backend", "operation"}),
+		storeErrors: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "store_errors_total",
+			Help: "The number of store operations that failed, by backend and operation.",
+		}, []string{"backend", "operation"}),
+		bundleWatchers: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "bundle_watchers_active",
+			Help: "The number of long-polls waiting for a bundle to change.",
+		}),
+		bundleDownloads: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "bundle_downloads_total",
+			Help: "The number of bundle downloads, by mode: snapshot, delta or not_modified.",
+		}, []string{"mode"}),
+	}
+}
+
+func (m *apiMetrics) collectors() []prometheus.Collector {
+	return []prometheus.Collector{
+		m.compileDuration,
+		m.evalDuration,
+		m.queryErrors,
+		m.regoVersionFallbacks,
+		m.storeDuration,
+		m.storeErrors,
+		m.bundleWatchers,
+		m.bundleDownloads,
+	}
+}
+
+func (m *apiMetrics) observeCompile(regoVersion int, start time.Time) {
+	m.compileDuration.WithLabelValues(strconv.Itoa(regoVersion)).Observe(time.Since(start).Seconds())
+}
+
+func (m *apiMetrics) queryError(stage string, status int) {
+	m.queryErrors.WithLabelValues(stage, strconv.Itoa(status)).Inc()
+}
+
+func (m *apiMetrics) observeStore(backend, operation string, start time.Time, err error) {
+	m.storeDuration.WithLabelValues(backend, operation).Observe(time.Since(start).Seconds())
+	if err != nil {
+		m.storeErrors.WithLabelValues(backend, operation).Inc()
+	}
+}
@@ -0,0 +1,75 @@
+package api
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestApiMetrics(t *testing.T) {
+	store := NewMemoryDataRequestStore()
+	s := NewAPIService("", store, nil, "./", "", "", "")
+
+	post := func(body string) int {
+		w := httptest.NewRecorder()
+		s.router.ServeHTTP(w, httptest.NewRequest("POST", "/v1/data", strings.NewReader(body)))
+		return w.Code
+	}
+	query := func(module string) int {
+		return post(`{"rego_modules": {"test.rego": ` + module + `}, "rego": "data.test.p"}`)
+	}
+
+	if code := query(`"package test\np := 1"`); code != http.StatusOK {
+		t.Fatalf("expected 200 response but got: %v", code)
+	}
+	if code := query(`"package test\np { true }"`); code != http.StatusOK {
+		t.Fatalf("expected 200 response for a v0 module but got: %v", code)
+	}
+	if code := query(`"package test\np := "`); code != http.StatusBadRequest {
+		t.Fatalf("expected 400 response but got: %v", code)
+	}
+	if code := post(`{"rego": "data.test.p"}`); code != http.StatusBadRequest {
+		t.Fatalf("expected 400 response but got: %v", code)
+	}
+
+	if v := testutil.ToFloat64(s.metrics.regoVersionFallbacks); v != 1 {
+		t.Fatalf("expected 1 fallback to v0 but got: %v", v)
+	}
+	if n := testutil.CollectAndCount(s.metrics.compileDuration); n != 2 {
+		t.Fatalf("expected compilations as v0 and v1 but got %v series", n)
+	}
+	if v := testutil.ToFloat64(s.metrics.queryErrors.WithLabelValues(queryStageCompile, "400")); v != 1 {
+		t.Fatalf("expected 1 compile error but got: %v", v)
+	}
+	if v := testutil.ToFloat64(s.metrics.queryErrors.WithLabelValues(queryStageParse, "400")); v != 1 {
+		t.Fatalf("expected 1 parse error but got: %v", v)
+	}
+
+	key := StoreKey{Id: "foo"}
+	dr := makeDR("package test\np := 1", "", "", 1)
+	dr.Etag = "bar"
+	if _, err := store.Put(&key, dr, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, etag := range []string{"", "bar"} {
+		s.doHandleRetrieveBundle(context.Background(), httptest.NewRecorder(), &key, etag, 0, nil, nil)
+	}
+
+	for mode, exp := range map[string]float64{bundleDownloadSnapshot: 1, bundleDownloadNotModified: 1, bundleDownloadDelta: 0} {
+		if v := testutil.ToFloat64(s.metrics.bundleDownloads.WithLabelValues(mode)); v != exp {
+			t.Fatalf("expected %v %v downloads but got: %v", exp, mode, v)
+		}
+	}
+
+	if n := testutil.CollectAndCount(s.metrics.storeDuration, "store_operation_duration_seconds"); n != 1 {
+		t.Fatalf("expected the gets of the memory store to be measured, got %v series", n)
+	}
+	if v := testutil.ToFloat64(s.metrics.storeErrors.WithLabelValues("memory", "Get")); v != 0 {
+		t.Fatalf("expected no store errors but got: %v", v)
+	}
+}
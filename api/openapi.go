@@ -0,0 +1,175 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	_ "embed"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"regexp"
+	"strings"
+
+	"github.com/getkin/kin-openapi/openapi3"
+	"github.com/gorilla/mux"
+	"github.com/open-policy-agent/opa/util"
+
+	"github.com/open-policy-agent/rego-playground/version"
+)
+
+// maxValidatedBodyBytes is the size of the largest request body validated
+// against the OpenAPI document. Larger bodies are left to the handlers, which
+// limit their size.
+const maxValidatedBodyBytes = int64(1 << 20)
+
+//go:embed openapi.yaml
+var openapiSpec []byte
+
+var (
+	// openapiDoc is the OpenAPI document of the routes of NewAPIService,
+	// served at /v1/openapi.json.
+	openapiDoc = mustLoadOpenAPI()
+
+	// routeVariablePattern matches the patterns of the variables of route
+	// templates, e.g. {path:.+}, which OpenAPI paths don't have.
+	routeVariablePattern = regexp.MustCompile(`\{([^:{}]+):[^{}]+\}`)
+
+	pointerEscaper = strings.NewReplacer("~", "~0", "/", "~1")
+)
+
+// loadOpenAPI loads and validates the embedded OpenAPI document.
+func loadOpenAPI() (*openapi3.T, error) {
+	doc, err := openapi3.NewLoader().LoadFromData(openapiSpec)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load OpenAPI document: %w", err)
+	}
+	if err := doc.Validate(context.Background()); err != nil {
+		return nil, fmt.Errorf("invalid OpenAPI document: %w", err)
+	}
+	if version.Version != "" {
+		doc.Info.Version = version.Version
+	}
+	return doc, nil
+}
+
+func mustLoadOpenAPI() *openapi3.T {
+	doc, err := loadOpenAPI()
+	if err != nil {
+		panic(err)
+	}
+	return doc
+}
+
+func (api *API) handleOpenAPI(w http.ResponseWriter, r *http.Request) {
+	addCORSHeaders(w, r)
+	writeJSON(w, http.StatusOK, openapiDoc)
+}
+
+// openapiPath returns the OpenAPI path of a route template.
+func openapiPath(tmpl string) string {
+	return routeVariablePattern.ReplaceAllString(tmpl, "{$1}")
+}
+
+// openapiOperation returns the operation of the route of r, or nil if the
+// document doesn't have it.
+func openapiOperation(r *http.Request) *openapi3.Operation {
+	route := mux.CurrentRoute(r)
+	if route == nil {
+		return nil
+	}
+	tmpl, err := route.GetPathTemplate()
+	if err != nil {
+		return nil
+	}
+	item := openapiDoc.Paths.Find(openapiPath(tmpl))
+	if item == nil {
+		return nil
+	}
+	return item.GetOperation(r.Method)
+}
+
+// validateRequest rejects the requests whose JSON body doesn't match the
+// schema of their operation in the OpenAPI document, before they reach the
+// handlers. The rate limited routes validate after the rate limit.
+func validateRequest(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		op := openapiOperation(r)
+		if op == nil || op.RequestBody == nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+		body := op.RequestBody.Value
+		media := body.Content.Get("application/json")
+		if media == nil || media.Schema == nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		bs, err := io.ReadAll(io.LimitReader(r.Body, maxValidatedBodyBytes+1))
+		if err != nil {
+			writeError(w, http.StatusBadRequest, apiCodeInvalidArgument, fmt.Errorf("failed reading request body: %w", err))
+			return
+		}
+		r.Body = struct {
+			io.Reader
+			io.Closer
+		}{io.MultiReader(bytes.NewReader(bs), r.Body), r.Body}
+
+		if int64(len(bs)) <= maxValidatedBodyBytes {
+			if err := validateBody(body, media.Schema.Value, bs); err != nil {
+				writeError(w, http.StatusBadRequest, apiCodeInvalidArgument, err)
+				return
+			}
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// validateBody validates a request body against the schema of its operation.
+func validateBody(body *openapi3.RequestBody, schema *openapi3.Schema, bs []byte) error {
+	if len(bytes.TrimSpace(bs)) == 0 {
+		if body.Required {
+			return errors.New("request body is required")
+		}
+		return nil
+	}
+
+	var v any
+	if err := util.UnmarshalJSON(bs, &v); err != nil {
+		return fmt.Errorf("request body is not valid JSON: %w", err)
+	}
+
+	if err := schema.VisitJSON(v); err != nil {
+		var schemaErr *openapi3.SchemaError
+		if !errors.As(err, &schemaErr) {
+			return fmt.Errorf("invalid request body: %w", err)
+		}
+		return fmt.Errorf("invalid request body: %s", schemaErrorMessage(schemaErr))
+	}
+	return nil
+}
+
+// schemaErrorMessage returns the JSON pointer of the invalid value of err and
+// the reason it's invalid, without the schema and the value, which the error
+// message of err includes. Errors of subschemas, e.g. of allOf, are followed
+// to the value that caused them.
+func schemaErrorMessage(err *openapi3.SchemaError) string {
+	var pointer []string
+	for {
+		pointer = append(pointer, err.JSONPointer()...)
+		var origin *openapi3.SchemaError
+		if !errors.As(err.Origin, &origin) {
+			break
+		}
+		err = origin
+	}
+	if len(pointer) == 0 {
+		return err.Reason
+	}
+	for i, token := range pointer {
+		pointer[i] = pointerEscaper.Replace(token)
+	}
+	return "/" + strings.Join(pointer, "/") + ": " + err.Reason
+}
@@ -0,0 +1,220 @@
+package api
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/mux"
+)
+
+func TestOpenAPIMatchesRouter(t *testing.T) {
+	s := NewAPIService("", NewMemoryDataRequestStore(), nil, "./", "", "", "")
+
+	// OpenAPI paths that differ by the names of their variables only are
+	// the same path, e.g. /v1/data/{path} and /v1/data/{key}.
+	variables := regexp.MustCompile(`\{[^{}]*\}`)
+	operation := func(method, path string) string {
+		return method + " " + variables.ReplaceAllString(path, "{}")
+	}
+
+	routes := map[string]bool{}
+	err := s.router.Walk(func(route *mux.Route, _ *mux.Router, _ []*mux.Route) error {
+		if route.GetHandler() == nil {
+			return nil // subrouters
+		}
+		tmpl, err := route.GetPathTemplate()
+		if err != nil {
+			return err
+		}
+		methods, err := route.GetMethods()
+		if err != nil {
+			methods = []string{http.MethodGet} // routes without methods, e.g. the OAuth redirects
+		}
+		for _, method := range methods {
+			routes[operation(method, openapiPath(tmpl))] = true
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	documented := map[string]bool{}
+	for path, item := range openapiDoc.Paths.Map() {
+		for method := range item.Operations() {
+			documented[operation(method, path)] = true
+		}
+	}
+
+	var missing, extra []string
+	for op := range routes {
+		if !documented[op] {
+			missing = append(missing, op)
+		}
+	}
+	for op := range documented {
+		if !routes[op] {
+			extra = append(extra, op)
+		}
+	}
+	sort.Strings(missing)
+	sort.Strings(extra)
+
+	if len(missing) > 0 {
+		t.Errorf("expected the OpenAPI document to have the routes: %v", missing)
+	}
+	if len(extra) > 0 {
+		t.Errorf("expected the router to have the operations of the OpenAPI document: %v", extra)
+	}
+}
+
+func TestHandleOpenAPI(t *testing.T) {
+	s := NewAPIService("", NewMemoryDataRequestStore(), nil, "./", "", "", "")
+
+	w := httptest.NewRecorder()
+	s.router.ServeHTTP(w, httptest.NewRequest("GET", "/v1/openapi.json", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected 200 response but got: %v", w.Code)
+	}
+
+	var doc struct {
+		OpenAPI string                    `json:"openapi"`
+		Paths   map[string]map[string]any `json:"paths"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &doc); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(doc.OpenAPI, "3.") || doc.Paths["/v1/data"]["post"] == nil {
+		t.Fatalf("expected the OpenAPI document, got: %v", w.Body.String())
+	}
+}
+
+func TestValidateRequest(t *testing.T) {
+	s := NewAPIService("", NewMemoryDataRequestStore(), nil, "./", "", "", "")
+	s.EnableAdmin("secret", io.Discard)
+
+	tests := []struct {
+		note    string
+		method  string
+		path    string
+		body    string
+		status  int
+		message string
+	}{
+		{
+			note:   "valid",
+			method: "POST",
+			path:   "/v1/data",
+			body:   `{"rego_modules": {"test.rego": "package test\np := 1"}, "rego_version": 1, "query_imports": null}`,
+			status: http.StatusOK,
+		},
+		{
+			note:    "not JSON",
+			method:  "POST",
+			path:    "/v1/data",
+			body:    `{"rego_modules":`,
+			status:  http.StatusBadRequest,
+			message: "request body is not valid JSON",
+		},
+		{
+			note:    "missing body",
+			method:  "POST",
+			path:    "/v1/share",
+			status:  http.StatusBadRequest,
+			message: "request body is required",
+		},
+		{
+			note:    "module not a string",
+			method:  "POST",
+			path:    "/v1/data",
+			body:    `{"rego_modules": {"authz/test.rego": 1}}`,
+			status:  http.StatusBadRequest,
+			message: "invalid request body: /rego_modules/authz~1test.rego: value must be a string",
+		},
+		{
+			note:    "rego version not an integer",
+			method:  "POST",
+			path:    "/v1/data/test/p",
+			body:    `{"rego_modules": {"test.rego": "package test\np := 1"}, "rego_version": 1.5}`,
+			status:  http.StatusBadRequest,
+			message: "invalid request body: /rego_version: value must be an integer",
+		},
+		{
+			note:    "nested",
+			method:  "POST",
+			path:    "/v1/compare",
+			body:    `{"base": {"data_request": {"data_documents": [{"value": 1}]}}}`,
+			status:  http.StatusBadRequest,
+			message: `invalid request body: /base/data_request/data_documents/0/path: property "path" is missing`,
+		},
+		{
+			note:    "body not an object",
+			method:  "POST",
+			path:    "/v1/fmt",
+			body:    `[]`,
+			status:  http.StatusBadRequest,
+			message: "invalid request body: value must be an object",
+		},
+		{
+			note:    "required property",
+			method:  "POST",
+			path:    "/v1/report/foo",
+			body:    `{}`,
+			status:  http.StatusBadRequest,
+			message: `invalid request body: /reason: property "reason" is missing`,
+		},
+		{
+			note:   "optional body",
+			method: "POST",
+			path:   "/admin/v1/shares/foo/takedown",
+			status: http.StatusNotFound,
+		},
+		{
+			note:    "invalid optional body",
+			method:  "POST",
+			path:    "/admin/v1/shares/foo/takedown",
+			body:    `{"reason": 1}`,
+			status:  http.StatusBadRequest,
+			message: "invalid request body: /reason: value must be a string",
+		},
+		{
+			note:   "no body",
+			method: "GET",
+			path:   "/v1/system/alive",
+			status: http.StatusOK,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.note, func(t *testing.T) {
+			r := httptest.NewRequest(tc.method, tc.path, strings.NewReader(tc.body))
+			r.Header.Set("Authorization", "Bearer secret")
+			w := httptest.NewRecorder()
+			s.router.ServeHTTP(w, r)
+
+			if w.Code != tc.status {
+				t.Fatalf("expected %v response but got: %v, %v", tc.status, w.Code, w.Body.String())
+			}
+			if tc.message == "" {
+				return
+			}
+
+			var resErr apiError
+			if err := json.Unmarshal(w.Body.Bytes(), &resErr); err != nil {
+				t.Fatal(err)
+			}
+			if resErr.Code != apiCodeInvalidArgument {
+				t.Fatalf("expected error code %v but got: %v", apiCodeInvalidArgument, resErr.Code)
+			}
+			if !strings.HasPrefix(resErr.Message, tc.message) {
+				t.Fatalf("expected message %q but got: %q", tc.message, resErr.Message)
+			}
+		})
+	}
+}
@@ -0,0 +1,80 @@
+package api
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+)
+
+// ownerTokenHeader carries the owner token of a distribution in requests that
+// change it.
+const ownerTokenHeader = "X-Owner-Token"
+
+var (
+	errOwnerTokenRequired = errors.New("owner token required, set the " + ownerTokenHeader + " header")
+	errOwnerTokenInvalid  = errors.New("invalid owner token")
+	errOwnerTokenUnset    = errors.New("distribution has no owner token, ask an admin to assign one")
+)
+
+// newOwnerToken returns a random owner token and its hash, which is stored in
+// place of the token.
+func newOwnerToken() (string, string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", "", fmt.Errorf("failed to create owner token: %w", err)
+	}
+
+	token := base64.RawURLEncoding.EncodeToString(b)
+	return token, hashOwnerToken(token), nil
+}
+
+// hashOwnerToken returns the hex encoded SHA-256 digest of token. The tokens
+// are random, so they don't need to be salted or stretched.
+func hashOwnerToken(token string) string {
+	digest := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(digest[:])
+}
+
+// validOwnerTokenHash returns true if hash could be a hash of hashOwnerToken.
+func validOwnerTokenHash(hash string) bool {
+	b, err := hex.DecodeString(hash)
+	return err == nil && len(b) == sha256.Size
+}
+
+// checkOwnerToken returns an error if the request doesn't carry the owner
+// token of dr. Distributions created before owner tokens were introduced
+// have none: they can still be updated without one if allowUnset is true, as
+// before, but only an admin can assign them an owner.
+func checkOwnerToken(r *http.Request, dr DataRequest, allowUnset bool) error {
+	if dr.OwnerTokenHash == "" {
+		if allowUnset {
+			return nil
+		}
+		return errOwnerTokenUnset
+	}
+
+	token := r.Header.Get(ownerTokenHeader)
+	if token == "" {
+		return errOwnerTokenRequired
+	}
+
+	if subtle.ConstantTimeCompare([]byte(hashOwnerToken(token)), []byte(dr.OwnerTokenHash)) != 1 {
+		return errOwnerTokenInvalid
+	}
+
+	return nil
+}
+
+// writeOwnerTokenError writes an error of checkOwnerToken.
+func writeOwnerTokenError(w http.ResponseWriter, err error) {
+	if errors.Is(err, errOwnerTokenRequired) {
+		writeError(w, http.StatusUnauthorized, apiCodeUnauthorized, err)
+		return
+	}
+	writeError(w, http.StatusForbidden, apiCodeForbidden, err)
+}
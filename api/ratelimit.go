@@ -0,0 +1,383 @@
+package api
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	log "github.com/sirupsen/logrus"
+)
+
+// Classes of requests, each limited by a budget of its own.
+const (
+	RateClassEval   = "eval"   // evaluation and other compilations of policies
+	RateClassLint   = "lint"   // linting, formatting and other editor support
+	RateClassShare  = "share"  // creating and changing shares
+	RateClassBundle = "bundle" // polling bundles
+	RateClassRead   = "read"   // reading shares
+)
+
+const (
+	rateLimitByIP        = "ip"
+	rateLimitByPrincipal = "principal"
+
+	// memoryRateLimitSweep is how often the in-memory backend drops the
+	// buckets that were refilled, so that it doesn't grow with every client.
+	memoryRateLimitSweep = time.Minute
+)
+
+// defaultRateLimits are the budgets of each client, per class.
+var defaultRateLimits = map[string]RateLimit{
+	RateClassEval:   {Rate: 1, Burst: 30},
+	RateClassLint:   {Rate: 5, Burst: 100},
+	RateClassShare:  {Rate: 1.0 / 60, Burst: 20},
+	RateClassBundle: {Rate: 1, Burst: 60},
+	RateClassRead:   {Rate: 5, Burst: 100},
+}
+
+// RateLimit represents a token bucket, refilled at Rate tokens per second up
+// to Burst tokens. Each request takes a token.
+type RateLimit struct {
+	Rate  float64
+	Burst int
+}
+
+// ParseRateLimit parses a rate limit of the form "<count>/<duration>" or
+// "<count>/<duration>:<burst>", e.g. "60/1m:10". The burst defaults to the
+// count.
+func ParseRateLimit(s string) (RateLimit, error) {
+	rate, burst, hasBurst := strings.Cut(s, ":")
+
+	count, per, ok := strings.Cut(rate, "/")
+	if !ok {
+		return RateLimit{}, fmt.Errorf("invalid rate limit %q, expected <count>/<duration>[:<burst>]", s)
+	}
+
+	n, err := strconv.Atoi(count)
+	if err != nil || n <= 0 {
+		return RateLimit{}, fmt.Errorf("invalid rate limit %q: count must be a positive integer", s)
+	}
+
+	d, err := time.ParseDuration(per)
+	if err != nil || d <= 0 {
+		return RateLimit{}, fmt.Errorf("invalid rate limit %q: duration must be positive, e.g. 1m", s)
+	}
+
+	limit := RateLimit{Rate: float64(n) / d.Seconds(), Burst: n}
+	if hasBurst {
+		if limit.Burst, err = strconv.Atoi(burst); err != nil || limit.Burst <= 0 {
+			return RateLimit{}, fmt.Errorf("invalid rate limit %q: burst must be a positive integer", s)
+		}
+	}
+
+	return limit, nil
+}
+
+// ParseTrustedProxies parses IP addresses and CIDR ranges of proxies whose
+// forwarding headers are trusted.
+func ParseTrustedProxies(proxies []string) ([]*net.IPNet, error) {
+	nets := make([]*net.IPNet, 0, len(proxies))
+
+	for _, p := range proxies {
+		if !strings.Contains(p, "/") {
+			ip := net.ParseIP(p)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid trusted proxy %q", p)
+			}
+			bits := 8 * len(ip)
+			if ip4 := ip.To4(); ip4 != nil {
+				ip, bits = ip4, 32
+			}
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+
+		_, n, err := net.ParseCIDR(p)
+		if err != nil {
+			return nil, fmt.Errorf("invalid trusted proxy %q: %w", p, err)
+		}
+		nets = append(nets, n)
+	}
+
+	return nets, nil
+}
+
+// RateLimitBackend stores the token buckets of a RateLimiter. Backends shared
+// by several instances of the playground limit clients across all of them.
+type RateLimitBackend interface {
+	// Take takes a token from the bucket of key. It returns zero if a token was
+	// taken, or how long it takes until one is available.
+	Take(ctx context.Context, key string, limit RateLimit) (time.Duration, error)
+}
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+	limit  RateLimit
+}
+
+// refill adds the tokens accumulated since the bucket was last used.
+func (b *tokenBucket) refill(now time.Time) {
+	b.tokens = math.Min(float64(b.limit.Burst), b.tokens+now.Sub(b.last).Seconds()*b.limit.Rate)
+	b.last = now
+}
+
+// MemoryRateLimitBackend keeps token buckets in memory, limiting clients of
+// a single instance.
+type MemoryRateLimitBackend struct {
+	mu        sync.Mutex
+	buckets   map[string]*tokenBucket
+	lastSweep time.Time
+	now       func() time.Time
+}
+
+// NewMemoryRateLimitBackend returns an empty in-memory backend.
+func NewMemoryRateLimitBackend() *MemoryRateLimitBackend {
+	return &MemoryRateLimitBackend{
+		buckets: map[string]*tokenBucket{},
+		now:     time.Now,
+	}
+}
+
+// Take implements RateLimitBackend.
+func (m *MemoryRateLimitBackend) Take(_ context.Context, key string, limit RateLimit) (time.Duration, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := m.now()
+	m.sweep(now)
+
+	b, ok := m.buckets[key]
+	if !ok {
+		b = &tokenBucket{tokens: float64(limit.Burst), last: now}
+		m.buckets[key] = b
+	}
+	b.limit = limit
+	b.refill(now)
+
+	if b.tokens >= 1 {
+		b.tokens--
+		return 0, nil
+	}
+
+	return time.Duration((1 - b.tokens) / limit.Rate * float64(time.Second)), nil
+}
+
+// sweep drops the buckets that were refilled, as they are the same as new
+// ones.
+func (m *MemoryRateLimitBackend) sweep(now time.Time) {
+	if now.Sub(m.lastSweep) < memoryRateLimitSweep {
+		return
+	}
+	m.lastSweep = now
+
+	for key, b := range m.buckets {
+		b.refill(now)
+		if b.tokens >= float64(b.limit.Burst) {
+			delete(m.buckets, key)
+		}
+	}
+}
+
+// RateLimiter limits the requests of each client IP, and of each GitHub
+// principal, with a token bucket per class of requests.
+type RateLimiter struct {
+	backend        RateLimitBackend
+	limits         map[string]RateLimit
+	trustedProxies []*net.IPNet
+
+	rejections *prometheus.CounterVec
+	errors     prometheus.Counter
+}
+
+type RateLimiterOption func(*RateLimiter)
+
+// NewRateLimiter returns a rate limiter with the default budgets, keeping its
+// buckets in memory unless another backend is given.
+func NewRateLimiter(options ...RateLimiterOption) *RateLimiter {
+	l := &RateLimiter{
+		backend: NewMemoryRateLimitBackend(),
+		limits:  map[string]RateLimit{},
+		rejections: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "rate_limit_rejections_total",
+			Help: "The number of requests rejected by the rate limiter, by class and by what was limited.",
+		}, []string{"class", "by"}),
+		errors: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "rate_limit_errors_total",
+			Help: "The number of requests let through because the rate limit backend failed.",
+		}),
+	}
+
+	for class, limit := range defaultRateLimits {
+		l.limits[class] = limit
+	}
+
+	for _, opt := range options {
+		opt(l)
+	}
+
+	return l
+}
+
+// RateLimitBackendOption sets where the token buckets are kept.
+func RateLimitBackendOption(b RateLimitBackend) RateLimiterOption {
+	return func(l *RateLimiter) {
+		l.backend = b
+	}
+}
+
+// RateLimitBudget sets the budget of a class of requests.
+func RateLimitBudget(class string, limit RateLimit) RateLimiterOption {
+	return func(l *RateLimiter) {
+		l.limits[class] = limit
+	}
+}
+
+// RateLimitTrustedProxies sets the proxies whose X-Forwarded-For and
+// X-Real-IP headers are trusted to tell the client IP.
+func RateLimitTrustedProxies(nets []*net.IPNet) RateLimiterOption {
+	return func(l *RateLimiter) {
+		l.trustedProxies = nets
+	}
+}
+
+// RateLimitMetrics registers the metrics of the rate limiter.
+func RateLimitMetrics(r prometheus.Registerer) RateLimiterOption {
+	return func(l *RateLimiter) {
+		r.MustRegister(l.rejections, l.errors)
+	}
+}
+
+// SetRateLimiter sets the rate limiter of the requests; nil disables it.
+func (api *API) SetRateLimiter(l *RateLimiter) {
+	api.rateLimiter = l
+}
+
+// rateLimit limits the requests handled by next with the budget of class,
+// if a rate limiter is set. The bodies of the requests let through are then
+// validated, so that rejected requests aren't read.
+func (api *API) rateLimit(class string, next http.Handler) http.Handler {
+	return api.rateLimitBy(func(*http.Request) []string { return []string{class} }, next)
+}
+
+// rateLimitRead limits the reads of shares with the budget of RateClassRead,
+// and the reads that evaluate the share with the budget of RateClassEval too.
+func (api *API) rateLimitRead(next http.Handler) http.Handler {
+	return api.rateLimitBy(func(r *http.Request) []string {
+		if getBoolParam(r.URL, "evaluate", false) || getBoolParam(r.URL, "coverage", false) {
+			return []string{RateClassRead, RateClassEval}
+		}
+		return []string{RateClassRead}
+	}, next)
+}
+
+// rateLimitBy limits the requests handled by next with the budgets of the
+// classes of each request, then validates their bodies.
+func (api *API) rateLimitBy(classes func(*http.Request) []string, next http.Handler) http.Handler {
+	next = validateRequest(next)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if l := api.rateLimiter; l != nil {
+			principal := api.getPrincipal(r)
+			for _, class := range classes(r) {
+				if !l.allow(w, r, class, principal) {
+					return
+				}
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// allow takes a token from the buckets of the client IP and of the principal,
+// if there is one. If either is empty, the rejection is written to w and
+// false is returned. Requests are let through if the backend fails.
+func (l *RateLimiter) allow(w http.ResponseWriter, r *http.Request, class string, principal *Principal) bool {
+	limit, ok := l.limits[class]
+	if !ok {
+		return true
+	}
+
+	keys := map[string]string{rateLimitByIP: l.clientIP(r)}
+	if principal != nil && principal.accessToken != nil && principal.accessToken.AccessToken != "" {
+		digest := sha256.Sum256([]byte(principal.accessToken.AccessToken))
+		keys[rateLimitByPrincipal] = hex.EncodeToString(digest[:])
+	}
+
+	for _, by := range []string{rateLimitByIP, rateLimitByPrincipal} {
+		key, ok := keys[by]
+		if !ok {
+			continue
+		}
+
+		wait, err := l.backend.Take(r.Context(), class+":"+by+":"+key, limit)
+		if err != nil {
+			l.errors.Inc()
+			log.WithError(err).Warn("Rate limit backend failed.")
+			return true
+		}
+		if wait > 0 {
+			l.rejections.WithLabelValues(class, by).Inc()
+			w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+			writeError(w, http.StatusTooManyRequests, apiCodeTooManyRequests, errors.New("rate limit exceeded, retry later"))
+			return false
+		}
+	}
+
+	return true
+}
+
+// clientIP returns the IP of the client of r. Forwarding headers are only
+// trusted if the request came from a trusted proxy, in which case the
+// rightmost untrusted address of X-Forwarded-For is the client.
+func (l *RateLimiter) clientIP(r *http.Request) string {
+	remote := r.RemoteAddr
+	if host, _, err := net.SplitHostPort(remote); err == nil {
+		remote = host
+	}
+
+	if !l.trusted(remote) {
+		return remote
+	}
+
+	if xff := r.Header.Values("X-Forwarded-For"); len(xff) > 0 {
+		hops := strings.Split(strings.Join(xff, ","), ",")
+		for i := len(hops) - 1; i >= 0; i-- {
+			hop := strings.TrimSpace(hops[i])
+			if net.ParseIP(hop) == nil {
+				break
+			}
+			if !l.trusted(hop) || i == 0 {
+				return hop
+			}
+		}
+	}
+
+	if ip := strings.TrimSpace(r.Header.Get("X-Real-IP")); net.ParseIP(ip) != nil {
+		return ip
+	}
+
+	return remote
+}
+
+func (l *RateLimiter) trusted(addr string) bool {
+	ip := net.ParseIP(addr)
+	if ip == nil {
+		return false
+	}
+	for _, n := range l.trustedProxies {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
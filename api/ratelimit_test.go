@@ -0,0 +1,203 @@
+package api
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestParseRateLimit(t *testing.T) {
+	tests := []struct {
+		s      string
+		exp    RateLimit
+		expErr bool
+	}{
+		{s: "60/1m", exp: RateLimit{Rate: 1, Burst: 60}},
+		{s: "10/1s:5", exp: RateLimit{Rate: 10, Burst: 5}},
+		{s: "60", expErr: true},
+		{s: "0/1m", expErr: true},
+		{s: "60/m", expErr: true},
+		{s: "60/1m:0", expErr: true},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.s, func(t *testing.T) {
+			actual, err := ParseRateLimit(tc.s)
+			if tc.expErr {
+				if err == nil {
+					t.Fatalf("expected an error but got: %+v", actual)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if actual != tc.exp {
+				t.Fatalf("expected %+v but got: %+v", tc.exp, actual)
+			}
+		})
+	}
+}
+
+func TestMemoryRateLimitBackend(t *testing.T) {
+	ctx := context.Background()
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	b := NewMemoryRateLimitBackend()
+	b.now = func() time.Time { return now }
+
+	limit := RateLimit{Rate: 0.5, Burst: 2}
+
+	for i := 0; i < 2; i++ {
+		if wait, _ := b.Take(ctx, "a", limit); wait != 0 {
+			t.Fatalf("expected token %d to be taken, got wait: %v", i, wait)
+		}
+	}
+
+	if wait, _ := b.Take(ctx, "a", limit); wait != 2*time.Second {
+		t.Fatalf("expected to wait 2s but got: %v", wait)
+	}
+
+	if wait, _ := b.Take(ctx, "b", limit); wait != 0 {
+		t.Fatalf("expected buckets to be separate, got wait: %v", wait)
+	}
+
+	now = now.Add(2 * time.Second)
+	if wait, _ := b.Take(ctx, "a", limit); wait != 0 {
+		t.Fatalf("expected the bucket to be refilled, got wait: %v", wait)
+	}
+
+	now = now.Add(memoryRateLimitSweep)
+	b.Take(ctx, "c", limit)
+	if _, ok := b.buckets["a"]; ok || len(b.buckets) != 1 {
+		t.Fatalf("expected the refilled buckets to be swept, got: %v", b.buckets)
+	}
+}
+
+func TestRateLimiterClientIP(t *testing.T) {
+	proxies, err := ParseTrustedProxies([]string{"10.0.0.0/8", "192.168.1.1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	l := NewRateLimiter(RateLimitTrustedProxies(proxies))
+
+	tests := []struct {
+		note    string
+		remote  string
+		headers map[string]string
+		exp     string
+	}{
+		{note: "direct", remote: "1.2.3.4:1234", exp: "1.2.3.4"},
+		{note: "untrusted proxy", remote: "1.2.3.4:1234", headers: map[string]string{"X-Forwarded-For": "5.6.7.8"}, exp: "1.2.3.4"},
+		{note: "trusted proxy", remote: "10.0.0.1:1234", headers: map[string]string{"X-Forwarded-For": "5.6.7.8"}, exp: "5.6.7.8"},
+		{note: "spoofed hops", remote: "10.0.0.1:1234", headers: map[string]string{"X-Forwarded-For": "9.9.9.9, 5.6.7.8, 192.168.1.1"}, exp: "5.6.7.8"},
+		{note: "only proxies", remote: "10.0.0.1:1234", headers: map[string]string{"X-Forwarded-For": "10.0.0.2"}, exp: "10.0.0.2"},
+		{note: "real ip", remote: "192.168.1.1:1234", headers: map[string]string{"X-Real-IP": "5.6.7.8"}, exp: "5.6.7.8"},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.note, func(t *testing.T) {
+			r := httptest.NewRequest("GET", "/", nil)
+			r.RemoteAddr = tc.remote
+			for k, v := range tc.headers {
+				r.Header.Set(k, v)
+			}
+			if actual := l.clientIP(r); actual != tc.exp {
+				t.Fatalf("expected %v but got: %v", tc.exp, actual)
+			}
+		})
+	}
+}
+
+func TestApiRateLimit(t *testing.T) {
+	s := NewAPIService("", NewMemoryDataRequestStore(), nil, "./", "", "", "")
+
+	reg := prometheus.NewRegistry()
+	l := NewRateLimiter(
+		RateLimitBudget(RateClassLint, RateLimit{Rate: 1.0 / 60, Burst: 2}),
+		RateLimitMetrics(reg),
+	)
+	s.SetRateLimiter(l)
+
+	do := func(path, remote, token string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("POST", path, strings.NewReader(`{"rego_modules": {"a.rego": "package a"}}`))
+		r.RemoteAddr = remote
+		if token != "" {
+			r.Header.Set("Authorization", "Bearer "+token)
+		}
+		w := httptest.NewRecorder()
+		s.router.ServeHTTP(w, r)
+		return w
+	}
+
+	for i := 0; i < 2; i++ {
+		if w := do("/v1/fmt", "1.2.3.4:1", ""); w.Code == http.StatusTooManyRequests {
+			t.Fatalf("expected request %d to be allowed", i)
+		}
+	}
+
+	w := do("/v1/lint", "1.2.3.4:1", "")
+	if w.Code != http.StatusTooManyRequests || w.Header().Get("Retry-After") != "60" {
+		t.Fatalf("expected 429 response with Retry-After 60 but got: %v, %q", w.Code, w.Header().Get("Retry-After"))
+	}
+
+	if w := do("/v1/data", "1.2.3.4:1", ""); w.Code == http.StatusTooManyRequests {
+		t.Fatal("expected the evaluation budget to be separate")
+	}
+
+	// A principal is limited across IPs.
+	for i := 0; i < 2; i++ {
+		do("/v1/fmt", "5.6.7.8:1", "token")
+	}
+	if w := do("/v1/fmt", "9.9.9.9:1", "token"); w.Code != http.StatusTooManyRequests {
+		t.Fatalf("expected 429 response for the principal but got: %v", w.Code)
+	}
+
+	if v := testutil.ToFloat64(l.rejections.WithLabelValues(RateClassLint, rateLimitByIP)); v != 1 {
+		t.Fatalf("expected 1 rejection by IP but got: %v", v)
+	}
+	if v := testutil.ToFloat64(l.rejections.WithLabelValues(RateClassLint, rateLimitByPrincipal)); v != 1 {
+		t.Fatalf("expected 1 rejection by principal but got: %v", v)
+	}
+}
+
+func TestApiRateLimitRead(t *testing.T) {
+	s := NewAPIService("", NewMemoryDataRequestStore(), nil, "./", "", "", "")
+	s.SetRateLimiter(NewRateLimiter(
+		RateLimitBudget(RateClassRead, RateLimit{Rate: 1.0 / 60, Burst: 3}),
+		RateLimitBudget(RateClassEval, RateLimit{Rate: 1.0 / 60, Burst: 1}),
+	))
+
+	do := func(method, path string) int {
+		r := httptest.NewRequest(method, path, strings.NewReader(`{"rego_modules": 1}`))
+		r.RemoteAddr = "1.2.3.4:1"
+		w := httptest.NewRecorder()
+		s.router.ServeHTTP(w, r)
+		return w.Code
+	}
+
+	if code := do("GET", "/v1/data/abc?evaluate=true"); code == http.StatusTooManyRequests {
+		t.Fatal("expected the first evaluating read to be allowed")
+	}
+	if code := do("GET", "/v1/data/abc?coverage=true"); code != http.StatusTooManyRequests {
+		t.Fatalf("expected 429 response for a read evaluating over the evaluation budget but got: %v", code)
+	}
+	if code := do("GET", "/v1/data/abc"); code == http.StatusTooManyRequests {
+		t.Fatal("expected a read without evaluation to be allowed")
+	}
+	if code := do("GET", "/v1/data/abc"); code != http.StatusTooManyRequests {
+		t.Fatalf("expected 429 response over the read budget but got: %v", code)
+	}
+
+	// Invalid bodies are only validated once the rate limit lets them through.
+	if code := do("POST", "/v1/data"); code != http.StatusTooManyRequests {
+		t.Fatalf("expected 429 response before the validation of the body but got: %v", code)
+	}
+}
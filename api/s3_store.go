@@ -2,16 +2,29 @@ package api
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
+	"fmt"
 	"io/ioutil"
+	"net/http"
+	"net/url"
 	"sync"
 	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/awserr"
 	"github.com/aws/aws-sdk-go/service/s3"
+	log "github.com/sirupsen/logrus"
 )
 
+// s3LastAccessedMetadata is the metadata of an object holding the time its
+// DataRequest was last accessed, see DataRequestStore.Get.
+const s3LastAccessedMetadata = "Last-Accessed"
+
+// s3MaxUpdateAttempts is the number of times an update of a DataRequest is
+// attempted while its object is changed concurrently.
+const s3MaxUpdateAttempts = 5
+
 // S3DataRequestStore is a DataRequestStore backed by s3.
 type S3DataRequestStore struct {
 	s3       *s3.S3
@@ -29,8 +42,92 @@ func NewS3DataRequestStore(s3 *s3.S3, bucket string) *S3DataRequestStore {
 	}
 }
 
+// CheckHealth checks that the bucket is reachable (see api.HealthChecker)
+func (s *S3DataRequestStore) CheckHealth(ctx context.Context) error {
+	_, err := s.s3.HeadBucketWithContext(ctx, &s3.HeadBucketInput{Bucket: aws.String(s.bucket)})
+	return err
+}
+
 // Get a DataRequest (see api.DataRequestStore)
 func (s *S3DataRequestStore) Get(key *StoreKey, _ *Principal) (DataRequest, bool, error) {
+	dr, etag, found, err := s.getObject(key)
+	if err != nil || !found {
+		return dr, found, err
+	}
+
+	now := time.Now()
+	if dr.expired(now) {
+		return DataRequest{}, false, nil
+	}
+
+	if dr.LastAccessedAt == nil || now.Sub(*dr.LastAccessedAt) > lastAccessResolution {
+		if err := s.copyWithLastAccess(key, etag, now); err != nil {
+			log.WithError(err).WithField("key", key.Id).Warn("Failed to record access of share.")
+		}
+		dr.LastAccessedAt = &now
+	}
+
+	return dr, true, nil
+}
+
+func (s *S3DataRequestStore) peek(key *StoreKey) (DataRequest, bool, error) {
+	dr, _, found, err := s.getObject(key)
+	return dr, found, err
+}
+
+func (s *S3DataRequestStore) touch(key *StoreKey, at time.Time) error {
+	return s.copyWithLastAccess(key, nil, at)
+}
+
+// update puts the object of a DataRequest updated by fn only if it still has
+// the ETag it was gotten with, and tries again otherwise.
+func (s *S3DataRequestStore) update(key *StoreKey, fn func(*DataRequest) error) (bool, error) {
+	for range s3MaxUpdateAttempts {
+		dr, etag, found, err := s.getObject(key)
+		if err != nil || !found {
+			return found, err
+		}
+		if err := fn(&dr); err != nil {
+			return true, err
+		}
+
+		bs, err := json.Marshal(dr)
+		if err != nil {
+			return true, err
+		}
+
+		lastAccess := time.Now()
+		if dr.LastAccessedAt != nil {
+			lastAccess = *dr.LastAccessedAt
+		}
+
+		req, _ := s.s3.PutObjectRequest(&s3.PutObjectInput{
+			Body:     aws.ReadSeekCloser(bytes.NewReader(bs)),
+			Bucket:   aws.String(s.bucket),
+			Key:      aws.String(key.Id),
+			Metadata: lastAccessMetadata(lastAccess),
+		})
+		// The PutObjectInput of this SDK has no field for conditional writes.
+		req.HTTPRequest.Header.Set("If-Match", aws.StringValue(etag))
+
+		err = req.Send()
+		if aerr, ok := err.(awserr.RequestFailure); ok {
+			switch {
+			case aerr.Code() == s3.ErrCodeNoSuchKey:
+				return false, nil
+			case aerr.StatusCode() == http.StatusPreconditionFailed, aerr.StatusCode() == http.StatusConflict:
+				continue
+			}
+		}
+		return true, err
+	}
+
+	return true, fmt.Errorf("key %v was changed concurrently, gave up updating it after %d attempts", key.Id, s3MaxUpdateAttempts)
+}
+
+// getObject gets a DataRequest with the time it was last accessed, which is
+// kept in the metadata of its object, and the ETag of the object.
+func (s *S3DataRequestStore) getObject(key *StoreKey) (DataRequest, *string, bool, error) {
 	input := &s3.GetObjectInput{
 		Bucket: aws.String(s.bucket),
 		Key:    aws.String(key.Id),
@@ -39,23 +136,52 @@ func (s *S3DataRequestStore) Get(key *StoreKey, _ *Principal) (DataRequest, bool
 	result, err := s.s3.GetObject(input)
 	if err != nil {
 		if aerr, ok := err.(awserr.Error); ok && aerr.Code() == s3.ErrCodeNoSuchKey {
-			return DataRequest{}, false, nil
+			return DataRequest{}, nil, false, nil
 		}
-		return DataRequest{}, false, err
+		return DataRequest{}, nil, false, err
 	}
 	defer result.Body.Close()
 
 	bs, err := ioutil.ReadAll(result.Body)
 	if err != nil {
-		return DataRequest{}, true, err
+		return DataRequest{}, nil, true, err
 	}
 
 	var dr DataRequest
 	if err := json.Unmarshal(bs, &dr); err != nil {
-		return DataRequest{}, true, err
+		return DataRequest{}, nil, true, err
 	}
 
-	return dr, true, nil
+	if v, ok := result.Metadata[s3LastAccessedMetadata]; ok && v != nil {
+		if t, err := time.Parse(time.RFC3339, *v); err == nil {
+			dr.LastAccessedAt = &t
+		}
+	}
+
+	return dr, result.ETag, true, nil
+}
+
+// copyWithLastAccess copies an object onto itself to replace the time it was
+// last accessed, unless it changed since it had the ETag etag (if not nil).
+// Copying rather than putting it keeps concurrent updates of the object.
+func (s *S3DataRequestStore) copyWithLastAccess(key *StoreKey, etag *string, at time.Time) error {
+	input := &s3.CopyObjectInput{
+		Bucket:            aws.String(s.bucket),
+		Key:               aws.String(key.Id),
+		CopySource:        aws.String(s.bucket + "/" + url.PathEscape(key.Id)),
+		CopySourceIfMatch: etag,
+		MetadataDirective: aws.String(s3.MetadataDirectiveReplace),
+		Metadata:          lastAccessMetadata(at),
+	}
+
+	_, err := s.s3.CopyObject(input)
+	return err
+}
+
+func lastAccessMetadata(at time.Time) map[string]*string {
+	return map[string]*string{
+		s3LastAccessedMetadata: aws.String(at.UTC().Format(time.RFC3339)),
+	}
 }
 
 // Put a DataRequest (see api.DataRequestStore)
@@ -66,9 +192,10 @@ func (s *S3DataRequestStore) Put(key *StoreKey, dr DataRequest, _ *Principal) (*
 	}
 
 	input := &s3.PutObjectInput{
-		Body:   aws.ReadSeekCloser(bytes.NewReader(bs)),
-		Bucket: aws.String(s.bucket),
-		Key:    aws.String(key.Id),
+		Body:     aws.ReadSeekCloser(bytes.NewReader(bs)),
+		Bucket:   aws.String(s.bucket),
+		Key:      aws.String(key.Id),
+		Metadata: lastAccessMetadata(time.Now()),
 	}
 
 	_, err = s.s3.PutObject(input)
@@ -87,6 +214,28 @@ func (s *S3DataRequestStore) Put(key *StoreKey, dr DataRequest, _ *Principal) (*
 	return key, nil
 }
 
+// Delete a DataRequest (see api.DataRequestStore)
+func (s *S3DataRequestStore) Delete(key *StoreKey, _ *Principal) error {
+	input := &s3.DeleteObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(key.Id),
+	}
+
+	if _, err := s.s3.DeleteObject(input); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if up, ok := s.watchers[key.Id]; ok {
+		up.cb(DataRequest{})
+		delete(s.watchers, key.Id)
+		close(up.done)
+	}
+
+	return nil
+}
+
 // Watch adds a watcher to provide change notifications when the store is changed
 func (s *S3DataRequestStore) Watch(key *StoreKey, etag string, timeout time.Duration, cb func(DataRequest), principal *Principal) (bool, error) {
 	dr, found, err := s.Get(key, principal)
@@ -157,6 +306,38 @@ func (s *S3DataRequestStore) List(prefix *StoreKey, _ *Principal) ([]*StoreKey,
 	return keys, nil
 }
 
+// listPage lists a page of keys, whose cursors are the continuation tokens
+// of S3.
+func (s *S3DataRequestStore) listPage(prefix, cursor string, limit int) ([]string, string, error) {
+	input := &s3.ListObjectsV2Input{
+		Bucket:  aws.String(s.bucket),
+		MaxKeys: aws.Int64(int64(limit)),
+	}
+	if prefix != "" {
+		input.Prefix = aws.String(prefix)
+	}
+	if cursor != "" {
+		input.ContinuationToken = aws.String(cursor)
+	}
+
+	res, err := s.s3.ListObjectsV2(input)
+	if err != nil {
+		return nil, "", err
+	}
+
+	keys := make([]string, 0, len(res.Contents))
+	for _, item := range res.Contents {
+		keys = append(keys, *item.Key)
+	}
+
+	var next string
+	if aws.BoolValue(res.IsTruncated) {
+		next = aws.StringValue(res.NextContinuationToken)
+	}
+
+	return keys, next, nil
+}
+
 // ListAll the keys that are set (see api.DataRequestStore)
 func (s *S3DataRequestStore) ListAll(principal *Principal) ([]*StoreKey, error) {
 	return s.List(&StoreKey{Id: ""}, principal)
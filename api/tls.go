@@ -0,0 +1,101 @@
+package api
+
+import (
+	"crypto/tls"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// certReloadInterval is how often the certificate files are checked for
+// changes, at most.
+const certReloadInterval = 10 * time.Second
+
+// certReloader serves a certificate from files, reloading it when the files
+// change so that renewed certificates are served without a restart.
+type certReloader struct {
+	certFile, keyFile string
+
+	mu        sync.Mutex
+	cert      *tls.Certificate
+	modTime   time.Time
+	lastCheck time.Time
+	now       func() time.Time
+}
+
+func newCertReloader(certFile, keyFile string) (*certReloader, error) {
+	c := &certReloader{certFile: certFile, keyFile: keyFile, now: time.Now}
+	if err := c.reload(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// getCertificate implements tls.Config.GetCertificate. If the files changed
+// but fail to load, e.g. while they are being replaced, the previous
+// certificate is served.
+func (c *certReloader) getCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if now := c.now(); now.Sub(c.lastCheck) >= certReloadInterval {
+		c.lastCheck = now
+		if err := c.reload(); err != nil {
+			log.WithError(err).Warn("Failed to reload TLS certificate.")
+		}
+	}
+
+	return c.cert, nil
+}
+
+// reload loads the certificate if the files were modified since it was last
+// loaded. The caller must hold the lock, except in newCertReloader.
+func (c *certReloader) reload() error {
+	modTime, err := latestModTime(c.certFile, c.keyFile)
+	if err != nil {
+		return err
+	}
+	if c.cert != nil && !modTime.After(c.modTime) {
+		return nil
+	}
+
+	cert, err := tls.LoadX509KeyPair(c.certFile, c.keyFile)
+	if err != nil {
+		return fmt.Errorf("failed to load TLS certificate: %w", err)
+	}
+
+	if c.cert != nil {
+		log.WithField("cert_file", c.certFile).Info("Reloaded TLS certificate.")
+	}
+
+	c.cert, c.modTime = &cert, modTime
+	return nil
+}
+
+func latestModTime(files ...string) (time.Time, error) {
+	var latest time.Time
+	for _, f := range files {
+		fi, err := os.Stat(f)
+		if err != nil {
+			return time.Time{}, err
+		}
+		if fi.ModTime().After(latest) {
+			latest = fi.ModTime()
+		}
+	}
+	return latest, nil
+}
+
+// EnableTLS serves the API over TLS with the certificate and key in the given
+// files, which are reloaded when they change.
+func (api *API) EnableTLS(certFile, keyFile string) error {
+	c, err := newCertReloader(certFile, keyFile)
+	if err != nil {
+		return err
+	}
+	api.certs = c
+	return nil
+}
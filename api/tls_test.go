@@ -0,0 +1,110 @@
+package api
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func writeTestCert(t *testing.T, certFile, keyFile, name string, modTime time.Time) {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, f := range []string{certFile, keyFile} {
+		if err := os.Chtimes(f, modTime, modTime); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestCertReloader(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "tls.crt"), filepath.Join(dir, "tls.key")
+
+	modTime := time.Now().Add(-time.Hour)
+	writeTestCert(t, certFile, keyFile, "first", modTime)
+
+	c, err := newCertReloader(certFile, keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Now()
+	c.now = func() time.Time { return now }
+
+	commonName := func() string {
+		cert, err := c.getCertificate(nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		leaf, err := x509.ParseCertificate(cert.Certificate[0])
+		if err != nil {
+			t.Fatal(err)
+		}
+		return leaf.Subject.CommonName
+	}
+
+	if name := commonName(); name != "first" {
+		t.Fatalf("expected the first certificate but got: %v", name)
+	}
+
+	writeTestCert(t, certFile, keyFile, "second", modTime.Add(time.Minute))
+
+	if name := commonName(); name != "first" {
+		t.Fatalf("expected the certificate not to be checked again yet, got: %v", name)
+	}
+
+	now = now.Add(certReloadInterval)
+	if name := commonName(); name != "second" {
+		t.Fatalf("expected the renewed certificate but got: %v", name)
+	}
+
+	// A broken renewal keeps the previous certificate.
+	if err := os.WriteFile(certFile, []byte("broken"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	now = now.Add(certReloadInterval)
+	if name := commonName(); name != "second" {
+		t.Fatalf("expected the previous certificate but got: %v", name)
+	}
+
+	if _, err := newCertReloader(certFile, keyFile); err == nil {
+		t.Fatal("expected an error for a broken certificate")
+	}
+}
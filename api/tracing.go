@@ -0,0 +1,420 @@
+package api
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	log "github.com/sirupsen/logrus"
+	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	"go.opentelemetry.io/otel/trace"
+	"golang.org/x/oauth2"
+
+	"github.com/open-policy-agent/rego-playground/version"
+)
+
+// Exporters of the spans, see TracingExporter.
+const (
+	TracingExporterNone   = "none"
+	TracingExporterOTLP   = "otlp"   // OTLP over HTTP, configured by the OTEL_EXPORTER_OTLP_* variables unless an endpoint is set
+	TracingExporterStdout = "stdout" // JSON lines, for debugging
+
+	tracingServiceName = "rego-playground"
+)
+
+var (
+	tracer = otel.Tracer("github.com/open-policy-agent/rego-playground/api")
+
+	// propagator extracts the trace context of incoming requests from their
+	// traceparent, tracestate and baggage headers.
+	propagator = propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{})
+
+	// githubHTTPClient traces the calls to the GitHub API. The trace context
+	// isn't sent to GitHub.
+	githubHTTPClient = &http.Client{
+		Transport: otelhttp.NewTransport(http.DefaultTransport,
+			otelhttp.WithPropagators(propagation.NewCompositeTextMapPropagator()),
+			otelhttp.WithSpanNameFormatter(func(_ string, r *http.Request) string {
+				return "GitHub " + r.Method
+			}),
+		),
+	}
+
+	// untracedPaths are the paths of probes and scrapes, which would drown
+	// the traces of users' requests.
+	untracedPaths = []string{"/metrics", "/v1/system/"}
+)
+
+// TracingService exports the spans of the playground, and of the OPA
+// compilations and evaluations it runs, as configured with its options.
+type TracingService struct {
+	exporter    string
+	endpoint    string
+	sampleRatio float64
+	out         io.Writer
+
+	provider *sdktrace.TracerProvider
+}
+
+type TracingServiceOption func(*TracingService)
+
+// NewTracingService returns a service exporting no spans unless configured
+// to.
+func NewTracingService(options ...TracingServiceOption) *TracingService {
+	s := &TracingService{
+		exporter:    TracingExporterNone,
+		sampleRatio: 1,
+		out:         os.Stdout,
+	}
+
+	for _, opt := range options {
+		opt(s)
+	}
+
+	return s
+}
+
+// TracingExporter sets the exporter of the spans, one of TracingExporterNone,
+// TracingExporterOTLP or TracingExporterStdout.
+func TracingExporter(name string) TracingServiceOption {
+	return func(s *TracingService) {
+		s.exporter = name
+	}
+}
+
+// TracingEndpoint sets the URL the OTLP exporter sends the spans to, e.g.
+// http://collector:4318/v1/traces.
+func TracingEndpoint(url string) TracingServiceOption {
+	return func(s *TracingService) {
+		s.endpoint = url
+	}
+}
+
+// TracingSampleRatio sets the ratio of the traces started by the playground
+// that are sampled. Traces started by a caller are sampled if it sampled
+// them.
+func TracingSampleRatio(ratio float64) TracingServiceOption {
+	return func(s *TracingService) {
+		s.sampleRatio = ratio
+	}
+}
+
+// TracingOutput sets the writer of the stdout exporter.
+func TracingOutput(w io.Writer) TracingServiceOption {
+	return func(s *TracingService) {
+		s.out = w
+	}
+}
+
+// Name returns the name of the service.
+func (*TracingService) Name() string {
+	return "tracing"
+}
+
+// Init sets up the exporter, and the global tracer provider and propagator.
+func (s *TracingService) Init(ctx context.Context) error {
+	if s.sampleRatio < 0 || s.sampleRatio > 1 {
+		return fmt.Errorf("sample ratio must be between 0 and 1")
+	}
+
+	var exporter sdktrace.SpanExporter
+	var err error
+
+	switch s.exporter {
+	case TracingExporterNone, "":
+		return nil
+	case TracingExporterOTLP:
+		var opts []otlptracehttp.Option
+		if s.endpoint != "" {
+			opts = append(opts, otlptracehttp.WithEndpointURL(s.endpoint))
+		}
+		exporter, err = otlptracehttp.New(ctx, opts...)
+	case TracingExporterStdout:
+		exporter, err = stdouttrace.New(stdouttrace.WithWriter(s.out))
+	default:
+		return fmt.Errorf("unknown tracing exporter %q", s.exporter)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to create tracing exporter: %w", err)
+	}
+
+	res, err := resource.Merge(resource.Default(), resource.NewSchemaless(
+		semconv.ServiceName(tracingServiceName),
+		semconv.ServiceVersion(version.Version),
+	))
+	if err != nil {
+		return err
+	}
+
+	s.provider = sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(res),
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(s.sampleRatio))),
+	)
+
+	otel.SetTracerProvider(s.provider)
+	otel.SetTextMapPropagator(propagator)
+
+	log.WithField("exporter", s.exporter).Info("Exporting traces.")
+	return nil
+}
+
+// Start does nothing, as spans are exported in the background once Init set
+// up the provider.
+func (*TracingService) Start(context.Context) error {
+	return nil
+}
+
+// Stop exports the remaining spans. It should be stopped after the services
+// creating spans.
+func (s *TracingService) Stop(ctx context.Context) {
+	if s.provider == nil {
+		return
+	}
+	if err := s.provider.Shutdown(ctx); err != nil {
+		log.WithError(err).Warn("Failed to export the remaining spans.")
+	}
+}
+
+// handler returns the handler of the server: the router, traced and
+// recovering from panics.
+func (api *API) handler() http.Handler {
+	return RecoveryHandler()(otelhttp.NewHandler(api.router, "",
+		otelhttp.WithPropagators(propagator),
+		otelhttp.WithFilter(func(r *http.Request) bool {
+			for _, p := range untracedPaths {
+				if strings.HasPrefix(r.URL.Path, p) {
+					return false
+				}
+			}
+			return true
+		}),
+		otelhttp.WithSpanNameFormatter(func(_ string, r *http.Request) string {
+			return r.Method
+		}),
+	))
+}
+
+// traceRoute names the span of a request after its route, once routed, so
+// that spans are grouped by handler rather than by key.
+func traceRoute(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if route := mux.CurrentRoute(r); route != nil {
+			if tmpl, err := route.GetPathTemplate(); err == nil {
+				span := trace.SpanFromContext(r.Context())
+				span.SetName(r.Method + " " + tmpl)
+				span.SetAttributes(semconv.HTTPRoute(tmpl))
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// endSpan ends span, recording err if any.
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+// withGithubHTTPClient returns a context making the OAuth2 clients use
+// githubHTTPClient.
+func withGithubHTTPClient(ctx context.Context) context.Context {
+	return context.WithValue(ctx, oauth2.HTTPClient, githubHTTPClient)
+}
+
+// traceLogHook adds the IDs of the span of the context of log entries, given
+// with log.WithContext, to them.
+type traceLogHook struct{}
+
+func (traceLogHook) Levels() []log.Level {
+	return log.AllLevels
+}
+
+func (traceLogHook) Fire(e *log.Entry) error {
+	if e.Context == nil {
+		return nil
+	}
+	if sc := trace.SpanContextFromContext(e.Context); sc.IsValid() {
+		e.Data["trace_id"] = sc.TraceID().String()
+		e.Data["span_id"] = sc.SpanID().String()
+	}
+	return nil
+}
+
+// tracedStore traces the calls to a store as children of the span of ctx,
+// and measures them.
+type tracedStore struct {
+	ctx     context.Context
+	name    string
+	store   DataRequestStore
+	metrics *apiMetrics
+}
+
+// v1 returns the v1 store, tracing its calls as children of the span of ctx.
+func (api *API) v1(ctx context.Context) *tracedStore {
+	return &tracedStore{ctx: ctx, name: "v1", store: api.v1Store, metrics: api.metrics}
+}
+
+// v2 returns the v2 store, tracing its calls as children of the span of ctx.
+func (api *API) v2(ctx context.Context) *tracedStore {
+	return &tracedStore{ctx: ctx, name: "v2", store: api.v2Store, metrics: api.metrics}
+}
+
+// start starts the span of an operation, returning it and the function
+// ending and measuring it.
+func (s *tracedStore) start(op string, key *StoreKey) (trace.Span, func(error)) {
+	begin := time.Now()
+	backend := storeBackend(s.store)
+
+	_, span := tracer.Start(s.ctx, "store."+op, trace.WithAttributes(
+		attribute.String("playground.store", s.name),
+		attribute.String("playground.store.backend", backend),
+	))
+	if key != nil {
+		span.SetAttributes(attribute.String("playground.key", key.Id))
+	}
+
+	return span, func(err error) {
+		s.metrics.observeStore(backend, op, begin, err)
+		endSpan(span, err)
+	}
+}
+
+func (s *tracedStore) Get(key *StoreKey, principal *Principal) (DataRequest, bool, error) {
+	span, end := s.start("Get", key)
+	dr, found, err := s.store.Get(key, principal)
+	span.SetAttributes(attribute.Bool("playground.found", found))
+	end(err)
+	return dr, found, err
+}
+
+func (s *tracedStore) Put(key *StoreKey, dr DataRequest, principal *Principal) (*StoreKey, error) {
+	_, end := s.start("Put", key)
+	key, err := s.store.Put(key, dr, principal)
+	end(err)
+	return key, err
+}
+
+func (s *tracedStore) List(prefix *StoreKey, principal *Principal) ([]*StoreKey, error) {
+	span, end := s.start("List", prefix)
+	keys, err := s.store.List(prefix, principal)
+	span.SetAttributes(attribute.Int("playground.keys", len(keys)))
+	end(err)
+	return keys, err
+}
+
+func (s *tracedStore) ListAll(principal *Principal) ([]*StoreKey, error) {
+	span, end := s.start("ListAll", nil)
+	keys, err := s.store.ListAll(principal)
+	span.SetAttributes(attribute.Int("playground.keys", len(keys)))
+	end(err)
+	return keys, err
+}
+
+func (s *tracedStore) Watch(key *StoreKey, etag string, timeout time.Duration, cb func(DataRequest), principal *Principal) (bool, error) {
+	span, end := s.start("Watch", key)
+	found, err := s.store.Watch(key, etag, timeout, cb, principal)
+	span.SetAttributes(attribute.Bool("playground.found", found))
+	end(err)
+	return found, err
+}
+
+func (s *tracedStore) Delete(key *StoreKey, principal *Principal) error {
+	_, end := s.start("Delete", key)
+	err := s.store.Delete(key, principal)
+	end(err)
+	return err
+}
+
+// peek gets a DataRequest without recording an access if the store is an
+// accessTracker, and like Get otherwise.
+func (s *tracedStore) peek(key *StoreKey) (DataRequest, bool, error) {
+	tracker, ok := s.store.(accessTracker)
+	if !ok {
+		return s.Get(key, nil)
+	}
+
+	span, end := s.start("peek", key)
+	dr, found, err := tracker.peek(key)
+	span.SetAttributes(attribute.Bool("playground.found", found))
+	end(err)
+	return dr, found, err
+}
+
+// update updates a DataRequest atomically if the store is a shareUpdater,
+// and with peek and Put otherwise.
+func (s *tracedStore) update(key *StoreKey, fn func(*DataRequest) error) (bool, error) {
+	updater, ok := s.store.(shareUpdater)
+	if !ok {
+		dr, found, err := s.peek(key)
+		if err != nil || !found {
+			return found, err
+		}
+		if err := fn(&dr); err != nil {
+			return true, err
+		}
+		_, err = s.Put(key, dr, nil)
+		return true, err
+	}
+
+	span, end := s.start("update", key)
+	found, err := updater.update(key, fn)
+	span.SetAttributes(attribute.Bool("playground.found", found))
+	end(err)
+	return found, err
+}
+
+// listPage lists a page of keys if the store is a sharePager, and pages all
+// its keys by the last key of each page otherwise.
+func (s *tracedStore) listPage(prefix, cursor string, limit int) ([]string, string, error) {
+	pager, ok := s.store.(sharePager)
+	if !ok {
+		keys, err := s.List(&StoreKey{Id: prefix}, nil)
+		if err != nil {
+			return nil, "", err
+		}
+		ids := make([]string, 0, len(keys))
+		for _, key := range keys {
+			ids = append(ids, key.Id)
+		}
+		ids, next := pageKeys(ids, cursor, limit)
+		return ids, next, nil
+	}
+
+	span, end := s.start("listPage", &StoreKey{Id: prefix})
+	keys, next, err := pager.listPage(prefix, cursor, limit)
+	span.SetAttributes(attribute.Int("playground.keys", len(keys)))
+	end(err)
+	return keys, next, err
+}
+
+// storeBackend returns the name of the backend of store.
+func storeBackend(store DataRequestStore) string {
+	switch store.(type) {
+	case *MemoryDataRequestStore:
+		return "memory"
+	case *S3DataRequestStore:
+		return "s3"
+	case *GistStore:
+		return "gist"
+	default:
+		return "other"
+	}
+}
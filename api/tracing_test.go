@@ -0,0 +1,125 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	log "github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+var (
+	recordedSpans   = tracetest.NewInMemoryExporter()
+	recordSpansOnce sync.Once
+)
+
+// recordSpans makes the global tracer provider record the spans, which are
+// reset. The tracers of the packages are bound to the first global provider,
+// so it's set once.
+func recordSpans() *tracetest.InMemoryExporter {
+	recordSpansOnce.Do(func() {
+		otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSyncer(recordedSpans)))
+	})
+	recordedSpans.Reset()
+	return recordedSpans
+}
+
+func TestApiTracing(t *testing.T) {
+	spans := recordSpans()
+
+	s := NewAPIService("", NewMemoryDataRequestStore(), nil, "./", "", "", "")
+	handler := s.handler()
+
+	const traceID = "4bf92f3577b34da6a3ce929d0e0e4736"
+
+	do := func(method, path, body string) {
+		r := httptest.NewRequest(method, path, strings.NewReader(body))
+		r.Header.Set("traceparent", "00-"+traceID+"-00f067aa0ba902b7-01")
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected 200 response for %v but got: %v, %v", path, w.Code, w.Body.String())
+		}
+	}
+
+	body := `{"rego_modules": {"test.rego": "package test\np := 1"}, "rego": "data.test.p"}`
+	do("POST", "/v1/share", body)
+	do("POST", "/v1/data", body)
+	do("GET", "/v1/system/alive", "")
+
+	names := map[string]bool{}
+	for _, span := range spans.GetSpans() {
+		if span.SpanContext.TraceID().String() != traceID {
+			t.Fatalf("expected span %v to continue the incoming trace, got: %v", span.Name, span.SpanContext.TraceID())
+		}
+		names[span.Name] = true
+	}
+
+	for _, name := range []string{"POST /v1/share", "store.Put", "POST /v1/data", "opa.Compile", "opa.Eval"} {
+		if !names[name] {
+			t.Fatalf("expected span %v, got: %v", name, names)
+		}
+	}
+
+	if len(names) != 5 {
+		t.Fatalf("expected the probe not to be traced, got: %v", names)
+	}
+}
+
+func TestTraceLogHook(t *testing.T) {
+	recordSpans()
+
+	ctx, span := tracer.Start(context.Background(), "test")
+	defer span.End()
+
+	var buf bytes.Buffer
+	logger := log.New()
+	logger.SetOutput(&buf)
+	logger.SetFormatter(&log.JSONFormatter{})
+	logger.AddHook(traceLogHook{})
+
+	logger.WithContext(ctx).Info("correlated")
+	logger.Info("not correlated")
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if !strings.Contains(lines[0], `"trace_id":"`+span.SpanContext().TraceID().String()+`"`) || !strings.Contains(lines[0], `"span_id":"`) {
+		t.Fatalf("expected the entry to be correlated, got: %v", lines[0])
+	}
+	if strings.Contains(lines[1], "trace_id") {
+		t.Fatalf("expected the entry not to be correlated, got: %v", lines[1])
+	}
+}
+
+func TestTracingService(t *testing.T) {
+	// Bind the tracers of the packages before the service replaces the global
+	// provider, and restore it.
+	recordSpans()
+	prev := otel.GetTracerProvider()
+	defer otel.SetTracerProvider(prev)
+
+	if err := NewTracingService(TracingExporter("jaeger")).Init(context.Background()); err == nil {
+		t.Fatal("expected an error for an unknown exporter")
+	}
+
+	var buf bytes.Buffer
+	s := NewTracingService(TracingExporter(TracingExporterStdout), TracingOutput(&buf))
+	if err := s.Init(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	_, span := otel.Tracer("test").Start(context.Background(), "exported")
+	span.End()
+
+	s.Stop(context.Background())
+
+	if out := buf.String(); !strings.Contains(out, `"Name":"exported"`) || !strings.Contains(out, tracingServiceName) {
+		t.Fatalf("expected the span to be exported, got: %v", out)
+	}
+}
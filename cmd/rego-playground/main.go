@@ -5,6 +5,7 @@ package main
 import (
 	"context"
 	"fmt"
+	"io"
 	"net"
 	"os"
 	"path"
@@ -43,21 +44,65 @@ type cliConfig struct {
 	UIContentRoot string
 	ExternalURL   string
 
+	TLSCertFile string
+	TLSKeyFile  string
+
+	ShareGCInterval time.Duration
+	ShareMaxIdle    time.Duration
+	ShareGCDryRun   bool
+
+	AdminToken    string
+	AdminAuditLog string
+
+	Blocklist string
+
+	RateLimit               bool
+	RateLimitTrustedProxies []string
+	RateLimitEval           string
+	RateLimitLint           string
+	RateLimitShare          string
+	RateLimitBundle         string
+	RateLimitRead           string
+
+	TracingExporter    string
+	TracingEndpoint    string
+	TracingSampleRatio float64
+
 	ConfigFile string
 }
 
 const (
-	configKeyHTTPAddr       = "addr"
-	configKeyHTTPPort       = "port"
-	configKeyVerbose        = "verbose"
-	configKeyLogFormat      = "log-format"
-	configKeyNoPersist      = "no-persist"
-	configKeyRegion         = "aws-region"
-	configKeyResourcePrefix = "resource-prefix"
-	configKeyS3Endpoint     = "s3-endpoint"
-	configKeyUIContentRoot  = "ui-content-root"
-	configKeyExternalURL    = "external-url"
-	configKeyConfigFile     = "config-file"
+	configKeyHTTPAddr        = "addr"
+	configKeyHTTPPort        = "port"
+	configKeyVerbose         = "verbose"
+	configKeyLogFormat       = "log-format"
+	configKeyNoPersist       = "no-persist"
+	configKeyRegion          = "aws-region"
+	configKeyResourcePrefix  = "resource-prefix"
+	configKeyS3Endpoint      = "s3-endpoint"
+	configKeyUIContentRoot   = "ui-content-root"
+	configKeyExternalURL     = "external-url"
+	configKeyTLSCertFile     = "tls-cert-file"
+	configKeyTLSKeyFile      = "tls-key-file"
+	configKeyConfigFile      = "config-file"
+	configKeyShareGCInterval = "share-gc-interval"
+	configKeyShareMaxIdle    = "share-max-idle"
+	configKeyShareGCDryRun   = "share-gc-dry-run"
+	configKeyAdminToken      = "admin-token"
+	configKeyAdminAuditLog   = "admin-audit-log"
+	configKeyBlocklist       = "blocklist"
+
+	configKeyRateLimit               = "rate-limit"
+	configKeyRateLimitTrustedProxies = "rate-limit-trusted-proxies"
+	configKeyRateLimitEval           = "rate-limit-eval"
+	configKeyRateLimitLint           = "rate-limit-lint"
+	configKeyRateLimitShare          = "rate-limit-share"
+	configKeyRateLimitBundle         = "rate-limit-bundle"
+	configKeyRateLimitRead           = "rate-limit-read"
+
+	configKeyTracingExporter    = "tracing-exporter"
+	configKeyTracingEndpoint    = "tracing-endpoint"
+	configKeyTracingSampleRatio = "tracing-sample-ratio"
 )
 
 var (
@@ -92,7 +137,25 @@ func init() {
 	cmd.Flags().StringVar(&config.S3Endpoint, configKeyS3Endpoint, config.S3Endpoint, "AWS S3 endpoint.")
 	cmd.Flags().StringVar(&config.UIContentRoot, configKeyUIContentRoot, "/openpolicyagent/ui", "Root directory of the ui content to be served.")
 	cmd.Flags().StringVar(&config.ExternalURL, configKeyExternalURL, "https://play.openpolicyagent.org", "The external URL which the service should be accessed.")
+	cmd.Flags().StringVar(&config.TLSCertFile, configKeyTLSCertFile, "", "Certificate file to serve TLS with, reloaded when it changes.")
+	cmd.Flags().StringVar(&config.TLSKeyFile, configKeyTLSKeyFile, "", "Key file of the TLS certificate, reloaded when it changes.")
 	cmd.Flags().StringVar(&config.ConfigFile, configKeyConfigFile, "", "Config file to use (same options as via CLI or ENV)")
+	cmd.Flags().DurationVar(&config.ShareGCInterval, configKeyShareGCInterval, 0, "Interval of deleting expired and idle shares, 0 disables it.")
+	cmd.Flags().DurationVar(&config.ShareMaxIdle, configKeyShareMaxIdle, 0, "Delete shares not accessed for this long, 0 keeps them.")
+	cmd.Flags().BoolVar(&config.ShareGCDryRun, configKeyShareGCDryRun, config.ShareGCDryRun, "Only log and count the shares that would be deleted.")
+	cmd.Flags().StringVar(&config.AdminToken, configKeyAdminToken, "", "Bearer token of the admin API, which is disabled without one. Prefer setting it via PLAYGROUND_ADMIN_TOKEN.")
+	cmd.Flags().StringVar(&config.AdminAuditLog, configKeyAdminAuditLog, "", "File to append the audit log of the admin API to, in addition to the service log.")
+	cmd.Flags().BoolVar(&config.RateLimit, configKeyRateLimit, true, "Limit the rate of requests per client IP and GitHub principal. Behind a proxy or load balancer, set --rate-limit-trusted-proxies, or all clients share the budget of the proxy's IP.")
+	cmd.Flags().StringSliceVar(&config.RateLimitTrustedProxies, configKeyRateLimitTrustedProxies, nil, "IPs or CIDR ranges of proxies whose X-Forwarded-For and X-Real-IP headers are trusted. Required for --rate-limit to tell clients apart behind a proxy.")
+	cmd.Flags().StringVar(&config.RateLimitEval, configKeyRateLimitEval, "", "Rate limit of evaluations, e.g. 60/1m:30 for 60 per minute with bursts of 30.")
+	cmd.Flags().StringVar(&config.RateLimitLint, configKeyRateLimitLint, "", "Rate limit of linting and formatting, e.g. 300/1m:100.")
+	cmd.Flags().StringVar(&config.RateLimitShare, configKeyRateLimitShare, "", "Rate limit of share creation, e.g. 1/1m:20.")
+	cmd.Flags().StringVar(&config.RateLimitBundle, configKeyRateLimitBundle, "", "Rate limit of bundle polling, e.g. 60/1m:60.")
+	cmd.Flags().StringVar(&config.RateLimitRead, configKeyRateLimitRead, "", "Rate limit of share reads, e.g. 300/1m:100. Reads that evaluate the share are limited as evaluations too.")
+	cmd.Flags().StringVar(&config.TracingExporter, configKeyTracingExporter, api.TracingExporterNone, "Exporter of OpenTelemetry traces, valid options are 'none', 'otlp', 'stdout'.")
+	cmd.Flags().StringVar(&config.TracingEndpoint, configKeyTracingEndpoint, "", "URL of the OTLP/HTTP traces endpoint, e.g. http://localhost:4318/v1/traces. Defaults to the OTEL_EXPORTER_OTLP_* variables.")
+	cmd.Flags().Float64Var(&config.TracingSampleRatio, configKeyTracingSampleRatio, 1, "Ratio of the traces started by the playground that are sampled.")
+	cmd.Flags().StringVar(&config.Blocklist, configKeyBlocklist, "", "JSON or YAML file of rules that rejects or quarantines shares matching them.")
 
 	// Setup config file bindings
 	err := viper.BindPFlags(cmd.Flags())
@@ -168,10 +231,105 @@ func run(cmd *cobra.Command, args []string) {
 	addr := fmt.Sprintf("%v:%v", viper.GetString(configKeyHTTPAddr), viper.GetString(configKeyHTTPPort))
 	apiService := api.NewAPIService(addr, v1Store, v2Store, viper.GetString(configKeyUIContentRoot), viper.GetString(configKeyExternalURL), githubClientID, githubClientSecret)
 
+	certFile, keyFile := viper.GetString(configKeyTLSCertFile), viper.GetString(configKeyTLSKeyFile)
+	if (certFile == "") != (keyFile == "") {
+		log.Fatalf("Both --%s and --%s must be set to serve TLS", configKeyTLSCertFile, configKeyTLSKeyFile)
+	}
+	if certFile != "" {
+		if err := apiService.EnableTLS(certFile, keyFile); err != nil {
+			log.Fatalf("Failed to enable TLS: %s", err)
+		}
+	}
+
+	if token := viper.GetString(configKeyAdminToken); token != "" {
+		var audit io.Writer
+		if name := viper.GetString(configKeyAdminAuditLog); name != "" {
+			f, err := os.OpenFile(name, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o600)
+			if err != nil {
+				log.Fatalf("Failed to open admin audit log: %s", err)
+			}
+			defer f.Close()
+			audit = f
+		}
+		apiService.EnableAdmin(token, audit)
+	}
+
+	if name := viper.GetString(configKeyBlocklist); name != "" {
+		f, err := os.Open(name)
+		if err != nil {
+			log.Fatalf("Failed to open blocklist: %s", err)
+		}
+		blocklist, err := api.LoadBlocklist(f)
+		f.Close()
+		if err != nil {
+			log.Fatalf("Failed to load blocklist: %s", err)
+		}
+		apiService.SetBlocklist(blocklist)
+	}
+
+	if viper.GetBool(configKeyRateLimit) {
+		limiter, err := rateLimiter(apiService)
+		if err != nil {
+			log.Fatalf("Invalid rate limit configuration: %s", err)
+		}
+		apiService.SetRateLimiter(limiter)
+	}
+
+	services := []utils.Service{apiService}
+
+	if interval := viper.GetDuration(configKeyShareGCInterval); interval > 0 {
+		services = append(services, api.NewGCService(v1Store,
+			api.GCInterval(interval),
+			api.GCMaxIdle(viper.GetDuration(configKeyShareMaxIdle)),
+			api.GCDryRun(viper.GetBool(configKeyShareGCDryRun)),
+			api.GCMetrics(apiService.Metrics()),
+		))
+	}
+
+	// Stopped last, to export the spans of the other services.
+	services = append(services, api.NewTracingService(
+		api.TracingExporter(viper.GetString(configKeyTracingExporter)),
+		api.TracingEndpoint(viper.GetString(configKeyTracingEndpoint)),
+		api.TracingSampleRatio(viper.GetFloat64(configKeyTracingSampleRatio)),
+	))
+
 	ctx := context.Background()
-	utils.RunServices(ctx,
-		apiService,
-	)
+	utils.RunServices(ctx, services...)
+}
+
+func rateLimiter(apiService *api.API) (*api.RateLimiter, error) {
+	proxies, err := api.ParseTrustedProxies(viper.GetStringSlice(configKeyRateLimitTrustedProxies))
+	if err != nil {
+		return nil, err
+	}
+
+	if len(proxies) == 0 {
+		log.Warnf("Rate limiting by the IP of the connection, as no proxies are trusted. If the server is behind a proxy or load balancer, all clients share its budget: set --%s to its IPs, or disable --%s.",
+			configKeyRateLimitTrustedProxies, configKeyRateLimit)
+	}
+
+	opts := []api.RateLimiterOption{
+		api.RateLimitTrustedProxies(proxies),
+		api.RateLimitMetrics(apiService.Metrics()),
+	}
+
+	for class, key := range map[string]string{
+		api.RateClassEval:   configKeyRateLimitEval,
+		api.RateClassLint:   configKeyRateLimitLint,
+		api.RateClassShare:  configKeyRateLimitShare,
+		api.RateClassBundle: configKeyRateLimitBundle,
+		api.RateClassRead:   configKeyRateLimitRead,
+	} {
+		if s := viper.GetString(key); s != "" {
+			limit, err := api.ParseRateLimit(s)
+			if err != nil {
+				return nil, err
+			}
+			opts = append(opts, api.RateLimitBudget(class, limit))
+		}
+	}
+
+	return api.NewRateLimiter(opts...), nil
 }
 
 func createTestBucket() (*s3.S3, string, error) {
@@ -7,6 +7,7 @@ package github
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
 	"time"
 
@@ -74,6 +75,16 @@ type GistFile struct {
 	Content  *string `json:"content,omitempty"`
 }
 
+// MarshalJSON marshals a file without any fields as null, which deletes the
+// file when the gist is edited.
+func (g GistFile) MarshalJSON() ([]byte, error) {
+	if g == (GistFile{}) {
+		return []byte("null"), nil
+	}
+	type gistFile GistFile
+	return json.Marshal(gistFile(g))
+}
+
 func (g GistFile) String() string {
 	return gh.Stringify(g)
 }
@@ -0,0 +1,234 @@
+package opa
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/open-policy-agent/opa/ast"
+	"github.com/open-policy-agent/opa/bundle"
+	"github.com/open-policy-agent/opa/compile"
+	"github.com/open-policy-agent/opa/rego"
+	"github.com/open-policy-agent/opa/storage"
+
+	// The Wasm engine evaluates the modules built for the wasm target.
+	_ "github.com/open-policy-agent/opa/features/wasm"
+)
+
+// Build targets, see the compile package.
+const (
+	TargetRego = compile.TargetRego
+	TargetPlan = compile.TargetPlan
+	TargetWasm = compile.TargetWasm
+)
+
+// BuildResult represents the result of the Build function.
+type BuildResult struct {
+	Target      string           `json:"target"`
+	Entrypoints []string         `json:"entrypoints"`
+	Plan        json.RawMessage  `json:"plan,omitempty"`        // The intermediate representation, for the plan target
+	Wasm        []byte           `json:"wasm,omitempty"`        // The compiled module, for the wasm target
+	Evaluations []WasmEvaluation `json:"evaluations,omitempty"` // The entrypoints evaluated with Wasm and topdown, for the wasm target
+}
+
+// WasmEvaluation compares the result of an entrypoint evaluated with OPA's
+// Wasm runtime with the result of the topdown evaluator.
+type WasmEvaluation struct {
+	Entrypoint string      `json:"entrypoint"`
+	Wasm       interface{} `json:"wasm"`
+	Topdown    interface{} `json:"topdown"`
+	Mismatch   bool        `json:"mismatch"`
+	Error      string      `json:"error,omitempty"` // Set if the entrypoint could not be evaluated with Wasm
+}
+
+// Build compiles the modules of a compile result for the plan or wasm target.
+// Entrypoints are given as `<package>/<rule>` paths or `data` refs; without
+// any, the query is used if it refers to a document under data. For the wasm
+// target, each entrypoint is also evaluated with the Wasm runtime and checked
+// against topdown, as not every built-in is supported in Wasm. The runtime is
+// only available in binaries built with OPA's Wasm engine; otherwise the
+// evaluations carry the reason instead of a result.
+func Build(ctx context.Context, input *CompileResult, target string, entrypoints []string) (*BuildResult, error) {
+	if target != TargetPlan && target != TargetWasm {
+		return nil, fmt.Errorf("unsupported target %q: use %q or %q", target, TargetPlan, TargetWasm)
+	}
+
+	if len(entrypoints) == 0 {
+		if ep, ok := queryEntrypoint(input.QueryParseResult.ParsedQuery); ok {
+			entrypoints = []string{ep}
+		} else {
+			return nil, fmt.Errorf("the %s target requires entrypoints", target)
+		}
+	}
+
+	paths := make([]string, len(entrypoints))
+	for i, ep := range entrypoints {
+		path, err := entrypointPath(ep)
+		if err != nil {
+			return nil, err
+		}
+		paths[i] = path
+	}
+
+	b := &bundle.Bundle{}
+	for name, m := range input.Modules {
+		b.Modules = append(b.Modules, bundle.ModuleFile{
+			URL:    name,
+			Path:   name,
+			Parsed: m,
+		})
+	}
+
+	if input.Store != nil {
+		data, err := storage.ReadOne(ctx, input.Store, storage.Path{})
+		if err != nil {
+			return nil, err
+		}
+		if obj, ok := data.(map[string]interface{}); ok {
+			b.Data = obj
+		}
+	}
+
+	compiler := compile.New().
+		WithCapabilities(caps).
+		WithRegoVersion(regoVersionOf(input.Modules)).
+		WithTarget(target).
+		WithEntrypoints(paths...).
+		WithBundle(b)
+	if err := compiler.Build(ctx); err != nil {
+		return nil, err
+	}
+
+	result := &BuildResult{
+		Target:      target,
+		Entrypoints: paths,
+	}
+
+	built := compiler.Bundle()
+	switch target {
+	case TargetPlan:
+		if len(built.PlanModules) == 0 {
+			return nil, errors.New("no plan was built")
+		}
+		result.Plan = built.PlanModules[0].Raw
+	case TargetWasm:
+		if len(built.WasmModules) == 0 {
+			return nil, errors.New("no wasm module was built")
+		}
+		result.Wasm = built.WasmModules[0].Raw
+
+		ctx, cancel := context.WithTimeout(ctx, evalTimeout)
+		defer cancel()
+
+		for _, path := range paths {
+			result.Evaluations = append(result.Evaluations, evalWasm(ctx, input, path))
+		}
+	}
+
+	return result, nil
+}
+
+// evalWasm evaluates the document at path with the Wasm runtime and topdown.
+func evalWasm(ctx context.Context, input *CompileResult, path string) WasmEvaluation {
+	ev := WasmEvaluation{Entrypoint: path}
+	query := "data." + strings.ReplaceAll(path, "/", ".")
+
+	eval := func(opts ...func(*rego.Rego)) (interface{}, error) {
+		opts = append(opts,
+			rego.Query(query),
+			rego.Compiler(input.Compiler),
+			rego.Store(input.Store),
+			rego.ParsedInput(input.ParsedInput),
+			rego.StrictBuiltinErrors(true),
+		)
+		rs, err := rego.New(opts...).Eval(ctx)
+		if err != nil {
+			return nil, err
+		}
+		if len(rs) == 0 {
+			return nil, nil
+		}
+		return rs[0].Expressions[0].Value, nil
+	}
+
+	var err error
+	ev.Topdown, err = eval()
+	if err != nil {
+		ev.Error = fmt.Sprintf("topdown: %v", err)
+		return ev
+	}
+
+	ev.Wasm, err = eval(rego.Target(TargetWasm))
+	if err != nil {
+		ev.Error = fmt.Sprintf("wasm: %v", err)
+		return ev
+	}
+
+	ev.Mismatch = !equalValues(ev.Wasm, ev.Topdown)
+	return ev
+}
+
+// queryEntrypoint returns the entrypoint for queries of the form `data.x.y`.
+func queryEntrypoint(query ast.Body) (string, bool) {
+	if len(query) != 1 {
+		return "", false
+	}
+
+	term, ok := query[0].Terms.(*ast.Term)
+	if !ok {
+		return "", false
+	}
+
+	ref, ok := term.Value.(ast.Ref)
+	if !ok || !ref.HasPrefix(ast.DefaultRootRef) || len(ref) < 2 {
+		return "", false
+	}
+
+	path, err := storage.NewPathForRef(ref)
+	if err != nil {
+		return "", false
+	}
+
+	return strings.Join(path, "/"), true
+}
+
+// entrypointPath normalises an entrypoint to the `<package>/<rule>` form.
+func entrypointPath(ep string) (string, error) {
+	if !strings.HasPrefix(ep, ast.DefaultRootDocument.String()+".") {
+		return strings.TrimPrefix(ep, "/"), nil
+	}
+
+	body, err := ast.ParseBody(ep)
+	if err != nil {
+		return "", fmt.Errorf("entrypoint %v not valid: %w", ep, err)
+	}
+
+	path, ok := queryEntrypoint(body)
+	if !ok {
+		return "", fmt.Errorf("entrypoint %v not valid: use <package>/<rule>", ep)
+	}
+
+	return path, nil
+}
+
+// regoVersionOf returns the Rego version the modules were parsed for.
+func regoVersionOf(modules map[string]*ast.Module) ast.RegoVersion {
+	for _, m := range modules {
+		return m.RegoVersion()
+	}
+	return ast.DefaultRegoVersion
+}
+
+func equalValues(a, b interface{}) bool {
+	av, err := ast.InterfaceToValue(a)
+	if err != nil {
+		return false
+	}
+	bv, err := ast.InterfaceToValue(b)
+	if err != nil {
+		return false
+	}
+	return av.Compare(bv) == 0
+}
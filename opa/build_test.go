@@ -0,0 +1,114 @@
+package opa
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"reflect"
+	"testing"
+
+	"github.com/open-policy-agent/opa/util"
+)
+
+func TestBuild(t *testing.T) {
+	ctx := context.Background()
+	input := util.MustUnmarshalJSON([]byte(`{"x": 1}`))
+	policy := "package play\n\nallow if input.x == 1\n\ndeny if input.x == 2\n"
+	regoVersion := 1
+
+	cr, _, err := Compile(ctx, &input, nil, nil, map[string]string{"policy.rego": policy}, "data.play.allow", nil, nil, false, &regoVersion)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Run("plan for query", func(t *testing.T) {
+		res, err := Build(ctx, cr, TargetPlan, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if exp := []string{"play/allow"}; !reflect.DeepEqual(exp, res.Entrypoints) {
+			t.Fatalf("expected entrypoints %v, got %v", exp, res.Entrypoints)
+		}
+
+		var plan struct {
+			Plans struct {
+				Plans []struct {
+					Name string `json:"name"`
+				} `json:"plans"`
+			} `json:"plans"`
+		}
+		if err := json.Unmarshal(res.Plan, &plan); err != nil {
+			t.Fatal(err)
+		}
+
+		if len(plan.Plans.Plans) != 1 || plan.Plans.Plans[0].Name != "play/allow" {
+			t.Fatalf("expected plan for play/allow, got %s", res.Plan)
+		}
+	})
+
+	t.Run("wasm for entrypoints", func(t *testing.T) {
+		res, err := Build(ctx, cr, TargetWasm, []string{"data.play.allow", "play/deny"})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if !bytes.HasPrefix(res.Wasm, []byte("\x00asm")) {
+			t.Fatal("expected a wasm module")
+		}
+
+		if len(res.Evaluations) != 2 {
+			t.Fatalf("expected 2 evaluations, got %v", res.Evaluations)
+		}
+
+		ev := res.Evaluations[0]
+		if ev.Entrypoint != "play/allow" || ev.Topdown != true {
+			t.Fatalf("unexpected evaluation: %+v", ev)
+		}
+
+		if ev.Error != "" || ev.Mismatch || ev.Wasm != true {
+			t.Fatalf("unexpected wasm result: %+v", ev)
+		}
+
+		if ev := res.Evaluations[1]; ev.Error != "" || ev.Mismatch || ev.Topdown != nil || ev.Wasm != nil {
+			t.Fatalf("expected undefined results for play/deny, got %+v", ev)
+		}
+	})
+
+	t.Run("wasm mismatch", func(t *testing.T) {
+		// topdown rounds products of big integers, which the Wasm runtime doesn't
+		policy := "package play\n\nx := 12345678901234567890 * 12345678901234567890\n"
+		cr, _, err := Compile(ctx, nil, nil, nil, map[string]string{"policy.rego": policy}, "data.play.x", nil, nil, false, &regoVersion)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		res, err := Build(ctx, cr, TargetWasm, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		ev := res.Evaluations[0]
+		if ev.Error != "" || !ev.Mismatch {
+			t.Fatalf("expected a mismatch, got %+v", ev)
+		}
+		if exp := json.Number("152415787532388367501905199875019052100"); ev.Wasm != exp {
+			t.Fatalf("expected wasm result %v, got %v", exp, ev.Wasm)
+		}
+	})
+
+	t.Run("errors", func(t *testing.T) {
+		if _, err := Build(ctx, cr, "js", nil); err == nil {
+			t.Fatal("expected error for unsupported target")
+		}
+
+		cr, _, err := Compile(ctx, &input, nil, nil, map[string]string{"policy.rego": policy}, "x := 1", nil, nil, false, &regoVersion)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if _, err := Build(ctx, cr, TargetPlan, nil); err == nil {
+			t.Fatal("expected error for query without entrypoint")
+		}
+	})
+}
@@ -0,0 +1,323 @@
+package opa
+
+import (
+	"context"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/open-policy-agent/opa/ast"
+	"github.com/open-policy-agent/opa/rego"
+)
+
+// Kinds of diff operations, named after their JSON Patch counterparts.
+const (
+	DiffAdd     = "add"
+	DiffRemove  = "remove"
+	DiffReplace = "replace"
+)
+
+// Decision is the outcome of the query for one input.
+type Decision struct {
+	Defined bool        `json:"defined"`
+	Value   interface{} `json:"value,omitempty"` // The value of the results, see decisionValue
+	Error   string      `json:"error,omitempty"`
+}
+
+// DiffOp is a change between two JSON values.
+type DiffOp struct {
+	Op   string      `json:"op"`
+	Path string      `json:"path"` // A JSON pointer to the changed value
+	Old  interface{} `json:"old,omitempty"`
+	New  interface{} `json:"new,omitempty"`
+}
+
+// Comparison holds the decisions of both sides for an input that changed.
+type Comparison struct {
+	Index int         `json:"index"` // The position of the input in the corpus
+	Input interface{} `json:"input"`
+	Base  Decision    `json:"base"`
+	Head  Decision    `json:"head"`
+	Diff  []DiffOp    `json:"diff"`
+	Rules []string    `json:"rules,omitempty"` // The rules whose values differ, e.g. data.play.allow
+}
+
+// CompareSummary counts the outcomes of a comparison.
+type CompareSummary struct {
+	Inputs    int            `json:"inputs"` // The number of inputs compared
+	Changed   int            `json:"changed"`
+	Unchanged int            `json:"unchanged"`
+	Errors    int            `json:"errors"` // Inputs that failed to evaluate on either side
+	Rules     map[string]int `json:"rules"`  // The number of changed decisions each rule differs in
+}
+
+// CompareResult represents the result of the Compare function.
+type CompareResult struct {
+	Summary   CompareSummary `json:"summary"`
+	Changes   []Comparison   `json:"changes"`
+	Truncated bool           `json:"truncated,omitempty"` // Whether the context was done before all inputs were compared
+}
+
+// Compare evaluates the queries of base and head for each input and reports
+// the inputs whose decisions differ, or that fail to evaluate on either side.
+// Changed decisions are attributed to rules by comparing the documents of all
+// packages of both sides for the input. Once the context is done, the inputs
+// compared so far are returned, marked as truncated.
+func Compare(ctx context.Context, base, head *CompileResult, inputs []interface{}) (*CompareResult, error) {
+	result := &CompareResult{
+		Summary: CompareSummary{
+			Rules: map[string]int{},
+		},
+		Changes: []Comparison{},
+	}
+
+	for i, x := range inputs {
+		if ctx.Err() != nil {
+			result.Truncated = true
+			break
+		}
+
+		input, err := ast.InterfaceToValue(x)
+		if err != nil {
+			return nil, err
+		}
+
+		b := withInput(base, input)
+		h := withInput(head, input)
+
+		c := Comparison{
+			Index: i,
+			Input: x,
+		}
+		c.Base, _ = evalDecision(ctx, b)
+		c.Head, _ = evalDecision(ctx, h)
+
+		// Decisions cut short by the end of the context aren't outcomes.
+		if ctx.Err() != nil {
+			result.Truncated = true
+			break
+		}
+
+		if c.Base.Error != "" || c.Head.Error != "" {
+			result.Summary.Errors++
+			result.Changes = append(result.Changes, c)
+			continue
+		}
+
+		c.Diff = diffDecisions(c.Base, c.Head)
+		if len(c.Diff) == 0 {
+			result.Summary.Unchanged++
+			continue
+		}
+
+		c.Rules = changedRules(ctx, b, h)
+		if ctx.Err() != nil {
+			result.Truncated = true
+			break
+		}
+		for _, rule := range c.Rules {
+			result.Summary.Rules[rule]++
+		}
+
+		result.Summary.Changed++
+		result.Changes = append(result.Changes, c)
+	}
+
+	result.Summary.Inputs = result.Summary.Changed + result.Summary.Unchanged + result.Summary.Errors
+	return result, nil
+}
+
+// withInput returns a copy of a compile result that evaluates with input.
+func withInput(cr *CompileResult, input ast.Value) *CompileResult {
+	c := *cr
+	c.ParsedInput = input
+	return &c
+}
+
+// evalDecision evaluates the query of a compile result, and returns the time
+// the evaluation took in nanoseconds.
+func evalDecision(ctx context.Context, input *CompileResult) (Decision, int64) {
+	result, err := Eval(ctx, input, EvalOptions{})
+	if err != nil {
+		return Decision{Error: err.RawError.Error()}, 0
+	}
+
+	if len(result.Result) == 0 {
+		return Decision{}, result.Time
+	}
+
+	return Decision{Defined: true, Value: decisionValue(result.Result)}, result.Time
+}
+
+// decisionValue represents each result by its bindings, if it has any, or else
+// by its expression values; a single expression by its value. A single result
+// is represented on its own, any other number as an array.
+func decisionValue(rs rego.ResultSet) interface{} {
+	values := make([]interface{}, len(rs))
+	for i, r := range rs {
+		switch {
+		case len(r.Bindings) > 0:
+			values[i] = map[string]interface{}(r.Bindings)
+		case len(r.Expressions) == 1:
+			values[i] = r.Expressions[0].Value
+		default:
+			exprs := make([]interface{}, len(r.Expressions))
+			for j, e := range r.Expressions {
+				exprs[j] = e.Value
+			}
+			values[i] = exprs
+		}
+	}
+
+	if len(values) == 1 {
+		return values[0]
+	}
+	return values
+}
+
+func diffDecisions(base, head Decision) []DiffOp {
+	switch {
+	case base.Defined && !head.Defined:
+		return []DiffOp{{Op: DiffRemove, Path: "", Old: base.Value}}
+	case !base.Defined && head.Defined:
+		return []DiffOp{{Op: DiffAdd, Path: "", New: head.Value}}
+	}
+	return DiffValues(base.Value, head.Value)
+}
+
+// DiffValues returns the changes from the JSON value a to b. Objects are
+// compared by key and arrays by position; changes to any other values, or to
+// values of different types, replace them as a whole.
+func DiffValues(a, b interface{}) []DiffOp {
+	var ops []DiffOp
+	diffValues("", a, b, &ops)
+	return ops
+}
+
+func diffValues(path string, a, b interface{}, ops *[]DiffOp) {
+	switch a := a.(type) {
+	case map[string]interface{}:
+		if b, ok := b.(map[string]interface{}); ok {
+			keys := make([]string, 0, len(a)+len(b))
+			for k := range a {
+				keys = append(keys, k)
+			}
+			for k := range b {
+				if _, ok := a[k]; !ok {
+					keys = append(keys, k)
+				}
+			}
+			sort.Strings(keys)
+
+			for _, k := range keys {
+				p := path + "/" + escapePointer(k)
+				av, inA := a[k]
+				bv, inB := b[k]
+				switch {
+				case !inB:
+					*ops = append(*ops, DiffOp{Op: DiffRemove, Path: p, Old: av})
+				case !inA:
+					*ops = append(*ops, DiffOp{Op: DiffAdd, Path: p, New: bv})
+				default:
+					diffValues(p, av, bv, ops)
+				}
+			}
+			return
+		}
+	case []interface{}:
+		if b, ok := b.([]interface{}); ok {
+			for i := 0; i < max(len(a), len(b)); i++ {
+				p := path + "/" + strconv.Itoa(i)
+				switch {
+				case i >= len(b):
+					*ops = append(*ops, DiffOp{Op: DiffRemove, Path: p, Old: a[i]})
+				case i >= len(a):
+					*ops = append(*ops, DiffOp{Op: DiffAdd, Path: p, New: b[i]})
+				default:
+					diffValues(p, a[i], b[i], ops)
+				}
+			}
+			return
+		}
+	}
+
+	if !equalValues(a, b) {
+		*ops = append(*ops, DiffOp{Op: DiffReplace, Path: path, Old: a, New: b})
+	}
+}
+
+func escapePointer(s string) string {
+	return strings.ReplaceAll(strings.ReplaceAll(s, "~", "~0"), "/", "~1")
+}
+
+func unescapePointer(s string) string {
+	return strings.ReplaceAll(strings.ReplaceAll(s, "~1", "/"), "~0", "~")
+}
+
+// changedRules compares the documents of the packages of both sides and
+// returns the rules whose values differ. Packages that fail to evaluate on
+// either side are skipped.
+func changedRules(ctx context.Context, base, head *CompileResult) []string {
+	var rules []string
+
+	for _, pkg := range comparePackages(base, head) {
+		b, err := evalDocument(ctx, base, pkg)
+		if err != nil {
+			continue
+		}
+		h, err := evalDocument(ctx, head, pkg)
+		if err != nil {
+			continue
+		}
+
+		for _, op := range DiffValues(b, h) {
+			for _, name := range changedRuleNames(op) {
+				rule := pkg.Append(ast.StringTerm(name)).String()
+				if !slices.Contains(rules, rule) {
+					rules = append(rules, rule)
+				}
+			}
+		}
+	}
+
+	sort.Strings(rules)
+	return rules
+}
+
+// changedRuleNames returns the names of the rules a change of a package
+// document is in: the first segment of its path, or all keys of the changed
+// document if it was added or removed as a whole.
+func changedRuleNames(op DiffOp) []string {
+	if op.Path != "" {
+		name, _, _ := strings.Cut(strings.TrimPrefix(op.Path, "/"), "/")
+		return []string{unescapePointer(name)}
+	}
+
+	var names []string
+	for _, doc := range []interface{}{op.Old, op.New} {
+		if obj, ok := doc.(map[string]interface{}); ok {
+			for name := range obj {
+				names = append(names, name)
+			}
+		}
+	}
+	return names
+}
+
+func comparePackages(base, head *CompileResult) []ast.Ref {
+	var pkgs []ast.Ref
+	for _, cr := range []*CompileResult{base, head} {
+		for _, m := range cr.Compiler.Modules {
+			if !slices.ContainsFunc(pkgs, func(pkg ast.Ref) bool { return pkg.Equal(m.Package.Path) }) {
+				pkgs = append(pkgs, m.Package.Path)
+			}
+		}
+	}
+
+	sort.Slice(pkgs, func(i, j int) bool {
+		return pkgs[i].Compare(pkgs[j]) < 0
+	})
+
+	return pkgs
+}
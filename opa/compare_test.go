@@ -0,0 +1,182 @@
+package opa
+
+import (
+	"context"
+	"encoding/json"
+	"reflect"
+	"testing"
+
+	"github.com/open-policy-agent/opa/util"
+)
+
+func TestDiffValues(t *testing.T) {
+	tests := []struct {
+		note string
+		a, b string
+		exp  []DiffOp
+	}{
+		{
+			note: "equal",
+			a:    `{"a": [1, {"b": true}]}`,
+			b:    `{"a": [1, {"b": true}]}`,
+		},
+		{
+			note: "scalar",
+			a:    `true`,
+			b:    `false`,
+			exp:  []DiffOp{{Op: DiffReplace, Path: "", Old: true, New: false}},
+		},
+		{
+			note: "objects",
+			a:    `{"a": 1, "b": {"c": "x"}, "d/e": 1}`,
+			b:    `{"b": {"c": "y"}, "d/e": 1, "f": null}`,
+			exp: []DiffOp{
+				{Op: DiffRemove, Path: "/a", Old: json.Number("1")},
+				{Op: DiffReplace, Path: "/b/c", Old: "x", New: "y"},
+				{Op: DiffAdd, Path: "/f"},
+			},
+		},
+		{
+			note: "arrays",
+			a:    `[1, 2, 3]`,
+			b:    `[1, 4]`,
+			exp: []DiffOp{
+				{Op: DiffReplace, Path: "/1", Old: json.Number("2"), New: json.Number("4")},
+				{Op: DiffRemove, Path: "/2", Old: json.Number("3")},
+			},
+		},
+		{
+			note: "numbers",
+			a:    `{"a": 1.0}`,
+			b:    `{"a": 1}`,
+		},
+		{
+			note: "escaped keys",
+			a:    `{"a/b~c": 1}`,
+			b:    `{"a/b~c": 2}`,
+			exp:  []DiffOp{{Op: DiffReplace, Path: "/a~1b~0c", Old: json.Number("1"), New: json.Number("2")}},
+		},
+		{
+			note: "different types",
+			a:    `{"a": [1]}`,
+			b:    `{"a": {"0": 1}}`,
+			exp: []DiffOp{{
+				Op:   DiffReplace,
+				Path: "/a",
+				Old:  []interface{}{json.Number("1")},
+				New:  map[string]interface{}{"0": json.Number("1")},
+			}},
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.note, func(t *testing.T) {
+			var a, b interface{}
+			if err := util.UnmarshalJSON([]byte(tc.a), &a); err != nil {
+				t.Fatal(err)
+			}
+			if err := util.UnmarshalJSON([]byte(tc.b), &b); err != nil {
+				t.Fatal(err)
+			}
+
+			actual := DiffValues(a, b)
+			if !reflect.DeepEqual(tc.exp, actual) {
+				t.Fatalf("expected %+v but got: %+v", tc.exp, actual)
+			}
+		})
+	}
+}
+
+func TestCompare(t *testing.T) {
+	ctx := context.Background()
+	regoVersion := 1
+
+	base, _, err := Compile(ctx, nil, nil, nil, map[string]string{
+		"play.rego": `package play
+
+allow if input.role == "admin"
+
+reasons contains "admin" if allow
+
+limit := 10
+`,
+	}, "data.play.allow", nil, nil, false, &regoVersion)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	head, _, err := Compile(ctx, nil, nil, nil, map[string]string{
+		"play.rego": `package play
+
+allow if input.role in {"admin", "editor", "root"}
+
+allow := false if input.role == "root"
+
+reasons contains input.role if allow
+
+limit := 10
+`,
+	}, "data.play.allow", nil, nil, false, &regoVersion)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	inputs := []interface{}{
+		map[string]interface{}{"role": "admin"},
+		map[string]interface{}{"role": "editor"},
+		map[string]interface{}{"role": "viewer"},
+		map[string]interface{}{"role": "root"},
+	}
+
+	result, err := Compare(ctx, base, head, inputs)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expSummary := CompareSummary{
+		Inputs:    4,
+		Changed:   1,
+		Unchanged: 2,
+		Errors:    1,
+		Rules: map[string]int{
+			"data.play.allow":   1,
+			"data.play.reasons": 1,
+		},
+	}
+
+	if !reflect.DeepEqual(expSummary, result.Summary) {
+		t.Fatalf("expected summary %+v but got: %+v", expSummary, result.Summary)
+	}
+
+	if len(result.Changes) != 2 {
+		t.Fatalf("expected 2 changes but got: %+v", result.Changes)
+	}
+
+	expChanged := Comparison{
+		Index: 1,
+		Input: inputs[1],
+		Base:  Decision{},
+		Head:  Decision{Defined: true, Value: true},
+		Diff:  []DiffOp{{Op: DiffAdd, Path: "", New: true}},
+		Rules: []string{"data.play.allow", "data.play.reasons"},
+	}
+	if !reflect.DeepEqual(expChanged, result.Changes[0]) {
+		t.Fatalf("expected %+v but got: %+v", expChanged, result.Changes[0])
+	}
+
+	failed := result.Changes[1]
+	if failed.Index != 3 || failed.Base.Error != "" || failed.Head.Error == "" {
+		t.Fatalf("expected head to fail for the last input but got: %+v", failed)
+	}
+
+	cancelled, cancel := context.WithCancel(ctx)
+	cancel()
+
+	result, err = Compare(cancelled, base, head, inputs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !result.Truncated || result.Summary.Inputs != 0 || len(result.Changes) != 0 {
+		t.Fatalf("expected a truncated result without changes but got: %+v", result)
+	}
+}
@@ -0,0 +1,506 @@
+package opa
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/open-policy-agent/opa/ast"
+)
+
+// Completion kinds, in the order they are usually ranked.
+const (
+	CompletionKindRule     = "rule"
+	CompletionKindFunction = "function"
+	CompletionKindPackage  = "package"
+	CompletionKindImport   = "import"
+	CompletionKindInput    = "input"
+	CompletionKindData     = "data"
+	CompletionKindBuiltin  = "builtin"
+)
+
+const (
+	// maxCompletions caps the number of suggestions returned for a single request.
+	maxCompletions = 200
+	// maxParseRetries bounds how often a broken module is re-parsed with the offending lines removed.
+	maxParseRetries = 5
+)
+
+// Completion is a single suggestion for the token under the cursor. Label
+// is the full text that should replace the token.
+type Completion struct {
+	Label  string `json:"label"`
+	Kind   string `json:"kind"`
+	Detail string `json:"detail,omitempty"`
+	Doc    string `json:"documentation,omitempty"`
+
+	rank int
+}
+
+// CompletionResult represents the result of the Complete function.
+type CompletionResult struct {
+	Token       string       `json:"token"` // The text before the cursor that the completions replace
+	Completions []Completion `json:"completions"`
+}
+
+// Complete returns ranked completions for the cursor at row/col (1-based, as
+// in ast.Location) in the module named file. Paths under `input.` and `data.`
+// are derived from the supplied documents, so the suggestions reflect the keys
+// that actually exist.
+func Complete(policies map[string]string, file string, row, col int, input *interface{}, data *interface{}, regoVersion *int) (*CompletionResult, error) {
+	src, ok := policies[file]
+	if !ok {
+		return nil, fmt.Errorf("module %q not found", file)
+	}
+
+	lines := strings.Split(src, "\n")
+	if row < 1 || row > len(lines) {
+		return nil, fmt.Errorf("row %d out of range", row)
+	}
+	if col < 1 {
+		return nil, fmt.Errorf("col %d out of range", col)
+	}
+
+	line := lines[row-1]
+	if col-1 < len(line) {
+		line = line[:col-1]
+	}
+	token := tokenBefore(line)
+
+	regoVer := ast.DefaultRegoVersion
+	if regoVersion != nil {
+		regoVer = ast.RegoVersionFromInt(*regoVersion)
+	}
+
+	var current *ast.Module
+	modules := make([]*ast.Module, 0, len(policies))
+	for name, policy := range policies {
+		var m *ast.Module
+		if name == file {
+			m = parseForCompletion(name, lines, row, regoVer)
+			current = m
+		} else {
+			m, _ = ast.ParseModuleWithOpts(name, policy, ast.ParserOptions{RegoVersion: regoVer})
+		}
+		if m != nil {
+			modules = append(modules, m)
+		}
+	}
+
+	c := completer{
+		token:   token,
+		current: current,
+		input:   jsonNode(input, CompletionKindInput),
+		data:    dataNode(modules, data),
+	}
+
+	result := &CompletionResult{
+		Token:       token,
+		Completions: c.complete(),
+	}
+
+	return result, nil
+}
+
+// tokenBefore returns the ref-like token that ends at the end of line.
+func tokenBefore(line string) string {
+	i := len(line)
+	for i > 0 && isTokenChar(line[i-1]) {
+		i--
+	}
+	return line[i:]
+}
+
+func isTokenChar(b byte) bool {
+	switch {
+	case 'a' <= b && b <= 'z', 'A' <= b && b <= 'Z', '0' <= b && b <= '9':
+		return true
+	}
+	return b == '_' || b == '.' || b == '[' || b == ']' || b == '"'
+}
+
+// parseForCompletion parses the module being edited. The line under the cursor
+// is usually incomplete, so if the module doesn't parse we blank it and any
+// lines the parser complains about, to still offer the rules and imports of
+// the module.
+func parseForCompletion(name string, lines []string, row int, regoVersion ast.RegoVersion) *ast.Module {
+	opts := ast.ParserOptions{RegoVersion: regoVersion}
+
+	m, err := ast.ParseModuleWithOpts(name, strings.Join(lines, "\n"), opts)
+	if err == nil {
+		return m
+	}
+
+	lines = append([]string(nil), lines...)
+	lines[row-1] = ""
+
+	for range maxParseRetries {
+		m, err = ast.ParseModuleWithOpts(name, strings.Join(lines, "\n"), opts)
+		if err == nil {
+			return m
+		}
+
+		var errs ast.Errors
+		if !errors.As(err, &errs) {
+			return nil
+		}
+
+		blanked := false
+		for _, e := range errs {
+			if i := errorLine(e, lines); i >= 0 && lines[i] != "" {
+				lines[i] = ""
+				blanked = true
+			}
+		}
+		if !blanked {
+			return nil
+		}
+	}
+
+	return nil
+}
+
+// errorLine returns the index of the line a parse error refers to, or -1. The
+// parser reports errors at the token following an incomplete line, so the line
+// quoted in the error details is preferred over the reported row.
+func errorLine(e *ast.Error, lines []string) int {
+	if e.Location == nil || e.Location.Row < 1 || e.Location.Row > len(lines) {
+		return -1
+	}
+
+	row := e.Location.Row - 1
+	if d, ok := e.Details.(*ast.ParserErrorDetail); ok && row > 0 && lines[row] != d.Line && lines[row-1] == d.Line {
+		return row - 1
+	}
+
+	return row
+}
+
+// pathNode is a node in a tree of document paths, built either from a JSON
+// document or from the rules of the parsed modules.
+type pathNode struct {
+	kind     string
+	detail   string
+	array    bool
+	children map[string]*pathNode
+}
+
+func (n *pathNode) child(key string, kind string) *pathNode {
+	if n.children == nil {
+		n.children = make(map[string]*pathNode)
+	}
+	c, ok := n.children[key]
+	if !ok {
+		c = &pathNode{kind: kind}
+		n.children[key] = c
+	}
+	return c
+}
+
+// walk follows ref (excluding its head) down the tree.
+func (n *pathNode) walk(ref ast.Ref) *pathNode {
+	curr := n
+	for _, t := range ref {
+		if curr == nil {
+			return nil
+		}
+		switch v := t.Value.(type) {
+		case ast.String:
+			curr = curr.children[string(v)]
+		case ast.Number:
+			curr = curr.children[v.String()]
+		default:
+			return nil
+		}
+	}
+	return curr
+}
+
+func jsonNode(doc *interface{}, kind string) *pathNode {
+	if doc == nil {
+		return nil
+	}
+	n := &pathNode{kind: kind}
+	addJSON(n, *doc, kind)
+	return n
+}
+
+func addJSON(n *pathNode, x interface{}, kind string) {
+	switch x := x.(type) {
+	case map[string]interface{}:
+		n.detail = "object"
+		for k, v := range x {
+			addJSON(n.child(k, kind), v, kind)
+		}
+	case []interface{}:
+		n.detail = "array"
+		n.array = true
+		for i, v := range x {
+			addJSON(n.child(strconv.Itoa(i), kind), v, kind)
+		}
+	default:
+		bs, err := json.Marshal(x)
+		if err != nil {
+			return
+		}
+		n.detail = truncate(string(bs), 40)
+	}
+}
+
+// dataNode merges the paths of all rules with the data document.
+func dataNode(modules []*ast.Module, data *interface{}) *pathNode {
+	n := jsonNode(data, CompletionKindData)
+	if n == nil {
+		n = &pathNode{kind: CompletionKindData}
+	}
+
+	for _, m := range modules {
+		curr := n
+		for _, t := range m.Package.Path[1:] {
+			s, ok := t.Value.(ast.String)
+			if !ok {
+				break
+			}
+			curr = curr.child(string(s), CompletionKindPackage)
+		}
+
+		for _, r := range m.Rules {
+			ref := r.Head.Ref().StringPrefix()
+			if len(ref) == 0 {
+				continue
+			}
+			kind, detail := ruleKindAndDetail(r)
+			leaf := curr.child(string(ref[0].Value.(ast.Var)), kind)
+			for _, t := range ref[1:] {
+				leaf = leaf.child(string(t.Value.(ast.String)), kind)
+			}
+			leaf.kind, leaf.detail = kind, detail
+		}
+	}
+
+	return n
+}
+
+func ruleKindAndDetail(r *ast.Rule) (string, string) {
+	if len(r.Head.Args) > 0 {
+		return CompletionKindFunction, fmt.Sprintf("%v%v", r.Head.Ref(), r.Head.Args)
+	}
+	return CompletionKindRule, truncate(r.Head.String(), 60)
+}
+
+func truncate(s string, limit int) string {
+	if len(s) > limit {
+		return s[:limit] + "..."
+	}
+	return s
+}
+
+type completer struct {
+	token   string
+	current *ast.Module
+	input   *pathNode
+	data    *pathNode
+}
+
+func (c *completer) complete() []Completion {
+	var cs []Completion
+
+	if dot := strings.LastIndex(c.token, "."); dot >= 0 {
+		cs = append(cs, c.completePath(c.token[:dot], c.token[dot+1:])...)
+	} else {
+		cs = append(cs, c.completeIdentifier()...)
+	}
+
+	cs = append(cs, c.completeBuiltins()...)
+
+	sort.SliceStable(cs, func(i, j int) bool {
+		if cs[i].rank != cs[j].rank {
+			return cs[i].rank < cs[j].rank
+		}
+		if len(cs[i].Label) != len(cs[j].Label) {
+			return len(cs[i].Label) < len(cs[j].Label)
+		}
+		return cs[i].Label < cs[j].Label
+	})
+
+	// Builtins and rules can both produce the same label (e.g. a package
+	// named like a builtin namespace), keep the best ranked one.
+	seen := make(map[string]struct{}, len(cs))
+	result := make([]Completion, 0, len(cs))
+	for _, x := range cs {
+		if _, ok := seen[x.Label]; ok {
+			continue
+		}
+		seen[x.Label] = struct{}{}
+		result = append(result, x)
+		if len(result) == maxCompletions {
+			break
+		}
+	}
+
+	return result
+}
+
+// completePath suggests the children of the document at head (e.g.
+// `input.request`) that start with partial.
+func (c *completer) completePath(head string, partial string) []Completion {
+	term, err := ast.ParseTerm(head)
+	if err != nil {
+		return nil
+	}
+
+	var ref ast.Ref
+	switch v := term.Value.(type) {
+	case ast.Ref:
+		ref = v
+	case ast.Var:
+		ref = ast.Ref{term}
+	default:
+		return nil
+	}
+
+	root, ok := ref[0].Value.(ast.Var)
+	if !ok {
+		return nil
+	}
+
+	var n *pathNode
+	switch {
+	case root.Equal(ast.InputRootDocument.Value):
+		n = c.input.walk(ref[1:])
+	case root.Equal(ast.DefaultRootDocument.Value):
+		n = c.data.walk(ref[1:])
+	default:
+		imported := c.resolveImport(string(root))
+		if imported == nil {
+			return nil
+		}
+		switch {
+		case imported[0].Equal(ast.InputRootDocument):
+			n = c.input.walk(imported[1:].Concat(ref[1:]))
+		case imported[0].Equal(ast.DefaultRootDocument):
+			n = c.data.walk(imported[1:].Concat(ref[1:]))
+		}
+	}
+
+	if n == nil {
+		return nil
+	}
+
+	cs := make([]Completion, 0, len(n.children))
+	for key, child := range n.children {
+		if !strings.HasPrefix(key, partial) {
+			continue
+		}
+		var label string
+		switch {
+		case n.array:
+			label = fmt.Sprintf("%s[%s]", head, key)
+		case ast.IsVarCompatibleString(key) && !ast.IsKeywordInRegoVersion(key, ast.RegoV1):
+			label = head + "." + key
+		default:
+			label = fmt.Sprintf("%s[%q]", head, key)
+		}
+		cs = append(cs, Completion{
+			Label:  label,
+			Kind:   child.kind,
+			Detail: child.detail,
+			rank:   0,
+		})
+	}
+
+	return cs
+}
+
+// completeIdentifier suggests rules, imports and the root documents for a
+// token without any dots.
+func (c *completer) completeIdentifier() []Completion {
+	var cs []Completion
+
+	add := func(label, kind, detail string, rank int) {
+		if strings.HasPrefix(label, c.token) {
+			cs = append(cs, Completion{Label: label, Kind: kind, Detail: detail, rank: rank})
+		}
+	}
+
+	add(ast.InputRootDocument.String(), CompletionKindInput, "input document", 1)
+	add(ast.DefaultRootDocument.String(), CompletionKindData, "data document", 1)
+
+	if c.current == nil {
+		return cs
+	}
+
+	for _, imp := range c.current.Imports {
+		if name := importName(imp); name != "" {
+			add(name, CompletionKindImport, imp.Path.String(), 1)
+		}
+	}
+
+	// Rules in the package of the current module can be referred to by name.
+	pkg := c.data.walk(c.current.Package.Path[1:])
+	if pkg == nil {
+		return cs
+	}
+	for name, child := range pkg.children {
+		if child.kind == CompletionKindRule || child.kind == CompletionKindFunction {
+			add(name, child.kind, child.detail, 0)
+		}
+	}
+
+	return cs
+}
+
+func (c *completer) completeBuiltins() []Completion {
+	var cs []Completion
+
+	for _, bi := range caps.Builtins {
+		if bi.Infix != "" || bi.IsDeprecated() || !strings.HasPrefix(bi.Name, c.token) {
+			continue
+		}
+
+		cs = append(cs, Completion{
+			Label:  bi.Name,
+			Kind:   CompletionKindBuiltin,
+			Detail: fmt.Sprintf("%s%v => %v", bi.Name, bi.Decl.NamedFuncArgs(), bi.Decl.NamedResult()),
+			Doc:    bi.Description,
+			rank:   2,
+		})
+	}
+
+	return cs
+}
+
+// resolveImport returns the path imported under name in the current module.
+func (c *completer) resolveImport(name string) ast.Ref {
+	if c.current == nil {
+		return nil
+	}
+	for _, imp := range c.current.Imports {
+		if importName(imp) != name {
+			continue
+		}
+		if ref, ok := imp.Path.Value.(ast.Ref); ok {
+			return ref
+		}
+	}
+	return nil
+}
+
+// importName returns the name an import is referred to by in the module, or
+// an empty string for imports that only opt into language features.
+func importName(imp *ast.Import) string {
+	ref, ok := imp.Path.Value.(ast.Ref)
+	if !ok || !(ref[0].Equal(ast.InputRootDocument) || ref[0].Equal(ast.DefaultRootDocument)) {
+		return ""
+	}
+	if len(imp.Alias) > 0 {
+		return imp.Alias.String()
+	}
+	if tail, ok := tailOfImportPath(imp); ok {
+		return tail
+	}
+	return ""
+}
@@ -0,0 +1,167 @@
+package opa
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/open-policy-agent/opa/util"
+)
+
+func TestComplete(t *testing.T) {
+	policy := `package play
+
+import data.users
+
+allow if {
+	input.request.
+}
+
+is_admin if users.alice.admin
+
+role := "admin"
+
+x := r
+`
+	other := `package lib.authz
+
+deny contains "nope" if false
+`
+
+	input := util.MustUnmarshalJSON([]byte(`{"request": {"method": "GET", "path": ["a", "b"], "x-forwarded-for": "1.2.3.4"}}`))
+	data := util.MustUnmarshalJSON([]byte(`{"users": {"alice": {"admin": true}, "bob": {}}}`))
+	policies := map[string]string{"policy.rego": policy, "lib.rego": other}
+	regoVersion := 1
+
+	tests := []struct {
+		note     string
+		row, col int
+		token    string
+		labels   []string // expected prefix of the ranked labels
+		contains []string
+	}{
+		{
+			note:   "input keys",
+			row:    6,
+			col:    16,
+			token:  "input.request.",
+			labels: []string{"input.request.path", "input.request.method", `input.request["x-forwarded-for"]`},
+		},
+		{
+			note:   "imported data path",
+			row:    9,
+			col:    19,
+			token:  "users.",
+			labels: []string{"users.bob", "users.alice"},
+		},
+		{
+			note:     "imports and builtins",
+			row:      9,
+			col:      14,
+			token:    "u",
+			contains: []string{"upper", "units.parse", "users"},
+		},
+		{
+			note:   "rule names first",
+			row:    13,
+			col:    7,
+			token:  "r",
+			labels: []string{"role"},
+		},
+		{
+			note:     "empty token",
+			row:      11,
+			col:      1,
+			token:    "",
+			contains: []string{"allow", "is_admin", "concat", "data", "input"},
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.note, func(t *testing.T) {
+			res, err := Complete(policies, "policy.rego", tc.row, tc.col, &input, &data, &regoVersion)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if tc.token != res.Token {
+				t.Fatalf("expected token %q, got %q", tc.token, res.Token)
+			}
+
+			labels := make([]string, 0, len(res.Completions))
+			for _, c := range res.Completions {
+				labels = append(labels, c.Label)
+			}
+
+			if len(tc.labels) > 0 && (len(labels) < len(tc.labels) || !reflect.DeepEqual(labels[:len(tc.labels)], tc.labels)) {
+				t.Fatalf("expected completions to start with %v, got %v", tc.labels, labels)
+			}
+
+			for _, exp := range tc.contains {
+				found := false
+				for _, l := range labels {
+					if l == exp {
+						found = true
+						break
+					}
+				}
+				if !found {
+					t.Errorf("expected completion %q in %v", exp, labels)
+				}
+			}
+		})
+	}
+}
+
+func TestCompleteDataPaths(t *testing.T) {
+	policy := "package play\n\np := data.\n"
+	other := "package lib.authz\n\ndeny contains \"nope\" if false\n\nf(x) := x\n"
+	data := util.MustUnmarshalJSON([]byte(`{"lib": {"limits": {"max": 10}}}`))
+	regoVersion := 1
+
+	res, err := Complete(map[string]string{"policy.rego": policy, "lib.rego": other}, "policy.rego", 3, 11, nil, &data, &regoVersion)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if exp, act := "data.", res.Token; exp != act {
+		t.Fatalf("expected token %q, got %q", exp, act)
+	}
+
+	var labels []string
+	for _, c := range res.Completions {
+		if c.Kind != CompletionKindBuiltin {
+			labels = append(labels, c.Label+":"+c.Kind)
+		}
+	}
+
+	if exp := []string{"data.lib:data", "data.play:package"}; !reflect.DeepEqual(labels, exp) {
+		t.Fatalf("expected %v, got %v", exp, labels)
+	}
+
+	res, err = Complete(map[string]string{"policy.rego": strings.Replace(policy, "data.", "data.lib.", 1), "lib.rego": other}, "policy.rego", 3, 15, nil, &data, &regoVersion)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	labels = labels[:0]
+	for _, c := range res.Completions {
+		labels = append(labels, c.Label+":"+c.Kind)
+	}
+
+	if exp := []string{"data.lib.authz:package", "data.lib.limits:data"}; !reflect.DeepEqual(labels, exp) {
+		t.Fatalf("expected %v, got %v", exp, labels)
+	}
+}
+
+func TestCompleteErrors(t *testing.T) {
+	policies := map[string]string{"policy.rego": "package play\n"}
+
+	if _, err := Complete(policies, "other.rego", 1, 1, nil, nil, nil); err == nil {
+		t.Fatal("expected error for unknown module")
+	}
+
+	if _, err := Complete(policies, "policy.rego", 5, 1, nil, nil, nil); err == nil {
+		t.Fatal("expected error for row out of range")
+	}
+}
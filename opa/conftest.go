@@ -0,0 +1,295 @@
+package opa
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"slices"
+	"sort"
+	"strings"
+
+	"github.com/open-policy-agent/opa/ast"
+	"github.com/open-policy-agent/opa/rego"
+)
+
+// conftestRuleRegexp matches the names of the rules conftest evaluates.
+var conftestRuleRegexp = regexp.MustCompile(`^(deny|violation|warn)(_[a-zA-Z0-9_]+)*$`)
+
+// ConftestMessage is a message returned by a deny, warn or violation rule.
+type ConftestMessage struct {
+	Rule     string                 `json:"rule"`
+	Msg      string                 `json:"msg"`
+	Metadata map[string]interface{} `json:"metadata,omitempty"` // The other fields of messages returned as objects
+}
+
+// ConftestResult holds the outcome of the rules of a namespace.
+type ConftestResult struct {
+	Namespace  string            `json:"namespace"`
+	Successes  int               `json:"successes"` // The number of rules that returned no messages
+	Failures   []ConftestMessage `json:"failures"`
+	Warnings   []ConftestMessage `json:"warnings"`
+	Exceptions []ConftestMessage `json:"exceptions"` // Failures of rules excepted by an exception rule
+}
+
+// ConftestSummary represents the result of the EvalConftest function.
+type ConftestSummary struct {
+	Results    []ConftestResult `json:"results"`
+	Tests      int              `json:"tests"`
+	Passed     int              `json:"passed"`
+	Warnings   int              `json:"warnings"`
+	Failures   int              `json:"failures"`
+	Exceptions int              `json:"exceptions"`
+}
+
+// EvalConftest evaluates the deny, warn and violation rules, including their
+// variants like deny_foo, of the namespaces the way conftest does. Without
+// namespaces, the packages of all modules are used. Rules return sets of
+// messages, either as strings or as objects with a msg field, or booleans,
+// where true is a failure without a message. A deny_foo or violation_foo rule
+// is excepted if exception contains an array with "foo" in the same package.
+func EvalConftest(ctx context.Context, input *CompileResult, namespaces []string) (*ConftestSummary, error) {
+	rules := conftestRules(input.Compiler.Modules)
+
+	if len(namespaces) == 0 {
+		for ns := range rules {
+			namespaces = append(namespaces, ns)
+		}
+		sort.Strings(namespaces)
+	}
+
+	summary := &ConftestSummary{
+		Results: make([]ConftestResult, 0, len(namespaces)),
+	}
+
+	for _, ns := range namespaces {
+		pkg, err := conftestNamespace(ns)
+		if err != nil {
+			return nil, err
+		}
+
+		result, err := evalConftestNamespace(ctx, input, pkg, rules[conftestNamespaceName(pkg)])
+		if err != nil {
+			return nil, err
+		}
+
+		summary.Results = append(summary.Results, *result)
+		summary.Passed += result.Successes
+		summary.Warnings += len(result.Warnings)
+		summary.Failures += len(result.Failures)
+		summary.Exceptions += len(result.Exceptions)
+	}
+
+	summary.Tests = summary.Passed + summary.Warnings + summary.Failures + summary.Exceptions
+
+	return summary, nil
+}
+
+// conftestNamespace returns the package path of a namespace, e.g. data.main
+// for main. Namespaces must be ground refs of strings.
+func conftestNamespace(ns string) (ast.Ref, error) {
+	term, err := ast.ParseTerm(ns)
+	if err != nil {
+		return nil, fmt.Errorf("invalid namespace %q: %w", ns, err)
+	}
+
+	var ref ast.Ref
+	switch v := term.Value.(type) {
+	case ast.Var:
+		ref = ast.Ref{term}
+	case ast.Ref:
+		ref = v
+	default:
+		return nil, fmt.Errorf("invalid namespace %q: expected a package path", ns)
+	}
+
+	head, ok := ref[0].Value.(ast.Var)
+	if !ok {
+		return nil, fmt.Errorf("invalid namespace %q: expected a package path", ns)
+	}
+
+	pkg := ast.Ref{ast.DefaultRootDocument, ast.StringTerm(string(head))}
+	for _, t := range ref[1:] {
+		if _, ok := t.Value.(ast.String); !ok {
+			return nil, fmt.Errorf("invalid namespace %q: expected a package path", ns)
+		}
+		pkg = append(pkg, t)
+	}
+
+	return pkg, nil
+}
+
+// conftestNamespaceName returns the namespace of a package path.
+func conftestNamespaceName(pkg ast.Ref) string {
+	return strings.TrimPrefix(pkg.String(), ast.DefaultRootDocument.String()+".")
+}
+
+// conftestRules returns the names of the conftest rules by namespace.
+func conftestRules(modules map[string]*ast.Module) map[string][]string {
+	rules := map[string][]string{}
+
+	for _, m := range modules {
+		ns := conftestNamespaceName(m.Package.Path)
+		for _, r := range m.Rules {
+			ref := r.Head.Ref()
+			if len(ref) == 0 {
+				continue
+			}
+			name := ref[0].Value.String()
+			if conftestRuleRegexp.MatchString(name) && !slices.Contains(rules[ns], name) {
+				rules[ns] = append(rules[ns], name)
+			}
+		}
+	}
+
+	for _, names := range rules {
+		sort.Strings(names)
+	}
+
+	return rules
+}
+
+func evalConftestNamespace(ctx context.Context, input *CompileResult, pkg ast.Ref, rules []string) (*ConftestResult, error) {
+	result := &ConftestResult{
+		Namespace:  conftestNamespaceName(pkg),
+		Failures:   []ConftestMessage{},
+		Warnings:   []ConftestMessage{},
+		Exceptions: []ConftestMessage{},
+	}
+
+	exceptions, err := conftestExceptions(ctx, input, pkg)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, rule := range rules {
+		value, err := evalDocument(ctx, input, pkg.Append(ast.StringTerm(rule)))
+		if err != nil {
+			return nil, err
+		}
+
+		messages, err := conftestMessages(rule, value)
+		if err != nil {
+			return nil, err
+		}
+
+		if len(messages) == 0 {
+			result.Successes++
+			continue
+		}
+
+		kind, name, _ := strings.Cut(rule, "_")
+		switch {
+		case kind == "warn":
+			result.Warnings = append(result.Warnings, messages...)
+		case exceptions[name]:
+			result.Exceptions = append(result.Exceptions, messages...)
+		default:
+			result.Failures = append(result.Failures, messages...)
+		}
+	}
+
+	return result, nil
+}
+
+// conftestExceptions returns the names of the excepted rules of a namespace.
+func conftestExceptions(ctx context.Context, input *CompileResult, pkg ast.Ref) (map[string]bool, error) {
+	ref := pkg.Append(ast.StringTerm("exception"))
+	value, err := evalDocument(ctx, input, ref)
+	if err != nil {
+		return nil, err
+	}
+
+	exceptions := map[string]bool{}
+	set, _ := value.([]interface{})
+	for _, names := range set {
+		arr, ok := names.([]interface{})
+		if !ok {
+			return nil, fmt.Errorf("%v must contain arrays of rule names", ref)
+		}
+		for _, name := range arr {
+			if s, ok := name.(string); ok {
+				exceptions[s] = true
+			}
+		}
+	}
+
+	return exceptions, nil
+}
+
+// evalDocument returns the value of a document, or nil if it's undefined.
+func evalDocument(ctx context.Context, input *CompileResult, ref ast.Ref) (interface{}, error) {
+	ctx, cancel := context.WithTimeout(ctx, evalTimeout)
+	defer cancel()
+
+	rs, err := rego.New(
+		rego.ParsedQuery(ast.NewBody(ast.NewExpr(ast.NewTerm(ref)))),
+		rego.Compiler(input.Compiler),
+		rego.Store(input.Store),
+		rego.ParsedInput(input.ParsedInput),
+		rego.StrictBuiltinErrors(true),
+	).Eval(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(rs) == 0 {
+		return nil, nil
+	}
+
+	return rs[0].Expressions[0].Value, nil
+}
+
+func conftestMessages(rule string, value interface{}) ([]ConftestMessage, error) {
+	switch value := value.(type) {
+	case nil:
+		return nil, nil
+	case bool:
+		if value {
+			return []ConftestMessage{{Rule: rule}}, nil
+		}
+		return nil, nil
+	case string:
+		return []ConftestMessage{{Rule: rule, Msg: value}}, nil
+	case []interface{}:
+		messages := make([]ConftestMessage, 0, len(value))
+		for _, v := range value {
+			msg, err := conftestMessage(rule, v)
+			if err != nil {
+				return nil, err
+			}
+			messages = append(messages, msg)
+		}
+		return messages, nil
+	default:
+		msg, err := conftestMessage(rule, value)
+		if err != nil {
+			return nil, err
+		}
+		return []ConftestMessage{msg}, nil
+	}
+}
+
+func conftestMessage(rule string, value interface{}) (ConftestMessage, error) {
+	switch value := value.(type) {
+	case string:
+		return ConftestMessage{Rule: rule, Msg: value}, nil
+	case map[string]interface{}:
+		msg, ok := value["msg"].(string)
+		if !ok {
+			return ConftestMessage{}, fmt.Errorf("rule %v returned an object without a msg string", rule)
+		}
+		var metadata map[string]interface{}
+		for k, v := range value {
+			if k == "msg" {
+				continue
+			}
+			if metadata == nil {
+				metadata = map[string]interface{}{}
+			}
+			metadata[k] = v
+		}
+		return ConftestMessage{Rule: rule, Msg: msg, Metadata: metadata}, nil
+	default:
+		return ConftestMessage{}, fmt.Errorf("rule %v returned %v, expected strings or objects with a msg string", rule, value)
+	}
+}
@@ -0,0 +1,123 @@
+package opa
+
+import (
+	"context"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestEvalConftest(t *testing.T) {
+	ctx := context.Background()
+
+	policies := map[string]string{
+		"main.rego": `package main
+
+deny contains msg if {
+	input.kind == "Deployment"
+	not input.spec.template.spec.securityContext.runAsNonRoot
+	msg := "Containers must not run as root"
+}
+
+deny_latest contains {"msg": "Images must not use the latest tag", "image": input.image} if {
+	endswith(input.image, ":latest")
+}
+
+violation_labels contains "Deployments must have an app label" if {
+	not input.metadata.labels.app
+}
+
+warn contains "Replicas should be at least 2" if {
+	input.spec.replicas < 2
+}
+
+exception contains ["labels"]
+`,
+		"other.rego": `package other
+
+deny if input.kind == "Pod"
+
+allow := true
+`,
+	}
+
+	in := interface{}(map[string]interface{}{
+		"kind":     "Deployment",
+		"image":    "nginx:latest",
+		"metadata": map[string]interface{}{},
+		"spec":     map[string]interface{}{"replicas": 1},
+	})
+
+	regoVersion := 1
+	cr, _, err := Compile(ctx, &in, nil, nil, policies, "data", nil, nil, false, &regoVersion)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	summary, err := EvalConftest(ctx, cr, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	exp := &ConftestSummary{
+		Results: []ConftestResult{
+			{
+				Namespace: "main",
+				Failures: []ConftestMessage{
+					{Rule: "deny", Msg: "Containers must not run as root"},
+					{Rule: "deny_latest", Msg: "Images must not use the latest tag", Metadata: map[string]interface{}{"image": "nginx:latest"}},
+				},
+				Warnings:   []ConftestMessage{{Rule: "warn", Msg: "Replicas should be at least 2"}},
+				Exceptions: []ConftestMessage{{Rule: "violation_labels", Msg: "Deployments must have an app label"}},
+			},
+			{
+				Namespace:  "other",
+				Successes:  1,
+				Failures:   []ConftestMessage{},
+				Warnings:   []ConftestMessage{},
+				Exceptions: []ConftestMessage{},
+			},
+		},
+		Tests:      5,
+		Passed:     1,
+		Warnings:   1,
+		Failures:   2,
+		Exceptions: 1,
+	}
+
+	if !reflect.DeepEqual(exp, summary) {
+		t.Fatalf("expected %+v but got: %+v", exp, summary)
+	}
+
+	summary, err = EvalConftest(ctx, cr, []string{"other"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(summary.Results) != 1 || summary.Results[0].Namespace != "other" || summary.Tests != 1 {
+		t.Fatalf("expected only the other namespace but got: %+v", summary)
+	}
+
+	for _, ns := range []string{"main; x := 1", "main[x]", "main[1]", `"main"`, "main.deny == 1"} {
+		if _, err := EvalConftest(ctx, cr, []string{ns}); err == nil || !strings.HasPrefix(err.Error(), "invalid namespace") {
+			t.Fatalf("expected namespace %q to be rejected but got: %v", ns, err)
+		}
+	}
+}
+
+func TestEvalConftestInvalidMessage(t *testing.T) {
+	ctx := context.Background()
+	policies := map[string]string{
+		"main.rego": "package main\n\ndeny contains 1\n",
+	}
+
+	regoVersion := 1
+	cr, _, err := Compile(ctx, nil, nil, nil, policies, "data", nil, nil, false, &regoVersion)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = EvalConftest(ctx, cr, nil)
+	if err == nil || err.Error() != "rule deny returned 1, expected strings or objects with a msg string" {
+		t.Fatalf("expected invalid message error but got: %v", err)
+	}
+}
@@ -0,0 +1,148 @@
+package opa
+
+import (
+	"context"
+	"fmt"
+	"maps"
+
+	"github.com/open-policy-agent/opa/ast"
+	"github.com/open-policy-agent/opa/storage"
+	"github.com/open-policy-agent/opa/storage/inmem"
+	log "github.com/sirupsen/logrus"
+)
+
+// DataDocument is a document mounted at a path under data. Unlike the root
+// data document, its value doesn't need to be an object.
+type DataDocument struct {
+	Path  string      `json:"path"` // A ref under data, e.g. data.users or data.config.limits
+	Value interface{} `json:"value"`
+}
+
+// MountData returns the data document with the documents mounted at their
+// paths, creating the objects along the way. Documents must not overwrite
+// each other or values of the data document, and can only be mounted into a
+// data document that is an object. Without documents, a data document that
+// isn't an object is ignored with a warning, so that stored shares keep
+// evaluating. The data document itself is left untouched. Nil is returned if
+// there is neither a data document nor any documents to mount.
+func MountData(data *interface{}, documents []DataDocument) (map[string]interface{}, error) {
+	var root map[string]interface{}
+	if data != nil && *data != nil {
+		var ok bool
+		root, ok = (*data).(map[string]interface{})
+		if !ok {
+			if len(documents) > 0 {
+				return nil, fmt.Errorf("data must be an object to mount data documents into, not %v; use a data document to mount other values", jsonTypeName(*data))
+			}
+			log.WithField("type", jsonTypeName(*data)).Warn("Ignoring data that is not an object.")
+			return nil, nil
+		}
+	}
+
+	if len(documents) == 0 {
+		return root, nil
+	}
+
+	if root == nil {
+		root = map[string]interface{}{}
+	}
+
+	for _, doc := range documents {
+		path, err := parseDataPath(doc.Path)
+		if err != nil {
+			return nil, err
+		}
+
+		if len(path) == 0 {
+			obj, ok := doc.Value.(map[string]interface{})
+			if !ok {
+				return nil, fmt.Errorf("data document %v must be an object", doc.Path)
+			}
+			for k, v := range obj {
+				if root, err = mountValue(root, storage.Path{k}, v, doc.Path); err != nil {
+					return nil, err
+				}
+			}
+			continue
+		}
+
+		if root, err = mountValue(root, path, doc.Value, doc.Path); err != nil {
+			return nil, err
+		}
+	}
+
+	return root, nil
+}
+
+// mountValue returns a copy of obj with value set at path. Only the objects
+// along the path are copied.
+func mountValue(obj map[string]interface{}, path storage.Path, value interface{}, name string) (map[string]interface{}, error) {
+	existing, found := obj[path[0]]
+
+	if len(path) == 1 {
+		if found {
+			return nil, fmt.Errorf("data document %v conflicts with data at the same path", name)
+		}
+	} else {
+		child := map[string]interface{}{}
+		if found {
+			var ok bool
+			if child, ok = existing.(map[string]interface{}); !ok {
+				return nil, fmt.Errorf("data document %v conflicts with non-object data at %v", name, path[0])
+			}
+		}
+
+		var err error
+		if value, err = mountValue(child, path[1:], value, name); err != nil {
+			return nil, err
+		}
+	}
+
+	obj = maps.Clone(obj)
+	obj[path[0]] = value
+	return obj, nil
+}
+
+// parseDataPath parses a ref under data into a storage path.
+func parseDataPath(s string) (storage.Path, error) {
+	ref, err := ast.ParseRef(s)
+	if err != nil || !ref.HasPrefix(ast.DefaultRootRef) {
+		return nil, fmt.Errorf("data document path %q not valid: use a ref under data, e.g. data.users", s)
+	}
+
+	path, err := storage.NewPathForRef(ref)
+	if err != nil {
+		return nil, fmt.Errorf("data document path %q not valid: %w", s, err)
+	}
+
+	return path, nil
+}
+
+// checkDataConflicts reports the rules that are defined at, or under, the
+// path of a mounted document, or inside one of its non-object values.
+func checkDataConflicts(ctx context.Context, compiler *ast.Compiler, documents []DataDocument) ast.Errors {
+	docs, err := MountData(nil, documents)
+	if err != nil {
+		return asErrors("", err)
+	}
+
+	store := inmem.NewFromObject(docs)
+	txn := storage.NewTransactionOrDie(ctx, store)
+	defer store.Abort(ctx, txn)
+
+	return ast.CheckPathConflicts(compiler, storage.NonEmpty(ctx, store, txn))
+}
+
+// jsonTypeName returns the JSON type of a decoded value.
+func jsonTypeName(x interface{}) string {
+	switch x.(type) {
+	case []interface{}:
+		return "an array"
+	case string:
+		return "a string"
+	case bool:
+		return "a boolean"
+	default:
+		return "a number"
+	}
+}
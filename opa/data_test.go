@@ -0,0 +1,199 @@
+package opa
+
+import (
+	"context"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestMountData(t *testing.T) {
+	tests := []struct {
+		note      string
+		data      interface{}
+		documents []DataDocument
+		exp       map[string]interface{}
+		expErr    string
+	}{
+		{
+			note: "no data",
+		},
+		{
+			note: "data only",
+			data: map[string]interface{}{"a": 1.0},
+			exp:  map[string]interface{}{"a": 1.0},
+		},
+		{
+			note: "non-object data",
+			data: []interface{}{1.0},
+		},
+		{
+			note: "documents into non-object data",
+			data: []interface{}{1.0},
+			documents: []DataDocument{
+				{Path: "data.users", Value: []interface{}{}},
+			},
+			expErr: "data must be an object to mount data documents into, not an array",
+		},
+		{
+			note: "non-object documents",
+			data: map[string]interface{}{"a": 1.0},
+			documents: []DataDocument{
+				{Path: "data.users", Value: []interface{}{"alice", "bob"}},
+				{Path: "data.config.limits.max", Value: 10.0},
+				{Path: `data.config["rate-limits"]`, Value: "none"},
+			},
+			exp: map[string]interface{}{
+				"a":     1.0,
+				"users": []interface{}{"alice", "bob"},
+				"config": map[string]interface{}{
+					"limits":      map[string]interface{}{"max": 10.0},
+					"rate-limits": "none",
+				},
+			},
+		},
+		{
+			note: "document at root",
+			documents: []DataDocument{
+				{Path: "data", Value: map[string]interface{}{"a": 1.0}},
+				{Path: "data.b", Value: true},
+			},
+			exp: map[string]interface{}{"a": 1.0, "b": true},
+		},
+		{
+			note: "non-object document at root",
+			documents: []DataDocument{
+				{Path: "data", Value: 1.0},
+			},
+			expErr: "data document data must be an object",
+		},
+		{
+			note: "conflicting documents",
+			documents: []DataDocument{
+				{Path: "data.users", Value: []interface{}{}},
+				{Path: "data.users", Value: []interface{}{}},
+			},
+			expErr: "data document data.users conflicts with data at the same path",
+		},
+		{
+			note: "document under non-object data",
+			data: map[string]interface{}{"config": "x"},
+			documents: []DataDocument{
+				{Path: "data.config.limits", Value: 1.0},
+			},
+			expErr: "data document data.config.limits conflicts with non-object data at config",
+		},
+		{
+			note: "invalid path",
+			documents: []DataDocument{
+				{Path: "input.users", Value: 1.0},
+			},
+			expErr: `data document path "input.users" not valid`,
+		},
+		{
+			note: "non-ground path",
+			documents: []DataDocument{
+				{Path: "data.users[x]", Value: 1.0},
+			},
+			expErr: `data document path "data.users[x]" not valid`,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.note, func(t *testing.T) {
+			var data *interface{}
+			if tc.data != nil {
+				data = &tc.data
+			}
+
+			actual, err := MountData(data, tc.documents)
+			if tc.expErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tc.expErr) {
+					t.Fatalf("expected error containing %q but got: %v", tc.expErr, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if !reflect.DeepEqual(tc.exp, actual) {
+				t.Fatalf("expected %v but got: %v", tc.exp, actual)
+			}
+		})
+	}
+}
+
+func TestMountDataLeavesDataUntouched(t *testing.T) {
+	var data interface{} = map[string]interface{}{"config": map[string]interface{}{"a": 1.0}}
+
+	if _, err := MountData(&data, []DataDocument{{Path: "data.config.b", Value: 2.0}}); err != nil {
+		t.Fatal(err)
+	}
+
+	exp := map[string]interface{}{"config": map[string]interface{}{"a": 1.0}}
+	if !reflect.DeepEqual(exp, data) {
+		t.Fatalf("expected data to be left untouched but got: %v", data)
+	}
+}
+
+func TestCompileWithDataDocuments(t *testing.T) {
+	ctx := context.Background()
+	policy := "package play\n\nallow if count(data.users) == 2\n"
+
+	tests := []struct {
+		note      string
+		documents []DataDocument
+		exp       interface{}
+		expErr    string
+	}{
+		{
+			note:      "no conflict",
+			documents: []DataDocument{{Path: "data.users", Value: []interface{}{"alice", "bob"}}},
+			exp:       true,
+		},
+		{
+			note:      "object sharing the package path",
+			documents: []DataDocument{{Path: "data.play.limits", Value: 1.0}},
+		},
+		{
+			note:      "document at rule path",
+			documents: []DataDocument{{Path: "data.play.allow", Value: true}},
+			expErr:    "conflicting rule for data path play/allow found",
+		},
+		{
+			note:      "document under rule path",
+			documents: []DataDocument{{Path: "data.play.allow.x", Value: true}},
+			expErr:    "conflicting rule for data path play/allow found",
+		},
+		{
+			note:      "non-object document at package path",
+			documents: []DataDocument{{Path: "data.play", Value: "x"}},
+			expErr:    "conflicting rule for data path play/allow found",
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.note, func(t *testing.T) {
+			regoVersion := 1
+			cr, _, err := Compile(ctx, nil, nil, tc.documents, map[string]string{"policy.rego": policy}, "data.play.allow", nil, nil, false, &regoVersion)
+			if tc.expErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tc.expErr) {
+					t.Fatalf("expected error containing %q but got: %v", tc.expErr, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			res, evalErr := Eval(ctx, cr, EvalOptions{})
+			if evalErr != nil {
+				t.Fatal(evalErr.RawError)
+			}
+			if tc.exp != nil && (len(res.Result) == 0 || res.Result[0].Expressions[0].Value != tc.exp) {
+				t.Fatalf("expected %v but got: %v", tc.exp, res.Result)
+			}
+		})
+	}
+}
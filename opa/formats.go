@@ -0,0 +1,408 @@
+package opa
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/hashicorp/hcl/v2"
+	"github.com/hashicorp/hcl/v2/hclsyntax"
+	"github.com/open-policy-agent/opa/ast"
+	"github.com/open-policy-agent/opa/util"
+	"github.com/pelletier/go-toml/v2"
+	ctyjson "github.com/zclconf/go-cty/cty/json"
+	"gopkg.in/yaml.v3"
+)
+
+// Formats of input and data documents given as text, see DecodeDocument.
+const (
+	FormatJSON = "json"
+	FormatYAML = "yaml"
+	FormatTOML = "toml"
+	FormatHCL2 = "hcl2"
+	FormatXML  = "xml"
+	FormatCSV  = "csv"
+)
+
+// formatExtensions maps the formats to the extensions of their files.
+var formatExtensions = map[string]string{
+	FormatJSON: "json",
+	FormatYAML: "yaml",
+	FormatTOML: "toml",
+	FormatHCL2: "hcl",
+	FormatXML:  "xml",
+	FormatCSV:  "csv",
+}
+
+// FormatExtension returns the file extension for a format, or an empty
+// string if the format isn't supported.
+func FormatExtension(format string) string {
+	return formatExtensions[format]
+}
+
+var yamlLineRegexp = regexp.MustCompile(`line (\d+)`)
+
+// DecodeDocument parses the text of a document in the given format into the
+// value it would have as JSON, the way conftest parses its inputs:
+//
+//   - a YAML stream with more than one document becomes an array of them
+//   - HCL2 blocks are nested by type and labels, with repeated blocks
+//     collected in arrays, and expressions that can't be evaluated on their
+//     own kept as "${...}" strings
+//   - XML elements become objects keyed by child element, with attributes
+//     prefixed by "-" and text in "#text"; elements with text only become
+//     strings
+//   - CSV becomes an array of records, each an array of strings
+//
+// Syntax errors are returned as an *ast.Error located in the named file.
+func DecodeDocument(name, format, text string) (interface{}, error) {
+	var x interface{}
+	var err error
+
+	switch format {
+	case FormatJSON:
+		x, err = decodeJSON(name, text)
+	case FormatYAML:
+		x, err = decodeYAML(name, text)
+	case FormatTOML:
+		x, err = decodeTOML(name, text)
+	case FormatHCL2:
+		x, err = decodeHCL2(name, text)
+	case FormatXML:
+		x, err = decodeXML(name, text)
+	case FormatCSV:
+		x, err = decodeCSV(name, text)
+	default:
+		return nil, fmt.Errorf("unsupported format %q", format)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return roundTripJSON(x)
+}
+
+func decodeJSON(name, text string) (interface{}, error) {
+	var x interface{}
+	if err := json.Unmarshal([]byte(text), &x); err != nil {
+		var serr *json.SyntaxError
+		if errors.As(err, &serr) {
+			row := 1 + strings.Count(text[:serr.Offset], "\n")
+			return nil, formatError(name, row, 0, serr.Error())
+		}
+		return nil, formatError(name, 0, 0, err.Error())
+	}
+	return x, nil
+}
+
+func decodeYAML(name, text string) (interface{}, error) {
+	var docs []interface{}
+
+	dec := yaml.NewDecoder(strings.NewReader(text))
+	for {
+		var doc interface{}
+		if err := dec.Decode(&doc); err == io.EOF {
+			break
+		} else if err != nil {
+			msg := strings.TrimPrefix(err.Error(), "yaml: ")
+			row := 0
+			if m := yamlLineRegexp.FindStringSubmatch(msg); m != nil {
+				row, _ = strconv.Atoi(m[1])
+				msg = strings.TrimPrefix(msg, m[0]+": ")
+			}
+			return nil, formatError(name, row, 0, msg)
+		}
+		docs = append(docs, doc)
+	}
+
+	switch len(docs) {
+	case 0:
+		return nil, nil
+	case 1:
+		return docs[0], nil
+	default:
+		return docs, nil
+	}
+}
+
+func decodeTOML(name, text string) (interface{}, error) {
+	var x map[string]interface{}
+	if err := toml.Unmarshal([]byte(text), &x); err != nil {
+		var derr *toml.DecodeError
+		if errors.As(err, &derr) {
+			row, col := derr.Position()
+			return nil, formatError(name, row, col, strings.TrimPrefix(derr.Error(), "toml: "))
+		}
+		return nil, formatError(name, 0, 0, err.Error())
+	}
+	return x, nil
+}
+
+func decodeHCL2(name, text string) (interface{}, error) {
+	file, diags := hclsyntax.ParseConfig([]byte(text), name, hcl.InitialPos)
+	if diags.HasErrors() {
+		return nil, hclError(name, diags)
+	}
+
+	return convertHCLBody(file.Body.(*hclsyntax.Body), file.Bytes)
+}
+
+func convertHCLBody(body *hclsyntax.Body, src []byte) (map[string]interface{}, error) {
+	out := make(map[string]interface{}, len(body.Attributes)+len(body.Blocks))
+
+	for name, attr := range body.Attributes {
+		v, err := convertHCLExpression(attr.Expr, src)
+		if err != nil {
+			return nil, err
+		}
+		out[name] = v
+	}
+
+	for _, block := range body.Blocks {
+		value, err := convertHCLBody(block.Body, src)
+		if err != nil {
+			return nil, err
+		}
+
+		obj, key := out, block.Type
+		for _, label := range block.Labels {
+			inner, ok := obj[key].(map[string]interface{})
+			if !ok {
+				inner = map[string]interface{}{}
+				obj[key] = inner
+			}
+			obj, key = inner, label
+		}
+
+		switch current := obj[key].(type) {
+		case nil:
+			obj[key] = value
+		case []interface{}:
+			obj[key] = append(current, value)
+		default:
+			obj[key] = []interface{}{current, value}
+		}
+	}
+
+	return out, nil
+}
+
+func convertHCLExpression(expr hclsyntax.Expression, src []byte) (interface{}, error) {
+	switch expr := expr.(type) {
+	case *hclsyntax.TupleConsExpr:
+		arr := make([]interface{}, len(expr.Exprs))
+		for i, e := range expr.Exprs {
+			v, err := convertHCLExpression(e, src)
+			if err != nil {
+				return nil, err
+			}
+			arr[i] = v
+		}
+		return arr, nil
+	case *hclsyntax.ObjectConsExpr:
+		obj := make(map[string]interface{}, len(expr.Items))
+		for _, item := range expr.Items {
+			key, err := convertHCLExpression(item.KeyExpr, src)
+			if err != nil {
+				return nil, err
+			}
+			v, err := convertHCLExpression(item.ValueExpr, src)
+			if err != nil {
+				return nil, err
+			}
+			obj[fmt.Sprint(key)] = v
+		}
+		return obj, nil
+	case *hclsyntax.ObjectConsKeyExpr:
+		if kw := hcl.ExprAsKeyword(expr); kw != "" {
+			return kw, nil
+		}
+		return convertHCLExpression(expr.Wrapped, src)
+	}
+
+	val, diags := expr.Value(nil)
+	if diags.HasErrors() || !val.IsWhollyKnown() {
+		// The expression refers to variables or functions, keep its source.
+		rng := expr.Range()
+		return "${" + string(rng.SliceBytes(src)) + "}", nil
+	}
+
+	bs, err := ctyjson.Marshal(val, val.Type())
+	if err != nil {
+		return nil, err
+	}
+
+	var x interface{}
+	if err := util.UnmarshalJSON(bs, &x); err != nil {
+		return nil, err
+	}
+	return x, nil
+}
+
+func hclError(name string, diags hcl.Diagnostics) error {
+	for _, d := range diags {
+		if d.Severity != hcl.DiagError {
+			continue
+		}
+		msg := d.Summary
+		if d.Detail != "" {
+			msg += ": " + d.Detail
+		}
+		if d.Subject != nil {
+			return formatError(name, d.Subject.Start.Line, d.Subject.Start.Column, msg)
+		}
+		return formatError(name, 0, 0, msg)
+	}
+	return formatError(name, 0, 0, diags.Error())
+}
+
+// xmlElement is an element being decoded by decodeXML.
+type xmlElement struct {
+	name     string
+	attrs    []xml.Attr
+	children map[string]interface{}
+	text     strings.Builder
+}
+
+func (e *xmlElement) value() interface{} {
+	text := strings.TrimSpace(e.text.String())
+	if len(e.attrs) == 0 && len(e.children) == 0 {
+		return text
+	}
+
+	obj := make(map[string]interface{}, len(e.attrs)+len(e.children)+1)
+	for _, a := range e.attrs {
+		obj["-"+a.Name.Local] = a.Value
+	}
+	for k, v := range e.children {
+		obj[k] = v
+	}
+	if text != "" {
+		obj["#text"] = text
+	}
+	return obj
+}
+
+func (e *xmlElement) add(name string, v interface{}) {
+	if e.children == nil {
+		e.children = map[string]interface{}{}
+	}
+	switch current := e.children[name].(type) {
+	case nil:
+		e.children[name] = v
+	case []interface{}:
+		e.children[name] = append(current, v)
+	default:
+		e.children[name] = []interface{}{current, v}
+	}
+}
+
+func decodeXML(name, text string) (interface{}, error) {
+	dec := xml.NewDecoder(strings.NewReader(text))
+	root := &xmlElement{}
+	stack := []*xmlElement{root}
+
+	for {
+		tok, err := dec.Token()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			var serr *xml.SyntaxError
+			if errors.As(err, &serr) {
+				return nil, formatError(name, serr.Line, 0, serr.Msg)
+			}
+			row, _ := dec.InputPos()
+			return nil, formatError(name, row, 0, err.Error())
+		}
+
+		switch tok := tok.(type) {
+		case xml.StartElement:
+			stack = append(stack, &xmlElement{name: tok.Name.Local, attrs: tok.Attr})
+		case xml.EndElement:
+			el := stack[len(stack)-1]
+			stack = stack[:len(stack)-1]
+			stack[len(stack)-1].add(el.name, el.value())
+		case xml.CharData:
+			stack[len(stack)-1].text.Write(tok)
+		}
+	}
+
+	if len(root.children) == 0 {
+		row, _ := dec.InputPos()
+		return nil, formatError(name, row, 0, "no root element")
+	}
+
+	return root.children, nil
+}
+
+func decodeCSV(name, text string) (interface{}, error) {
+	r := csv.NewReader(strings.NewReader(text))
+	r.FieldsPerRecord = -1
+
+	records, err := r.ReadAll()
+	if err != nil {
+		var perr *csv.ParseError
+		if errors.As(err, &perr) {
+			return nil, formatError(name, perr.Line, perr.Column, perr.Err.Error())
+		}
+		return nil, formatError(name, 0, 0, err.Error())
+	}
+
+	rows := make([]interface{}, len(records))
+	for i, record := range records {
+		row := make([]interface{}, len(record))
+		for j, field := range record {
+			row[j] = field
+		}
+		rows[i] = row
+	}
+	return rows, nil
+}
+
+// roundTripJSON converts a decoded document to the value it has as JSON, e.g.
+// YAML timestamps become strings and non-string keys are stringified.
+func roundTripJSON(x interface{}) (interface{}, error) {
+	bs, err := json.Marshal(stringKeys(x))
+	if err != nil {
+		return nil, err
+	}
+
+	var out interface{}
+	if err := util.UnmarshalJSON(bs, &out); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func stringKeys(x interface{}) interface{} {
+	switch x := x.(type) {
+	case map[interface{}]interface{}:
+		obj := make(map[string]interface{}, len(x))
+		for k, v := range x {
+			obj[fmt.Sprint(k)] = stringKeys(v)
+		}
+		return obj
+	case map[string]interface{}:
+		for k, v := range x {
+			x[k] = stringKeys(v)
+		}
+		return x
+	case []interface{}:
+		for i, v := range x {
+			x[i] = stringKeys(v)
+		}
+		return x
+	default:
+		return x
+	}
+}
+
+func formatError(name string, row, col int, msg string) *ast.Error {
+	return ast.NewError(ast.ParseErr, &ast.Location{File: name, Row: row, Col: col}, "%s", msg)
+}
@@ -0,0 +1,181 @@
+package opa
+
+import (
+	"encoding/json"
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/open-policy-agent/opa/ast"
+	"github.com/open-policy-agent/opa/util"
+)
+
+func TestDecodeDocument(t *testing.T) {
+	tests := []struct {
+		note   string
+		format string
+		text   string
+		exp    string
+	}{
+		{
+			note:   "json",
+			format: FormatJSON,
+			text:   `{"a": [1, 2.5]}`,
+			exp:    `{"a": [1, 2.5]}`,
+		},
+		{
+			note:   "yaml",
+			format: FormatYAML,
+			text:   "kind: Pod\nmetadata:\n  name: web\n  created: 2024-01-02T03:04:05Z\nspec:\n  replicas: 3\n  1: one\n",
+			exp:    `{"kind": "Pod", "metadata": {"name": "web", "created": "2024-01-02T03:04:05Z"}, "spec": {"replicas": 3, "1": "one"}}`,
+		},
+		{
+			note:   "yaml multi-document",
+			format: FormatYAML,
+			text:   "kind: Service\n---\nkind: Deployment\n",
+			exp:    `[{"kind": "Service"}, {"kind": "Deployment"}]`,
+		},
+		{
+			note:   "toml",
+			format: FormatTOML,
+			text:   "title = \"example\"\n\n[owner]\nname = \"tom\"\nports = [8000, 8001]\n",
+			exp:    `{"title": "example", "owner": {"name": "tom", "ports": [8000, 8001]}}`,
+		},
+		{
+			note:   "hcl2",
+			format: FormatHCL2,
+			text: `resource "aws_s3_bucket" "logs" {
+  bucket = "logs"
+  acl    = var.acl
+  tags   = { env = "prod" }
+}
+
+resource "aws_s3_bucket" "logs" {
+  bucket = "more-logs"
+}
+
+provider "aws" {
+  region = "eu-west-1"
+}
+`,
+			exp: `{
+				"resource": {"aws_s3_bucket": {"logs": [
+					{"bucket": "logs", "acl": "${var.acl}", "tags": {"env": "prod"}},
+					{"bucket": "more-logs"}
+				]}},
+				"provider": {"aws": {"region": "eu-west-1"}}
+			}`,
+		},
+		{
+			note:   "xml",
+			format: FormatXML,
+			text:   `<config version="2"><server port="80">web</server><user>alice</user><user>bob</user></config>`,
+			exp:    `{"config": {"-version": "2", "server": {"-port": "80", "#text": "web"}, "user": ["alice", "bob"]}}`,
+		},
+		{
+			note:   "csv",
+			format: FormatCSV,
+			text:   "name,role\nalice,admin\nbob\n",
+			exp:    `[["name", "role"], ["alice", "admin"], ["bob"]]`,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.note, func(t *testing.T) {
+			actual, err := DecodeDocument("input", tc.format, tc.text)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var exp interface{}
+			if err := util.UnmarshalJSON([]byte(tc.exp), &exp); err != nil {
+				t.Fatal(err)
+			}
+
+			if !reflect.DeepEqual(exp, actual) {
+				a, _ := json.Marshal(actual)
+				t.Fatalf("expected %v but got: %s", tc.exp, a)
+			}
+		})
+	}
+}
+
+func TestDecodeDocumentErrors(t *testing.T) {
+	tests := []struct {
+		note   string
+		format string
+		text   string
+		expRow int
+		expMsg string
+	}{
+		{
+			note:   "json",
+			format: FormatJSON,
+			text:   "{\n  \"a\": 1,\n  \"b\"\n}",
+			expRow: 4,
+			expMsg: "invalid character",
+		},
+		{
+			note:   "yaml",
+			format: FormatYAML,
+			text:   "a: 1\nb: 2\n  c: 3\n",
+			expRow: 3,
+			expMsg: "mapping values are not allowed",
+		},
+		{
+			note:   "toml",
+			format: FormatTOML,
+			text:   "a = 1\nb = \n",
+			expRow: 2,
+			expMsg: "incomplete number",
+		},
+		{
+			note:   "hcl2",
+			format: FormatHCL2,
+			text:   "a = 1\nb {\n",
+			expRow: 2,
+			expMsg: "Unclosed configuration block",
+		},
+		{
+			note:   "xml",
+			format: FormatXML,
+			text:   "<a>\n<b></c>\n</a>",
+			expRow: 2,
+			expMsg: "element <b> closed by </c>",
+		},
+		{
+			note:   "csv",
+			format: FormatCSV,
+			text:   "a,b\n\"c,d\n",
+			expRow: 2,
+			expMsg: "extraneous or missing",
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.note, func(t *testing.T) {
+			_, err := DecodeDocument("input."+FormatExtension(tc.format), tc.format, tc.text)
+
+			var astErr *ast.Error
+			if !errors.As(err, &astErr) {
+				t.Fatalf("expected *ast.Error but got: %v", err)
+			}
+
+			if astErr.Location.File != "input."+FormatExtension(tc.format) || astErr.Location.Row != tc.expRow {
+				t.Fatalf("expected error at %v:%d but got: %v", "input."+FormatExtension(tc.format), tc.expRow, astErr)
+			}
+
+			if !strings.Contains(astErr.Message, tc.expMsg) {
+				t.Fatalf("expected error containing %q but got: %v", tc.expMsg, astErr)
+			}
+		})
+	}
+}
+
+func TestDecodeDocumentUnsupportedFormat(t *testing.T) {
+	_, err := DecodeDocument("input", "ini", "a=1")
+	if err == nil || err.Error() != `unsupported format "ini"` {
+		t.Fatalf("expected unsupported format error but got: %v", err)
+	}
+}
@@ -0,0 +1,218 @@
+package opa
+
+import (
+	"context"
+	"math/rand"
+	"sort"
+
+	"github.com/open-policy-agent/opa/ast"
+)
+
+// Outcomes of a rule for an input, see GenerateInputs.
+const (
+	OutcomeTrue      = "true"
+	OutcomeFalse     = "false"
+	OutcomeUndefined = "undefined"
+	OutcomeMember    = "member" // The set of a multi-value rule contains the value
+	OutcomeValue     = "value"  // The rule has any other value, including an empty set
+	OutcomeError     = "error"  // The rule failed to evaluate with the message as value
+)
+
+// GenerateOptions configure how inputs are generated.
+type GenerateOptions struct {
+	Seed        int64 // The seed of the random inputs
+	Random      int   // The number of random inputs
+	MaxVariants int   // The maximum number of enumerated inputs
+	MaxShrinks  int   // The maximum number of evaluations to minimize the input of each outcome
+}
+
+// GeneratedOutcome is an outcome of the rule with a representative input.
+type GeneratedOutcome struct {
+	Outcome string      `json:"outcome"`
+	Value   interface{} `json:"value,omitempty"` // The set member, value or error message
+	Input   interface{} `json:"input"`           // A minimized input with the outcome
+	Inputs  int         `json:"inputs"`          // The number of generated inputs with the outcome
+}
+
+// GenerateResult represents the result of the GenerateInputs function.
+type GenerateResult struct {
+	Outcomes  []GeneratedOutcome `json:"outcomes"`
+	Inputs    int                `json:"inputs"` // The number of distinct inputs evaluated
+	Seed      int64              `json:"seed"`
+	Truncated bool               `json:"truncated,omitempty"` // Set if the deadline of the context was reached before all inputs were evaluated and minimized
+}
+
+// GenerateInputs generates inputs from a JSON Schema and evaluates the query
+// of the compile result, a reference to rule, with them. Inputs are
+// enumerated from enum values and the bounds of the schema, followed by
+// random inputs. The first input found for each outcome is minimized while
+// keeping the outcome. Outcomes are sorted by kind, and by when they were
+// found. Once the context is done, the outcomes found until then are
+// returned as truncated.
+func GenerateInputs(ctx context.Context, input *CompileResult, rule ast.Ref, schema interface{}, opts GenerateOptions) (*GenerateResult, error) {
+	s, err := parseInputSchema(schema)
+	if err != nil {
+		return nil, err
+	}
+
+	multi := isMultiValueRule(input.Compiler, rule)
+
+	candidates := s.variants(0, opts.MaxVariants)
+
+	rng := rand.New(rand.NewSource(opts.Seed))
+	for range opts.Random {
+		candidates = append(candidates, s.random(rng, 0))
+	}
+
+	candidates = distinctValues(candidates)
+
+	result := &GenerateResult{
+		Outcomes: []GeneratedOutcome{},
+		Seed:     opts.Seed,
+	}
+
+	found := map[string]int{}
+
+	for _, x := range candidates {
+		outcomes, err := evalOutcomes(ctx, input, x, multi)
+		if err != nil {
+			return nil, err
+		}
+
+		// The evaluation of an input interrupted by the deadline has no outcome.
+		if ctx.Err() != nil {
+			result.Truncated = true
+			break
+		}
+		result.Inputs++
+
+		for _, o := range outcomes {
+			key := outcomeKey(o)
+			i, ok := found[key]
+			if !ok {
+				i = len(result.Outcomes)
+				found[key] = i
+				o.Input = x
+				result.Outcomes = append(result.Outcomes, o)
+			}
+			result.Outcomes[i].Inputs++
+		}
+	}
+
+	for i, o := range result.Outcomes {
+		if ctx.Err() != nil {
+			result.Truncated = true
+			break
+		}
+
+		key := outcomeKey(o)
+		result.Outcomes[i].Input = minimizeInput(s, o.Input, opts.MaxShrinks, func(x interface{}) bool {
+			outcomes, err := evalOutcomes(ctx, input, x, multi)
+			if err != nil || ctx.Err() != nil {
+				return false
+			}
+			for _, o := range outcomes {
+				if outcomeKey(o) == key {
+					return true
+				}
+			}
+			return false
+		})
+	}
+
+	sort.SliceStable(result.Outcomes, func(i, j int) bool {
+		return outcomeRank(result.Outcomes[i].Outcome) < outcomeRank(result.Outcomes[j].Outcome)
+	})
+
+	return result, nil
+}
+
+// isMultiValueRule returns true if the rule is a multi-value rule, whose set
+// members are outcomes of their own.
+func isMultiValueRule(compiler *ast.Compiler, rule ast.Ref) bool {
+	for _, r := range compiler.GetRulesExact(rule) {
+		if r.Head.RuleKind() == ast.MultiValue {
+			return true
+		}
+	}
+	return false
+}
+
+func evalOutcomes(ctx context.Context, input *CompileResult, x interface{}, multi bool) ([]GeneratedOutcome, error) {
+	value, err := ast.InterfaceToValue(x)
+	if err != nil {
+		return nil, err
+	}
+
+	d, _ := evalDecision(ctx, withInput(input, value))
+
+	switch {
+	case d.Error != "":
+		return []GeneratedOutcome{{Outcome: OutcomeError, Value: d.Error}}, nil
+	case !d.Defined:
+		return []GeneratedOutcome{{Outcome: OutcomeUndefined}}, nil
+	case d.Value == true:
+		return []GeneratedOutcome{{Outcome: OutcomeTrue}}, nil
+	case d.Value == false:
+		return []GeneratedOutcome{{Outcome: OutcomeFalse}}, nil
+	}
+
+	if members, ok := d.Value.([]interface{}); ok && multi && len(members) > 0 {
+		outcomes := make([]GeneratedOutcome, len(members))
+		for i, m := range members {
+			outcomes[i] = GeneratedOutcome{Outcome: OutcomeMember, Value: m}
+		}
+		return outcomes, nil
+	}
+
+	return []GeneratedOutcome{{Outcome: OutcomeValue, Value: d.Value}}, nil
+}
+
+func outcomeKey(o GeneratedOutcome) string {
+	return o.Outcome + ":" + jsonKey(o.Value)
+}
+
+func outcomeRank(outcome string) int {
+	switch outcome {
+	case OutcomeTrue:
+		return 0
+	case OutcomeFalse:
+		return 1
+	case OutcomeUndefined:
+		return 2
+	case OutcomeError:
+		return 4
+	default:
+		return 3
+	}
+}
+
+// minimizeInput repeatedly replaces x with the first value shrunk from it that
+// is smaller in JSON and satisfies keep, until there is none or the
+// evaluations run out.
+func minimizeInput(s *inputSchema, x interface{}, evals int, keep func(interface{}) bool) interface{} {
+	for evals > 0 {
+		size := len(jsonKey(x))
+		shrunk := false
+
+		for _, c := range s.shrink(x, 0) {
+			if len(jsonKey(c)) >= size {
+				continue
+			}
+			if evals == 0 {
+				break
+			}
+			evals--
+			if keep(c) {
+				x, shrunk = c, true
+				break
+			}
+		}
+
+		if !shrunk {
+			break
+		}
+	}
+
+	return x
+}
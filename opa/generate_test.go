@@ -0,0 +1,178 @@
+package opa
+
+import (
+	"context"
+	"encoding/json"
+	"reflect"
+	"testing"
+
+	"github.com/open-policy-agent/opa/ast"
+	"github.com/open-policy-agent/opa/util"
+)
+
+func TestGenerateInputs(t *testing.T) {
+	ctx := context.Background()
+
+	policies := map[string]string{
+		"play.rego": `package play
+
+allow if {
+	input.user.role == "admin"
+	input.amount <= 100
+}
+
+allow := false if input.user.role == "guest"
+
+reasons contains "large" if input.amount > 1000
+
+reasons contains "anonymous" if not input.user.name
+`,
+	}
+
+	var schema interface{}
+	if err := util.UnmarshalJSON([]byte(`{
+		"type": "object",
+		"required": ["user", "amount"],
+		"properties": {
+			"user": {
+				"type": "object",
+				"required": ["role"],
+				"properties": {
+					"role": {"enum": ["admin", "editor", "guest"]},
+					"name": {"type": "string", "minLength": 1}
+				}
+			},
+			"amount": {"type": "integer", "minimum": 0, "maximum": 5000},
+			"comment": {"type": "string"}
+		}
+	}`), &schema); err != nil {
+		t.Fatal(err)
+	}
+
+	opts := GenerateOptions{Seed: 42, Random: 50, MaxVariants: 100, MaxShrinks: 100}
+
+	tests := []struct {
+		note string
+		rule string
+		exp  string
+	}{
+		{
+			note: "boolean",
+			rule: "data.play.allow",
+			exp: `[
+				{"outcome": "true", "input": {"user": {"role": "admin"}, "amount": 0}},
+				{"outcome": "false", "input": {"user": {"role": "guest"}, "amount": 0}},
+				{"outcome": "undefined", "input": {"user": {"role": "admin"}, "amount": 5000}}
+			]`,
+		},
+		{
+			note: "set members",
+			rule: "data.play.reasons",
+			exp: `[
+				{"outcome": "member", "value": "anonymous", "input": {"user": {"role": "admin"}, "amount": 0}},
+				{"outcome": "member", "value": "large", "input": {"user": {"role": "admin"}, "amount": 5000}},
+				{"outcome": "value", "value": [], "input": {"user": {"role": "admin", "name": "a"}, "amount": 0}}
+			]`,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.note, func(t *testing.T) {
+			regoVersion := 1
+			cr, _, err := Compile(ctx, nil, nil, nil, policies, tc.rule, nil, nil, false, &regoVersion)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			result, err := GenerateInputs(ctx, cr, ast.MustParseRef(tc.rule), schema, opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var exp []map[string]interface{}
+			if err := util.UnmarshalJSON([]byte(tc.exp), &exp); err != nil {
+				t.Fatal(err)
+			}
+
+			var actual []map[string]interface{}
+			bs, _ := json.Marshal(result.Outcomes)
+			if err := util.UnmarshalJSON(bs, &actual); err != nil {
+				t.Fatal(err)
+			}
+
+			for _, o := range actual {
+				if o["inputs"] == nil {
+					t.Fatalf("expected the number of inputs for each outcome but got: %v", o)
+				}
+				delete(o, "inputs")
+			}
+
+			if !reflect.DeepEqual(exp, actual) {
+				t.Fatalf("expected:\n%v\ngot:\n%s", tc.exp, bs)
+			}
+		})
+	}
+}
+
+func TestGenerateInputsSeed(t *testing.T) {
+	ctx := context.Background()
+
+	regoVersion := 1
+	cr, _, err := Compile(ctx, nil, nil, nil, map[string]string{
+		"play.rego": "package play\n\nlevel := input.n * 2\n",
+	}, "data.play.level", nil, nil, false, &regoVersion)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	schema := map[string]interface{}{
+		"type":       "object",
+		"properties": map[string]interface{}{"n": map[string]interface{}{"type": "number"}},
+	}
+
+	opts := GenerateOptions{Seed: 7, Random: 20, MaxVariants: 10, MaxShrinks: 10}
+
+	a, err := GenerateInputs(ctx, cr, ast.MustParseRef("data.play.level"), schema, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := GenerateInputs(ctx, cr, ast.MustParseRef("data.play.level"), schema, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !reflect.DeepEqual(a, b) {
+		t.Fatal("expected the same outcomes for the same seed")
+	}
+
+	if a.Seed != 7 || len(a.Outcomes) < 2 {
+		t.Fatalf("expected seed 7 and several outcomes but got: %+v", a)
+	}
+}
+
+func TestGenerateInputsDeadline(t *testing.T) {
+	regoVersion := 1
+	cr, _, err := Compile(context.Background(), nil, nil, nil, map[string]string{
+		"play.rego": "package play\n\nlevel := input.n * 2\n",
+	}, "data.play.level", nil, nil, false, &regoVersion)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	schema := map[string]interface{}{
+		"type":       "object",
+		"properties": map[string]interface{}{"n": map[string]interface{}{"type": "number"}},
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	res, err := GenerateInputs(ctx, cr, ast.MustParseRef("data.play.level"), schema, GenerateOptions{Random: 20, MaxVariants: 10, MaxShrinks: 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !res.Truncated || res.Inputs != 0 || len(res.Outcomes) != 0 {
+		t.Fatalf("expected a truncated result without outcomes but got: %+v", res)
+	}
+}
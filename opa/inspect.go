@@ -0,0 +1,174 @@
+package opa
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"sync"
+
+	"github.com/open-policy-agent/opa/ast"
+	astJSON "github.com/open-policy-agent/opa/v1/ast/json"
+)
+
+// StageSnapshot holds the modules as they were right after a compiler stage.
+type StageSnapshot struct {
+	Stage   string                 `json:"stage"`
+	Modules map[string]*ast.Module `json:"modules"`
+}
+
+// InspectResult represents the result of the Inspect function. Marshal it
+// with MarshalJSONWithLocations to include the locations of its AST nodes.
+type InspectResult struct {
+	Modules map[string]*ast.Module `json:"modules"`         // The parsed modules, keyed by file
+	Query   ast.Body               `json:"query,omitempty"` // The parsed query, if any
+	Stages  []StageSnapshot        `json:"stages"`          // Snapshots in the order the stages ran
+	Errors  ast.Errors             `json:"errors"`          // Errors reported by the compiler
+}
+
+// Inspect parses the policies and the query, and compiles the policies with
+// a snapshot of all modules taken after each of the named compiler stages.
+// Unknown stage names and parse errors are returned as errors. Compile errors
+// don't fail the inspection: the snapshots of the stages that ran before the
+// error are returned along with it.
+func Inspect(policies map[string]string, query string, stages []string, regoVersion *int) (*InspectResult, error) {
+	regoVer := ast.DefaultRegoVersion
+	if regoVersion != nil {
+		regoVer = ast.RegoVersionFromInt(*regoVersion)
+	}
+	popts := ast.ParserOptions{RegoVersion: regoVer, ProcessAnnotation: true}
+
+	result := &InspectResult{
+		Modules: make(map[string]*ast.Module, len(policies)),
+		Stages:  []StageSnapshot{},
+		Errors:  ast.Errors{},
+	}
+
+	var errs ast.Errors
+	for name, policy := range policies {
+		m, err := ast.ParseModuleWithOpts(name, policy, popts)
+		if err != nil {
+			errs = append(errs, asErrors(name, err)...)
+			continue
+		}
+		if m == nil {
+			return nil, fmt.Errorf("Invalid parameter: empty rego module")
+		}
+		result.Modules[name] = m
+	}
+	if len(errs) > 0 {
+		sort.Slice(errs, func(i, j int) bool { return errs[i].Location.Compare(errs[j].Location) < 0 })
+		return nil, errs
+	}
+
+	if query != "" {
+		body, err := ast.ParseBodyWithOpts(query, popts)
+		if err != nil {
+			return nil, err
+		}
+		result.Query = body
+	}
+
+	if stage := unknownStage(stages); stage != "" {
+		return nil, fmt.Errorf("unknown compiler stage %q", stage)
+	}
+
+	compiler := newCompiler(false)
+
+	for _, stage := range stages {
+		compiler.WithStageAfter(stage, ast.CompilerStageDefinition{
+			Name:       "Snapshot" + stage,
+			MetricName: "compile_stage_snapshot",
+			Stage: func(c *ast.Compiler) *ast.Error {
+				snapshot := StageSnapshot{
+					Stage:   stage,
+					Modules: make(map[string]*ast.Module, len(c.Modules)),
+				}
+				for name, m := range c.Modules {
+					snapshot.Modules[name] = m.Copy()
+				}
+				result.Stages = append(result.Stages, snapshot)
+				return nil
+			},
+		})
+	}
+
+	// The compiler works on copies, leaving the parsed modules untouched.
+	compiler.Compile(result.Modules)
+	if compiler.Failed() {
+		result.Errors = compiler.Errors
+		return result, nil
+	}
+
+	return result, nil
+}
+
+// unknownStage returns the first of the stages the compiler doesn't have, or
+// an empty string if it has all of them. The compiler doesn't list its
+// stages, so they are found by compiling no modules, which runs them all.
+func unknownStage(stages []string) string {
+	ran := make(map[string]bool, len(stages))
+
+	compiler := newCompiler(false)
+	for _, stage := range stages {
+		compiler.WithStageAfter(stage, ast.CompilerStageDefinition{
+			Name:       "Check" + stage,
+			MetricName: "compile_stage_check",
+			Stage: func(*ast.Compiler) *ast.Error {
+				ran[stage] = true
+				return nil
+			},
+		})
+	}
+	compiler.Compile(map[string]*ast.Module{})
+
+	for _, stage := range stages {
+		if !ran[stage] {
+			return stage
+		}
+	}
+	return ""
+}
+
+// astJSONMu guards the JSON options of the ast package, which only has
+// global ones. They are only changed to marshal AST nodes with their
+// locations, see MarshalJSONWithLocations.
+var astJSONMu sync.RWMutex
+
+// MarshalJSON is like json.Marshal, but doesn't marshal AST nodes while the
+// JSON options of the ast package are changed by MarshalJSONWithLocations.
+func MarshalJSON(x any) ([]byte, error) {
+	astJSONMu.RLock()
+	defer astJSONMu.RUnlock()
+	return json.Marshal(x)
+}
+
+// MarshalJSONWithLocations is like MarshalJSON, but includes the locations of
+// all AST nodes in x, e.g. of an InspectResult.
+func MarshalJSONWithLocations(x any) ([]byte, error) {
+	astJSONMu.Lock()
+	defer astJSONMu.Unlock()
+
+	opts := astJSON.GetOptions()
+	defer astJSON.SetOptions(opts)
+
+	astJSON.SetOptions(astJSON.Options{
+		MarshalOptions: astJSON.MarshalOptions{
+			IncludeLocation: astJSON.NodeToggle{
+				Term:           true,
+				Package:        true,
+				Comment:        true,
+				Import:         true,
+				Rule:           true,
+				Head:           true,
+				Expr:           true,
+				SomeDecl:       true,
+				Every:          true,
+				With:           true,
+				Annotations:    true,
+				AnnotationsRef: true,
+			},
+		},
+	})
+
+	return json.Marshal(x)
+}
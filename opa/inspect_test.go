@@ -0,0 +1,140 @@
+package opa
+
+import (
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/open-policy-agent/opa/ast"
+	astJSON "github.com/open-policy-agent/opa/v1/ast/json"
+)
+
+func TestInspect(t *testing.T) {
+	regoVersion := 1
+	policies := map[string]string{
+		"policy.rego": "package play\n\nallow if {\n\tx := input.x\n\tx > 1\n}\n",
+	}
+
+	res, err := Inspect(policies, "data.play.allow", []string{"RewriteWithValues", "RewriteLocalVars"}, &regoVersion)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(res.Errors) != 0 {
+		t.Fatalf("unexpected errors: %v", res.Errors)
+	}
+
+	if exp, act := "data.play.allow", res.Query.String(); exp != act {
+		t.Fatalf("expected query %v, got %v", exp, act)
+	}
+
+	// the parsed module must not be affected by the compiler rewrites
+	if body := res.Modules["policy.rego"].Rules[0].Body.String(); strings.Contains(body, "__local") {
+		t.Fatalf("expected parsed module without rewritten vars, got %v", body)
+	}
+
+	if len(res.Stages) != 2 {
+		t.Fatalf("expected 2 snapshots, got %d", len(res.Stages))
+	}
+
+	// snapshots are taken in the order the stages run
+	if res.Stages[0].Stage != "RewriteLocalVars" || res.Stages[1].Stage != "RewriteWithValues" {
+		t.Fatalf("unexpected stage order: %v, %v", res.Stages[0].Stage, res.Stages[1].Stage)
+	}
+
+	if body := res.Stages[0].Modules["policy.rego"].Rules[0].Body.String(); !strings.Contains(body, "__local0__") {
+		t.Fatalf("expected rewritten local vars, got %v", body)
+	}
+}
+
+func TestInspectErrors(t *testing.T) {
+	regoVersion := 1
+
+	if _, err := Inspect(map[string]string{"policy.rego": "package play\n\np if {\n"}, "", nil, &regoVersion); err == nil {
+		t.Fatal("expected parse error")
+	}
+
+	if _, err := Inspect(map[string]string{"policy.rego": "package play\n"}, "", []string{"NoSuchStage"}, &regoVersion); err == nil || !strings.Contains(err.Error(), "NoSuchStage") {
+		t.Fatalf("expected unknown stage error, got %v", err)
+	}
+
+	res, err := Inspect(map[string]string{"policy.rego": "package play\n\np if q\n"}, "", []string{"RewriteLocalVars", "CheckTypes"}, &regoVersion)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(res.Errors) != 1 || len(res.Stages) != 1 {
+		t.Fatalf("expected 1 compile error and 1 snapshot, got %v and %d", res.Errors, len(res.Stages))
+	}
+
+	// Unknown stages are reported even if the policy fails to compile.
+	if _, err := Inspect(map[string]string{"policy.rego": "package play\n\np if q\n"}, "", []string{"RewriteLocalVar"}, &regoVersion); err == nil || !strings.Contains(err.Error(), "RewriteLocalVar") {
+		t.Fatalf("expected unknown stage error, got %v", err)
+	}
+}
+
+func TestMarshalJSONWithLocations(t *testing.T) {
+	module := ast.MustParseModuleWithOpts(`# METADATA
+# title: Test
+package play
+
+import data.lib.x as y
+import input.z
+
+# a comment
+default allow := false
+
+allow if {
+	some i
+	input.xs[i] == 1
+	not deny with input as {"a": [1, {2}], "b": null}
+	every k, v in {"a": 1} { k != v }
+	count([x | x := input.xs[_]]) > 0
+	s := {x | x := input.xs[_]}
+	o := {k: v | some k, v in input.m}
+}
+
+deny if false else := true
+
+f(x) := x + 1
+
+p.q[r] contains 1 if r := "s"
+`, ast.ParserOptions{RegoVersion: ast.RegoV1, ProcessAnnotation: true})
+
+	// The locations are included like with the JSON options of the ast package.
+	opts := astJSON.GetOptions()
+	astJSON.SetOptions(astJSON.Options{
+		MarshalOptions: astJSON.MarshalOptions{
+			IncludeLocation: astJSON.NodeToggle{
+				Term: true, Package: true, Comment: true, Import: true, Rule: true, Head: true,
+				Expr: true, SomeDecl: true, Every: true, With: true, Annotations: true, AnnotationsRef: true,
+			},
+		},
+	})
+	exp, err := json.Marshal(module)
+	astJSON.SetOptions(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	act, err := MarshalJSONWithLocations(module)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var expDoc, actDoc any
+	if err := json.Unmarshal(exp, &expDoc); err != nil {
+		t.Fatal(err)
+	}
+	if err := json.Unmarshal(act, &actDoc); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(act), `"location"`) || !reflect.DeepEqual(expDoc, actDoc) {
+		t.Fatalf("expected:\n%s\ngot:\n%s", exp, act)
+	}
+
+	if bs, _ := MarshalJSON(module); strings.Contains(string(bs), "location") {
+		t.Fatalf("expected the JSON options to be restored, got: %s", bs)
+	}
+}
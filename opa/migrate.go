@@ -0,0 +1,118 @@
+package opa
+
+import (
+	"sort"
+
+	"github.com/open-policy-agent/opa/ast"
+	"github.com/open-policy-agent/opa/format"
+	astv1 "github.com/open-policy-agent/opa/v1/ast"
+)
+
+// deprecatedBuiltinReplacements maps deprecated built-ins to the built-ins
+// that can be called in their place with the same arguments. Any other
+// deprecated built-in is left for the user to replace.
+var deprecatedBuiltinReplacements = map[string]*ast.Builtin{
+	ast.RegexMatchDeprecated.Name: ast.RegexMatch,
+	ast.NetCIDROverlap.Name:       ast.NetCIDRContains,
+	ast.SetDiff.Name:              ast.Minus,
+}
+
+// MigrateResult represents the result of the Migrate function.
+type MigrateResult struct {
+	Modules map[string]string // The migrated modules, keyed by file
+	Issues  ast.Errors        // Constructs that need to be migrated manually
+}
+
+// Migrate rewrites Rego v0 modules as Rego v1. Rules are formatted with the
+// `if` and `contains` keywords, `future.keywords` and `rego.v1` imports are
+// dropped and deprecated built-ins with a drop-in replacement are renamed.
+// Whatever cannot be rewritten automatically is returned as an issue located
+// in the original module. Modules that are already v1 are returned unchanged.
+func Migrate(policies map[string]string) *MigrateResult {
+	result := &MigrateResult{
+		Modules: make(map[string]string, len(policies)),
+	}
+
+	for name, policy := range policies {
+		migrated, issues := migrateModule(name, policy)
+		result.Modules[name] = migrated
+		result.Issues = append(result.Issues, issues...)
+	}
+
+	sort.Slice(result.Issues, func(i, j int) bool {
+		a, b := result.Issues[i].Location, result.Issues[j].Location
+		if a == nil || b == nil {
+			return b != nil
+		}
+		return a.Compare(b) < 0
+	})
+
+	return result
+}
+
+func migrateModule(name, policy string) (string, ast.Errors) {
+	module, err := ast.ParseModuleWithOpts(name, policy, ast.ParserOptions{RegoVersion: ast.RegoV0})
+	if err != nil {
+		if _, v1Err := ast.ParseModuleWithOpts(name, policy, ast.ParserOptions{RegoVersion: ast.RegoV1}); v1Err == nil {
+			return policy, nil
+		}
+		return policy, asErrors(name, err)
+	}
+
+	replaceDeprecatedBuiltins(module)
+
+	checkOpts := astv1.NewRegoCheckOptions()
+	// Missing keywords and rule bodies are added by the formatter.
+	checkOpts.RequireIfKeyword = false
+	checkOpts.RequireContainsKeyword = false
+	checkOpts.RequireRuleBodyOrValue = false
+	issues := astv1.CheckRegoV1WithOptions(module, checkOpts)
+	if len(issues) > 0 {
+		return policy, issues
+	}
+
+	formatted, err := format.AstWithOpts(module, format.Opts{
+		RegoVersion:   ast.RegoV1,
+		DropV0Imports: true,
+	})
+	if err != nil {
+		return policy, asErrors(name, err)
+	}
+
+	return string(formatted), nil
+}
+
+// replaceDeprecatedBuiltins renames calls to deprecated built-ins listed in
+// deprecatedBuiltinReplacements, keeping the location of the original call.
+func replaceDeprecatedBuiltins(module *ast.Module) {
+	replace := func(op *ast.Term) {
+		if bi, ok := deprecatedBuiltinReplacements[op.Value.String()]; ok {
+			op.Value = bi.Ref()
+		}
+	}
+
+	ast.NewGenericVisitor(func(x interface{}) bool {
+		switch x := x.(type) {
+		case *ast.Expr:
+			if x.IsCall() {
+				replace(x.Terms.([]*ast.Term)[0])
+			}
+		case ast.Call:
+			if len(x) > 0 {
+				replace(x[0])
+			}
+		}
+		return false
+	}).Walk(module)
+}
+
+func asErrors(name string, err error) ast.Errors {
+	switch err := err.(type) {
+	case ast.Errors:
+		return err
+	case *ast.Error:
+		return ast.Errors{err}
+	default:
+		return ast.Errors{ast.NewError(ast.CompileErr, &ast.Location{File: name}, "%s", err.Error())}
+	}
+}
@@ -0,0 +1,92 @@
+package opa
+
+import (
+	"testing"
+)
+
+func TestMigrate(t *testing.T) {
+	policies := map[string]string{
+		"authz.rego": `package authz
+
+import future.keywords.in
+
+default allow = false
+
+allow {
+	input.user in {"alice", "bob"}
+	re_match("^/api/", input.path)
+}
+
+deny[msg] {
+	not allow
+	msg := "denied"
+}
+`,
+		"roles.rego": `package roles
+
+input = {"user": "alice"}
+
+admin {
+	any([input.user == "alice"])
+}
+`,
+		"v1.rego": `package v1
+
+p contains 1 if true
+`,
+		"broken.rego": `package broken
+
+p {
+`,
+	}
+
+	res := Migrate(policies)
+
+	expAuthz := `package authz
+
+default allow := false
+
+allow if {
+	input.user in {"alice", "bob"}
+	regex.match("^/api/", input.path)
+}
+
+deny contains msg if {
+	not allow
+	msg := "denied"
+}
+`
+	if act := res.Modules["authz.rego"]; act != expAuthz {
+		t.Errorf("expected authz.rego:\n%s\ngot:\n%s", expAuthz, act)
+	}
+
+	for _, name := range []string{"roles.rego", "v1.rego", "broken.rego"} {
+		if res.Modules[name] != policies[name] {
+			t.Errorf("expected %s to be unchanged, got:\n%s", name, res.Modules[name])
+		}
+	}
+
+	exp := []struct {
+		file    string
+		row     int
+		message string
+	}{
+		{"broken.rego", 4, "unexpected eof token"},
+		{"roles.rego", 3, "rules must not shadow input (use a different rule name)"},
+		{"roles.rego", 6, "deprecated built-in function calls in expression: any"},
+	}
+
+	if len(res.Issues) != len(exp) {
+		t.Fatalf("expected %d issues, got %v", len(exp), res.Issues)
+	}
+
+	for i, e := range exp {
+		act := res.Issues[i]
+		if act.Location.File != e.file || act.Location.Row != e.row {
+			t.Errorf("expected issue %d at %s:%d, got %v", i, e.file, e.row, act)
+		}
+		if act.Message != e.message {
+			t.Errorf("expected issue %d message %q, got %q", i, e.message, act.Message)
+		}
+	}
+}
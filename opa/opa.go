@@ -12,6 +12,10 @@ import (
 	"time"
 
 	log "github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
 
 	"github.com/open-policy-agent/opa/ast"
 	coverpkg "github.com/open-policy-agent/opa/cover"
@@ -51,6 +55,11 @@ var parserOptions = []struct {
 
 var caps = capabilities()
 
+// evalTimeout is the maximum duration of an evaluation.
+const evalTimeout = 5 * time.Second
+
+var tracer = otel.Tracer("github.com/open-policy-agent/rego-playground/opa")
+
 func capabilities() *ast.Capabilities {
 	caps := ast.CapabilitiesForThisVersion()
 
@@ -84,6 +93,7 @@ type CompileResult struct {
 	Compiler         *ast.Compiler
 	ParsedInput      ast.Value
 	Store            storage.Store
+	Metrics          metrics.Metrics // Timers of parsing and compiling the modules and the query
 }
 
 // EvalOptions defines options for evaluation
@@ -92,6 +102,7 @@ type EvalOptions struct {
 	Cover               bool
 	BuiltInErrorsAll    bool
 	BuiltInErrorsStrict bool
+	Metrics             bool // Instrument evaluation and report all metrics
 }
 
 // EvalResult represents the result of the evaluation function.
@@ -101,6 +112,9 @@ type EvalResult struct {
 	Trace    []*topdown.Event
 	Coverage *coverpkg.Report
 	Output   string
+
+	Metrics      map[string]interface{} // All compile and eval metrics, if requested
+	BuiltinCalls map[string]int         // Number of calls per built-in function, if metrics were requested
 }
 
 // ParseResult represents the result of parsing a rego source text string
@@ -118,8 +132,32 @@ func newError() *Error {
 	return &Error{}
 }
 
-// Compile compiles OPA query. There must be at least one policy.
-func Compile(ctx context.Context, input *interface{}, data *interface{}, policies map[string]string, query string,
+// Compile compiles OPA query. There must be at least one policy. The data
+// documents are mounted into the data document at their paths, and must not
+// conflict with the rules of the policies.
+func Compile(ctx context.Context, input *interface{}, data *interface{}, documents []DataDocument, policies map[string]string, query string,
+	queryPackage *string, queryImports *[]string, strict bool, regoVersion *int,
+) (*CompileResult, Ignored, error) {
+	ctx, span := tracer.Start(ctx, "opa.Compile", trace.WithAttributes(
+		attribute.Int("rego.modules", len(policies)),
+		attribute.Bool("rego.strict", strict),
+	))
+	defer span.End()
+
+	if regoVersion != nil {
+		span.SetAttributes(attribute.Int("rego.version", *regoVersion))
+	}
+
+	result, ignored, err := compilePolicies(ctx, input, data, documents, policies, query, queryPackage, queryImports, strict, regoVersion)
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, "compile error")
+	}
+
+	return result, ignored, err
+}
+
+func compilePolicies(ctx context.Context, input *interface{}, data *interface{}, documents []DataDocument, policies map[string]string, query string,
 	queryPackage *string, queryImports *[]string, strict bool, regoVersion *int,
 ) (*CompileResult, Ignored, error) {
 	var inputValue ast.Value
@@ -135,11 +173,12 @@ func Compile(ctx context.Context, input *interface{}, data *interface{}, policie
 	// To avoid a hard error on the frontend, we leave the store null if the
 	// data document was null; otherwise, it is populated normally.
 	var store storage.Store
-	if data != nil {
-		dataMap, ok := (*data).(map[string]interface{})
-		if ok {
-			store = inmem.NewFromObject(dataMap)
-		}
+	dataMap, err := MountData(data, documents)
+	if err != nil {
+		return nil, nil, err
+	}
+	if dataMap != nil {
+		store = inmem.NewFromObject(dataMap)
 	}
 
 	regoVer := ast.DefaultRegoVersion
@@ -147,6 +186,9 @@ func Compile(ctx context.Context, input *interface{}, data *interface{}, policie
 		regoVer = ast.RegoVersionFromInt(*regoVersion)
 	}
 
+	met := metrics.New()
+
+	met.Timer(metrics.RegoModuleParse).Start()
 	ms := make(map[string]*ast.Module, len(policies))
 	for name, policy := range policies {
 		m, err := ast.ParseModuleWithOpts(name, policy, ast.ParserOptions{RegoVersion: regoVer})
@@ -158,6 +200,7 @@ func Compile(ctx context.Context, input *interface{}, data *interface{}, policie
 		}
 		ms[name] = m
 	}
+	met.Timer(metrics.RegoModuleParse).Stop()
 
 	// Extract one of the parsed modules (not a compiled module, otherwise imports are lost);
 	// potentially used to determine query string, package, and imports.
@@ -168,20 +211,20 @@ func Compile(ctx context.Context, input *interface{}, data *interface{}, policie
 	}
 
 	// Compile the modules, caching the result in the compiler
-	compiler := ast.NewCompiler().
-		WithCapabilities(caps).
-		WithEnablePrintStatements(true).
-		WithStrict(strict).
-		WithStageAfter("RewriteWithValues", ast.CompilerStageDefinition{
-			Name:       "CheckHTTPSend",
-			MetricName: "compiler_stage_check_http_send",
-			Stage:      checkHTTPSendCompiler,
-		})
+	compiler := newCompiler(strict).WithMetrics(met)
+	met.Timer(metrics.RegoModuleCompile).Start()
 	compiler.Compile(ms)
+	met.Timer(metrics.RegoModuleCompile).Stop()
 	if compiler.Failed() {
 		return nil, nil, compiler.Errors
 	}
 
+	if len(documents) > 0 {
+		if errs := checkDataConflicts(ctx, compiler, documents); len(errs) > 0 {
+			return nil, nil, errs
+		}
+	}
+
 	// Choose a query if none provided.
 	if query == "" {
 		if len(compiler.Modules) == 1 {
@@ -241,7 +284,9 @@ func Compile(ctx context.Context, input *interface{}, data *interface{}, policie
 	}
 
 	// Parse and compile the query.
+	met.Timer(metrics.RegoQueryParse).Start()
 	queryParseResult, ignored, err := parseQuery(query, opts, one)
+	met.Timer(metrics.RegoQueryParse).Stop()
 	if err != nil {
 		return nil, ignored, err
 	}
@@ -255,7 +300,9 @@ func Compile(ctx context.Context, input *interface{}, data *interface{}, policie
 			Stage:      checkHTTPSend,
 		}).
 		WithEnablePrintStatements(true)
+	met.Timer(metrics.RegoQueryCompile).Start()
 	_, err = qc.Compile(queryParseResult.ParsedQuery)
+	met.Timer(metrics.RegoQueryCompile).Stop()
 	if err != nil {
 		return nil, ignored, err
 	}
@@ -268,9 +315,24 @@ func Compile(ctx context.Context, input *interface{}, data *interface{}, policie
 		Compiler:         compiler,
 		ParsedInput:      inputValue,
 		Store:            store,
+		Metrics:          met,
 	}, ignored, nil
 }
 
+// newCompiler returns a compiler configured the way the playground compiles
+// modules for evaluation.
+func newCompiler(strict bool) *ast.Compiler {
+	return ast.NewCompiler().
+		WithCapabilities(caps).
+		WithEnablePrintStatements(true).
+		WithStrict(strict).
+		WithStageAfter("RewriteWithValues", ast.CompilerStageDefinition{
+			Name:       "CheckHTTPSend",
+			MetricName: "compiler_stage_check_http_send",
+			Stage:      checkHTTPSendCompiler,
+		})
+}
+
 func parseQuery(query string, opts ast.ParserOptions, one *ast.Module) (QueryParseResult, Ignored, error) {
 	stmts, _, err := ast.ParseStatementsWithOpts("", query, opts)
 	if err != nil {
@@ -395,8 +457,20 @@ func (e WriteableBuiltInErrors) Error() string {
 }
 
 // Eval evaluates OPA query.
-func Eval(ctx context.Context, input *CompileResult, options EvalOptions) (*EvalResult, *Error) {
-	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+func Eval(ctx context.Context, input *CompileResult, options EvalOptions) (_ *EvalResult, panicErr *Error) {
+	ctx, span := tracer.Start(ctx, "opa.Eval", trace.WithAttributes(
+		attribute.Bool("opa.trace", options.DebugTrace),
+		attribute.Bool("opa.coverage", options.Cover),
+	))
+	defer func() {
+		if panicErr != nil {
+			span.RecordError(panicErr.RawError)
+			span.SetStatus(codes.Error, "eval error")
+		}
+		span.End()
+	}()
+
+	ctx, cancel := context.WithTimeout(ctx, evalTimeout)
 	defer cancel()
 
 	evalError := newError()
@@ -411,6 +485,7 @@ func Eval(ctx context.Context, input *CompileResult, options EvalOptions) (*Eval
 			} else {
 				evalError.RawError = err
 			}
+			panicErr = evalError
 		}
 	}()
 
@@ -450,11 +525,18 @@ func Eval(ctx context.Context, input *CompileResult, options EvalOptions) (*Eval
 		rego.EvalTime(now),
 	}
 
-	var tracer *topdown.BufferTracer
+	var bufTracer *topdown.BufferTracer
 
 	if options.DebugTrace {
-		tracer = topdown.NewBufferTracer()
-		evalArgs = append(evalArgs, rego.EvalTracer(tracer), rego.EvalRuleIndexing(false))
+		bufTracer = topdown.NewBufferTracer()
+		evalArgs = append(evalArgs, rego.EvalTracer(bufTracer), rego.EvalRuleIndexing(false))
+	}
+
+	var builtins *builtinCounter
+
+	if options.Metrics {
+		builtins = &builtinCounter{counts: map[string]int{}}
+		evalArgs = append(evalArgs, rego.EvalQueryTracer(builtins), rego.EvalInstrument(true))
 	}
 
 	var cover *coverpkg.Cover
@@ -501,8 +583,18 @@ func Eval(ctx context.Context, input *CompileResult, options EvalOptions) (*Eval
 		return nil, evalError
 	}
 
-	if tracer != nil {
-		result.Trace = *tracer
+	if bufTracer != nil {
+		result.Trace = *bufTracer
+	}
+
+	if builtins != nil {
+		result.Metrics = met.All()
+		if input.Metrics != nil {
+			for name, value := range input.Metrics.All() {
+				result.Metrics[name] = value
+			}
+		}
+		result.BuiltinCalls = builtins.counts
 	}
 
 	if cover != nil {
@@ -517,6 +609,39 @@ func Eval(ctx context.Context, input *CompileResult, options EvalOptions) (*Eval
 	return &result, nil
 }
 
+// builtinCounter is a query tracer counting the calls of each built-in
+// function. Unification and assignment are not counted.
+type builtinCounter struct {
+	counts map[string]int
+}
+
+func (*builtinCounter) Enabled() bool {
+	return true
+}
+
+func (*builtinCounter) Config() topdown.TraceConfig {
+	return topdown.TraceConfig{}
+}
+
+func (c *builtinCounter) TraceEvent(ev topdown.Event) {
+	if ev.Op != topdown.EvalOp {
+		return
+	}
+
+	expr, ok := ev.Node.(*ast.Expr)
+	if !ok || !expr.IsCall() {
+		return
+	}
+
+	name := expr.Operator().String()
+	if name == ast.Equality.Name || name == ast.Assign.Name {
+		return
+	}
+	if _, ok := ast.BuiltinMap[name]; ok {
+		c.counts[name]++
+	}
+}
+
 func VarsForSelection(rawModule string, rawSelection string) (*ParseResult, *Error) {
 	// Make sure the selection parses first.. don't bother with anything else if it isn't valid.
 	body, err := ast.ParseBody(rawSelection)
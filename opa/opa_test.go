@@ -37,7 +37,7 @@ func TestCompileWithFullUserInput(t *testing.T) {
 	  input.message == "world"
 	}`
 
-	actual, _, err := Compile(ctx, &in, nil, map[string]string{"test.rego": policy}, "", nil, nil, false, nil)
+	actual, _, err := Compile(ctx, &in, nil, nil, map[string]string{"test.rego": policy}, "", nil, nil, false, nil)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -80,7 +80,7 @@ func TestCompileWithMockFullInput(t *testing.T) {
 		hello with input as {"message": "world", "foo": "bar"}
 	}`
 
-	actual, _, err := Compile(ctx, nil, nil, map[string]string{"test.rego": policy}, "test_allow", nil, nil, false, nil)
+	actual, _, err := Compile(ctx, nil, nil, nil, map[string]string{"test.rego": policy}, "test_allow", nil, nil, false, nil)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -119,7 +119,7 @@ func TestCompileWithMockFullInputDotNotation(t *testing.T) {
 		hello with input.message as "world" with input.foo as "bar"
 	}`
 
-	actual, _, err := Compile(ctx, nil, nil, map[string]string{"test.rego": policy}, "test_allow", nil, nil, false, nil)
+	actual, _, err := Compile(ctx, nil, nil, nil, map[string]string{"test.rego": policy}, "test_allow", nil, nil, false, nil)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -162,7 +162,7 @@ func TestCompileWithMockPartialInputDotNotation(t *testing.T) {
 		hello with input.foo as "bar"
 	}`
 
-	actual, _, err := Compile(ctx, &in, nil, map[string]string{"test.rego": policy}, "test_allow", nil, nil, false, nil)
+	actual, _, err := Compile(ctx, &in, nil, nil, map[string]string{"test.rego": policy}, "test_allow", nil, nil, false, nil)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -199,7 +199,7 @@ func TestCompileWithPackageUserInput(t *testing.T) {
 	  input.foo == "bar"
 	}`
 
-	actual, _, err := Compile(ctx, nil, nil, map[string]string{"test.rego": policy}, "package play", nil, nil, false, nil)
+	actual, _, err := Compile(ctx, nil, nil, nil, map[string]string{"test.rego": policy}, "package play", nil, nil, false, nil)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -233,7 +233,7 @@ func TestCompileWithRuleBodyUserInput(t *testing.T) {
 	  input.foo == "bar"
 	}`
 
-	actual, _, err := Compile(ctx, nil, nil, map[string]string{"test.rego": policy}, query, nil, nil, false, nil)
+	actual, _, err := Compile(ctx, nil, nil, nil, map[string]string{"test.rego": policy}, query, nil, nil, false, nil)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -341,7 +341,7 @@ func TestCompileIgnoredUserInput(t *testing.T) {
 
 	for _, tc := range testCases {
 		t.Run(tc.note, func(t *testing.T) {
-			actual, ignored, err := Compile(ctx, nil, nil, map[string]string{"test.rego": policy}, tc.query, nil, nil, false, nil)
+			actual, ignored, err := Compile(ctx, nil, nil, nil, map[string]string{"test.rego": policy}, tc.query, nil, nil, false, nil)
 
 			if len(ignored) != len(tc.expectedIgnored) {
 				t.Fatalf("Got warnings: %v, expected: %v", ignored, tc.expectedIgnored)
@@ -400,7 +400,7 @@ allow if 2 / 0 == 2
 play.rego:5: eval_builtin_error: div: divide by zero
 play.rego:7: eval_builtin_error: div: divide by zero`
 
-	compileRes, _, err := Compile(ctx, nil, nil, map[string]string{"play.rego": policy}, "allow", nil, nil, false, nil)
+	compileRes, _, err := Compile(ctx, nil, nil, nil, map[string]string{"play.rego": policy}, "allow", nil, nil, false, nil)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -429,7 +429,7 @@ allow if 2 / 0 == 2
 `
 	expectedError := "play.rego:5: eval_builtin_error: div: divide by zero"
 
-	compileRes, _, err := Compile(ctx, nil, nil, map[string]string{"play.rego": policy}, "allow", nil, nil, false, nil)
+	compileRes, _, err := Compile(ctx, nil, nil, nil, map[string]string{"play.rego": policy}, "allow", nil, nil, false, nil)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -523,7 +523,7 @@ data := 1
 
 	for _, tc := range testCases {
 		t.Run(tc.note, func(t *testing.T) {
-			_, _, err := Compile(ctx, nil, nil, map[string]string{"test.rego": tc.policy}, "data.play", nil, nil, true, nil)
+			_, _, err := Compile(ctx, nil, nil, nil, map[string]string{"test.rego": tc.policy}, "data.play", nil, nil, true, nil)
 
 			if err == nil {
 				t.Fatal("expected error")
@@ -554,7 +554,7 @@ func TestEvalWithFullUserInput(t *testing.T) {
 	  input.message == "world"
 	}`
 
-	compileRes, _, err := Compile(ctx, &in, nil, map[string]string{"test.rego": policy}, "hello", nil, nil, false, nil)
+	compileRes, _, err := Compile(ctx, &in, nil, nil, map[string]string{"test.rego": policy}, "hello", nil, nil, false, nil)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -581,7 +581,7 @@ func TestEvalWithMockFullInput(t *testing.T) {
 		hello with input as {"message": "world", "foo": "bar"}
 	}`
 
-	compileRes, _, err := Compile(ctx, nil, nil, map[string]string{"test.rego": policy}, "test_allow", nil, nil, false, nil)
+	compileRes, _, err := Compile(ctx, nil, nil, nil, map[string]string{"test.rego": policy}, "test_allow", nil, nil, false, nil)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -609,7 +609,7 @@ func TestEvalWithMockFullInputDotNotation(t *testing.T) {
 		hello with input.message as "world" with input.foo as "bar"
 	}`
 
-	compileRes, _, err := Compile(ctx, nil, nil, map[string]string{"test.rego": policy}, "test_allow", nil, nil, false, nil)
+	compileRes, _, err := Compile(ctx, nil, nil, nil, map[string]string{"test.rego": policy}, "test_allow", nil, nil, false, nil)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -641,7 +641,7 @@ func TestEvalWithMockPartialInputDotNotation(t *testing.T) {
 		hello with input.foo as "bar"
 	}`
 
-	compileRes, _, err := Compile(ctx, &in, nil, map[string]string{"test.rego": policy}, "test_allow", nil, nil, false, nil)
+	compileRes, _, err := Compile(ctx, &in, nil, nil, map[string]string{"test.rego": policy}, "test_allow", nil, nil, false, nil)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -665,7 +665,7 @@ func TestEvalWithPackageUserInput(t *testing.T) {
 	  input.message == "world"
 	}`
 
-	compileRes, _, err := Compile(ctx, &in, nil, map[string]string{"test.rego": policy}, "package play", nil, nil, false, nil)
+	compileRes, _, err := Compile(ctx, &in, nil, nil, map[string]string{"test.rego": policy}, "package play", nil, nil, false, nil)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -700,7 +700,7 @@ func TestEvalWithRuleBodyUserInput(t *testing.T) {
 	
 	bye {false}`
 
-	compileRes, _, err := Compile(ctx, &in, nil, map[string]string{"test.rego": policy}, query, nil, nil, false, nil)
+	compileRes, _, err := Compile(ctx, &in, nil, nil, map[string]string{"test.rego": policy}, query, nil, nil, false, nil)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -723,7 +723,7 @@ func TestEvalWithCoverage(t *testing.T) {
 	}`
 
 	var in interface{} = map[string]string{}
-	c, _, err := Compile(ctx, &in, nil, map[string]string{"test.rego": module}, "allow", nil, nil, false, nil)
+	c, _, err := Compile(ctx, &in, nil, nil, map[string]string{"test.rego": module}, "allow", nil, nil, false, nil)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -749,7 +749,7 @@ func TestEvalWithContextCancel(t *testing.T) {
 	}
 	`
 
-	compileRes, _, err := Compile(ctx, nil, nil, map[string]string{"test.rego": policy}, "allow", nil, nil, false, nil)
+	compileRes, _, err := Compile(ctx, nil, nil, nil, map[string]string{"test.rego": policy}, "allow", nil, nil, false, nil)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -800,3 +800,52 @@ func assertResultSet(t *testing.T, rs rego.ResultSet, expectedExpressions string
 		t.Fatalf("Expected bindings:\n\n%v\n\nGot:\n\n%v", expectedBindings, bindings)
 	}
 }
+
+func TestEvalWithMetrics(t *testing.T) {
+	ctx := context.Background()
+
+	policy := `package play
+
+import future.keywords
+
+names := [upper(n) | some n in ["a", "b", "c"]]
+
+allow if count(names) == 3
+`
+
+	compileRes, _, err := Compile(ctx, nil, nil, nil, map[string]string{"play.rego": policy}, "allow", nil, nil, false, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	res, evalErr := Eval(ctx, compileRes, EvalOptions{})
+	if evalErr != nil {
+		t.Fatal(evalErr.RawError)
+	}
+	if res.Metrics != nil || res.BuiltinCalls != nil {
+		t.Fatal("expected no metrics unless requested")
+	}
+
+	res, evalErr = Eval(ctx, compileRes, EvalOptions{Metrics: true})
+	if evalErr != nil {
+		t.Fatal(evalErr.RawError)
+	}
+
+	for _, name := range []string{
+		"timer_rego_module_parse_ns",
+		"timer_rego_module_compile_ns",
+		"timer_compile_stage_rewrite_local_vars_ns",
+		"timer_rego_query_parse_ns",
+		"timer_rego_query_compile_ns",
+		"timer_rego_query_eval_ns",
+		"timer_eval_op_builtin_call_ns",
+	} {
+		if _, ok := res.Metrics[name]; !ok {
+			t.Errorf("expected metric %v in %v", name, res.Metrics)
+		}
+	}
+
+	if exp := map[string]int{"upper": 3, "count": 1}; !reflect.DeepEqual(exp, res.BuiltinCalls) {
+		t.Fatalf("expected builtin calls %v, got %v", exp, res.BuiltinCalls)
+	}
+}
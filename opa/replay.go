@@ -0,0 +1,263 @@
+package opa
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/open-policy-agent/opa/ast"
+	"github.com/open-policy-agent/opa/storage"
+	"github.com/open-policy-agent/opa/util"
+)
+
+// maxDecisionLogLineBytes is the maximum size of a decision log entry.
+const maxDecisionLogLineBytes = 1 << 20
+
+// ErrDecisionLogTooLarge is returned by ReadDecisionLogs for logs larger than
+// its limit once decompressed.
+var ErrDecisionLogTooLarge = errors.New("decision log too large")
+
+// DecisionLogEntry is the part of an OPA decision log entry that is replayed.
+type DecisionLogEntry struct {
+	DecisionID string                 `json:"decision_id"`
+	Path       string                 `json:"path"` // The path of the decision, e.g. play/allow
+	Input      *interface{}           `json:"input"`
+	Result     *interface{}           `json:"result"`
+	Erased     []string               `json:"erased"` // JSON pointers to values masked before logging
+	Metrics    map[string]interface{} `json:"metrics"`
+
+	Line int `json:"-"` // The line of the entry in the log
+}
+
+// ReplayedDecision holds the logged and replayed decisions of an entry that
+// changed or failed to replay.
+type ReplayedDecision struct {
+	DecisionID     string      `json:"decision_id"`
+	Line           int         `json:"line"`
+	Path           string      `json:"path"`
+	Input          interface{} `json:"input"`
+	Logged         Decision    `json:"logged"`
+	Replayed       Decision    `json:"replayed"`
+	Diff           []DiffOp    `json:"diff"`
+	EvalTime       int64       `json:"eval_time"`                  // Time of the replayed evaluation in nanoseconds
+	LoggedEvalTime int64       `json:"logged_eval_time,omitempty"` // Time of the logged evaluation, if metrics were logged
+}
+
+// ReplaySummary counts the outcomes of a replay.
+type ReplaySummary struct {
+	Entries   int   `json:"entries"` // The number of entries replayed
+	Changed   int   `json:"changed"`
+	Unchanged int   `json:"unchanged"`
+	Errors    int   `json:"errors"`    // Entries that failed to evaluate, or had their input or result erased
+	EvalTime  int64 `json:"eval_time"` // Total time of the replayed evaluations in nanoseconds
+}
+
+// ReplayResult represents the result of the Replay function.
+type ReplayResult struct {
+	Summary   ReplaySummary      `json:"summary"`
+	Changes   []ReplayedDecision `json:"changes"`
+	Truncated bool               `json:"truncated,omitempty"` // Whether the context was done before all entries were replayed
+}
+
+// ReadDecisionLogs reads the entries of a decision log in OPA's JSON lines
+// format, which may be gzipped. It fails on logs of more than maxEntries, or
+// of more than maxBytes once decompressed.
+func ReadDecisionLogs(r io.Reader, maxEntries int, maxBytes int64) ([]DecisionLogEntry, error) {
+	br := bufio.NewReader(r)
+
+	if magic, _ := br.Peek(2); bytes.Equal(magic, []byte{0x1f, 0x8b}) {
+		gr, err := gzip.NewReader(br)
+		if err != nil {
+			return nil, err
+		}
+		defer gr.Close()
+		br = bufio.NewReader(gr)
+	}
+
+	scanner := bufio.NewScanner(&cappedReader{r: br, remaining: maxBytes})
+	scanner.Buffer(nil, maxDecisionLogLineBytes)
+
+	var entries []DecisionLogEntry
+	var line int
+
+	for scanner.Scan() {
+		line++
+
+		bs := bytes.TrimSpace(scanner.Bytes())
+		if len(bs) == 0 {
+			continue
+		}
+
+		if len(entries) == maxEntries {
+			return nil, fmt.Errorf("too many decision log entries, the limit is %d", maxEntries)
+		}
+
+		var entry DecisionLogEntry
+		if err := util.UnmarshalJSON(bs, &entry); err != nil {
+			return nil, fmt.Errorf("line %d: %w", line, err)
+		}
+		entry.Line = line
+
+		entries = append(entries, entry)
+	}
+
+	if err := scanner.Err(); err != nil {
+		if errors.Is(err, ErrDecisionLogTooLarge) {
+			return nil, fmt.Errorf("%w, the limit is %d bytes decompressed", err, maxBytes)
+		}
+		return nil, fmt.Errorf("line %d: %w", line+1, err)
+	}
+
+	return entries, nil
+}
+
+// cappedReader fails with ErrDecisionLogTooLarge once more than remaining
+// bytes were read, so that a small gzipped log can't expand without bounds.
+type cappedReader struct {
+	r         io.Reader
+	remaining int64
+}
+
+func (c *cappedReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.remaining -= int64(n)
+	if c.remaining < 0 {
+		return n, ErrDecisionLogTooLarge
+	}
+	return n, err
+}
+
+// DecisionQuery returns the query of a decision log path.
+func DecisionQuery(path string) (string, error) {
+	p, ok := storage.ParsePathEscaped("/" + strings.Trim(path, "/"))
+	if !ok {
+		return "", fmt.Errorf("invalid decision path %q", path)
+	}
+	return p.Ref(ast.DefaultRootDocument).String(), nil
+}
+
+// Replay evaluates the input of each decision log entry with the query of its
+// path and reports the entries whose decisions differ from the logged result,
+// or that fail to evaluate. The compile function returns the compiled policy
+// for a query. Once the context is done, the entries replayed so far are
+// returned, marked as truncated.
+func Replay(ctx context.Context, entries []DecisionLogEntry, compile func(query string) (*CompileResult, error)) (*ReplayResult, error) {
+	result := &ReplayResult{
+		Changes: []ReplayedDecision{},
+	}
+
+	compiled := map[string]replayCompiled{}
+
+	for _, entry := range entries {
+		if ctx.Err() != nil {
+			result.Truncated = true
+			break
+		}
+
+		d := ReplayedDecision{
+			DecisionID: entry.DecisionID,
+			Line:       entry.Line,
+			Path:       entry.Path,
+			Logged:     loggedDecision(entry),
+		}
+
+		if entry.Input != nil {
+			d.Input = *entry.Input
+		}
+
+		if eval, ok := entry.Metrics["timer_rego_query_eval_ns"].(json.Number); ok {
+			d.LoggedEvalTime, _ = eval.Int64()
+		}
+
+		cr, err := replayCompileResult(entry, compiled, compile)
+		if ctx.Err() != nil {
+			result.Truncated = true
+			break
+		}
+		if err != nil {
+			d.Replayed.Error = err.Error()
+			result.Summary.Errors++
+			result.Changes = append(result.Changes, d)
+			continue
+		}
+
+		d.Replayed, d.EvalTime = evalDecision(ctx, cr)
+
+		// Decisions cut short by the end of the context aren't outcomes.
+		if ctx.Err() != nil {
+			result.Truncated = true
+			break
+		}
+		result.Summary.EvalTime += d.EvalTime
+
+		if d.Replayed.Error != "" {
+			result.Summary.Errors++
+			result.Changes = append(result.Changes, d)
+			continue
+		}
+
+		d.Diff = diffDecisions(d.Logged, d.Replayed)
+		if len(d.Diff) == 0 {
+			result.Summary.Unchanged++
+			continue
+		}
+
+		result.Summary.Changed++
+		result.Changes = append(result.Changes, d)
+	}
+
+	result.Summary.Entries = result.Summary.Changed + result.Summary.Unchanged + result.Summary.Errors
+	return result, nil
+}
+
+type replayCompiled struct {
+	cr  *CompileResult
+	err error
+}
+
+func loggedDecision(entry DecisionLogEntry) Decision {
+	if entry.Result == nil {
+		return Decision{}
+	}
+	return Decision{Defined: true, Value: *entry.Result}
+}
+
+// replayCompileResult returns the compiled policy for the path of an entry with
+// its input. Compile results and errors are cached by query.
+func replayCompileResult(entry DecisionLogEntry, compiled map[string]replayCompiled, compile func(string) (*CompileResult, error)) (*CompileResult, error) {
+	for _, erased := range entry.Erased {
+		if erased == "/input" || strings.HasPrefix(erased, "/input/") || erased == "/result" || strings.HasPrefix(erased, "/result/") {
+			return nil, fmt.Errorf("entry can't be replayed, %v was erased", erased)
+		}
+	}
+
+	query, err := DecisionQuery(entry.Path)
+	if err != nil {
+		return nil, err
+	}
+
+	c, ok := compiled[query]
+	if !ok {
+		c.cr, c.err = compile(query)
+		compiled[query] = c
+	}
+	if c.err != nil {
+		return nil, c.err
+	}
+
+	var input ast.Value
+	if entry.Input != nil {
+		input, err = ast.InterfaceToValue(*entry.Input)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return withInput(c.cr, input), nil
+}
@@ -0,0 +1,163 @@
+package opa
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+const decisionLog = `{"decision_id": "a", "path": "play/allow", "input": {"role": "admin"}, "result": true}
+
+{"decision_id": "b", "path": "play/allow", "input": {"role": "editor"}, "result": true, "metrics": {"timer_rego_query_eval_ns": 1500}}
+{"decision_id": "c", "path": "play/allow", "input": {"role": "viewer"}}
+{"decision_id": "d", "path": "play", "input": {"role": "admin"}, "result": {"allow": true}}
+{"decision_id": "e", "path": "play/allow", "erased": ["/input/password"], "result": true}
+`
+
+func TestReadDecisionLogs(t *testing.T) {
+	var gz bytes.Buffer
+	zw := gzip.NewWriter(&gz)
+	if _, err := zw.Write([]byte(decisionLog)); err != nil {
+		t.Fatal(err)
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	for note, bs := range map[string][]byte{"plain": []byte(decisionLog), "gzipped": gz.Bytes()} {
+		t.Run(note, func(t *testing.T) {
+			entries, err := ReadDecisionLogs(bytes.NewReader(bs), 10, 1<<20)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var ids []string
+			var lines []int
+			for _, e := range entries {
+				ids = append(ids, e.DecisionID)
+				lines = append(lines, e.Line)
+			}
+
+			if !reflect.DeepEqual(ids, []string{"a", "b", "c", "d", "e"}) || !reflect.DeepEqual(lines, []int{1, 3, 4, 5, 6}) {
+				t.Fatalf("expected entries a to e on their lines but got: %v, %v", ids, lines)
+			}
+		})
+	}
+
+	if _, err := ReadDecisionLogs(strings.NewReader(decisionLog), 4, 1<<20); err == nil || err.Error() != "too many decision log entries, the limit is 4" {
+		t.Fatalf("expected too many entries error but got: %v", err)
+	}
+
+	if _, err := ReadDecisionLogs(strings.NewReader("{}\n{\"path\": 1}\n"), 10, 1<<20); err == nil || !strings.HasPrefix(err.Error(), "line 2: ") {
+		t.Fatalf("expected error on line 2 but got: %v", err)
+	}
+}
+
+func TestReadDecisionLogsGzipBomb(t *testing.T) {
+	// 64MB of blank lines compress to about 64KB.
+	var gz bytes.Buffer
+	zw := gzip.NewWriter(&gz)
+	line := bytes.Repeat([]byte(" "), 1023)
+	line = append(line, '\n')
+	for i := 0; i < 64<<10; i++ {
+		if _, err := zw.Write(line); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	_, err := ReadDecisionLogs(bytes.NewReader(gz.Bytes()), 10, 1<<20)
+	if !errors.Is(err, ErrDecisionLogTooLarge) {
+		t.Fatalf("expected the log to be too large but got: %v", err)
+	}
+}
+
+func TestDecisionQuery(t *testing.T) {
+	tests := map[string]string{
+		"":              "data",
+		"play/allow":    "data.play.allow",
+		"/play/allow/":  "data.play.allow",
+		"play/a%2Fb":    `data.play["a/b"]`,
+		"play/x-y/deny": `data.play["x-y"].deny`,
+	}
+
+	for path, exp := range tests {
+		actual, err := DecisionQuery(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if actual != exp {
+			t.Fatalf("expected query %v for path %q but got: %v", exp, path, actual)
+		}
+	}
+}
+
+func TestReplay(t *testing.T) {
+	ctx := context.Background()
+
+	entries, err := ReadDecisionLogs(strings.NewReader(decisionLog), 10, 1<<20)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	policies := map[string]string{
+		"play.rego": "package play\n\nallow if input.role == \"admin\"\n",
+	}
+
+	var queries []string
+	compile := func(query string) (*CompileResult, error) {
+		queries = append(queries, query)
+		regoVersion := 1
+		cr, _, err := Compile(ctx, nil, nil, nil, policies, query, nil, nil, false, &regoVersion)
+		return cr, err
+	}
+
+	result, err := Replay(ctx, entries, compile)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !reflect.DeepEqual(queries, []string{"data.play.allow", "data.play"}) {
+		t.Fatalf("expected each query to be compiled once but got: %v", queries)
+	}
+
+	if result.Summary.Entries != 5 || result.Summary.Changed != 1 || result.Summary.Unchanged != 3 || result.Summary.Errors != 1 {
+		t.Fatalf("expected 1 changed, 3 unchanged and 1 error but got: %+v", result.Summary)
+	}
+
+	if len(result.Changes) != 2 {
+		t.Fatalf("expected 2 changes but got: %+v", result.Changes)
+	}
+
+	changed := result.Changes[0]
+	expDiff := []DiffOp{{Op: DiffRemove, Path: "", Old: true}}
+	if changed.DecisionID != "b" || changed.Line != 3 || changed.Replayed.Defined || !reflect.DeepEqual(changed.Diff, expDiff) || changed.LoggedEvalTime != 1500 {
+		t.Fatalf("expected decision b to become undefined but got: %+v", changed)
+	}
+
+	erased := result.Changes[1]
+	if erased.DecisionID != "e" || erased.Replayed.Error != "entry can't be replayed, /input/password was erased" {
+		t.Fatalf("expected decision e to fail but got: %+v", erased)
+	}
+
+	if changed.Input == nil || result.Summary.EvalTime <= 0 {
+		t.Fatalf("expected input and eval time to be reported but got: %+v", result)
+	}
+
+	cancelled, cancel := context.WithCancel(ctx)
+	cancel()
+
+	result, err = Replay(cancelled, entries, compile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !result.Truncated || result.Summary.Entries != 0 || len(result.Changes) != 0 {
+		t.Fatalf("expected a truncated result without changes but got: %+v", result)
+	}
+}
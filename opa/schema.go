@@ -0,0 +1,772 @@
+package opa
+
+import (
+	"encoding/json"
+	"fmt"
+	"maps"
+	"math"
+	"math/bits"
+	"math/rand"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const (
+	maxSchemaDepth   = 8    // Depth of nested values at which generated values are kept simplest
+	fuzzNumberBound  = 1000 // Bound of random numbers without a minimum or maximum
+	fuzzExtraLength  = 8    // Maximum number of characters added to random strings beyond their minimum length
+	fuzzExtraItems   = 3    // Maximum number of items added to random arrays beyond their minimum
+	fuzzAlphabet     = "abcdefghijklmnopqrstuvwxyz0123456789-_"
+	maxEnumeratedLen = 64   // Maximum length of strings enumerated at their maxLength
+	maxSchemaLength  = 1024 // Maximum minLength of a schema
+	maxSchemaItems   = 64   // Maximum minItems of a schema
+)
+
+// schemaTypes are the JSON Schema types in the order they are enumerated.
+var schemaTypes = []string{"null", "boolean", "integer", "number", "string", "array", "object"}
+
+// formatExamples are values of string formats, which can't be generated.
+var formatExamples = map[string]string{
+	"date":      "2024-01-01",
+	"date-time": "2024-01-01T00:00:00Z",
+	"time":      "00:00:00Z",
+	"email":     "user@example.com",
+	"hostname":  "example.com",
+	"ipv4":      "192.0.2.1",
+	"ipv6":      "2001:db8::1",
+	"uri":       "https://example.com",
+	"uuid":      "00000000-0000-0000-0000-000000000000",
+}
+
+// inputSchema is the subset of JSON Schema used to generate inputs: types,
+// const and enum, properties and required, items, anyOf and oneOf, numeric
+// bounds, string and array lengths, string formats, examples and default, and
+// local references to definitions.
+type inputSchema struct {
+	types      []string
+	enum       []interface{}
+	anyOf      []*inputSchema
+	properties map[string]*inputSchema
+	required   []string
+	items      *inputSchema
+	minimum    *float64
+	maximum    *float64
+	exclMin    bool
+	exclMax    bool
+	minLength  int
+	maxLength  *int
+	minItems   int
+	maxItems   *int
+	format     string
+	examples   []interface{}
+}
+
+// schemaParser parses schemas, sharing the schemas of references so that
+// recursive schemas terminate.
+type schemaParser struct {
+	root interface{}
+	refs map[string]*inputSchema
+}
+
+// parseInputSchema parses a JSON Schema decoded from JSON.
+func parseInputSchema(schema interface{}) (*inputSchema, error) {
+	p := &schemaParser{root: schema, refs: map[string]*inputSchema{}}
+	s := &inputSchema{}
+	if err := p.parse(s, schema); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (p *schemaParser) parse(s *inputSchema, node interface{}) error {
+	switch node := node.(type) {
+	case bool:
+		s.types = schemaTypes
+		return nil
+	case map[string]interface{}:
+		if ref, ok := node["$ref"].(string); ok {
+			rs, err := p.ref(ref)
+			if err != nil {
+				return err
+			}
+			*s = *rs
+			return nil
+		}
+		return p.parseObject(s, node)
+	default:
+		return fmt.Errorf("invalid schema: expected an object or boolean but got %v", node)
+	}
+}
+
+func (p *schemaParser) sub(node interface{}) (*inputSchema, error) {
+	if obj, ok := node.(map[string]interface{}); ok {
+		if ref, ok := obj["$ref"].(string); ok {
+			return p.ref(ref)
+		}
+	}
+	s := &inputSchema{}
+	if err := p.parse(s, node); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// ref returns the schema of a reference, which is incomplete while it is
+// being parsed.
+func (p *schemaParser) ref(ref string) (*inputSchema, error) {
+	if s, ok := p.refs[ref]; ok {
+		return s, nil
+	}
+
+	target, err := resolveSchemaRef(p.root, ref)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &inputSchema{}
+	p.refs[ref] = s
+	if err := p.parse(s, target); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (p *schemaParser) parseObject(s *inputSchema, node map[string]interface{}) error {
+	switch t := node["type"].(type) {
+	case nil:
+	case string:
+		s.types = []string{t}
+	case []interface{}:
+		for _, x := range t {
+			if name, ok := x.(string); ok {
+				s.types = append(s.types, name)
+			}
+		}
+	}
+
+	for _, t := range s.types {
+		if !slices.Contains(schemaTypes, t) {
+			return fmt.Errorf("invalid schema: unknown type %q", t)
+		}
+	}
+
+	if c, ok := node["const"]; ok {
+		s.enum = []interface{}{c}
+	} else if enum, ok := node["enum"].([]interface{}); ok {
+		s.enum = enum
+	}
+
+	for _, key := range []string{"anyOf", "oneOf"} {
+		subs, _ := node[key].([]interface{})
+		for _, sub := range subs {
+			ss, err := p.sub(sub)
+			if err != nil {
+				return err
+			}
+			s.anyOf = append(s.anyOf, ss)
+		}
+	}
+
+	if props, ok := node["properties"].(map[string]interface{}); ok {
+		s.properties = make(map[string]*inputSchema, len(props))
+		for k, prop := range props {
+			ps, err := p.sub(prop)
+			if err != nil {
+				return err
+			}
+			s.properties[k] = ps
+		}
+	}
+
+	required, _ := node["required"].([]interface{})
+	for _, r := range required {
+		if name, ok := r.(string); ok {
+			s.required = append(s.required, name)
+		}
+	}
+
+	if items, ok := node["items"]; ok {
+		is, err := p.sub(items)
+		if err != nil {
+			return err
+		}
+		s.items = is
+	}
+
+	s.minimum = schemaNumber(node["minimum"])
+	s.maximum = schemaNumber(node["maximum"])
+
+	// exclusiveMinimum and exclusiveMaximum are numbers since draft 6, and booleans before.
+	switch x := node["exclusiveMinimum"].(type) {
+	case bool:
+		s.exclMin = x
+	default:
+		if n := schemaNumber(x); n != nil {
+			s.minimum, s.exclMin = n, true
+		}
+	}
+	switch x := node["exclusiveMaximum"].(type) {
+	case bool:
+		s.exclMax = x
+	default:
+		if n := schemaNumber(x); n != nil {
+			s.maximum, s.exclMax = n, true
+		}
+	}
+
+	if n := schemaNumber(node["minLength"]); n != nil {
+		if *n < 0 || *n > maxSchemaLength {
+			return fmt.Errorf("invalid schema: minLength must be between 0 and %d", maxSchemaLength)
+		}
+		s.minLength = int(*n)
+	}
+	if n := schemaNumber(node["maxLength"]); n != nil {
+		l := int(*n)
+		s.maxLength = &l
+	}
+	if n := schemaNumber(node["minItems"]); n != nil {
+		if *n < 0 || *n > maxSchemaItems {
+			return fmt.Errorf("invalid schema: minItems must be between 0 and %d", maxSchemaItems)
+		}
+		s.minItems = int(*n)
+	}
+	if n := schemaNumber(node["maxItems"]); n != nil {
+		l := int(*n)
+		s.maxItems = &l
+	}
+
+	s.format, _ = node["format"].(string)
+
+	if examples, ok := node["examples"].([]interface{}); ok {
+		s.examples = append(s.examples, examples...)
+	}
+	if def, ok := node["default"]; ok {
+		s.examples = append(s.examples, def)
+	}
+
+	if len(s.types) == 0 && len(s.enum) == 0 && len(s.anyOf) == 0 {
+		s.types = s.inferTypes()
+	}
+
+	return nil
+}
+
+// inferTypes returns the types of a schema without a type from its keywords.
+func (s *inputSchema) inferTypes() []string {
+	switch {
+	case s.properties != nil || len(s.required) > 0:
+		return []string{"object"}
+	case s.items != nil || s.minItems > 0 || s.maxItems != nil:
+		return []string{"array"}
+	case s.minimum != nil || s.maximum != nil:
+		return []string{"number"}
+	case s.minLength > 0 || s.maxLength != nil || s.format != "":
+		return []string{"string"}
+	case len(s.examples) > 0:
+		return nil
+	default:
+		return schemaTypes
+	}
+}
+
+// resolveSchemaRef resolves a local reference like #/$defs/user.
+func resolveSchemaRef(root interface{}, ref string) (interface{}, error) {
+	if ref == "#" {
+		return root, nil
+	}
+
+	if !strings.HasPrefix(ref, "#/") {
+		return nil, fmt.Errorf("invalid schema: only local references are supported, got %q", ref)
+	}
+
+	node := root
+	for _, segment := range strings.Split(strings.TrimPrefix(ref, "#/"), "/") {
+		obj, ok := node.(map[string]interface{})
+		if !ok {
+			return nil, fmt.Errorf("invalid schema: reference %q not found", ref)
+		}
+		node, ok = obj[unescapePointer(segment)]
+		if !ok {
+			return nil, fmt.Errorf("invalid schema: reference %q not found", ref)
+		}
+	}
+
+	return node, nil
+}
+
+func schemaNumber(x interface{}) *float64 {
+	var f float64
+	switch x := x.(type) {
+	case json.Number:
+		var err error
+		if f, err = x.Float64(); err != nil {
+			return nil
+		}
+	case float64:
+		f = x
+	case int:
+		f = float64(x)
+	default:
+		return nil
+	}
+	return &f
+}
+
+// simplest returns the simplest value of a schema: its first enum value,
+// the simplest value of its first type, or its first example. Alternatives
+// count as a level of depth, so that recursive ones terminate.
+func (s *inputSchema) simplest(depth int) interface{} {
+	switch {
+	case len(s.enum) > 0:
+		return s.enum[0]
+	case len(s.types) > 0:
+		return s.simplestOfType(s.types[0], depth)
+	case len(s.anyOf) > 0 && depth < maxSchemaDepth:
+		return s.anyOf[0].simplest(depth + 1)
+	case len(s.examples) > 0:
+		return s.examples[0]
+	default:
+		return nil
+	}
+}
+
+func (s *inputSchema) simplestOfType(t string, depth int) interface{} {
+	switch t {
+	case "boolean":
+		return false
+	case "integer", "number":
+		return s.numbers(t)[0]
+	case "string":
+		return s.strings()[0]
+	case "array":
+		if depth >= maxSchemaDepth {
+			return []interface{}{}
+		}
+		n, itemDepth := arrayItems(depth, s.minItems)
+		arr := make([]interface{}, n)
+		for i := range arr {
+			arr[i] = s.itemSchema().simplest(itemDepth)
+		}
+		return arr
+	case "object":
+		obj := map[string]interface{}{}
+		if depth < maxSchemaDepth {
+			for _, k := range s.required {
+				obj[k] = s.propertySchema(k).simplest(depth + 1)
+			}
+		}
+		return obj
+	default:
+		return nil
+	}
+}
+
+// variants enumerates at most limit values of a schema: its enum values, the
+// bounds of its numbers and lengths, and objects varying one property at a
+// time from the object of the simplest values of all properties. The limit is
+// passed down to nested schemas, so that recursive schemas stop being
+// enumerated once it's reached.
+func (s *inputSchema) variants(depth, limit int) []interface{} {
+	if limit <= 0 {
+		return nil
+	}
+
+	if len(s.enum) > 0 {
+		return s.enum[:min(len(s.enum), limit)]
+	}
+
+	var values []interface{}
+	for _, t := range s.types {
+		if len(values) >= limit {
+			break
+		}
+		switch t {
+		case "null":
+			values = append(values, nil)
+		case "boolean":
+			values = append(values, false, true)
+		case "integer", "number":
+			values = append(values, s.numbers(t)...)
+		case "string":
+			values = append(values, s.strings()...)
+		case "array":
+			values = append(values, s.arrayVariants(depth, limit-len(values))...)
+		case "object":
+			values = append(values, s.objectVariants(depth, limit-len(values))...)
+		}
+	}
+
+	for _, sub := range s.anyOf {
+		if len(values) >= limit || depth >= maxSchemaDepth {
+			break
+		}
+		values = append(values, sub.variants(depth+1, limit-len(values))...)
+	}
+
+	values = append(values, s.examples...)
+
+	values = distinctValues(values)
+	return values[:min(len(values), limit)]
+}
+
+func (s *inputSchema) arrayVariants(depth, limit int) []interface{} {
+	simplest := s.simplestOfType("array", depth).([]interface{})
+	values := []interface{}{simplest}
+
+	if depth >= maxSchemaDepth || (s.maxItems != nil && *s.maxItems == 0) {
+		return values
+	}
+
+	for _, item := range s.itemSchema().variants(depth+1, limit-len(values)) {
+		arr := slices.Clone(simplest)
+		if len(arr) == 0 {
+			arr = append(arr, item)
+		} else {
+			arr[0] = item
+		}
+		values = append(values, arr)
+	}
+
+	return values
+}
+
+func (s *inputSchema) objectVariants(depth, limit int) []interface{} {
+	if depth >= maxSchemaDepth {
+		return []interface{}{s.simplestOfType("object", depth)}
+	}
+
+	keys := s.propertyKeys()
+
+	base := map[string]interface{}{}
+	for _, k := range keys {
+		base[k] = s.propertySchema(k).simplest(depth + 1)
+	}
+
+	values := []interface{}{base, s.simplestOfType("object", depth)}
+
+	for _, k := range keys {
+		if len(values) >= limit {
+			break
+		}
+		for _, v := range s.propertySchema(k).variants(depth+1, limit-len(values)) {
+			obj := maps.Clone(base)
+			obj[k] = v
+			values = append(values, obj)
+		}
+		if !s.isRequired(k) {
+			obj := maps.Clone(base)
+			delete(obj, k)
+			values = append(values, obj)
+		}
+	}
+
+	return values
+}
+
+// numbers returns the simplest number in the bounds of a schema, followed by
+// the bounds and other interesting numbers within them.
+func (s *inputSchema) numbers(t string) []interface{} {
+	lo, hi, inclusive := s.numberBounds(t)
+
+	inRange := func(f float64) bool {
+		if math.IsInf(f, 0) || math.IsNaN(f) {
+			return false
+		}
+		if inclusive {
+			return f >= lo && f <= hi
+		}
+		return (f > lo || (f == lo && !s.exclMin)) && (f < hi || (f == hi && !s.exclMax))
+	}
+
+	candidates := []float64{0, lo, hi, 1, -1, lo + 1, hi - 1}
+	if t != "integer" {
+		candidates = append(candidates, 0.5, (lo+hi)/2)
+	}
+
+	var values []interface{}
+	for _, f := range candidates {
+		if inRange(f) {
+			values = append(values, jsonNumber(f))
+		}
+	}
+
+	if len(values) == 0 {
+		values = append(values, jsonNumber(lo))
+	}
+
+	return distinctValues(values)
+}
+
+// numberBounds returns the bounds of a number or integer schema, infinite if
+// it has none. The bounds of integers are always inclusive.
+func (s *inputSchema) numberBounds(t string) (float64, float64, bool) {
+	lo, hi := math.Inf(-1), math.Inf(1)
+
+	if s.minimum != nil {
+		lo = *s.minimum
+	}
+	if s.maximum != nil {
+		hi = *s.maximum
+	}
+
+	if t != "integer" {
+		return lo, hi, false
+	}
+
+	if s.exclMin && lo == math.Floor(lo) {
+		lo++
+	}
+	if s.exclMax && hi == math.Floor(hi) {
+		hi--
+	}
+
+	return math.Ceil(lo), math.Floor(hi), true
+}
+
+// strings returns the simplest string of a schema, followed by strings of its
+// minimum and maximum lengths, and its format.
+func (s *inputSchema) strings() []interface{} {
+	var values []interface{}
+
+	if ex, ok := formatExamples[s.format]; ok {
+		values = append(values, ex)
+	}
+
+	values = append(values, strings.Repeat("a", s.minLength))
+	if s.minLength == 0 {
+		values = append(values, "a")
+	}
+	if s.maxLength != nil && *s.maxLength <= maxEnumeratedLen {
+		values = append(values, strings.Repeat("z", *s.maxLength))
+	}
+
+	var valid []interface{}
+	for _, v := range values {
+		if n := len(v.(string)); n >= s.minLength && (s.maxLength == nil || n <= *s.maxLength) {
+			valid = append(valid, v)
+		}
+	}
+
+	if len(valid) == 0 {
+		valid = append(valid, strings.Repeat("a", s.minLength))
+	}
+
+	return distinctValues(valid)
+}
+
+// random returns a random value of a schema. A quarter of the numbers and
+// strings are enumerated values, to hit the bounds more often.
+func (s *inputSchema) random(rng *rand.Rand, depth int) interface{} {
+	if depth >= maxSchemaDepth {
+		return s.simplest(depth)
+	}
+
+	if len(s.enum) > 0 {
+		return s.enum[rng.Intn(len(s.enum))]
+	}
+
+	if len(s.anyOf) > 0 && (len(s.types) == 0 || rng.Intn(2) == 0) {
+		return s.anyOf[rng.Intn(len(s.anyOf))].random(rng, depth+1)
+	}
+
+	if len(s.examples) > 0 && (len(s.types) == 0 || rng.Intn(8) == 0) {
+		return s.examples[rng.Intn(len(s.examples))]
+	}
+
+	if len(s.types) == 0 {
+		return nil
+	}
+
+	switch t := s.types[rng.Intn(len(s.types))]; t {
+	case "boolean":
+		return rng.Intn(2) == 0
+	case "integer", "number":
+		if rng.Intn(4) == 0 {
+			values := s.numbers(t)
+			return values[rng.Intn(len(values))]
+		}
+		lo, hi, _ := s.numberBounds(t)
+		lo = max(lo, min(hi, -fuzzNumberBound))
+		hi = min(hi, max(lo, fuzzNumberBound))
+		f := lo + rng.Float64()*(hi-lo)
+		if t == "integer" {
+			f = math.Max(math.Ceil(lo), math.Min(math.Floor(hi), math.Round(f)))
+		}
+		return jsonNumber(f)
+	case "string":
+		if rng.Intn(4) == 0 {
+			values := s.strings()
+			return values[rng.Intn(len(values))]
+		}
+		n := s.minLength + rng.Intn(fuzzExtraLength+1)
+		if s.maxLength != nil {
+			n = min(n, *s.maxLength)
+		}
+		bs := make([]byte, n)
+		for i := range bs {
+			bs[i] = fuzzAlphabet[rng.Intn(len(fuzzAlphabet))]
+		}
+		return string(bs)
+	case "array":
+		n := s.minItems + rng.Intn(fuzzExtraItems+1)
+		if s.maxItems != nil {
+			n = max(s.minItems, min(n, *s.maxItems))
+		}
+		n, itemDepth := arrayItems(depth, n)
+		arr := make([]interface{}, n)
+		for i := range arr {
+			arr[i] = s.itemSchema().random(rng, itemDepth)
+		}
+		return arr
+	case "object":
+		obj := map[string]interface{}{}
+		for _, k := range s.propertyKeys() {
+			if s.isRequired(k) || rng.Intn(2) == 0 {
+				obj[k] = s.propertySchema(k).random(rng, depth+1)
+			}
+		}
+		return obj
+	default:
+		return nil
+	}
+}
+
+// shrink returns values of a schema derived from x that are likely smaller:
+// the simplest value, and x without optional properties or surplus items,
+// with shorter strings, or with any of its values shrunk.
+func (s *inputSchema) shrink(x interface{}, depth int) []interface{} {
+	values := []interface{}{s.simplest(depth)}
+	if depth >= maxSchemaDepth {
+		return values
+	}
+
+	switch x := x.(type) {
+	case string:
+		if len(s.enum) == 0 && len(x)/2 >= s.minLength {
+			values = append(values, x[:len(x)/2])
+		}
+	case []interface{}:
+		if len(x) > s.minItems {
+			for i := range x {
+				values = append(values, slices.Delete(slices.Clone(x), i, i+1))
+			}
+		}
+		for i, item := range x {
+			for _, v := range s.itemSchema().shrink(item, depth+1) {
+				arr := slices.Clone(x)
+				arr[i] = v
+				values = append(values, arr)
+			}
+		}
+	case map[string]interface{}:
+		keys := make([]string, 0, len(x))
+		for k := range x {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+
+		for _, k := range keys {
+			if !s.isRequired(k) {
+				obj := maps.Clone(x)
+				delete(obj, k)
+				values = append(values, obj)
+			}
+		}
+		for _, k := range keys {
+			for _, v := range s.propertySchema(k).shrink(x[k], depth+1) {
+				obj := maps.Clone(x)
+				obj[k] = v
+				values = append(values, obj)
+			}
+		}
+	}
+
+	return values
+}
+
+// arrayItems returns how many of n items an array at depth is generated with,
+// and the depth of the items. Every doubling of the items counts as a level,
+// so that nested arrays have fewer than 2^maxSchemaDepth items in total; the
+// arrays near the maximum depth have fewer items than their minimum.
+func arrayItems(depth, n int) (int, int) {
+	n = min(n, 1<<max(maxSchemaDepth-depth, 0)-1)
+	return n, depth + max(bits.Len(uint(n)), 1)
+}
+
+// propertyKeys returns the sorted names of the properties of an object schema,
+// including those of its alternatives.
+func (s *inputSchema) propertyKeys() []string {
+	var keys []string
+	for _, ss := range append([]*inputSchema{s}, s.anyOf...) {
+		for k := range ss.properties {
+			if !slices.Contains(keys, k) {
+				keys = append(keys, k)
+			}
+		}
+		for _, k := range ss.required {
+			if !slices.Contains(keys, k) {
+				keys = append(keys, k)
+			}
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func (s *inputSchema) propertySchema(k string) *inputSchema {
+	for _, ss := range append([]*inputSchema{s}, s.anyOf...) {
+		if ps, ok := ss.properties[k]; ok {
+			return ps
+		}
+	}
+	return anySchema
+}
+
+// isRequired returns true if any alternative of an object schema requires
+// the property.
+func (s *inputSchema) isRequired(k string) bool {
+	for _, ss := range append([]*inputSchema{s}, s.anyOf...) {
+		if slices.Contains(ss.required, k) {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *inputSchema) itemSchema() *inputSchema {
+	for _, ss := range append([]*inputSchema{s}, s.anyOf...) {
+		if ss.items != nil {
+			return ss.items
+		}
+	}
+	return anySchema
+}
+
+// anySchema is the schema of values without a schema.
+var anySchema = &inputSchema{types: schemaTypes}
+
+// distinctValues removes duplicates from values, keeping their order.
+func distinctValues(values []interface{}) []interface{} {
+	seen := map[string]bool{}
+	distinct := values[:0:0]
+	for _, v := range values {
+		key := jsonKey(v)
+		if !seen[key] {
+			seen[key] = true
+			distinct = append(distinct, v)
+		}
+	}
+	return distinct
+}
+
+// jsonKey returns the JSON of a value, which is the same for equal values.
+func jsonKey(x interface{}) string {
+	bs, _ := json.Marshal(x)
+	return string(bs)
+}
+
+func jsonNumber(f float64) json.Number {
+	return json.Number(strconv.FormatFloat(f, 'f', -1, 64))
+}
@@ -0,0 +1,171 @@
+package opa
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"math/rand"
+	"strings"
+	"testing"
+
+	"github.com/open-policy-agent/opa/util"
+)
+
+func TestInputSchemaVariants(t *testing.T) {
+	tests := []struct {
+		note   string
+		schema string
+		exp    string
+	}{
+		{
+			note:   "enum",
+			schema: `{"enum": ["a", 1, null]}`,
+			exp:    `["a",1,null]`,
+		},
+		{
+			note:   "integer bounds",
+			schema: `{"type": "integer", "minimum": 2, "exclusiveMaximum": 10}`,
+			exp:    `[2,9,3,8]`,
+		},
+		{
+			note:   "number bounds",
+			schema: `{"type": "number", "exclusiveMinimum": 0, "maximum": 1}`,
+			exp:    `[1,0.5]`,
+		},
+		{
+			note:   "strings",
+			schema: `{"type": "string", "minLength": 2, "maxLength": 4}`,
+			exp:    `["aa","zzzz"]`,
+		},
+		{
+			note:   "format",
+			schema: `{"type": "string", "format": "email"}`,
+			exp:    `["user@example.com","","a"]`,
+		},
+		{
+			note:   "arrays",
+			schema: `{"type": "array", "items": {"type": "boolean"}, "maxItems": 2}`,
+			exp:    `[[],[false],[true]]`,
+		},
+		{
+			note:   "objects",
+			schema: `{"properties": {"a": {"type": "boolean"}, "b": {"const": 1}}, "required": ["b"]}`,
+			exp:    `[{"a":false,"b":1},{"b":1},{"a":true,"b":1}]`,
+		},
+		{
+			note:   "any of",
+			schema: `{"anyOf": [{"type": "null"}, {"$ref": "#/$defs/flag"}], "$defs": {"flag": {"type": "boolean"}}}`,
+			exp:    `[null,false,true]`,
+		},
+		{
+			note:   "recursive",
+			schema: `{"$defs": {"node": {"type": "object", "required": ["next"], "properties": {"next": {"$ref": "#/$defs/node"}}}}, "$ref": "#/$defs/node"}`,
+			exp:    `[{"next":{"next":{"next":{"next":{"next":{"next":{"next":{"next":{}}}}}}}}}]`,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.note, func(t *testing.T) {
+			var schema interface{}
+			if err := util.UnmarshalJSON([]byte(tc.schema), &schema); err != nil {
+				t.Fatal(err)
+			}
+
+			s, err := parseInputSchema(schema)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			bs, err := json.Marshal(s.variants(0, math.MaxInt))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if string(bs) != tc.exp {
+				t.Fatalf("expected %v but got: %s", tc.exp, bs)
+			}
+		})
+	}
+}
+
+func TestInputSchemaVariantsLimit(t *testing.T) {
+	// Without a limit, the variants of 10 recursive properties grow as 10^8.
+	var props []string
+	for i := range 10 {
+		props = append(props, fmt.Sprintf(`"p%d": {"$ref": "#"}`, i))
+	}
+
+	var schema interface{}
+	if err := util.UnmarshalJSON([]byte(`{"type": "object", "properties": {`+strings.Join(props, ", ")+`}}`), &schema); err != nil {
+		t.Fatal(err)
+	}
+
+	s, err := parseInputSchema(schema)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if n := len(s.variants(0, 500)); n == 0 || n > 500 {
+		t.Fatalf("expected at most 500 variants but got: %v", n)
+	}
+}
+
+func TestInputSchemaRecursive(t *testing.T) {
+	schemas := []string{
+		`{"type": "array", "minItems": 1, "items": {"$ref": "#"}}`,
+		`{"type": "array", "minItems": 64, "items": {"$ref": "#"}}`,
+		`{"type": "object", "required": ["a"], "properties": {"a": {"type": "array", "minItems": 2, "items": {"$ref": "#"}}}}`,
+		`{"anyOf": [{"$ref": "#"}, {"type": "array", "items": {"$ref": "#"}}]}`,
+	}
+
+	for _, schema := range schemas {
+		t.Run(schema, func(t *testing.T) {
+			var x interface{}
+			if err := util.UnmarshalJSON([]byte(schema), &x); err != nil {
+				t.Fatal(err)
+			}
+
+			s, err := parseInputSchema(x)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			// Nested arrays have fewer than 2^maxSchemaDepth items in total.
+			values := append([]interface{}{s.simplest(0)}, s.variants(0, 100)...)
+			rng := rand.New(rand.NewSource(1))
+			for range 100 {
+				values = append(values, s.random(rng, 0))
+			}
+			values = append(values, s.shrink(values[len(values)-1], 0)...)
+
+			for _, v := range values {
+				if bs, _ := json.Marshal(v); len(bs) > 16<<maxSchemaDepth {
+					t.Fatalf("expected a small value but got %d bytes", len(bs))
+				}
+			}
+		})
+	}
+}
+
+func TestInputSchemaErrors(t *testing.T) {
+	tests := map[string]string{
+		`{"type": "float"}`:      `invalid schema: unknown type "float"`,
+		`{"$ref": "#/missing"}`:  `invalid schema: reference "#/missing" not found`,
+		`{"$ref": "other.json"}`: `invalid schema: only local references are supported, got "other.json"`,
+		`[]`:                     `invalid schema: expected an object or boolean but got []`,
+		`{"minItems": -1}`:       `invalid schema: minItems must be between 0 and 64`,
+		`{"minItems": 1e9}`:      `invalid schema: minItems must be between 0 and 64`,
+		`{"minLength": -1}`:      `invalid schema: minLength must be between 0 and 1024`,
+	}
+
+	for schema, exp := range tests {
+		var x interface{}
+		if err := util.UnmarshalJSON([]byte(schema), &x); err != nil {
+			t.Fatal(err)
+		}
+
+		if _, err := parseInputSchema(x); err == nil || err.Error() != exp {
+			t.Fatalf("expected error %q for %v but got: %v", exp, schema, err)
+		}
+	}
+}
@@ -0,0 +1,288 @@
+package opa
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/open-policy-agent/opa/ast"
+	"github.com/open-policy-agent/opa/format"
+	"github.com/open-policy-agent/opa/rego"
+	"github.com/open-policy-agent/opa/storage"
+)
+
+// GenerateTests returns a test module asserting the values that the rules
+// referred to by the query of the compile result evaluate to, with its input
+// and data. Each rule is asserted by a test of its own, overriding the input
+// and the top-level documents of the data with `with` statements. Rules that
+// fail to evaluate are recorded as comments. The module is formatted for
+// regoVersion.
+func GenerateTests(ctx context.Context, input *CompileResult, regoVersion ast.RegoVersion) ([]byte, error) {
+	rules := queriedRules(input)
+	if len(rules) == 0 {
+		return nil, errors.New("query does not refer to any rules to generate tests for")
+	}
+
+	withs, err := testOverrides(ctx, input)
+	if err != nil {
+		return nil, err
+	}
+
+	pkg := input.Package
+	if pkg == nil {
+		pkg = rules[0].Module.Package
+	}
+
+	var buf strings.Builder
+	fmt.Fprintf(&buf, "%v\n", testPackage(pkg))
+
+	names := map[string]bool{}
+
+	for _, rule := range rules {
+		path := rule.Path()
+
+		value, err := evalRuleValue(ctx, input, path)
+		if err != nil {
+			fmt.Fprintf(&buf, "\n# %v: %v\n", path, strings.ReplaceAll(err.Error(), "\n", " "))
+			continue
+		}
+
+		var assertion string
+		switch {
+		case value == nil:
+			assertion = "not " + path.String()
+		case value.Equal(ast.BooleanTerm(true)):
+			assertion = path.String()
+		default:
+			assertion = fmt.Sprintf("%v == %v", path, value)
+		}
+
+		buf.WriteString("\n" + testName(rule, names))
+		if regoVersion == ast.RegoV1 {
+			buf.WriteString(" if")
+		}
+		fmt.Fprintf(&buf, " {\n\t%v%v\n}\n", assertion, withs)
+	}
+
+	parserVersion := regoVersion
+	if parserVersion != ast.RegoV1 {
+		parserVersion = ast.RegoV0
+	}
+
+	return format.SourceWithOpts("test.rego", []byte(buf.String()), format.Opts{
+		RegoVersion:   regoVersion,
+		ParserOptions: &ast.ParserOptions{RegoVersion: parserVersion},
+	})
+}
+
+// queriedRules returns the rules referred to by the query, sorted by path.
+// Functions, tests, and all but one rule of each path are left out.
+func queriedRules(input *CompileResult) []*ast.Rule {
+	var rules []*ast.Rule
+	seen := map[string]bool{}
+
+	for _, ref := range queryRefs(input) {
+		for _, rule := range input.Compiler.GetRules(ref.GroundPrefix()) {
+			path := rule.Path()
+			if len(rule.Head.Args) > 0 || seen[path.String()] {
+				continue
+			}
+			if last, ok := path[len(path)-1].Value.(ast.String); ok && strings.HasPrefix(string(last), "test_") {
+				continue
+			}
+			seen[path.String()] = true
+			rules = append(rules, rule)
+		}
+	}
+
+	sort.Slice(rules, func(i, j int) bool {
+		return rules[i].Path().Compare(rules[j].Path()) < 0
+	})
+
+	return rules
+}
+
+// queryRefs returns the references under data in the query, resolving
+// variables and references relative to the package and imports of the query.
+func queryRefs(input *CompileResult) []ast.Ref {
+	var refs []ast.Ref
+
+	vis := ast.NewGenericVisitor(func(x interface{}) bool {
+		var ref ast.Ref
+		switch x := x.(type) {
+		case ast.Ref:
+			ref = x
+		case ast.Var:
+			ref = ast.Ref{ast.NewTerm(x)}
+		default:
+			return false
+		}
+		if ref = resolveQueryRef(input, ref); ref != nil {
+			refs = append(refs, ref)
+		}
+		return true
+	})
+	vis.Walk(input.QueryParseResult.ParsedQuery)
+
+	return refs
+}
+
+func resolveQueryRef(input *CompileResult, ref ast.Ref) ast.Ref {
+	head, ok := ref[0].Value.(ast.Var)
+	if !ok {
+		return nil
+	}
+
+	switch {
+	case ref.HasPrefix(ast.DefaultRootRef):
+		return ref
+	case ref.HasPrefix(ast.InputRootRef), head.IsWildcard(), head.IsGenerated(), ast.BuiltinMap[ref.String()] != nil:
+		return nil
+	}
+
+	for _, imp := range input.Imports {
+		path, ok := imp.Path.Value.(ast.Ref)
+		if !ok || !path.HasPrefix(ast.DefaultRootRef) || len(path) < 2 {
+			continue
+		}
+		name := imp.Alias
+		if name == "" {
+			s, ok := path[len(path)-1].Value.(ast.String)
+			if !ok {
+				continue
+			}
+			name = ast.Var(s)
+		}
+		if name == head {
+			return path.Concat(ref[1:])
+		}
+	}
+
+	if input.Package == nil {
+		return nil
+	}
+
+	return input.Package.Path.Append(ast.StringTerm(string(head))).Concat(ref[1:])
+}
+
+// testOverrides returns the `with` statements replacing the input and the
+// top-level documents of the data for the tests. Documents that rules are
+// defined in can't be replaced and are left out.
+func testOverrides(ctx context.Context, input *CompileResult) (string, error) {
+	var buf strings.Builder
+
+	if input.ParsedInput != nil {
+		fmt.Fprintf(&buf, " with input as %v", input.ParsedInput)
+	}
+
+	if input.Store == nil {
+		return buf.String(), nil
+	}
+
+	data, err := storage.ReadOne(ctx, input.Store, storage.Path{})
+	if err != nil {
+		return "", err
+	}
+
+	docs, ok := data.(map[string]interface{})
+	if !ok {
+		return buf.String(), nil
+	}
+
+	keys := make([]string, 0, len(docs))
+	for k := range docs {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	for _, k := range keys {
+		ref := ast.DefaultRootRef.Append(ast.StringTerm(k))
+		if len(input.Compiler.GetRulesWithPrefix(ref)) > 0 {
+			continue
+		}
+		value, err := ast.InterfaceToValue(docs[k])
+		if err != nil {
+			return "", err
+		}
+		fmt.Fprintf(&buf, " with %v as %v", ref, value)
+	}
+
+	return buf.String(), nil
+}
+
+// evalRuleValue evaluates a rule, keeping sets in its value. It returns nil if
+// the rule is undefined. Rules are evaluated on their own rather than taken
+// from the result of the query, which holds the values of its expressions
+// instead of those of each rule, and has sets converted to arrays.
+func evalRuleValue(ctx context.Context, input *CompileResult, path ast.Ref) (*ast.Term, error) {
+	ctx, cancel := context.WithTimeout(ctx, evalTimeout)
+	defer cancel()
+
+	rs, err := rego.New(
+		rego.ParsedQuery(ast.NewBody(ast.NewExpr(ast.NewTerm(path)))),
+		rego.Compiler(input.Compiler),
+		rego.Store(input.Store),
+		rego.ParsedInput(input.ParsedInput),
+		rego.GenerateJSON(func(t *ast.Term, _ *rego.EvalContext) (interface{}, error) {
+			return t, nil
+		}),
+	).Eval(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(rs) == 0 {
+		return nil, nil
+	}
+
+	value, ok := rs[0].Expressions[0].Value.(*ast.Term)
+	if !ok {
+		return nil, fmt.Errorf("unexpected value %v", rs[0].Expressions[0].Value)
+	}
+
+	return value, nil
+}
+
+// testPackage returns the package of the tests of pkg, e.g. play_test for play.
+func testPackage(pkg *ast.Package) *ast.Package {
+	path := pkg.Path.Copy()
+	last := path[len(path)-1]
+	if s, ok := last.Value.(ast.String); ok {
+		path[len(path)-1] = ast.StringTerm(string(s) + "_test")
+	}
+	return &ast.Package{Path: path}
+}
+
+// testName returns a unique name for the test of a rule, made of the segments
+// of its path in its package.
+func testName(rule *ast.Rule, names map[string]bool) string {
+	path := rule.Path()[len(rule.Module.Package.Path):]
+
+	parts := []string{"test"}
+	for _, t := range path {
+		s, ok := t.Value.(ast.String)
+		if !ok {
+			parts = append(parts, t.Value.String())
+			continue
+		}
+		parts = append(parts, string(s))
+	}
+
+	name := strings.Map(func(r rune) rune {
+		if r == '_' || r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' {
+			return r
+		}
+		return '_'
+	}, strings.Join(parts, "_"))
+
+	unique := name
+	for i := 2; names[unique]; i++ {
+		unique = name + "_" + strconv.Itoa(i)
+	}
+	names[unique] = true
+
+	return unique
+}
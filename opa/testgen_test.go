@@ -0,0 +1,191 @@
+package opa
+
+import (
+	"context"
+	"testing"
+
+	"github.com/open-policy-agent/opa/ast"
+	"github.com/open-policy-agent/opa/rego"
+	"github.com/open-policy-agent/opa/util"
+)
+
+func TestGenerateTests(t *testing.T) {
+	ctx := context.Background()
+
+	policies := map[string]string{
+		"play.rego": `package play
+
+import data.lib.roles
+
+default allow := false
+
+allow if roles.admin[input.user]
+
+reasons contains "owner" if input.user == data.owner
+
+limits.max := data.limit
+
+fail := input.user
+
+fail := "x"
+
+greet(name) := sprintf("hi %v", [name])
+
+test_allow if allow with input.user as "alice"
+`,
+		"lib.rego": `package lib.roles
+
+admin contains "alice"
+`,
+	}
+
+	play := "play"
+
+	tests := []struct {
+		note        string
+		query       string
+		pkg         *string
+		imports     *[]string
+		input       string
+		data        string
+		regoVersion int
+		policies    map[string]string
+		exp         string
+		expErr      string
+	}{
+		{
+			note:  "package",
+			query: "data.play",
+			input: `{"user": "alice"}`,
+			data:  `{"owner": "alice", "limit": 10}`,
+			exp: `package play_test
+
+test_allow if {
+	data.play.allow with input as {"user": "alice"} with data.limit as 10 with data.owner as "alice"
+}
+
+# data.play.fail: play.rego:13: eval_conflict_error: complete rules must not produce multiple outputs
+
+test_limits_max if {
+	data.play.limits.max == 10 with input as {"user": "alice"} with data.limit as 10 with data.owner as "alice"
+}
+
+test_reasons if {
+	data.play.reasons == {"owner"} with input as {"user": "alice"} with data.limit as 10 with data.owner as "alice"
+}
+`,
+		},
+		{
+			note:    "relative and imported references",
+			query:   "x := allow; roles.admin[y]; not limits",
+			pkg:     &play,
+			imports: &[]string{"data.lib.roles"},
+			input:   `{"user": "bob"}`,
+			exp: `package play_test
+
+test_admin if {
+	data.lib.roles.admin == {"alice"} with input as {"user": "bob"}
+}
+
+test_allow if {
+	data.play.allow == false with input as {"user": "bob"}
+}
+
+test_limits_max if {
+	not data.play.limits.max with input as {"user": "bob"}
+}
+`,
+		},
+		{
+			note:        "rego v0",
+			query:       "data.play.p",
+			regoVersion: 0,
+			policies: map[string]string{
+				"play.rego": "package play\n\np[x] { x := input.xs[_] }\n",
+			},
+			input: `{"xs": [1, 2]}`,
+			exp: `package play_test
+
+test_p {
+	data.play.p == {1, 2} with input as {"xs": [1, 2]}
+}
+`,
+		},
+		{
+			note:   "no rules",
+			query:  "input.user",
+			expErr: "query does not refer to any rules to generate tests for",
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.note, func(t *testing.T) {
+			ps := policies
+			if tc.policies != nil {
+				ps = tc.policies
+			}
+
+			regoVersion := 1
+			if tc.policies != nil {
+				regoVersion = tc.regoVersion
+			}
+
+			var input, data *interface{}
+			if tc.input != "" {
+				input = new(interface{})
+				if err := util.UnmarshalJSON([]byte(tc.input), input); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if tc.data != "" {
+				data = new(interface{})
+				if err := util.UnmarshalJSON([]byte(tc.data), data); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			cr, _, err := Compile(ctx, input, data, nil, ps, tc.query, tc.pkg, tc.imports, false, &regoVersion)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			actual, err := GenerateTests(ctx, cr, ast.RegoVersionFromInt(regoVersion))
+			if tc.expErr != "" {
+				if err == nil || err.Error() != tc.expErr {
+					t.Fatalf("expected error %q but got: %v", tc.expErr, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if string(actual) != tc.exp {
+				t.Fatalf("expected:\n%s\ngot:\n%s", tc.exp, actual)
+			}
+
+			// The generated tests pass without the input and data.
+			opts := []func(*rego.Rego){
+				rego.Query("data.play_test"),
+				rego.SetRegoVersion(ast.RegoVersionFromInt(regoVersion)),
+				rego.Module("test.rego", string(actual)),
+			}
+			for name, p := range ps {
+				opts = append(opts, rego.Module(name, p))
+			}
+
+			rs, err := rego.New(opts...).Eval(ctx)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			m := ast.MustParseModuleWithOpts(string(actual), ast.ParserOptions{RegoVersion: ast.RegoVersionFromInt(regoVersion)})
+			results := rs[0].Expressions[0].Value.(map[string]interface{})
+			for _, rule := range m.Rules {
+				if results[rule.Head.Name.String()] != true {
+					t.Fatalf("expected %v to pass, got: %v", rule.Head.Name, results)
+				}
+			}
+		})
+	}
+}
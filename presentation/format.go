@@ -0,0 +1,172 @@
+package presentation
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"slices"
+	"sort"
+	"strings"
+
+	"github.com/open-policy-agent/opa/ast"
+	"github.com/open-policy-agent/opa/rego"
+	"sigs.k8s.io/yaml"
+)
+
+// Formats of result sets, see Format.
+const (
+	FormatJSON     = "json"     // The result set as JSON
+	FormatValues   = "values"   // The expression values of each result as JSON
+	FormatBindings = "bindings" // The variable bindings of each result as JSON
+	FormatPretty   = "pretty"   // A table of bindings and expression values, or a single value as JSON
+	FormatYAML     = "yaml"     // The expression values of each result as YAML
+	FormatCSV      = "csv"      // The objects of a set or array result, or the bindings of each result, as CSV
+	FormatSource   = "source"   // The expression values of each result as a Rego literal
+)
+
+// Formats lists all formats supported by Format.
+var Formats = []string{FormatJSON, FormatValues, FormatBindings, FormatPretty, FormatYAML, FormatCSV, FormatSource}
+
+// Options configure how result sets are formatted.
+type Options struct {
+	Limit int // Truncate the values in pretty tables to this many bytes, 0 for no limit
+}
+
+// FormatString formats a result set as a string, see Format.
+func FormatString(format string, rs rego.ResultSet, opts Options) (string, error) {
+	sb := &strings.Builder{}
+	if err := Format(sb, format, rs, opts); err != nil {
+		return "", err
+	}
+	return sb.String(), nil
+}
+
+// Format writes a result set in one of the Formats. The values, yaml and
+// source formats present a result with a single expression as its value and
+// other results as arrays of values; a single result is presented on its own,
+// any other number as an array of them.
+func Format(w io.Writer, format string, rs rego.ResultSet, opts Options) error {
+	switch format {
+	case FormatJSON:
+		return JSON(w, rs)
+	case FormatValues:
+		return JSON(w, resultValues(rs))
+	case FormatBindings:
+		bindings := make([]rego.Vars, len(rs))
+		for i, r := range rs {
+			bindings[i] = r.Bindings
+		}
+		return JSON(w, bindings)
+	case FormatPretty:
+		return prettyResult(w, rs, opts.Limit)
+	case FormatYAML:
+		bs, err := json.Marshal(resultValues(rs))
+		if err != nil {
+			return err
+		}
+		bs, err = yaml.JSONToYAML(bs)
+		if err != nil {
+			return err
+		}
+		_, err = w.Write(bs)
+		return err
+	case FormatCSV:
+		return resultCSV(w, rs)
+	case FormatSource:
+		v, err := ast.InterfaceToValue(resultValues(rs))
+		if err != nil {
+			return err
+		}
+		_, err = fmt.Fprintln(w, v.String())
+		return err
+	default:
+		return fmt.Errorf("unsupported format %q: use one of %s", format, strings.Join(Formats, ", "))
+	}
+}
+
+func resultValues(rs rego.ResultSet) interface{} {
+	values := make([]interface{}, len(rs))
+	for i, r := range rs {
+		if len(r.Expressions) == 1 {
+			values[i] = r.Expressions[0].Value
+			continue
+		}
+		exprs := make([]interface{}, len(r.Expressions))
+		for j, e := range r.Expressions {
+			exprs[j] = e.Value
+		}
+		values[i] = exprs
+	}
+
+	if len(values) == 1 {
+		return values[0]
+	}
+	return values
+}
+
+// resultCSV writes the rows of a result set as CSV, with a header of the
+// sorted keys of all rows. Values that aren't strings are written as JSON.
+func resultCSV(w io.Writer, rs rego.ResultSet) error {
+	var rows []map[string]interface{}
+
+	if len(rs) == 1 && len(rs[0].Bindings) == 0 && len(rs[0].Expressions) == 1 {
+		arr, ok := rs[0].Expressions[0].Value.([]interface{})
+		if !ok {
+			return errors.New("csv format requires a set or array of objects")
+		}
+		for _, x := range arr {
+			obj, ok := x.(map[string]interface{})
+			if !ok {
+				return errors.New("csv format requires a set or array of objects")
+			}
+			rows = append(rows, obj)
+		}
+	} else {
+		for _, r := range rs {
+			if len(r.Bindings) == 0 {
+				return errors.New("csv format requires a set or array of objects, or variable bindings")
+			}
+			rows = append(rows, r.Bindings)
+		}
+	}
+
+	var header []string
+	for _, row := range rows {
+		for k := range row {
+			if !slices.Contains(header, k) {
+				header = append(header, k)
+			}
+		}
+	}
+	sort.Strings(header)
+
+	cw := csv.NewWriter(w)
+	if err := cw.Write(header); err != nil {
+		return err
+	}
+
+	for _, row := range rows {
+		record := make([]string, len(header))
+		for i, k := range header {
+			switch v := row[k].(type) {
+			case nil:
+			case string:
+				record[i] = v
+			default:
+				bs, err := json.Marshal(v)
+				if err != nil {
+					return err
+				}
+				record[i] = string(bs)
+			}
+		}
+		if err := cw.Write(record); err != nil {
+			return err
+		}
+	}
+
+	cw.Flush()
+	return cw.Error()
+}
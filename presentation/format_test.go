@@ -0,0 +1,109 @@
+package presentation
+
+import (
+	"context"
+	"testing"
+
+	"github.com/open-policy-agent/opa/rego"
+)
+
+func TestFormat(t *testing.T) {
+	ctx := context.Background()
+
+	users := `[{"name": "alice", "roles": ["admin"]}, {"name": "bob", "age": 42}]`
+
+	tests := []struct {
+		note   string
+		query  string
+		format string
+		opts   Options
+		exp    string
+		expErr string
+	}{
+		{
+			note:   "values",
+			query:  `x := 1; y := "a"`,
+			format: FormatValues,
+			exp:    "[\n  true,\n  true\n]\n",
+		},
+		{
+			note:   "values, single expression",
+			query:  users,
+			format: FormatValues,
+			exp:    "[\n  {\n    \"name\": \"alice\",\n    \"roles\": [\n      \"admin\"\n    ]\n  },\n  {\n    \"age\": 42,\n    \"name\": \"bob\"\n  }\n]\n",
+		},
+		{
+			note:   "bindings",
+			query:  `x := [1, 2][_]`,
+			format: FormatBindings,
+			exp:    "[\n  {\n    \"x\": 1\n  },\n  {\n    \"x\": 2\n  }\n]\n",
+		},
+		{
+			note:   "pretty with limit",
+			query:  `x := "abcdefgh"`,
+			format: FormatPretty,
+			opts:   Options{Limit: 4},
+			exp:    "+---------+\n|    x    |\n+---------+\n| \"abc... |\n+---------+\n",
+		},
+		{
+			note:   "yaml",
+			query:  users,
+			format: FormatYAML,
+			exp:    "- name: alice\n  roles:\n  - admin\n- age: 42\n  name: bob\n",
+		},
+		{
+			note:   "csv",
+			query:  users,
+			format: FormatCSV,
+			exp:    "age,name,roles\n,alice,\"[\"\"admin\"\"]\"\n42,bob,\n",
+		},
+		{
+			note:   "csv of bindings",
+			query:  `x := [1, 2][_]; y := "a"`,
+			format: FormatCSV,
+			exp:    "x,y\n1,a\n2,a\n",
+		},
+		{
+			note:   "csv of a non-object value",
+			query:  `[1, 2]`,
+			format: FormatCSV,
+			expErr: "csv format requires a set or array of objects",
+		},
+		{
+			note:   "source",
+			query:  `{"a": {1, 2}}`,
+			format: FormatSource,
+			exp:    "{\"a\": [1, 2]}\n",
+		},
+		{
+			note:   "unsupported",
+			query:  `true`,
+			format: "xml",
+			expErr: `unsupported format "xml": use one of json, values, bindings, pretty, yaml, csv, source`,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.note, func(t *testing.T) {
+			rs, err := rego.New(rego.Query(tc.query)).Eval(ctx)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			actual, err := FormatString(tc.format, rs, tc.opts)
+			if tc.expErr != "" {
+				if err == nil || err.Error() != tc.expErr {
+					t.Fatalf("expected error %q but got: %v", tc.expErr, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if actual != tc.exp {
+				t.Fatalf("expected:\n%q\ngot:\n%q", tc.exp, actual)
+			}
+		})
+	}
+}
@@ -2,19 +2,58 @@ package presentation
 
 import (
 	"encoding/json"
+	"fmt"
 	"io"
 	"sort"
 	"strings"
 
 	"github.com/olekukonko/tablewriter"
 	"github.com/open-policy-agent/opa/rego"
+
+	"github.com/open-policy-agent/rego-playground/opa"
 )
 
-// PrettyResultString pretty-formats a result set as a string.
-func PrettyResultString(rs rego.ResultSet) string {
-	pretty := &strings.Builder{}
-	prettyResult(pretty, rs, 0) // Swallow error, shouldn't happen while writing to a string builder.
-	return pretty.String()
+// ConftestSummaryString formats a conftest summary the way conftest prints
+// its results: a line per failure, warning and exception, followed by the
+// totals.
+func ConftestSummaryString(s *opa.ConftestSummary) string {
+	sb := &strings.Builder{}
+
+	for _, r := range s.Results {
+		for _, m := range r.Failures {
+			fmt.Fprintf(sb, "FAIL - %s - %s\n", r.Namespace, conftestMessageString(m))
+		}
+		for _, m := range r.Warnings {
+			fmt.Fprintf(sb, "WARN - %s - %s\n", r.Namespace, conftestMessageString(m))
+		}
+		for _, m := range r.Exceptions {
+			fmt.Fprintf(sb, "EXCP - %s - %s\n", r.Namespace, conftestMessageString(m))
+		}
+	}
+
+	if sb.Len() > 0 {
+		sb.WriteString("\n")
+	}
+
+	fmt.Fprintf(sb, "%s, %d passed, %s, %s, %s\n",
+		plural(s.Tests, "test"), s.Passed,
+		plural(s.Warnings, "warning"), plural(s.Failures, "failure"), plural(s.Exceptions, "exception"))
+
+	return sb.String()
+}
+
+func conftestMessageString(m opa.ConftestMessage) string {
+	if m.Msg == "" {
+		return m.Rule
+	}
+	return m.Rule + " - " + m.Msg
+}
+
+func plural(n int, noun string) string {
+	if n == 1 {
+		return fmt.Sprintf("%d %s", n, noun)
+	}
+	return fmt.Sprintf("%d %ss", n, noun)
 }
 
 // --- Copied verbatim from opa/internal/presentation/presentation.go (update from there needed) ---
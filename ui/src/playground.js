@@ -114,6 +114,7 @@ const playgroundState = {
       input: null,
       data: null,
       url: null,
+      ownerToken: null,
       regoVersionV1Mode: false
     },
 
@@ -1185,15 +1186,23 @@ function fetchPlayground() {
       if (mode === PlaygroundModes.PUBLISH) {
         const id = playgroundState.modes[PlaygroundModes.PUBLISH].id
         if (id) {
+          const ownerToken = playgroundState.modes[PlaygroundModes.PUBLISH].ownerToken
           api = `${api}/${id}`
-          params.method = 'PUT'
+          params = {
+            ...fetchParams,
+            headers: { ...fetchParams.headers, 'X-Owner-Token': ownerToken || '' },
+            method: 'PUT'
+          }
         }
       }
 
       fetch(api, params)
         .then((response) => response.json())
-        .then(({ result }) => {
+        .then(({ result, owner_token }) => {
           const state = playgroundState.modes[mode]
+          if (owner_token) {
+            state.ownerToken = owner_token
+          }
           state.url = result
           state.input = playgroundState.editors.input.getValue()
           state.data = playgroundState.editors.data.getValue()
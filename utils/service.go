@@ -32,6 +32,14 @@ type GracefulService interface {
 	Stop(ctx context.Context)
 }
 
+// DrainableService is told when shutdown starts, before it's stopped.
+type DrainableService interface {
+	Service
+
+	// Drain prepares the service to be stopped, e.g. failing readiness checks so that no new requests are sent to it.
+	Drain()
+}
+
 // RunServices initializes and starts the provided services, blocking forever.
 func RunServices(ctx context.Context, services ...Service) {
 	// Initialize services.
@@ -78,6 +86,12 @@ func RunServices(ctx context.Context, services ...Service) {
 	signal.Notify(ch, syscall.SIGTERM)
 	<-ch
 
+	for _, service := range services {
+		if s, ok := service.(DrainableService); ok {
+			s.Drain()
+		}
+	}
+
 	log.Debug("SIGTERM received. Waiting for 30 seconds before closing the listeners.")
 	time.Sleep(30 * time.Second)
 